@@ -0,0 +1,74 @@
+package borges
+
+import (
+	"gopkg.in/src-d/framework.v0/queue"
+	"gopkg.in/src-d/go-errors.v0"
+)
+
+var (
+	ErrInvalidAckPolicy = errors.NewKind("invalid ack policy: %s")
+)
+
+// AckPolicy sets when the consumer acknowledges the jobs it takes from the
+// queue, and so which delivery guarantees the jobs have.
+type AckPolicy int
+
+const (
+	// AckAfterProcessing acknowledges the jobs once they are processed,
+	// that is, after the transactions of the rooted repositories are
+	// committed. A job whose consumer dies or is stopped before finishing
+	// is delivered again, so every job is processed at least once, and
+	// some of them may be processed twice. Failed jobs are requeued up to
+	// the MaxRetries of the consumer. It is the default.
+	AckAfterProcessing AckPolicy = iota
+	// AckOnReceipt acknowledges the jobs as soon as they are received, so
+	// every job is processed at most once. Jobs are lost if the consumer
+	// dies or is stopped before finishing them, and failed jobs are never
+	// retried, but the queue does not have to keep track of the jobs being
+	// processed, which gives a higher throughput.
+	AckOnReceipt
+)
+
+// ParseAckPolicy returns the AckPolicy with the given name, which can be
+// "after-processing" or "on-receipt".
+func ParseAckPolicy(name string) (AckPolicy, error) {
+	switch name {
+	case "after-processing":
+		return AckAfterProcessing, nil
+	case "on-receipt":
+		return AckOnReceipt, nil
+	default:
+		return 0, ErrInvalidAckPolicy.New(name)
+	}
+}
+
+func (p AckPolicy) String() string {
+	switch p {
+	case AckAfterProcessing:
+		return "after-processing"
+	case AckOnReceipt:
+		return "on-receipt"
+	default:
+		return "unknown"
+	}
+}
+
+// ackedJob is the acknowledger of jobs already acknowledged on receipt. Both
+// acknowledging and rejecting them again do nothing.
+type ackedJob struct{}
+
+func (ackedJob) Ack() error        { return nil }
+func (ackedJob) Reject(bool) error { return nil }
+
+// retryJob publishes again to q a failed job, with its Retries incremented.
+func retryJob(q queue.Queue, j *Job) error {
+	retry := *j
+	retry.Retries++
+
+	qj := queue.NewJob()
+	if err := qj.Encode(&retry); err != nil {
+		return err
+	}
+
+	return q.Publish(qj)
+}
@@ -0,0 +1,20 @@
+package borges
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAckPolicy(t *testing.T) {
+	require := require.New(t)
+
+	for _, p := range []AckPolicy{AckAfterProcessing, AckOnReceipt} {
+		parsed, err := ParseAckPolicy(p.String())
+		require.NoError(err)
+		require.Equal(p, parsed)
+	}
+
+	_, err := ParseAckPolicy("never")
+	require.True(ErrInvalidAckPolicy.Is(err))
+}
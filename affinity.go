@@ -0,0 +1,42 @@
+package borges
+
+import (
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+// NewRootAffinity returns a function to be used as WorkerPool.Affinity that
+// keys the jobs by the root of their repository, so the jobs of repositories
+// pushing to the same rooted repository, such as forks archived on their own,
+// go to the same worker instead of contending for its transaction. The root
+// of a repository is the first init of its references in the store, so the
+// repositories not archived yet, or that cannot be read, are keyed by their
+// ID.
+func NewRootAffinity(store RepositoryStore) func(*Job) string {
+	return func(j *Job) string {
+		r, err := store.Get(kallax.ULID(j.RepositoryID))
+		if err != nil || len(r.References) == 0 {
+			return j.RepositoryID.String()
+		}
+
+		root := r.References[0].Init.String()
+		for _, ref := range r.References[1:] {
+			if init := ref.Init.String(); init < root {
+				root = init
+			}
+		}
+
+		return root
+	}
+}
+
+// NewRootSingleFlight returns a function to be used as WorkerPool.SingleFlight
+// that keys the jobs by the root of their repository, as NewRootAffinity
+// does, and the repository itself. The forks archived on their own share the
+// root of the repository but must be fetched too, so only the jobs of the same
+// repository are collapsed.
+func NewRootSingleFlight(store RepositoryStore) func(*Job) string {
+	root := NewRootAffinity(store)
+	return func(j *Job) string {
+		return root(j) + "/" + j.RepositoryID.String()
+	}
+}
@@ -1,16 +1,21 @@
 package borges
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"strings"
 	"time"
 
+	"github.com/inconshreveable/log15"
+	"github.com/satori/go.uuid"
 	"gopkg.in/src-d/core-retrieval.v0/model"
 	"gopkg.in/src-d/core-retrieval.v0/repository"
 	"gopkg.in/src-d/go-errors.v0"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 	"gopkg.in/src-d/go-kallax.v1"
 )
@@ -18,11 +23,29 @@ import (
 var (
 	ErrCleanRepositoryDir     = errors.NewKind("cleaning up local repo dir failed")
 	ErrClone                  = errors.NewKind("cloning %s failed")
+	ErrCloneTimeout           = errors.NewKind("cloning %s timed out")
 	ErrPushToRootedRepository = errors.NewKind("push to rooted repo %s failed")
 	ErrArchivingRoots         = errors.NewKind("archiving %d out of %d roots failed: %s")
 	ErrEndpointsEmpty         = errors.NewKind("endpoints is empty")
 	ErrRepositoryIDNotFound   = errors.NewKind("repository id not found: %s")
 	ErrChanges                = errors.NewKind("error computing changes")
+	ErrArchivingFork          = errors.NewKind("archiving fork %s failed")
+	ErrRepositoryGone         = errors.NewKind("repository %s no longer exists")
+	ErrCorruptRooted          = errors.NewKind("corrupt rooted repositories: %s")
+)
+
+// Phase is a phase of the archiving of a repository.
+type Phase string
+
+const (
+	// FetchPhase is the clone of the repository into temporary storage.
+	FetchPhase Phase = "fetch"
+	// PackPhase is the push of the changes of a root to its rooted
+	// repository.
+	PackPhase Phase = "pack"
+	// StorePhase is the commit of a rooted repository to the repository
+	// storage.
+	StorePhase Phase = "store"
 )
 
 // Archiver archives repositories. Archiver instances are thread-safe and can
@@ -40,20 +63,124 @@ type Archiver struct {
 		// Warn function, if set, is called whenever there is a warning
 		// during the processing of a repository.
 		Warn func(*Job, error)
+		// PhaseDone function, if set, is called whenever a phase of the
+		// processing of a repository finishes, with the time it took.
+		PhaseDone func(*Job, Phase, time.Duration)
+		// PhaseStart function, if set, is called whenever a phase of the
+		// processing of a repository starts, with the endpoint being
+		// fetched in FetchPhase, or empty in the other phases.
+		PhaseStart func(*Job, Phase, string)
+		// Submodules function, if set, is called with the submodules
+		// found in a repository of the job, see the Submodules option.
+		Submodules func(*Job, []*Submodule)
+		// Gone function, if set, is called with the repositories of the
+		// job that no longer exist, which are marked with the Gone
+		// status instead of failing.
+		Gone func(*Job, *model.Repository)
+		// Done function, if set, is called with every repository of the
+		// job successfully archived, and the stats of its rooted
+		// repositories once stored, which are nil if the rooted
+		// transactioner is not a RootedStatter.
+		Done func(*Job, *model.Repository, *ArchiveStats)
 	}
 
 	// TemporaryCloner is used to clone repositories into temporary storage.
 	TemporaryCloner TemporaryCloner
 
-	// RepositoryStore is the database where repository models are stored.
-	RepositoryStorage *model.RepositoryStore
+	// RepositoryStorage is where repository models are stored.
+	RepositoryStorage RepositoryStore
 
 	// RootedTransactioner is used to push new references to our repository
-	// storage.
+	// storage. If it is an EndpointTransactioner, the transactioner of each
+	// repository is selected by its endpoint.
 	RootedTransactioner repository.RootedTransactioner
+
+	// Options are optional settings of the archiver.
+	Options ArchiverOptions
+
+	// hosts limits the clones running from each host, shared by all the
+	// archivers of a worker pool, see PerHostConcurrency.
+	hosts *hostLimiter
 }
 
-func NewArchiver(r *model.RepositoryStore, tx repository.RootedTransactioner,
+// ArchiverOptions holds optional settings of an Archiver. The zero value is
+// valid and sets the default behaviour.
+type ArchiverOptions struct {
+	// FetchRetries is the maximum number of times a clone is retried if it
+	// fails with a transient error, such as a network timeout. Clones that
+	// fail with permanent errors, such as repository not found, are never
+	// retried.
+	FetchRetries int
+	// FetchRetryBackoff is the base time to wait before retrying a clone.
+	// It is doubled on every retry and a random jitter is applied to it.
+	FetchRetryBackoff time.Duration
+	// MaxJobTimeout caps the timeout set by jobs to clone their repository,
+	// see Job.Timeout. Zero means no limit.
+	MaxJobTimeout time.Duration
+	// SkipIfFresherThan makes the archiver skip the repositories that were
+	// successfully fetched less than this long ago, so jobs left on the
+	// queue after a restart are not processed again. Zero disables it.
+	SkipIfFresherThan time.Duration
+	// Incremental makes the archiver fetch only the objects missing from
+	// the rooted repositories where a repository was archived before, if
+	// the TemporaryCloner is an IncrementalCloner. If the repository has no
+	// references stored, the rooted repositories of its endpoint are used
+	// if the RepositoryStore is a RootIndex. If the incremental fetch
+	// fails, the whole repository is cloned. The rooted repositories are
+	// validated before fetching, see ValidateRootedRepository, and the
+	// corrupt ones are rewritten from scratch with the whole clone if the
+	// RootedTransactioner is a Rewriter, so a rooted repository left
+	// corrupt, such as by a crash, does not fail the next fetches. The
+	// references of the other repositories in a rewritten rooted
+	// repository are archived again by their next incremental fetch.
+	Incremental bool
+	// Submodules sets what is done with the submodules of the repositories,
+	// which are ignored by default. With FetchSubmodules, a repository model
+	// is created for every submodule without one, so it can be archived by
+	// the job passed to the Submodules notifier.
+	Submodules SubmodulePolicy
+	// DetectLFS makes the archiver look for repositories using Git LFS,
+	// whose LFS files are archived as the pointers stored in git, and report
+	// them with a warning of kind ErrLFSRepository. The LFS objects
+	// themselves are never fetched.
+	DetectLFS bool
+	// PerHostConcurrency is the maximum number of clones running at the
+	// same time from the same host, such as github.com, among all the
+	// workers of the pool created with NewArchiverWorkerPool. A job whose
+	// repository is from a host already at the limit fails with
+	// ErrHostBusy before being cloned, and it is requeued by the worker,
+	// so it does not keep the worker waiting. Forks from a busy host are
+	// not archived, with a warning. Zero means no limit.
+	PerHostConcurrency int
+	// WorkerTempDirs makes every worker of the pool created with
+	// NewArchiverWorkerPool clone into a directory of its own in the
+	// temporary filesystem, if the TemporaryCloner is a ScopedCloner. The
+	// directory is emptied after each job, so the files of a job never
+	// outlive it, even when it fails.
+	WorkerTempDirs bool
+	// AdaptiveTimeout, if positive, makes the clones of the repositories
+	// fetched before time out after this many times the duration of their
+	// last fetch, recorded in their ArchiveStats, instead of the timeout
+	// of the TemporaryCloner, so big repositories get more time than small
+	// ones. It is clamped between MinAdaptiveTimeout and MaxJobTimeout.
+	// The repositories never fetched and the jobs with their own timeout
+	// are not affected. It needs an ArchiveStatsStore. Note that the
+	// incremental fetches are faster than cloning the whole repository,
+	// so the factor must leave room for the clones made when they fail.
+	AdaptiveTimeout float64
+	// MinAdaptiveTimeout is the minimum timeout set by AdaptiveTimeout, so
+	// the clones of the repositories fetched quickly are not aborted by a
+	// slight slowdown.
+	MinAdaptiveTimeout time.Duration
+	// Steps are the steps run in order to archive every job, see Step. If
+	// empty, DefaultSteps are run. Other steps can be added between the
+	// default ones, such as a step scanning the temporary clones of the
+	// repositories after FetchStep, which can fail the ones that must not
+	// be archived. Only Do and DoContext run them, Pack does not.
+	Steps []Step
+}
+
+func NewArchiver(r RepositoryStore, tx repository.RootedTransactioner,
 	tc TemporaryCloner) *Archiver {
 	return &Archiver{
 		TemporaryCloner:     tc,
@@ -64,85 +191,738 @@ func NewArchiver(r *model.RepositoryStore, tx repository.RootedTransactioner,
 
 // Do archives a repository according to a job.
 func (a *Archiver) Do(j *Job) error {
+	return a.DoContext(context.Background(), j)
+}
+
+// DoContext archives a repository according to a job, like Do does. If the
+// given context is cancelled, the archiving stops as soon as possible: no more
+// repositories are cloned and no more rooted repositories are committed, and
+// the context error is returned. The rooted repositories already committed
+// are kept, along with the references of the repository model archived in
+// them.
+//
+// If the archiving panics, the temporary clones are removed and the
+// repositories being fetched are marked as errored before panicking again, so
+// a worker recovering the panic does not leak them, see
+// WorkerPool.RecoverPanics. The Stop notifier is called with an ErrJobPanic.
+func (a *Archiver) DoContext(ctx context.Context, j *Job) error {
 	a.notifyStart(j)
-	err := a.do(j)
+	defer func() {
+		if r := recover(); r != nil {
+			a.notifyStop(j, ErrJobPanic.New(r))
+			panic(r)
+		}
+	}()
+
+	err := a.do(ctx, j)
 	a.notifyStop(j, err)
 	return err
 }
 
-func (a *Archiver) do(j *Job) (err error) {
-	log := log.New("job", j.RepositoryID)
-	now := time.Now()
+func (a *Archiver) do(ctx context.Context, j *Job) error {
+	s := &JobState{Job: j, a: a, started: time.Now()}
+	defer func() {
+		if r := recover(); r != nil {
+			a.finishPanicked(j, s.remotes, s.started, r)
+			panic(r)
+		}
+	}()
+
+	return a.runSteps(ctx, s)
+}
+
+// remote is a repository being archived by a job, which can be either the
+// repository of the job or one of its forks.
+type remote struct {
+	id    uuid.UUID
+	log   log15.Logger
+	model *model.Repository
+	// tx is the transactioner of the rooted repositories of the remote.
+	tx repository.RootedTransactioner
+	// tr is the temporary clone of the repository, nil if it was not cloned.
+	tr TemporaryRepository
+	// bases are the transactions of the rooted repositories an incremental
+	// clone reads its objects from. They are never committed.
+	bases   []repository.Tx
+	changes Changes
+	// filtered are the blobs left out of the pushes of the temporary
+	// clone, kept when it is closed.
+	filtered []plumbing.Hash
+	// failedInits are the roots whose changes could not be archived.
+	failedInits []model.SHA1
+	// corrupt are the roots whose rooted repositories were found corrupt
+	// before fetching incrementally, rewritten from scratch when pushing.
+	corrupt []model.SHA1
+	// err is the error that stopped the archiving of the repository, if any.
+	err error
+	// fetchDuration is the time fetching the repository took, zero if it
+	// was not fetched.
+	fetchDuration time.Duration
+	// remoteRefs is the number of references of the remote to fetch, zero
+	// if they were not listed, see CloneOptions.MaxRefs.
+	remoteRefs int
+	// finished is whether the archiving of the repository was finished,
+	// successfully or not, see Archiver.finish.
+	finished bool
+}
 
-	r, err := a.getRepositoryModel(j)
+// fetch marks the repository of the remote as being fetched, clones it and
+// computes its changes. Any error is stored in the remote.
+func (a *Archiver) fetch(ctx context.Context, j *Job, rm *remote) {
+	if err := ctx.Err(); err != nil {
+		rm.err = err
+		return
+	}
+
+	r, err := a.getRepositoryModel(rm.id)
 	if err != nil {
-		return err
+		rm.err = err
+		return
 	}
 
-	log.Debug("repository model obtained",
+	rm.log.Debug("repository model obtained",
 		"status", r.Status,
 		"last-fetch", r.FetchedAt,
 		"references", len(r.References))
 
+	if a.isFresh(r, time.Now()) {
+		rm.log.Debug("repository fetched recently, skipping",
+			"fetched-at", r.FetchedAt)
+		return
+	}
+
+	release, err := a.acquireHost(r)
+	if err != nil {
+		rm.log.Debug("host busy, not fetching", "error", err)
+		rm.err = err
+		return
+	}
+	defer release()
+
+	if err := UpdateRepositoryStatus(a.RepositoryStorage, r, Fetching); err != nil {
+		rm.err = err
+		return
+	}
+
+	rm.model = r
 	endpoint, err := selectEndpoint(r.Endpoints)
 	if err != nil {
+		rm.err = err
+		return
+	}
+	rm.log.Debug("endpoint selected", "endpoint", endpoint)
+
+	rm.tx, err = a.rootedTransactioner(endpoint)
+	if err != nil {
+		rm.err = err
+		return
+	}
+
+	j = a.withAdaptiveTimeout(j, rm)
+	if roots := a.incrementalRoots(r, endpoint); len(roots) > 0 {
+		start := time.Now()
+		err := a.fetchIncremental(ctx, j, rm, endpoint, roots)
+		switch {
+		case err == nil:
+			rm.fetchDuration = time.Since(start)
+			rm.log.Debug("changes obtained incrementally", "roots", len(rm.changes))
+			a.inspect(j, rm)
+			return
+		case err == transport.ErrEmptyUploadPackRequest:
+			rm.log.Debug("empty remote repository")
+			return
+		case ErrCloneTimeout.Is(err), ErrRepoTooLarge.Is(err), isRateLimitError(err),
+			ErrRepositoryGone.Is(err), ErrBlockedEndpoint.Is(err), isTooManyRefsError(err),
+			ctx.Err() != nil:
+			rm.err = err
+			return
+		case ErrCorruptRooted.Is(err):
+			// the references in the corrupt rooted repositories are
+			// pushed again, since they are rewritten from scratch
+			rm.log.Warn("corrupt rooted repositories, repairing them with the whole repository",
+				"error", err)
+			r.References = referencesNotIn(r.References, rm.corrupt)
+		default:
+			rm.log.Warn("incremental fetch failed, cloning the whole repository",
+				"error", err)
+		}
+	}
+
+	start := time.Now()
+	gr, err := a.cloneEndpoint(ctx, j, rm.log, rm.id.String(), endpoint)
+	if err == nil {
+		rm.fetchDuration = time.Since(start)
+	}
+
+	if err == transport.ErrEmptyUploadPackRequest {
+		rm.log.Debug("empty remote repository")
+		return
+	}
+
+	if err != nil {
+		rm.err = err
+		return
+	}
+
+	rm.tr = gr
+	rm.log.Debug("remote repository cloned")
+
+	rm.changes, err = NewChanges(NewModelReferencer(r), gr)
+	if err != nil {
+		rm.log.Error("error computing changes", "error", err)
+		rm.err = ErrChanges.Wrap(err)
+		return
+	}
+
+	rm.log.Debug("changes obtained", "roots", len(rm.changes))
+	a.inspect(j, rm)
+}
+
+// acquireHost takes a slot of the host of the repository to clone it, see
+// PerHostConcurrency, returning the function that frees it. Repositories
+// without endpoints always get one, since they fail later anyway.
+func (a *Archiver) acquireHost(r *model.Repository) (func(), error) {
+	endpoint, err := selectEndpoint(r.Endpoints)
+	if err != nil {
+		return func() {}, nil
+	}
+
+	return a.hosts.acquire(endpoint)
+}
+
+// inspect looks for the features of the temporary repository of the remote
+// that are not archived, such as submodules and LFS files, reporting them.
+func (a *Archiver) inspect(j *Job, rm *remote) {
+	a.notifySubmodulesOf(j, rm)
+	a.checkLFS(j, rm)
+}
+
+// incrementalRoots returns the roots of the rooted repositories the
+// repository can be fetched incrementally from, see fetchIncremental, which
+// are the ones of its references or, if it has none, the ones indexed for the
+// endpoint, if the store is a RootIndex. It returns nil if the repository
+// cannot be fetched incrementally.
+func (a *Archiver) incrementalRoots(r *model.Repository, endpoint string) []model.SHA1 {
+	if !a.Options.Incremental {
+		return nil
+	}
+
+	if _, ok := a.TemporaryCloner.(IncrementalCloner); !ok {
+		return nil
+	}
+
+	if len(r.References) > 0 {
+		return repositoryRoots(r.References)
+	}
+
+	index, ok := a.RepositoryStorage.(RootIndex)
+	if !ok {
+		return nil
+	}
+
+	roots, err := index.Roots(endpoint)
+	if err != nil {
+		log.Warn("error reading the indexed roots of the endpoint",
+			"endpoint", endpoint, "error", err)
+		return nil
+	}
+
+	return roots
+}
+
+// fetchIncremental clones the repository of the remote reading the objects it
+// already had from the rooted repositories of the given roots, and computes
+// its changes. The commits of the references of the repository are the ones
+// the remote is told to be already available or, if it has none, the ones of
+// all the references of the rooted repositories. The references of the
+// repository missing from its rooted repositories, such as the ones lost when
+// a corrupt one was rewritten while archiving another repository, are
+// archived again. If it fails, the remote is left as it was before calling
+// it, except for the roots whose rooted repositories are corrupt, see
+// beginBase, which are recorded before failing with ErrCorruptRooted.
+func (a *Archiver) fetchIncremental(ctx context.Context, j *Job, rm *remote,
+	endpoint string, roots []model.SHA1) error {
+	var (
+		base    []storer.EncodedObjectStorer
+		indexed []plumbing.Hash
+	)
+
+	for _, root := range roots {
+		tx, err := a.beginBase(rm, root)
+		if ErrCorruptRooted.Is(err) {
+			rm.log.Warn("corrupt rooted repository", "root", root.String(), "error", err)
+			rm.corrupt = append(rm.corrupt, root)
+			continue
+		}
+
+		if err != nil {
+			_ = rm.close()
+			return err
+		}
+
+		rm.bases = append(rm.bases, tx)
+		base = append(base, tx.Storer())
+		if len(rm.model.References) > 0 {
+			if err := rm.dropUnarchived(root, tx.Storer()); err != nil {
+				_ = rm.close()
+				return err
+			}
+
+			continue
+		}
+
+		hashes, err := referenceHashes(tx.Storer())
+		if err != nil {
+			_ = rm.close()
+			return err
+		}
+
+		indexed = append(indexed, hashes...)
+	}
+
+	if len(rm.corrupt) > 0 {
+		_ = rm.close()
+		return ErrCorruptRooted.New(joinRoots(rm.corrupt))
+	}
+
+	var haves []plumbing.Hash
+	for _, ref := range rm.model.References {
+		haves = append(haves, plumbing.Hash(ref.Hash))
+	}
+
+	haves = append(haves, indexed...)
+
+	ctx, cancel := a.jobContext(ctx, j)
+	defer cancel()
+
+	a.notifyPhaseStart(j, FetchPhase, endpoint)
+	start := time.Now()
+	gr, err := a.TemporaryCloner.(IncrementalCloner).
+		CloneIncremental(ctx, rm.id.String(), endpoint, base, haves)
+	a.notifyPhaseDone(j, FetchPhase, time.Since(start))
+	if err != nil {
+		_ = rm.close()
 		return err
 	}
-	log.Debug("endpoint selected", "endpoint", endpoint)
 
-	gr, err := a.TemporaryCloner.Clone(j.RepositoryID.String(), endpoint)
+	rm.tr = gr
+	changes, err := NewChanges(NewModelReferencer(rm.model), gr)
+	if err != nil {
+		_ = rm.close()
+		return ErrChanges.Wrap(err)
+	}
+
+	rm.changes = changes
+	return nil
+}
+
+// beginBase begins the transaction of the rooted repository of the root an
+// incremental clone of the remote reads its objects from, checking that it is
+// valid first, see ValidateRootedRepository. The blobs missing from it are
+// allowed if the cloner is a BlobFilteringCloner filtering them. It fails with
+// ErrCorruptRooted if the rooted repository is not valid or its siva file
+// cannot be opened, see ErrCorruptSiva, but not if the transaction cannot be
+// begun for other reasons, such as the storage not being available.
+func (a *Archiver) beginBase(rm *remote, root model.SHA1) (repository.Tx, error) {
+	tx, err := rm.tx.Begin(plumbing.Hash(root))
+	if ErrCorruptSiva.Is(err) {
+		return nil, ErrCorruptRooted.Wrap(err, root.String())
+	}
+
 	if err != nil {
-		var finalErr error
-		if err != transport.ErrEmptyUploadPackRequest {
-			r.FetchErrorAt = &now
-			finalErr = ErrClone.Wrap(err, endpoint)
+		return nil, err
+	}
+
+	bf, ok := a.TemporaryCloner.(BlobFilteringCloner)
+	opts := ValidateOptions{AllowMissingBlobs: ok && bf.FiltersBlobs()}
+	if _, err := ValidateRootedRepository(tx.Storer(), opts); err != nil {
+		_ = abortTx(rm.tx, tx)
+		return nil, ErrCorruptRooted.Wrap(err, root.String())
+	}
+
+	return tx, nil
+}
+
+// dropUnarchived removes from the references of the repository model the ones
+// of the root that are not in its rooted repository, or point to a different
+// commit there, so they are pushed again.
+func (rm *remote) dropUnarchived(root model.SHA1, s storer.ReferenceStorer) error {
+	var refs []*model.Reference
+	for _, ref := range rm.model.References {
+		if ref.Init != root {
+			refs = append(refs, ref)
+			continue
 		}
 
-		_, errDB := a.RepositoryStorage.Update(r,
-			model.Schema.Repository.UpdatedAt,
-			model.Schema.Repository.FetchErrorAt,
-			model.Schema.Repository.References,
-		)
-		if errDB != nil {
-			return errDB
+		name := plumbing.ReferenceName(fmt.Sprintf("%s/%s", ref.Name, rm.model.ID))
+		r, err := s.Reference(name)
+		if err == plumbing.ErrReferenceNotFound {
+			continue
 		}
 
-		log.Error("error cloning repository", "error", err)
-		return finalErr
+		if err != nil {
+			return err
+		}
+
+		if r.Hash() == plumbing.Hash(ref.Hash) {
+			refs = append(refs, ref)
+		}
 	}
 
-	defer func() {
-		if cErr := gr.Close(); cErr != nil && err == nil {
+	if lost := len(rm.model.References) - len(refs); lost > 0 {
+		rm.log.Warn("references missing from rooted repository, archiving them again",
+			"root", root.String(), "references", lost)
+		rm.model.References = refs
+	}
+
+	return nil
+}
+
+// close removes the temporary clone of the remote and rolls back the
+// transactions of its bases.
+func (rm *remote) close() error {
+	var err error
+	if fr, ok := rm.tr.(BlobFilteringRepository); ok {
+		rm.filtered = fr.FilteredBlobs()
+	}
+
+	if rr, ok := rm.tr.(RefCountingRepository); ok {
+		rm.remoteRefs = rr.RemoteReferences()
+	}
+
+	if rm.tr != nil {
+		if cErr := rm.tr.Close(); cErr != nil {
 			err = ErrCleanRepositoryDir.Wrap(cErr)
 		}
-	}()
-	log.Debug("remote repository cloned")
+	}
 
-	oldRefs := NewModelReferencer(r)
-	newRefs := gr
-	changes, err := NewChanges(oldRefs, newRefs)
-	if err != nil {
-		log.Error("error computing changes", "error", err)
-		return ErrChanges.Wrap(err)
+	for _, tx := range rm.bases {
+		if rErr := abortTx(rm.tx, tx); rErr != nil && err == nil {
+			err = rErr
+		}
+	}
+
+	rm.tr, rm.bases = nil, nil
+	return err
+}
+
+// isFresh returns whether the repository was fetched recently enough at the
+// given time to be skipped, according to the SkipIfFresherThan option.
+func (a *Archiver) isFresh(r *model.Repository, now time.Time) bool {
+	if a.Options.SkipIfFresherThan <= 0 || r.FetchedAt == nil ||
+		r.Status != model.FetchStatus(model.Fetched) {
+		return false
+	}
+
+	return now.Sub(*r.FetchedAt) < a.Options.SkipIfFresherThan
+}
+
+// finish removes the temporary clone of the remote and stores the final
+// status of its repository, fetched at the given time. It returns the error
+// that made the archiving of the repository fail, if any.
+func (a *Archiver) finish(j *Job, rm *remote, then time.Time) error {
+	rm.finished = true
+	err := rm.err
+	if err == nil {
+		err = checkFailedInits(rm.changes, rm.failedInits)
+	}
+
+	if cErr := rm.close(); cErr != nil && err == nil {
+		err = cErr
+	}
+
+	if rm.model == nil {
+		return err
+	}
+
+	if ErrRepositoryGone.Is(err) {
+		return a.finishGone(j, rm, then, err)
+	}
+
+	if e, ok := err.(*TooManyRefsError); ok {
+		return a.finishTooManyRefs(j, rm, then, e)
+	}
+
+	if sErr := a.dbFinishRepository(rm.model, then, err); sErr != nil {
+		if err != nil {
+			rm.log.Error("error storing repository status", "error", sErr)
+			return err
+		}
+
+		return sErr
+	}
+
+	if err == nil {
+		a.indexRoots(rm)
+		a.storeArchiveStats(j, rm)
+		rm.log.Debug("repository processed")
+	}
+
+	return err
+}
+
+// finishPanicked finishes the remotes not finished yet when archiving them
+// panicked, failing them with an ErrJobPanic of the given value unless they
+// failed before, so their temporary clones are removed and their repositories
+// are marked as errored.
+func (a *Archiver) finishPanicked(j *Job, remotes []*remote, then time.Time, value interface{}) {
+	for _, rm := range remotes {
+		if rm == nil || rm.finished {
+			continue
+		}
+
+		if rm.err == nil {
+			rm.err = ErrJobPanic.New(value)
+		}
+
+		if err := a.finish(j, rm, then); err != nil && !ErrJobPanic.Is(err) {
+			rm.log.Error("error finishing repository after a panic", "error", err)
+		}
 	}
+}
 
-	log.Debug("changes obtained", "roots", len(changes))
-	if err := a.pushChangesToRootedRepositories(j, r, gr, changes, now); err != nil {
+// finishGone marks the repository of the remote, which no longer exists, with
+// the Gone status. It is not an error, so the job is not retried.
+func (a *Archiver) finishGone(j *Job, rm *remote, then time.Time, goneErr error) error {
+	rm.model.FetchErrorAt = &then
+	err := UpdateRepositoryStatus(a.RepositoryStorage, rm.model, Gone,
+		model.Schema.Repository.FetchErrorAt,
+	)
+	if err != nil {
 		return err
 	}
 
-	log.Debug("repository processed")
+	rm.log.Info("repository no longer exists, marked as gone", "error", goneErr)
+	a.notifyGone(j, rm.model)
 	return nil
 }
 
-func (a *Archiver) getRepositoryModel(j *Job) (*model.Repository, error) {
-	q := model.NewRepositoryQuery().FindByID(kallax.ULID(j.RepositoryID))
-	r, err := a.RepositoryStorage.FindOne(q)
+// finishTooManyRefs marks the repository of the remote, which has more
+// references than allowed, with the TooManyRefs status, and records their
+// number in its ArchiveStats, keeping the rest of the ones of its last
+// archiving. It returns the error, so the job fails.
+func (a *Archiver) finishTooManyRefs(j *Job, rm *remote, then time.Time, refsErr *TooManyRefsError) error {
+	rm.model.FetchErrorAt = &then
+	err := UpdateRepositoryStatus(a.RepositoryStorage, rm.model, TooManyRefs,
+		model.Schema.Repository.FetchErrorAt,
+	)
+	if err != nil {
+		rm.log.Error("error storing repository status", "error", err)
+		return refsErr
+	}
+
+	rm.log.Warn("repository has too many references, marked as such",
+		"references", refsErr.Refs, "max", refsErr.Max)
+	store, ok := a.RepositoryStorage.(ArchiveStatsStore)
+	if !ok {
+		return refsErr
+	}
+
+	stats, err := store.ArchiveStats(rm.model.ID)
+	if err == nil {
+		if stats == nil {
+			stats = &ArchiveStats{}
+		}
+
+		stats.RemoteReferences = refsErr.Refs
+		err = store.SetArchiveStats(rm.model.ID, stats)
+	}
+
 	if err != nil {
-		return nil, ErrRepositoryIDNotFound.Wrap(err, j.RepositoryID.String())
+		rm.log.Warn("error storing the number of references of the repository", "error", err)
+		a.notifyWarn(j, err)
+	}
+
+	return refsErr
+}
+
+// storeArchiveStats computes the ArchiveStats of the repository of the remote,
+// adding the blobs filtered before to the ones filtered now, stores them if
+// the store is an ArchiveStatsStore and notifies them with the Done notifier.
+// The repository is already archived, so the errors are only warnings.
+func (a *Archiver) storeArchiveStats(j *Job, rm *remote) {
+	var stats *ArchiveStats
+	if rm.tx != nil {
+		var err error
+		stats, err = archiveStats(rm.tx, rm.model)
+		if err != nil {
+			rm.log.Warn("error computing the archive stats", "error", err)
+			a.notifyWarn(j, err)
+			stats = nil
+		}
 	}
 
-	return r, nil
+	store, ok := a.RepositoryStorage.(ArchiveStatsStore)
+	if stats != nil {
+		var prev *ArchiveStats
+		if ok {
+			var err error
+			if prev, err = store.ArchiveStats(rm.model.ID); err != nil {
+				rm.log.Warn("error reading the previous archive stats", "error", err)
+				a.notifyWarn(j, err)
+			}
+		}
+
+		stats.FilteredBlobs = mergeFilteredBlobs(prev, rm.filtered)
+		stats.FetchDuration = rm.fetchDuration
+		stats.RemoteReferences = rm.remoteRefs
+	}
+
+	if ok && stats != nil {
+		if err := store.SetArchiveStats(rm.model.ID, stats); err != nil {
+			rm.log.Warn("error storing the archive stats", "error", err)
+			a.notifyWarn(j, err)
+		}
+	}
+
+	a.notifyDone(j, rm.model, stats)
+}
+
+// indexRoots stores the roots of the references of the repository of the
+// remote as the ones of all its endpoints, if the store is a RootIndex.
+func (a *Archiver) indexRoots(rm *remote) {
+	index, ok := a.RepositoryStorage.(RootIndex)
+	if !ok {
+		return
+	}
+
+	roots := repositoryRoots(rm.model.References)
+	for _, e := range rm.model.Endpoints {
+		if err := index.SetRoots(e, roots); err != nil {
+			rm.log.Warn("error indexing the roots of the endpoint",
+				"endpoint", e, "error", err)
+		}
+	}
+}
+
+// cloneEndpoint clones the endpoint, wrapping the error if it fails.
+func (a *Archiver) cloneEndpoint(ctx context.Context, j *Job, log log15.Logger,
+	id, endpoint string) (TemporaryRepository, error) {
+	log = log.New("endpoint", endpoint)
+	a.notifyPhaseStart(j, FetchPhase, endpoint)
+	start := time.Now()
+	gr, attempts, err := a.clone(ctx, j, log, id, endpoint)
+	a.notifyPhaseDone(j, FetchPhase, time.Since(start))
+	if err == nil || err == transport.ErrEmptyUploadPackRequest {
+		return gr, err
+	}
+
+	log.Error("error cloning repository", "attempts", attempts, "duration", time.Since(start), "error", err)
+	if ErrCloneTimeout.Is(err) || ErrRepoTooLarge.Is(err) || ErrRepositoryGone.Is(err) ||
+		ErrBlockedEndpoint.Is(err) || isTooManyRefsError(err) || err == context.Canceled {
+		return nil, err
+	}
+
+	err = ErrClone.Wrap(err, endpoint)
+	if attempts > 1 {
+		err = &RetryError{Attempts: attempts, Err: err}
+	}
+
+	return nil, err
+}
+
+// clone clones the endpoint using the TemporaryCloner, retrying it as many
+// times as configured in the archiver options if it fails with a transient
+// error. It returns the number of attempts made. It stops retrying if the
+// context is cancelled.
+func (a *Archiver) clone(ctx context.Context, j *Job, log log15.Logger,
+	id, endpoint string) (TemporaryRepository, int, error) {
+	for attempt := 1; ; attempt++ {
+		gr, err := a.cloneAttempt(ctx, j, id, endpoint)
+		if err == nil || attempt > a.Options.FetchRetries || !isTransientError(err) ||
+			ctx.Err() != nil {
+			return gr, attempt, err
+		}
+
+		wait := retryBackoff(a.Options.FetchRetryBackoff, attempt)
+		log.Warn("transient error cloning repository, retrying",
+			"attempt", attempt, "wait", wait, "error", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, attempt, ctx.Err()
+		}
+	}
+}
+
+// cloneAttempt clones the endpoint, using the timeout of the job if it has one.
+func (a *Archiver) cloneAttempt(ctx context.Context, j *Job, id, endpoint string) (TemporaryRepository, error) {
+	ctx, cancel := a.jobContext(ctx, j)
+	defer cancel()
+
+	return a.TemporaryCloner.Clone(ctx, id, endpoint)
+}
+
+// jobContext returns the context used to clone the repositories of the job,
+// derived from the given one, which has the timeout of the job, if any,
+// capped by MaxJobTimeout.
+func (a *Archiver) jobContext(ctx context.Context, j *Job) (context.Context, context.CancelFunc) {
+	timeout := j.Timeout
+	if a.Options.MaxJobTimeout > 0 && timeout > a.Options.MaxJobTimeout {
+		timeout = a.Options.MaxJobTimeout
+	}
+
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// withAdaptiveTimeout returns the job used to clone the repository of the
+// remote: a copy of j with the timeout derived from the duration of the last
+// fetch of the repository, see AdaptiveTimeout, or j itself if it does not
+// apply.
+func (a *Archiver) withAdaptiveTimeout(j *Job, rm *remote) *Job {
+	if a.Options.AdaptiveTimeout <= 0 || j.Timeout > 0 {
+		return j
+	}
+
+	store, ok := a.RepositoryStorage.(ArchiveStatsStore)
+	if !ok {
+		return j
+	}
+
+	stats, err := store.ArchiveStats(rm.model.ID)
+	if err != nil {
+		rm.log.Warn("error reading the archive stats, using the default clone timeout",
+			"error", err)
+		return j
+	}
+
+	if stats == nil || stats.FetchDuration <= 0 {
+		return j
+	}
+
+	cj := *j
+	cj.Timeout = adaptiveTimeout(stats.FetchDuration, a.Options.AdaptiveTimeout,
+		a.Options.MinAdaptiveTimeout, a.Options.MaxJobTimeout)
+	rm.log.Debug("adaptive clone timeout",
+		"last-fetch-duration", stats.FetchDuration, "timeout", cj.Timeout)
+	return &cj
+}
+
+// adaptiveTimeout returns the given factor of the duration of the last fetch
+// of a repository, clamped between min and max, if they are positive.
+func adaptiveTimeout(last time.Duration, factor float64, min, max time.Duration) time.Duration {
+	timeout := time.Duration(math.MaxInt64)
+	if t := float64(last) * factor; t < math.MaxInt64 {
+		timeout = time.Duration(t)
+	}
+
+	if timeout < min {
+		timeout = min
+	}
+
+	if max > 0 && timeout > max {
+		timeout = max
+	}
+
+	return timeout
+}
+
+func (a *Archiver) getRepositoryModel(id uuid.UUID) (*model.Repository, error) {
+	return a.RepositoryStorage.Get(kallax.ULID(id))
 }
 
 func (a *Archiver) notifyStart(j *Job) {
@@ -169,6 +949,110 @@ func (a *Archiver) notifyWarn(j *Job, err error) {
 	a.Notifiers.Warn(j, err)
 }
 
+func (a *Archiver) notifyPhaseDone(j *Job, p Phase, d time.Duration) {
+	if a.Notifiers.PhaseDone == nil {
+		return
+	}
+
+	a.Notifiers.PhaseDone(j, p, d)
+}
+
+func (a *Archiver) notifyPhaseStart(j *Job, p Phase, endpoint string) {
+	if a.Notifiers.PhaseStart == nil {
+		return
+	}
+
+	a.Notifiers.PhaseStart(j, p, endpoint)
+}
+
+func (a *Archiver) notifySubmodules(j *Job, subs []*Submodule) {
+	if a.Notifiers.Submodules == nil {
+		return
+	}
+
+	a.Notifiers.Submodules(j, subs)
+}
+
+func (a *Archiver) notifyGone(j *Job, r *model.Repository) {
+	if a.Notifiers.Gone == nil {
+		return
+	}
+
+	a.Notifiers.Gone(j, r)
+}
+
+func (a *Archiver) notifyDone(j *Job, r *model.Repository, s *ArchiveStats) {
+	if a.Notifiers.Done == nil {
+		return
+	}
+
+	a.Notifiers.Done(j, r, s)
+}
+
+// Pack archives the repository at the given endpoint the same way Do does,
+// but without using the repository database: the repository is treated as a
+// new one, so all its references are pushed to the rooted repositories. It
+// returns the resulting repository model, which is not stored anywhere.
+func (a *Archiver) Pack(endpoint string) (*model.Repository, error) {
+	return a.PackContext(context.Background(), endpoint)
+}
+
+// PackContext archives the repository at the given endpoint like Pack does,
+// stopping as soon as possible if the given context is cancelled, as
+// DoContext does.
+func (a *Archiver) PackContext(ctx context.Context, endpoint string) (r *model.Repository, err error) {
+	r = model.NewRepository()
+	r.Endpoints = []string{endpoint}
+	j := &Job{RepositoryID: uuid.UUID(r.ID)}
+	log := log.New("job", j.RepositoryID)
+
+	a.notifyStart(j)
+	defer func() { a.notifyStop(j, err) }()
+
+	tx, err := a.rootedTransactioner(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	gr, err := a.cloneEndpoint(ctx, j, log, j.RepositoryID.String(), endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if cErr := gr.Close(); cErr != nil && err == nil {
+			err = ErrCleanRepositoryDir.Wrap(cErr)
+		}
+	}()
+
+	changes, err := NewChanges(NewModelReferencer(r), gr)
+	if err != nil {
+		return nil, ErrChanges.Wrap(err)
+	}
+
+	var failedInits []model.SHA1
+	rm := &remote{model: r, tx: tx, tr: gr, changes: changes}
+	for ic, cs := range changes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if err := a.pushChangesToRootedRepository(ctx, j, tx, ic, []*remote{rm}); err != nil {
+			a.notifyWarn(j, ErrPushToRootedRepository.Wrap(err, ic.String()))
+			failedInits = append(failedInits, ic)
+			continue
+		}
+
+		r.References = updateRepositoryReferences(r.References, cs, ic)
+	}
+
+	now := time.Now()
+	r.Status = model.Fetched
+	r.FetchedAt = &now
+	r.LastCommitAt = lastCommitTime(r.References)
+	return r, checkFailedInits(changes, failedInits)
+}
+
 func selectEndpoint(endpoints []string) (string, error) {
 	if len(endpoints) == 0 {
 		return "", ErrEndpointsEmpty.New()
@@ -178,53 +1062,249 @@ func selectEndpoint(endpoints []string) (string, error) {
 	return endpoints[0], nil
 }
 
-func (a *Archiver) pushChangesToRootedRepositories(j *Job, r *model.Repository,
-	tr TemporaryRepository, changes Changes, now time.Time) error {
-	var failedInits []model.SHA1
-	for ic, cs := range changes {
+// rootedTransactioner returns the transactioner of the rooted repositories of
+// the repositories fetched from the given endpoint.
+func (a *Archiver) rootedTransactioner(endpoint string) (repository.RootedTransactioner, error) {
+	if et, ok := a.RootedTransactioner.(EndpointTransactioner); ok {
+		return et.ForEndpoint(endpoint)
+	}
+
+	return a.RootedTransactioner, nil
+}
+
+// pushChangesToRootedRepositories pushes the changes of all the remotes to
+// the rooted repositories of their roots, using a single transaction for each
+// rooted repository shared by several remotes. If the context is cancelled,
+// the remaining rooted repositories are not pushed and the context error is
+// stored in the remotes with changes for them.
+func (a *Archiver) pushChangesToRootedRepositories(ctx context.Context, j *Job, remotes []*remote) {
+	for root, rms := range remotesByRoot(remotes) {
+		ic := root.init
+		if err := ctx.Err(); err != nil {
+			for _, rm := range rms {
+				rm.err = err
+			}
+
+			continue
+		}
+
 		//TODO: try lock first_commit
 		//TODO: if lock cannot be acquired after timeout, continue
-		if err := a.pushChangesToRootedRepository(r, tr, ic, cs); err != nil {
-			err = ErrPushToRootedRepository.Wrap(err, ic.String())
-			a.notifyWarn(j, err)
-			failedInits = append(failedInits, ic)
+		if err := a.pushChangesToRootedRepository(ctx, j, root.tx, ic, rms); err != nil {
+			for _, rm := range rms {
+				a.failInit(j, rm, ic, err)
+			}
+
 			//TODO: release lock
 			continue
 		}
-		r.References = updateRepositoryReferences(r.References, cs, ic)
-		if err := a.dbUpdateRepository(r, now); err != nil {
-			err = ErrPushToRootedRepository.Wrap(err, ic.String())
-			a.notifyWarn(j, err)
-			failedInits = append(failedInits, ic)
+
+		for _, rm := range rms {
+			rm.model.References = updateRepositoryReferences(rm.model.References, rm.changes[ic], ic)
+			if err := a.dbUpdateRepository(rm.model); err != nil {
+				a.failInit(j, rm, ic, err)
+			}
 		}
 		//TODO: release lock
 	}
-	return checkFailedInits(changes, failedInits)
 }
 
-func (a *Archiver) pushChangesToRootedRepository(r *model.Repository, tr TemporaryRepository, ic model.SHA1, changes []*Command) error {
-	tx, err := a.RootedTransactioner.Begin(plumbing.Hash(ic))
+// rootedRepository identifies a rooted repository by its root commit and the
+// transactioner where it is stored.
+type rootedRepository struct {
+	tx   repository.RootedTransactioner
+	init model.SHA1
+}
+
+// remotesByRoot groups the remotes by the rooted repositories they have
+// changes for.
+func remotesByRoot(remotes []*remote) map[rootedRepository][]*remote {
+	m := make(map[rootedRepository][]*remote)
+	for _, rm := range remotes {
+		if rm.err != nil {
+			continue
+		}
+
+		for ic := range rm.changes {
+			root := rootedRepository{tx: rm.tx, init: ic}
+			m[root] = append(m[root], rm)
+		}
+	}
+
+	return m
+}
+
+func (a *Archiver) failInit(j *Job, rm *remote, ic model.SHA1, err error) {
+	a.notifyWarn(j, ErrPushToRootedRepository.Wrap(err, ic.String()))
+	rm.failedInits = append(rm.failedInits, ic)
+}
+
+// pushChangesToRootedRepository pushes the changes of the remotes for the
+// root ic to its rooted repository in rtx, committing all of them at once. If
+// any of the pushes fails or the context is cancelled before committing, none
+// of them is committed, and the transaction is aborted, so no file of it is
+// left behind (see Aborter), even if it panics. If the rooted repository
+// already has all the changes, nothing is committed, see alreadyPushed.
+func (a *Archiver) pushChangesToRootedRepository(ctx context.Context, j *Job,
+	rtx repository.RootedTransactioner, ic model.SHA1, remotes []*remote) error {
+	tx, err := a.beginRooted(j, rtx, ic, remotes)
 	if err != nil {
 		return err
 	}
 
 	rr, err := git.Open(tx.Storer(), nil)
 	if err != nil {
-		_ = tx.Rollback()
+		_ = abortTx(rtx, tx)
+		return err
+	}
+
+	pushed, err := a.alreadyPushed(rr, ic, remotes)
+	if err != nil {
+		_ = abortTx(rtx, tx)
 		return err
 	}
 
+	if pushed {
+		log.Debug("changes already in rooted repository, not committing",
+			"job", j.RepositoryID, "root", ic.String())
+		return abortTx(rtx, tx)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			_ = abortTx(rtx, tx)
+			panic(r)
+		}
+	}()
+
 	return WithInProcRepository(rr, func(url string) error {
-		refspecs := a.changesToPushRefSpec(r.ID, changes)
-		if err := tr.Push(url, refspecs); err != nil {
-			_ = tx.Rollback()
+		a.notifyPhaseStart(j, PackPhase, "")
+		start := time.Now()
+		for _, rm := range remotes {
+			refspecs := a.changesToPushRefSpec(rm.model.ID, rm.changes[ic])
+			if err := rm.tr.Push(url, refspecs); err != nil {
+				_ = abortTx(rtx, tx)
+				return err
+			}
+		}
+
+		a.notifyPhaseDone(j, PackPhase, time.Since(start))
+
+		if err := ctx.Err(); err != nil {
+			_ = abortTx(rtx, tx)
+			return err
+		}
+
+		a.notifyPhaseStart(j, StorePhase, "")
+		start = time.Now()
+		if err := tx.Commit(); err != nil {
+			_ = abortTx(rtx, tx)
 			return err
 		}
 
-		return tx.Commit()
+		a.notifyPhaseDone(j, StorePhase, time.Since(start))
+		return nil
 	})
 }
 
+// beginRooted begins the transaction of the rooted repository of the root ic
+// in rtx. If any of the remotes found it corrupt and rtx is a Rewriter, the
+// transaction begins with an empty rooted repository, so the corrupt one is
+// rewritten from scratch when committing it.
+func (a *Archiver) beginRooted(j *Job, rtx repository.RootedTransactioner,
+	ic model.SHA1, remotes []*remote) (repository.Tx, error) {
+	rw, ok := rtx.(Rewriter)
+	if !ok || !anyCorrupt(remotes, ic) {
+		return rtx.Begin(plumbing.Hash(ic))
+	}
+
+	log.Warn("rewriting corrupt rooted repository from scratch, the references of other repositories in it are archived again by their next fetch",
+		"job", j.RepositoryID, "root", ic.String())
+	return rw.BeginEmpty(plumbing.Hash(ic))
+}
+
+// anyCorrupt returns whether any of the remotes found the rooted repository of
+// the root ic corrupt.
+func anyCorrupt(remotes []*remote, ic model.SHA1) bool {
+	for _, rm := range remotes {
+		for _, c := range rm.corrupt {
+			if c == ic {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// referencesNotIn returns the references whose root is not one of the given
+// ones.
+func referencesNotIn(refs []*model.Reference, roots []model.SHA1) []*model.Reference {
+	var result []*model.Reference
+	for _, ref := range refs {
+		found := false
+		for _, root := range roots {
+			if ref.Init == root {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			result = append(result, ref)
+		}
+	}
+
+	return result
+}
+
+// joinRoots returns the given roots separated by commas.
+func joinRoots(roots []model.SHA1) string {
+	strs := make([]string, len(roots))
+	for i, r := range roots {
+		strs[i] = r.String()
+	}
+
+	return strings.Join(strs, ", ")
+}
+
+// alreadyPushed returns whether the references of the rooted repository are
+// already the ones the changes of the remotes for the root ic would leave. It
+// happens when the job was processed before, but the process died after
+// committing the rooted repository and before storing the references in the
+// repository model and acknowledging the job, which is then delivered again.
+func (a *Archiver) alreadyPushed(rr *git.Repository, ic model.SHA1, remotes []*remote) (bool, error) {
+	for _, rm := range remotes {
+		for _, ch := range rm.changes[ic] {
+			var name string
+			if ch.New != nil {
+				name = fmt.Sprintf("%s/%s", ch.New.Name, rm.model.ID)
+			} else {
+				name = fmt.Sprintf("%s/%s", ch.Old.Name, rm.model.ID)
+			}
+
+			ref, err := rr.Storer.Reference(plumbing.ReferenceName(name))
+			if err == plumbing.ErrReferenceNotFound {
+				if ch.New != nil {
+					return false, nil
+				}
+
+				continue
+			}
+
+			if err != nil {
+				return false, err
+			}
+
+			if ch.New == nil || ref.Hash() != plumbing.Hash(ch.New.Hash) {
+				return false, nil
+			}
+		}
+	}
+
+	return true, nil
+}
+
 func (a *Archiver) changesToPushRefSpec(id kallax.ULID, changes []*Command) []config.RefSpec {
 	var rss []config.RefSpec
 	for _, ch := range changes {
@@ -281,22 +1361,33 @@ func updateRepositoryReferences(oldRefs []*model.Reference, commands []*Command,
 	return result
 }
 
-// Updates DB: status, fetch time, commit time
-func (a *Archiver) dbUpdateRepository(repoDb *model.Repository, then time.Time) error {
+// dbUpdateRepository stores the references and last commit time of a
+// repository that is still being fetched.
+func (a *Archiver) dbUpdateRepository(repoDb *model.Repository) error {
+	repoDb.LastCommitAt = lastCommitTime(repoDb.References)
+	return UpdateRepositoryStatus(a.RepositoryStorage, repoDb, Fetching,
+		model.Schema.Repository.LastCommitAt,
+		model.Schema.Repository.References,
+	)
+}
+
+// dbFinishRepository stores the final status of a repository fetched at the
+// given time, which is Errored if the fetch failed and Fetched otherwise.
+func (a *Archiver) dbFinishRepository(repoDb *model.Repository, then time.Time, fetchErr error) error {
+	if fetchErr != nil {
+		repoDb.FetchErrorAt = &then
+		return UpdateRepositoryStatus(a.RepositoryStorage, repoDb, Errored,
+			model.Schema.Repository.FetchErrorAt,
+		)
+	}
 
-	repoDb.Status = model.Fetched
 	repoDb.FetchedAt = &then
 	repoDb.LastCommitAt = lastCommitTime(repoDb.References)
-
-	_, err := a.RepositoryStorage.Update(repoDb,
-		model.Schema.Repository.UpdatedAt,
+	return UpdateRepositoryStatus(a.RepositoryStorage, repoDb, model.Fetched,
 		model.Schema.Repository.FetchedAt,
 		model.Schema.Repository.LastCommitAt,
-		model.Schema.Repository.Status,
 		model.Schema.Repository.References,
 	)
-
-	return err
 }
 
 func lastCommitTime(refs []*model.Reference) *time.Time {
@@ -320,51 +1411,80 @@ func checkFailedInits(changes Changes, failed []model.SHA1) error {
 		return nil
 	}
 
-	strs := make([]string, n)
-	for i := 0; i < n; i++ {
-		strs[i] = failed[i].String()
-	}
-
 	return ErrArchivingRoots.New(
 		n,
 		len(changes),
-		strings.Join(strs, ", "),
+		joinRoots(failed),
 	)
 }
 
 // NewArchiverWorkerPool creates a new WorkerPool that uses an Archiver to
-// process jobs. It takes optional start, stop and warn notifier functions that
-// are equal to the Archiver notifiers but with additional WorkerContext.
-func NewArchiverWorkerPool(r *model.RepositoryStore,
+// process jobs with the given options. The archiver notifiers are forwarded to
+// the Notifiers of the returned WorkerPool, together with the WorkerContext of
+// the worker processing the job.
+func NewArchiverWorkerPool(r RepositoryStore,
 	tx repository.RootedTransactioner,
 	tc TemporaryCloner,
-	start func(*WorkerContext, *Job),
-	stop func(*WorkerContext, *Job, error),
-	warn func(*WorkerContext, *Job, error)) *WorkerPool {
-
-	do := func(ctx *WorkerContext, j *Job) error {
-		a := NewArchiver(r, tx, tc)
+	opts ArchiverOptions) *WorkerPool {
 
-		if start != nil {
-			a.Notifiers.Start = func(j *Job) {
-				start(ctx, j)
+	hosts := newHostLimiter(opts.PerHostConcurrency)
+	cloners := newWorkerClonerFactory(tc)
+	wp := NewWorkerPool(nil)
+	wp.hosts = hosts
+	wp.do = func(ctx *WorkerContext, j *Job) error {
+		wtc, clean := tc, func() error { return nil }
+		if opts.WorkerTempDirs {
+			var err error
+			wtc, clean, err = cloners.cloner(ctx)
+			if err != nil {
+				return err
 			}
 		}
 
-		if stop != nil {
-			a.Notifiers.Stop = func(j *Job, err error) {
-				stop(ctx, j, err)
+		defer func() {
+			if err := clean(); err != nil {
+				log.Warn("error cleaning the temporary directory of the worker",
+					"worker", ctx.ID, "error", err)
 			}
+		}()
+
+		a := NewArchiver(r, tx, wtc)
+		a.Options = opts
+		a.hosts = hosts
+		a.Notifiers.Start = func(j *Job) {
+			wp.notifyStart(ctx, j)
 		}
 
-		if warn != nil {
-			a.Notifiers.Warn = func(j *Job, err error) {
-				warn(ctx, j, err)
-			}
+		a.Notifiers.Stop = func(j *Job, err error) {
+			wp.notifyStop(ctx, j, err)
+		}
+
+		a.Notifiers.Warn = func(j *Job, err error) {
+			wp.notifyWarn(ctx, j, err)
+		}
+
+		a.Notifiers.PhaseDone = func(j *Job, p Phase, d time.Duration) {
+			wp.notifyPhaseDone(ctx, j, p, d)
+		}
+
+		a.Notifiers.PhaseStart = func(j *Job, p Phase, endpoint string) {
+			wp.notifyPhaseStart(ctx, j, p, endpoint)
+		}
+
+		a.Notifiers.Submodules = func(j *Job, subs []*Submodule) {
+			wp.notifySubmodules(ctx, j, subs)
+		}
+
+		a.Notifiers.Gone = func(j *Job, r *model.Repository) {
+			wp.notifyGone(ctx, j, r)
+		}
+
+		a.Notifiers.Done = func(j *Job, r *model.Repository, s *ArchiveStats) {
+			wp.notifyDone(ctx, j, r, s)
 		}
 
 		return a.Do(j)
 	}
 
-	return NewWorkerPool(do)
+	return wp
 }
@@ -1,12 +1,17 @@
 package borges
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/satori/go.uuid"
 	"github.com/src-d/go-git-fixtures"
@@ -18,6 +23,7 @@ import (
 	"gopkg.in/src-d/go-billy.v3"
 	"gopkg.in/src-d/go-billy.v3/osfs"
 	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/storage/filesystem"
 	"gopkg.in/src-d/go-git.v4/storage/memory"
 	"gopkg.in/src-d/go-kallax.v1"
@@ -75,7 +81,7 @@ func (s *ArchiverSuite) TestFixtures() {
 
 			s := model.NewRepositoryStore(s.DB)
 			tx := rrepository.NewSivaRootedTransactioner(rootedFs, txFs)
-			a := NewArchiver(s, tx, NewTemporaryCloner(tmpFs))
+			a := NewArchiver(NewSQLRepositoryStore(s), tx, NewTemporaryCloner(tmpFs, CloneOptions{}))
 
 			a.Notifiers.Warn = func(j *Job, err error) {
 				require.NoError(err, "job: %v", j)
@@ -140,6 +146,405 @@ func (s *ArchiverSuite) TestFixtures() {
 	}
 }
 
+func (s *ArchiverSuite) TestForks() {
+	require := s.Require()
+
+	tmp, err := ioutil.TempDir("", "borges-tests")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	fs := osfs.New(tmp)
+	rootedFs, err := fs.Chroot("rooted")
+	require.NoError(err)
+	txFs, err := fs.Chroot("tx")
+	require.NoError(err)
+	tmpFs, err := fs.Chroot("tmp")
+	require.NoError(err)
+
+	store := model.NewRepositoryStore(s.DB)
+	tx := rrepository.NewSivaRootedTransactioner(rootedFs, txFs)
+	a := NewArchiver(NewSQLRepositoryStore(store), tx, NewTemporaryCloner(tmpFs, CloneOptions{}))
+
+	var warnings []error
+	a.Notifiers.Warn = func(j *Job, err error) {
+		warnings = append(warnings, err)
+	}
+
+	repo, err := defaultRepository()
+	require.NoError(err)
+
+	var ids []kallax.ULID
+	err = WithInProcRepository(repo, func(url string) error {
+		j := &Job{}
+		for _, endpoint := range []string{url, url, "file:///does/not/exist"} {
+			mr := model.NewRepository()
+			mr.Endpoints = []string{endpoint}
+			_, err := store.Save(mr)
+			require.NoError(err)
+
+			ids = append(ids, mr.ID)
+			if j.RepositoryID == uuid.Nil {
+				j.RepositoryID = uuid.UUID(mr.ID)
+			} else {
+				j.Forks = append(j.Forks, uuid.UUID(mr.ID))
+			}
+		}
+
+		return a.Do(j)
+	})
+	require.NoError(err)
+	require.Len(warnings, 1)
+	require.True(ErrArchivingFork.Is(warnings[0]))
+
+	checkNoFiles(s.T(), txFs)
+	checkNoFiles(s.T(), tmpFs)
+
+	inits := make(map[model.SHA1]bool)
+	for _, id := range ids[:2] {
+		mr, err := store.FindOne(model.NewRepositoryQuery().FindByID(id))
+		require.NoError(err)
+		require.Equal(model.FetchStatus(model.Fetched), mr.Status)
+		require.NotEmpty(mr.References)
+		for _, ref := range mr.References {
+			inits[ref.Init] = true
+		}
+	}
+
+	mr, err := store.FindOne(model.NewRepositoryQuery().FindByID(ids[2]))
+	require.NoError(err)
+	require.Equal(Errored, mr.Status)
+
+	fis, err := rootedFs.ReadDir(".")
+	require.NoError(err)
+	require.Len(fis, len(inits))
+}
+
+func TestArchiverPack(t *testing.T) {
+	require := require.New(t)
+	require.NoError(fixtures.Init())
+	defer fixtures.Clean()
+
+	tmp, err := ioutil.TempDir("", "borges-tests")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	fs := osfs.New(tmp)
+	rootedFs, err := fs.Chroot("rooted")
+	require.NoError(err)
+	txFs, err := fs.Chroot("tx")
+	require.NoError(err)
+	tmpFs, err := fs.Chroot("tmp")
+	require.NoError(err)
+
+	tx := rrepository.NewSivaRootedTransactioner(
+		NewBucketFilesystem(rootedFs, 2), txFs)
+	a := NewArchiver(nil, tx, NewTemporaryCloner(tmpFs, CloneOptions{}))
+	a.Notifiers.Warn = func(j *Job, err error) {
+		require.NoError(err, "job: %v", j)
+	}
+
+	repo, err := defaultRepository()
+	require.NoError(err)
+
+	var r *model.Repository
+	err = WithInProcRepository(repo, func(url string) error {
+		var err error
+		r, err = a.Pack(url)
+		return err
+	})
+	require.NoError(err)
+
+	checkNoFiles(t, txFs)
+	checkNoFiles(t, tmpFs)
+
+	require.NotEmpty(r.References)
+	require.Equal(model.FetchStatus(model.Fetched), r.Status)
+	for _, ref := range r.References {
+		init := ref.Init.String()
+		_, err := rootedFs.Stat(rootedFs.Join(init[:2], init+".siva"))
+		require.NoError(err)
+	}
+}
+
+func TestArchiverCloneJobTimeout(t *testing.T) {
+	require := require.New(t)
+
+	tc := &deadlineCloner{}
+	a := NewArchiver(nil, nil, tc)
+	a.Options.MaxJobTimeout = time.Hour
+
+	_, err := a.cloneAttempt(context.Background(), &Job{}, "foo", "http://foo")
+	require.NoError(err)
+	require.False(tc.hasDeadline)
+
+	_, err = a.cloneAttempt(context.Background(), &Job{Timeout: time.Minute}, "foo", "http://foo")
+	require.NoError(err)
+	require.True(tc.hasDeadline)
+	require.True(tc.timeout <= time.Minute)
+	require.True(tc.timeout > 50*time.Second)
+
+	_, err = a.cloneAttempt(context.Background(), &Job{Timeout: 10 * time.Hour}, "foo", "http://foo")
+	require.NoError(err)
+	require.True(tc.timeout <= time.Hour)
+	require.True(tc.timeout > 59*time.Minute)
+}
+
+func TestAdaptiveTimeout(t *testing.T) {
+	require := require.New(t)
+
+	cases := []struct {
+		last     time.Duration
+		factor   float64
+		min, max time.Duration
+		expected time.Duration
+	}{
+		{time.Minute, 3, 0, 0, 3 * time.Minute},
+		{10 * time.Second, 2.5, 0, 0, 25 * time.Second},
+		{10 * time.Second, 3, time.Minute, time.Hour, time.Minute},
+		{time.Hour, 3, time.Minute, 2 * time.Hour, 2 * time.Hour},
+		{time.Hour, 1e10, 0, 0, time.Duration(math.MaxInt64)},
+	}
+
+	for _, c := range cases {
+		require.Equal(c.expected, adaptiveTimeout(c.last, c.factor, c.min, c.max),
+			"%v * %v in [%v, %v]", c.last, c.factor, c.min, c.max)
+	}
+}
+
+func TestArchiverWithAdaptiveTimeout(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("", "borges-adaptive-timeout")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	store, err := OpenBoltRepositoryStore(filepath.Join(tmp, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	a := NewArchiver(store, nil, nil)
+	a.Options.AdaptiveTimeout = 3
+	a.Options.MinAdaptiveTimeout = time.Minute
+	a.Options.MaxJobTimeout = time.Hour
+
+	mr := model.NewRepository()
+	require.NoError(store.Create(mr))
+	rm := &remote{log: log, model: mr}
+	j := &Job{RepositoryID: uuid.UUID(mr.ID)}
+
+	// first-time repositories use the default timeout
+	require.Equal(j, a.withAdaptiveTimeout(j, rm))
+
+	require.NoError(store.SetArchiveStats(mr.ID, &ArchiveStats{FetchDuration: 5 * time.Minute}))
+	aj := a.withAdaptiveTimeout(j, rm)
+	require.Equal(15*time.Minute, aj.Timeout)
+	require.Equal(j.RepositoryID, aj.RepositoryID)
+	require.Zero(j.Timeout)
+
+	require.NoError(store.SetArchiveStats(mr.ID, &ArchiveStats{FetchDuration: time.Second}))
+	require.Equal(time.Minute, a.withAdaptiveTimeout(j, rm).Timeout)
+
+	// the timeout of the job is kept
+	j.Timeout = time.Second
+	require.Equal(j, a.withAdaptiveTimeout(j, rm))
+}
+
+func TestArchiverDoContext_Cancelled(t *testing.T) {
+	require := require.New(t)
+
+	tc := &deadlineCloner{}
+	a := NewArchiver(nil, nil, tc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := a.DoContext(ctx, &Job{RepositoryID: uuid.NewV4()})
+	require.Equal(context.Canceled, err)
+	require.False(tc.cloned)
+}
+
+func TestArchiverClone_CancelledWhileRetrying(t *testing.T) {
+	require := require.New(t)
+
+	a := NewArchiver(nil, nil, &transientErrorCloner{})
+	a.Options.FetchRetries = 3
+	a.Options.FetchRetryBackoff = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, attempts, err := a.clone(ctx, &Job{}, log, "foo", "http://foo")
+	require.Equal(context.Canceled, err)
+	require.Equal(1, attempts)
+}
+
+func TestArchiverIsFresh(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	recently, long := now.Add(-time.Minute), now.Add(-2*time.Hour)
+	r := model.NewRepository()
+	r.Status = model.Fetched
+	r.FetchedAt = &recently
+
+	a := NewArchiver(nil, nil, nil)
+	require.False(a.isFresh(r, now))
+
+	a.Options.SkipIfFresherThan = time.Hour
+	require.True(a.isFresh(r, now))
+
+	r.FetchedAt = &long
+	require.False(a.isFresh(r, now))
+
+	r.FetchedAt = &recently
+	r.Status = Errored
+	require.False(a.isFresh(r, now))
+
+	r.Status = model.Fetched
+	r.FetchedAt = nil
+	require.False(a.isFresh(r, now))
+}
+
+func TestArchiverDo_CrashAfterCommit(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("", "borges-crash")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	fs := osfs.New(tmp)
+	store, err := OpenBoltRepositoryStore(fs.Join(tmp, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	txFs, err := fs.Chroot("tx")
+	require.NoError(err)
+	tmpFs, err := fs.Chroot("tmp")
+	require.NoError(err)
+	tx := &commitCountingTransactioner{
+		RootedTransactioner: rrepository.NewSivaRootedTransactioner(osfs.New(fs.Join(tmp, "rooted")), txFs),
+	}
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	commitFile(t, r, "README", "foo")
+
+	err = WithInProcRepository(r, func(url string) error {
+		mr := model.NewRepository()
+		mr.Endpoints = []string{url}
+		require.NoError(store.Create(mr))
+		j := &Job{RepositoryID: uuid.UUID(mr.ID)}
+
+		// the process dies once the rooted repository is committed, so
+		// neither the references nor the final status are stored
+		crashing := &crashingStore{RepositoryStore: store}
+		a := NewArchiver(crashing, tx, NewTemporaryCloner(tmpFs, CloneOptions{}))
+		require.Error(a.Do(j))
+		require.Equal(1, tx.commits)
+
+		stored, err := store.Get(mr.ID)
+		require.NoError(err)
+		require.Equal(Fetching, stored.Status)
+		require.Empty(stored.References)
+
+		// the job is delivered again to a new process
+		a = NewArchiver(store, tx, NewTemporaryCloner(tmpFs, CloneOptions{}))
+		require.NoError(a.Do(j))
+		require.Equal(1, tx.commits)
+
+		stored, err = store.Get(mr.ID)
+		require.NoError(err)
+		require.Equal(model.FetchStatus(model.Fetched), stored.Status)
+		checkReferencesInDB(t, stored, repoToModelRefs(t, r))
+		return nil
+	})
+	require.NoError(err)
+
+	checkNoFiles(t, txFs)
+	checkNoFiles(t, tmpFs)
+}
+
+// crashingStore is a RepositoryStore that fails every update after the first
+// one storing the references of a repository being fetched, which is done
+// right after committing its rooted repositories, as if the process died.
+type crashingStore struct {
+	RepositoryStore
+	crashed bool
+}
+
+func (s *crashingStore) UpdateStatus(r *model.Repository, status model.FetchStatus,
+	cols ...kallax.SchemaField) error {
+	if status == Fetching && len(cols) > 0 {
+		s.crashed = true
+	}
+
+	if s.crashed {
+		return fmt.Errorf("crashed")
+	}
+
+	return s.RepositoryStore.UpdateStatus(r, status, cols...)
+}
+
+// commitCountingTransactioner is a RootedTransactioner that counts the
+// transactions committed.
+type commitCountingTransactioner struct {
+	rrepository.RootedTransactioner
+	commits int
+}
+
+func (t *commitCountingTransactioner) Begin(h plumbing.Hash) (rrepository.Tx, error) {
+	tx, err := t.RootedTransactioner.Begin(h)
+	if err != nil {
+		return nil, err
+	}
+
+	return &commitCountingTx{Tx: tx, commits: &t.commits}, nil
+}
+
+type commitCountingTx struct {
+	rrepository.Tx
+	commits *int
+}
+
+func (tx *commitCountingTx) Commit() error {
+	if err := tx.Tx.Commit(); err != nil {
+		return err
+	}
+
+	*tx.commits++
+	return nil
+}
+
+func repoToModelRefs(t *testing.T, r *git.Repository) []*model.Reference {
+	refs, err := NewGitReferencer(r).References()
+	require.NoError(t, err)
+	return refs
+}
+
+// deadlineCloner is a TemporaryCloner that records the deadline of the
+// context of the last clone.
+type deadlineCloner struct {
+	cloned      bool
+	hasDeadline bool
+	timeout     time.Duration
+}
+
+func (c *deadlineCloner) Clone(ctx context.Context, id, url string) (TemporaryRepository, error) {
+	c.cloned = true
+	var deadline time.Time
+	deadline, c.hasDeadline = ctx.Deadline()
+	c.timeout = time.Until(deadline)
+	return nil, nil
+}
+
+// transientErrorCloner is a TemporaryCloner whose clones always fail with a
+// transient error.
+type transientErrorCloner struct{}
+
+func (transientErrorCloner) Clone(context.Context, string, string) (TemporaryRepository, error) {
+	return nil, syscall.ECONNRESET
+}
+
 func newRepository(f *fixtures.Fixture) *git.Repository {
 	fs := osfs.New(f.DotGit().Root())
 	st, err := filesystem.NewStorage(fs)
@@ -205,3 +610,384 @@ func checkNoFiles(t *testing.T, fs billy.Filesystem) {
 		checkNoFiles(t, fsr)
 	}
 }
+
+func TestArchiverDo_Gone(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("", "borges-gone")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	fs := osfs.New(tmp)
+	store, err := OpenBoltRepositoryStore(fs.Join(tmp, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	rootedFs, err := fs.Chroot("rooted")
+	require.NoError(err)
+	txFs, err := fs.Chroot("tx")
+	require.NoError(err)
+	tmpFs, err := fs.Chroot("tmp")
+	require.NoError(err)
+
+	a := NewArchiver(store, rrepository.NewSivaRootedTransactioner(rootedFs, txFs),
+		NewTemporaryCloner(tmpFs, CloneOptions{}))
+	a.Options.FetchRetries = 3
+	var gone []*model.Repository
+	a.Notifiers.Gone = func(j *Job, r *model.Repository) {
+		gone = append(gone, r)
+	}
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	mr := model.NewRepository()
+	err = WithInProcRepository(r, func(url string) error {
+		// only the repository at url exists
+		mr.Endpoints = []string{url + "/deleted"}
+		require.NoError(store.Create(mr))
+		return a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)})
+	})
+	require.NoError(err)
+
+	stored, err := store.Get(mr.ID)
+	require.NoError(err)
+	require.Equal(Gone, stored.Status)
+	require.NotNil(stored.FetchErrorAt)
+	require.Len(gone, 1)
+	require.Equal(mr.ID, gone[0].ID)
+}
+
+func TestArchiverDo_TooManyRefs(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("", "borges-max-refs")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	fs := osfs.New(tmp)
+	store, err := OpenBoltRepositoryStore(fs.Join(tmp, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	rootedFs, err := fs.Chroot("rooted")
+	require.NoError(err)
+	txFs, err := fs.Chroot("tx")
+	require.NoError(err)
+	tmpFs, err := fs.Chroot("tmp")
+	require.NoError(err)
+
+	a := NewArchiver(store, NewSivaRootedTransactioner(rootedFs, txFs, SivaOptions{}),
+		NewTemporaryCloner(tmpFs, CloneOptions{MaxRefs: 4}))
+
+	r := refFilterRepository(t)
+	mr := model.NewRepository()
+	err = WithInProcRepository(r, func(url string) error {
+		mr.Endpoints = []string{url}
+		require.NoError(store.Create(mr))
+		require.NoError(a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)}))
+
+		head, err := r.Reference("refs/heads/master", false)
+		require.NoError(err)
+		require.NoError(r.Storer.SetReference(
+			plumbing.NewHashReference("refs/pull/2/head", head.Hash())))
+		return a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)})
+	})
+	refsErr, ok := err.(*TooManyRefsError)
+	require.True(ok, "%v", err)
+	require.Equal(5, refsErr.Refs)
+
+	stored, err := store.Get(mr.ID)
+	require.NoError(err)
+	require.Equal(TooManyRefs, stored.Status)
+	require.NotNil(stored.FetchErrorAt)
+	require.Len(stored.References, 4)
+
+	stats, err := store.ArchiveStats(mr.ID)
+	require.NoError(err)
+	require.Equal(5, stats.RemoteReferences)
+	// the rest of the stats are the ones of the last archiving
+	require.Equal(4, stats.References)
+	require.NotZero(stats.Objects)
+}
+
+func TestArchiverDo_Panic(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("", "borges-panic")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	fs := osfs.New(tmp)
+	store, err := OpenBoltRepositoryStore(fs.Join(tmp, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	rootedFs, err := fs.Chroot("rooted")
+	require.NoError(err)
+	txFs, err := fs.Chroot("tx")
+	require.NoError(err)
+	tmpFs, err := fs.Chroot("tmp")
+	require.NoError(err)
+
+	a := NewArchiver(store, rrepository.NewSivaRootedTransactioner(rootedFs, txFs),
+		&panickingCloner{NewTemporaryCloner(tmpFs, CloneOptions{})})
+	var stopErr error
+	a.Notifiers.Stop = func(j *Job, err error) {
+		stopErr = err
+	}
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	commitFile(t, r, "README", "foo")
+
+	mr := model.NewRepository()
+	err = WithInProcRepository(r, func(url string) error {
+		mr.Endpoints = []string{url}
+		require.NoError(store.Create(mr))
+		require.Panics(func() {
+			_ = a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)})
+		})
+
+		return nil
+	})
+	require.NoError(err)
+	require.True(ErrJobPanic.Is(stopErr), "%v", stopErr)
+
+	stored, err := store.Get(mr.ID)
+	require.NoError(err)
+	require.Equal(Errored, stored.Status)
+
+	fis, err := tmpFs.ReadDir(tmpFs.Join("local_repos", uuid.UUID(mr.ID).String()))
+	require.NoError(err)
+	require.Empty(fis)
+}
+
+// panickingCloner is a TemporaryCloner whose repositories panic when their
+// references are read.
+type panickingCloner struct {
+	TemporaryCloner
+}
+
+func (c *panickingCloner) Clone(ctx context.Context, id, url string) (TemporaryRepository, error) {
+	r, err := c.TemporaryCloner.Clone(ctx, id, url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &panickingRepository{r}, nil
+}
+
+type panickingRepository struct {
+	TemporaryRepository
+}
+
+func (*panickingRepository) References() ([]*model.Reference, error) {
+	panic("foo")
+}
+
+func TestArchiverDo_CorruptRooted(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("", "borges-corrupt-rooted")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	fs := osfs.New(tmp)
+	store, err := OpenBoltRepositoryStore(fs.Join(tmp, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	rootedFs, err := fs.Chroot("rooted")
+	require.NoError(err)
+	txFs, err := fs.Chroot("tx")
+	require.NoError(err)
+	tmpFs, err := fs.Chroot("tmp")
+	require.NoError(err)
+
+	a := NewArchiver(store, NewSivaRootedTransactioner(rootedFs, txFs, SivaOptions{}),
+		NewTemporaryCloner(tmpFs, CloneOptions{}))
+	a.Options.Incremental = true
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	root, _ := commitFiles(t, r, map[string]string{"README": "foo"})
+
+	mr := model.NewRepository()
+	err = WithInProcRepository(r, func(url string) error {
+		mr.Endpoints = []string{url}
+		require.NoError(store.Create(mr))
+		require.NoError(a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)}))
+
+		// a crash left the siva file truncated
+		path := filepath.Join(tmp, "rooted", root.String()+".siva")
+		fi, err := os.Stat(path)
+		require.NoError(err)
+		require.NoError(os.Truncate(path, fi.Size()/2))
+
+		head, _ := commitFiles(t, r, map[string]string{"README": "bar"}, root)
+		require.NoError(a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)}))
+
+		tx, err := NewSivaRootedTransactioner(rootedFs, txFs, SivaOptions{}).Begin(root)
+		require.NoError(err)
+		defer func() { require.NoError(tx.Rollback()) }()
+
+		_, err = ValidateRootedRepository(tx.Storer(), ValidateOptions{})
+		require.NoError(err)
+
+		ref, err := tx.Storer().Reference(
+			plumbing.ReferenceName("refs/heads/master/" + mr.ID.String()))
+		require.NoError(err)
+		require.Equal(head, ref.Hash())
+		return nil
+	})
+	require.NoError(err)
+
+	stored, err := store.Get(mr.ID)
+	require.NoError(err)
+	require.Equal(model.FetchStatus(model.Fetched), stored.Status)
+	require.Len(stored.References, 1)
+}
+
+// TestArchiverDo_CorruptRootedShared rewrites a corrupt rooted repository
+// shared by two repositories, checking that the references of the one not
+// being archived are archived again by its next fetch.
+func TestArchiverDo_CorruptRootedShared(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("", "borges-corrupt-rooted-shared")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	fs := osfs.New(tmp)
+	store, err := OpenBoltRepositoryStore(fs.Join(tmp, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	rootedFs, err := fs.Chroot("rooted")
+	require.NoError(err)
+	txFs, err := fs.Chroot("tx")
+	require.NoError(err)
+	tmpFs, err := fs.Chroot("tmp")
+	require.NoError(err)
+
+	a := NewArchiver(store, NewSivaRootedTransactioner(rootedFs, txFs, SivaOptions{}),
+		NewTemporaryCloner(tmpFs, CloneOptions{}))
+	a.Options.Incremental = true
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	root, _ := commitFiles(t, r, map[string]string{"README": "foo"})
+
+	first, second := model.NewRepository(), model.NewRepository()
+	err = WithInProcRepository(r, func(url string) error {
+		for _, mr := range []*model.Repository{first, second} {
+			mr.Endpoints = []string{url}
+			require.NoError(store.Create(mr))
+			require.NoError(a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)}))
+		}
+
+		path := filepath.Join(tmp, "rooted", root.String()+".siva")
+		fi, err := os.Stat(path)
+		require.NoError(err)
+		require.NoError(os.Truncate(path, fi.Size()/2))
+
+		require.NoError(a.Do(&Job{RepositoryID: uuid.UUID(first.ID)}))
+		require.NoError(a.Do(&Job{RepositoryID: uuid.UUID(second.ID)}))
+
+		tx, err := NewSivaRootedTransactioner(rootedFs, txFs, SivaOptions{}).Begin(root)
+		require.NoError(err)
+		defer func() { require.NoError(tx.Rollback()) }()
+
+		for _, mr := range []*model.Repository{first, second} {
+			ref, err := tx.Storer().Reference(
+				plumbing.ReferenceName("refs/heads/master/" + mr.ID.String()))
+			require.NoError(err, mr.ID.String())
+			require.Equal(root, ref.Hash())
+		}
+
+		return nil
+	})
+	require.NoError(err)
+
+	stored, err := store.Get(second.ID)
+	require.NoError(err)
+	require.Len(stored.References, 1)
+}
+
+// TestArchiverDo_BeginFailure fails to begin the transaction of the rooted
+// repository of an incremental fetch once, checking that it is not taken as
+// corrupt and rewritten.
+func TestArchiverDo_BeginFailure(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("", "borges-begin-failure")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	fs := osfs.New(tmp)
+	store, err := OpenBoltRepositoryStore(fs.Join(tmp, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	rootedFs, err := fs.Chroot("rooted")
+	require.NoError(err)
+	txFs, err := fs.Chroot("tx")
+	require.NoError(err)
+	tmpFs, err := fs.Chroot("tmp")
+	require.NoError(err)
+
+	rt := &failingBeginTransactioner{Rewriter: NewSivaRootedTransactioner(
+		rootedFs, txFs, SivaOptions{}).(Rewriter)}
+	a := NewArchiver(store, rt, NewTemporaryCloner(tmpFs, CloneOptions{}))
+	a.Options.Incremental = true
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	root, _ := commitFiles(t, r, map[string]string{"README": "foo"})
+
+	mr := model.NewRepository()
+	err = WithInProcRepository(r, func(url string) error {
+		mr.Endpoints = []string{url}
+		require.NoError(store.Create(mr))
+		require.NoError(a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)}))
+
+		rt.failures = 1
+		head, _ := commitFiles(t, r, map[string]string{"README": "bar"}, root)
+		require.NoError(a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)}))
+		require.Equal(0, rt.failures)
+		require.Equal(0, rt.rewrites)
+
+		tx, err := rt.Begin(root)
+		require.NoError(err)
+		defer func() { require.NoError(tx.Rollback()) }()
+
+		ref, err := tx.Storer().Reference(
+			plumbing.ReferenceName("refs/heads/master/" + mr.ID.String()))
+		require.NoError(err)
+		require.Equal(head, ref.Hash())
+		return nil
+	})
+	require.NoError(err)
+}
+
+// failingBeginTransactioner is a Rewriter whose transactions fail to begin
+// the given number of times, and that counts the rewrites.
+type failingBeginTransactioner struct {
+	Rewriter
+	failures int
+	rewrites int
+}
+
+func (t *failingBeginTransactioner) Begin(h plumbing.Hash) (rrepository.Tx, error) {
+	if t.failures > 0 {
+		t.failures--
+		return nil, fmt.Errorf("storage not available")
+	}
+
+	return t.Rewriter.Begin(h)
+}
+
+func (t *failingBeginTransactioner) BeginEmpty(h plumbing.Hash) (rrepository.Tx, error) {
+	t.rewrites++
+	return t.Rewriter.BeginEmpty(h)
+}
@@ -0,0 +1,221 @@
+package borges
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/utils/binary"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+// ArchiveStats are the sizes of the rooted repositories where a repository is
+// archived, as they are once it is stored. Rooted repositories shared with
+// other repositories, such as forks, are counted fully for each of them.
+type ArchiveStats struct {
+	// Objects is the number of objects in the packfiles of the rooted
+	// repositories of the repository, plus the loose ones.
+	Objects int64 `json:"objects"`
+	// References is the number of references of the repository.
+	References int `json:"references"`
+	// SivaSize is the size in bytes of the siva files of the rooted
+	// repositories of the repository.
+	SivaSize int64 `json:"siva_size"`
+	// UpdatedAt is when the stats were computed.
+	UpdatedAt time.Time `json:"updated_at"`
+	// FilteredBlobs are the sorted hashes of the blobs of the repository
+	// left out of its rooted repositories for being too big, see
+	// CloneOptions.MaxBlobSize. The ones filtered when the repository was
+	// archived before are kept, since the objects already archived are
+	// not pushed again.
+	FilteredBlobs []string `json:"filtered_blobs,omitempty"`
+	// FetchDuration is the time the last fetch of the repository took,
+	// which is the base of its next clone timeout with
+	// ArchiverOptions.AdaptiveTimeout. It is zero if it was not fetched,
+	// such as when it was skipped for being fresh.
+	FetchDuration time.Duration `json:"fetch_duration,omitempty"`
+	// RemoteReferences is the number of references the remote had in the
+	// last fetch of the repository, counting only the ones allowed by the
+	// reference filters of the clones, which are the ones limited by
+	// CloneOptions.MaxRefs. It is recorded even if the fetch was aborted
+	// for having too many, and it is zero if the references were not
+	// listed, which they are only with MaxRefs or the filters.
+	RemoteReferences int `json:"remote_references,omitempty"`
+}
+
+// ArchiveStatsStore is a RepositoryStore that also stores the ArchiveStats of
+// the repositories, which the archiver sets every time a repository is
+// archived. Stores with a schema must be migrated first, see
+// MigrateArchiveStats.
+type ArchiveStatsStore interface {
+	// ArchiveStats returns the stats of the repository with the given ID,
+	// nil if there are none.
+	ArchiveStats(id kallax.ULID) (*ArchiveStats, error)
+	// SetArchiveStats replaces the stats of the repository with the
+	// given ID.
+	SetArchiveStats(id kallax.ULID, s *ArchiveStats) error
+}
+
+// archiveStatsCreator is an ArchiveStatsStore whose schema must be created
+// before using it.
+type archiveStatsCreator interface {
+	createArchiveStats() error
+}
+
+// MigrateArchiveStats creates the schema where the store keeps the
+// ArchiveStats of the repositories, if it is an ArchiveStatsStore that needs
+// one. It can be run again safely.
+func MigrateArchiveStats(store RepositoryStore) error {
+	if c, ok := store.(archiveStatsCreator); ok {
+		return c.createArchiveStats()
+	}
+
+	return nil
+}
+
+// RootedStatter is a RootedTransactioner that can report the size of the
+// rooted repositories committed to it.
+type RootedStatter interface {
+	repository.RootedTransactioner
+	// StatRooted returns the number of objects and the size in bytes of
+	// the rooted repository with the given root. It fails with an error
+	// satisfying os.IsNotExist if there is no such rooted repository.
+	StatRooted(h plumbing.Hash) (objects int64, size int64, err error)
+}
+
+// StatRooted implements the RootedStatter interface.
+func (t *sivaTransactioner) StatRooted(h plumbing.Hash) (int64, int64, error) {
+	p, err := t.currentSivaPath(h)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if p == "" {
+		return 0, 0, os.ErrNotExist
+	}
+
+	return statSivaFile(t.fs, p)
+}
+
+// archiveStats returns the ArchiveStats of the rooted repositories of the
+// references of the repository, stored in rtx. It returns nil if rtx is not a
+// RootedStatter.
+func archiveStats(rtx repository.RootedTransactioner, r *model.Repository) (*ArchiveStats, error) {
+	st, ok := rtx.(RootedStatter)
+	if !ok {
+		return nil, nil
+	}
+
+	stats := &ArchiveStats{References: len(r.References), UpdatedAt: time.Now()}
+	for _, root := range repositoryRoots(r.References) {
+		objects, size, err := st.StatRooted(plumbing.Hash(root))
+		if err != nil {
+			return nil, err
+		}
+
+		stats.Objects += objects
+		stats.SivaSize += size
+	}
+
+	return stats, nil
+}
+
+// mergeFilteredBlobs returns the sorted hashes of the blobs filtered before,
+// in the previous stats, if any, and the ones filtered now.
+func mergeFilteredBlobs(prev *ArchiveStats, filtered []plumbing.Hash) []string {
+	set := make(map[string]bool)
+	if prev != nil {
+		for _, h := range prev.FilteredBlobs {
+			set[h] = true
+		}
+	}
+
+	for _, h := range filtered {
+		set[h.String()] = true
+	}
+
+	if len(set) == 0 {
+		return nil
+	}
+
+	hashes := make([]string, 0, len(set))
+	for h := range set {
+		hashes = append(hashes, h)
+	}
+
+	sort.Strings(hashes)
+	return hashes
+}
+
+// packIndexHeader is the header of the version 2 packfile indexes.
+var packIndexHeader = []byte{0xff, 't', 'O', 'c', 0, 0, 0, 2}
+
+// statSivaFile returns the number of objects of the repository stored in the
+// siva file at path in fs, and its size. The objects of each packfile are
+// counted from the header of its index.
+func statSivaFile(fs billy.Filesystem, p string) (int64, int64, error) {
+	fi, err := fs.Stat(p)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	index, err := readSivaIndex(fs, p)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rfs := &sivaReadFS{fs: fs, path: p, index: index}
+	var objects int64
+	for _, e := range index {
+		dir, name := path.Split(e.Name)
+		switch {
+		case dir == "objects/pack/" && strings.HasSuffix(name, ".idx"):
+			n, err := countPackIndexObjects(rfs, e.Name)
+			if err != nil {
+				return 0, 0, err
+			}
+
+			objects += n
+		case len(dir) == len("objects/xx/") && strings.HasPrefix(dir, "objects/") &&
+			len(name) == 38:
+			objects++
+		}
+	}
+
+	return objects, fi.Size(), nil
+}
+
+// countPackIndexObjects returns the number of objects of the packfile index at
+// path in fs, which is the last entry of its fanout table.
+func countPackIndexObjects(fs billy.Basic, path string) (n int64, err error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer checkClose(f, &err)
+
+	header := make([]byte, len(packIndexHeader))
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, err
+	}
+
+	if !bytes.Equal(header, packIndexHeader) {
+		return 0, os.ErrInvalid
+	}
+
+	// the fanout has 256 entries, the last one is the number of objects
+	if _, err := f.Seek(255*4, io.SeekCurrent); err != nil {
+		return 0, err
+	}
+
+	count, err := binary.ReadUint32(f)
+	return int64(count), err
+}
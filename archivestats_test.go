@@ -0,0 +1,101 @@
+package borges
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+	"gopkg.in/src-d/go-billy.v3/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestSivaRootedTransactioner_StatRooted(t *testing.T) {
+	require := require.New(t)
+
+	fs := memfs.New()
+	rtx := NewSivaRootedTransactioner(fs, memfs.New(), SivaOptions{})
+	h := plumbing.NewHash("e41f091c11a338f62796a738c83d879936a508ec")
+
+	_, _, err := rtx.(RootedStatter).StatRooted(h)
+	require.True(os.IsNotExist(err), "%v", err)
+
+	tx, err := rtx.Begin(h)
+	require.NoError(err)
+	commitToTx(t, tx.Storer())
+	require.NoError(tx.Commit())
+
+	objects, size, err := rtx.(RootedStatter).StatRooted(h)
+	require.NoError(err)
+	// the blob, tree and commit are loose objects
+	require.Equal(int64(3), objects)
+
+	fi, err := fs.Stat(h.String() + sivaExt)
+	require.NoError(err)
+	require.Equal(fi.Size(), size)
+}
+
+func TestArchiverDo_Done(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("", "borges-done")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	fs := osfs.New(tmp)
+	store, err := OpenBoltRepositoryStore(fs.Join(tmp, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+	require.NoError(MigrateArchiveStats(store))
+
+	rootedFs, err := fs.Chroot("rooted")
+	require.NoError(err)
+	txFs, err := fs.Chroot("tx")
+	require.NoError(err)
+	tmpFs, err := fs.Chroot("tmp")
+	require.NoError(err)
+
+	a := NewArchiver(store, NewSivaRootedTransactioner(rootedFs, txFs, SivaOptions{}),
+		NewTemporaryCloner(tmpFs, CloneOptions{}))
+	var done []*ArchiveStats
+	a.Notifiers.Done = func(j *Job, r *model.Repository, s *ArchiveStats) {
+		done = append(done, s)
+	}
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	commitFile(t, r, "README", "foo")
+
+	mr := model.NewRepository()
+	err = WithInProcRepository(r, func(url string) error {
+		mr.Endpoints = []string{url}
+		require.NoError(store.Create(mr))
+		return a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)})
+	})
+	require.NoError(err)
+
+	require.Len(done, 1)
+	require.NotNil(done[0])
+	require.Equal(int64(3), done[0].Objects)
+	require.Equal(1, done[0].References)
+
+	stored, err := store.Get(mr.ID)
+	require.NoError(err)
+	require.Len(stored.References, 1)
+	root := stored.References[0].Init.String()
+	fi, err := rootedFs.Stat(root + sivaExt)
+	require.NoError(err)
+	require.Equal(fi.Size(), done[0].SivaSize)
+
+	stats, err := store.ArchiveStats(mr.ID)
+	require.NoError(err)
+	require.Equal(done[0].Objects, stats.Objects)
+	require.Equal(done[0].References, stats.References)
+	require.Equal(done[0].SivaSize, stats.SivaSize)
+	require.True(stats.FetchDuration > 0)
+}
@@ -0,0 +1,253 @@
+package borges
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-billy.v3"
+)
+
+// sivaExt is the extension of the siva files of the rooted repositories.
+const sivaExt = ".siva"
+
+// AuditOptions sets where the rooted repositories are stored, as in
+// NewLayoutTransactioner, and which siva files are audited.
+type AuditOptions struct {
+	// Naming is the naming of the rooted repositories of the endpoints
+	// without a matching layout, HashNaming if nil.
+	Naming SivaNaming
+	// Layouts are the layouts of the rooted repositories.
+	Layouts []*Layout
+	// MinAge is the time since their last modification the siva files
+	// must have to be reported as orphans, so the ones being committed
+	// while auditing, whose repository is not stored yet, are not.
+	MinAge time.Duration
+	// Immutable audits a store of versioned siva files, see SivaOptions.
+	// The rooted repositories are found by their manifests, so the paths
+	// of the report are the ones of the manifests, and fixing an orphan
+	// removes its manifest along with all its versions.
+	Immutable bool
+}
+
+// AuditReport is the result of an Audit.
+type AuditReport struct {
+	// Orphans are the paths of the siva files, relative to the root of the
+	// rooted repositories filesystem, that are not the rooted repository of
+	// any reference of the repositories stored.
+	Orphans []string
+	// Dangling are the repositories stored with references whose rooted
+	// repositories do not exist.
+	Dangling []*DanglingRepository
+
+	immutable bool
+}
+
+// DanglingRepository is a repository with references in rooted repositories
+// that do not exist.
+type DanglingRepository struct {
+	Repository *model.Repository
+	// Missing are the paths of the siva files that do not exist, relative
+	// to the root of the rooted repositories filesystem.
+	Missing []string
+}
+
+// Audit cross-references the repositories of the store with the siva files of
+// the rooted repositories stored in fs with the given options, reporting the
+// siva files no repository has references in and the repositories whose
+// references are in siva files that do not exist. The siva files of each
+// repository are looked for in the layout of its endpoint. Nothing is
+// changed, see AuditReport.Fix.
+func Audit(store RepositoryStore, fs billy.Filesystem, opts AuditOptions) (*AuditReport, error) {
+	found, err := findSivaFiles(fs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AuditReport{immutable: opts.Immutable}
+	used := make(map[string]bool)
+	err = NewRepositoryIter(store, &RepositoryQuery{}, 0).ForEach(func(r *model.Repository) error {
+		endpoint, err := selectEndpoint(r.Endpoints)
+		if err != nil || len(r.References) == 0 {
+			return nil
+		}
+
+		var missing []string
+		for _, root := range repositoryRoots(r.References) {
+			p, err := sivaPath(fs, opts, endpoint, root)
+			if err != nil {
+				return err
+			}
+
+			used[p] = true
+			if _, ok := found[p]; !ok {
+				missing = append(missing, p)
+			}
+		}
+
+		if len(missing) > 0 {
+			report.Dangling = append(report.Dangling,
+				&DanglingRepository{Repository: r, Missing: missing})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for p, modTime := range found {
+		if !used[p] && time.Since(modTime) >= opts.MinAge {
+			report.Orphans = append(report.Orphans, p)
+		}
+	}
+
+	sort.Strings(report.Orphans)
+	return report, nil
+}
+
+// Fix removes the orphan siva files of the report from fs and marks the
+// dangling repositories with the Errored status, so they are archived again
+// by the requeue command. The repositories updated since they were audited
+// are left as they are. It stops at the first error.
+func (r *AuditReport) Fix(store RepositoryStore, fs billy.Filesystem) error {
+	for _, p := range r.Orphans {
+		if r.immutable {
+			if err := removeVersionedSivaFiles(fs, p); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := fs.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	now := time.Now()
+	for _, d := range r.Dangling {
+		d.Repository.FetchErrorAt = &now
+		err := UpdateRepositoryStatus(store, d.Repository, Errored,
+			model.Schema.Repository.FetchErrorAt,
+		)
+		if ErrStaleRepository.Is(err) {
+			log.Warn("dangling repository updated since audited, not marked as errored",
+				"repository", d.Repository.ID)
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sivaPath returns the path in the rooted repositories filesystem fs of the
+// siva file of the given root for the repositories of the endpoint, the one
+// where it would be created if it does not exist.
+func sivaPath(fs billy.Filesystem, opts AuditOptions, endpoint string, root model.SHA1) (string, error) {
+	l, err := matchLayout(opts.Layouts, endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	dir, dirFs, naming, err := auditLayout(fs, opts, l)
+	if err != nil {
+		return "", err
+	}
+
+	p, err := naming.Path(dirFs, root.String()+rootedFileExt(opts))
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(dir, p), nil
+}
+
+// findSivaFiles returns the modification time of the siva files in the
+// directory of every layout of the options, and the root of fs, by their path.
+// Only the files stored following the naming of each one are taken into
+// account, such as the ones in the right bucket directories.
+func findSivaFiles(fs billy.Filesystem, opts AuditOptions) (map[string]time.Time, error) {
+	found := make(map[string]time.Time)
+	ext := rootedFileExt(opts)
+	for _, l := range append([]*Layout{nil}, opts.Layouts...) {
+		dir, dirFs, naming, err := auditLayout(fs, opts, l)
+		if err != nil {
+			return nil, err
+		}
+
+		err = naming.Walk(dirFs, func(p string, fi os.FileInfo) error {
+			if isRootedFile(fi, ext) {
+				found[path.Join(dir, p)] = fi.ModTime()
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return found, nil
+}
+
+// auditLayout returns the directory of fs where the rooted repositories of
+// the layout are stored, along with its filesystem, and their naming, or the
+// ones of the endpoints without a layout if it is nil.
+func auditLayout(fs billy.Filesystem, opts AuditOptions, l *Layout) (string, billy.Filesystem, SivaNaming, error) {
+	if l == nil {
+		naming := opts.Naming
+		if naming == nil {
+			naming = HashNaming()
+		}
+
+		return "", fs, naming, nil
+	}
+
+	naming, err := l.SivaNaming()
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	dirFs, err := fs.Chroot(l.Root)
+	return l.Root, dirFs, naming, err
+}
+
+func readDirIfExists(fs billy.Filesystem, dir string) ([]os.FileInfo, error) {
+	if dir == "" {
+		dir = "/"
+	}
+
+	fis, err := fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return fis, err
+}
+
+// rootedFileExt returns the extension of the file of each rooted repository
+// audited: the siva file, or the manifest of its versions in an immutable
+// store.
+func rootedFileExt(opts AuditOptions) string {
+	if opts.Immutable {
+		return versionsExt
+	}
+
+	return sivaExt
+}
+
+// isRootedFile returns whether the file is the file with the given extension
+// of a rooted repository, not a temporary one.
+func isRootedFile(fi os.FileInfo, ext string) bool {
+	name := fi.Name()
+	return fi.Mode().IsRegular() && strings.HasSuffix(name, ext) &&
+		len(name) == len(model.SHA1{})*2+len(ext)
+}
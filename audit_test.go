@@ -0,0 +1,148 @@
+package borges
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+	"gopkg.in/src-d/go-billy.v3/util"
+)
+
+func TestAudit(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "borges-audit")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(dir)) }()
+
+	store, err := OpenBoltRepositoryStore(filepath.Join(dir, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	a := model.NewSHA1("aa00000000000000000000000000000000000000")
+	b := model.NewSHA1("bb00000000000000000000000000000000000000")
+	c := model.NewSHA1("cc00000000000000000000000000000000000000")
+	d := model.NewSHA1("dd00000000000000000000000000000000000000")
+
+	fs := memfs.New()
+	for _, p := range []string{
+		"aa/" + a.String() + ".siva",
+		"aa/" + a.String() + ".siva.upload",
+		"cc/" + c.String() + ".siva",
+		// not in its bucket
+		b.String() + ".siva",
+		"gitlab/" + b.String() + ".siva",
+		"gitlab/" + d.String() + ".siva",
+	} {
+		require.NoError(util.WriteFile(fs, p, []byte("siva"), 0644))
+	}
+
+	ok := model.NewRepository()
+	ok.Endpoints = []string{"https://github.com/foo/ok"}
+	ok.References = []*model.Reference{{Name: "refs/heads/master", Init: a}}
+	require.NoError(store.Create(ok))
+
+	dangling := model.NewRepository()
+	dangling.Endpoints = []string{"https://github.com/foo/dangling"}
+	dangling.References = []*model.Reference{
+		{Name: "refs/heads/master", Init: a},
+		{Name: "refs/heads/foo", Init: b},
+	}
+	require.NoError(store.Create(dangling))
+
+	gitlab := model.NewRepository()
+	gitlab.Endpoints = []string{"https://gitlab.com/foo/bar"}
+	gitlab.References = []*model.Reference{{Name: "refs/heads/master", Init: b}}
+	require.NoError(store.Create(gitlab))
+
+	empty := model.NewRepository()
+	empty.Endpoints = []string{"https://github.com/foo/empty"}
+	require.NoError(store.Create(empty))
+
+	opts := AuditOptions{
+		Naming:  BucketNaming(2),
+		Layouts: []*Layout{{Host: "gitlab.com", Root: "gitlab"}},
+	}
+	report, err := Audit(store, fs, opts)
+	require.NoError(err)
+	require.Equal([]string{
+		"cc/" + c.String() + ".siva",
+		"gitlab/" + d.String() + ".siva",
+	}, report.Orphans)
+	require.Len(report.Dangling, 1)
+	require.Equal(dangling.ID, report.Dangling[0].Repository.ID)
+	require.Equal([]string{"bb/" + b.String() + ".siva"}, report.Dangling[0].Missing)
+
+	opts.MinAge = time.Hour
+	recent, err := Audit(store, fs, opts)
+	require.NoError(err)
+	require.Empty(recent.Orphans)
+	require.Len(recent.Dangling, 1)
+
+	require.NoError(report.Fix(store, fs))
+	for _, p := range report.Orphans {
+		_, err := fs.Stat(p)
+		require.True(os.IsNotExist(err), p)
+	}
+
+	_, err = fs.Stat("aa/" + a.String() + ".siva")
+	require.NoError(err)
+
+	stored, err := store.Get(dangling.ID)
+	require.NoError(err)
+	require.Equal(Errored, stored.Status)
+	require.NotNil(stored.FetchErrorAt)
+
+	stored, err = store.Get(ok.ID)
+	require.NoError(err)
+	require.EqualValues(model.Pending, stored.Status)
+}
+
+func TestAudit_Immutable(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "borges-audit")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(dir)) }()
+
+	store, err := OpenBoltRepositoryStore(filepath.Join(dir, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	a := model.NewSHA1("aa00000000000000000000000000000000000000")
+	b := model.NewSHA1("bb00000000000000000000000000000000000000")
+	c := model.NewSHA1("cc00000000000000000000000000000000000000")
+
+	fs := memfs.New()
+	for _, root := range []model.SHA1{a, c} {
+		version := root.String() + ".0000000000000000001.siva"
+		require.NoError(util.WriteFile(fs, version, []byte("siva"), 0644))
+		require.NoError(util.WriteFile(fs, root.String()+".versions",
+			[]byte(version+"\n"), 0644))
+	}
+
+	r := model.NewRepository()
+	r.Endpoints = []string{"https://github.com/foo/bar"}
+	r.References = []*model.Reference{
+		{Name: "refs/heads/master", Init: a},
+		{Name: "refs/heads/foo", Init: b},
+	}
+	require.NoError(store.Create(r))
+
+	report, err := Audit(store, fs, AuditOptions{Immutable: true})
+	require.NoError(err)
+	require.Equal([]string{c.String() + ".versions"}, report.Orphans)
+	require.Len(report.Dangling, 1)
+	require.Equal([]string{b.String() + ".versions"}, report.Dangling[0].Missing)
+
+	require.NoError(report.Fix(store, fs))
+	require.Equal([]string{
+		a.String() + ".0000000000000000001.siva",
+		a.String() + ".versions",
+	}, sortedFiles(t, fs))
+}
@@ -0,0 +1,141 @@
+package borges
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"gopkg.in/src-d/go-errors.v0"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+var (
+	ErrInvalidCredentials = errors.NewKind("invalid credentials for host %s: %s")
+)
+
+// defaultAuthUser is the user used when a credential does not set one. Most
+// git hosting providers ignore the user when a token or key is given.
+const defaultAuthUser = "git"
+
+// AuthProvider supplies the credentials used to access a given endpoint.
+type AuthProvider interface {
+	// Auth returns the auth method to use with the given endpoint, or nil if
+	// the endpoint has to be accessed anonymously.
+	Auth(endpoint string) (transport.AuthMethod, error)
+}
+
+// Credential holds the credentials used to access the hosts matching its
+// Host pattern. Token is used for HTTP endpoints and KeyPath for SSH ones.
+type Credential struct {
+	// Host is a pattern, as in path.Match, matched against the endpoint host.
+	Host string `json:"host"`
+	// User is the user to authenticate as, defaults to git.
+	User string `json:"user,omitempty"`
+	// Token is the password or access token used with HTTP basic auth.
+	Token string `json:"token,omitempty"`
+	// KeyPath is the path to the private key file used with SSH.
+	KeyPath string `json:"key_path,omitempty"`
+	// KeyPassword is the password of the private key, if any.
+	KeyPassword string `json:"key_password,omitempty"`
+}
+
+// String returns a representation of the credential with its secrets masked,
+// so it is safe to log.
+func (c *Credential) String() string {
+	token := "<empty>"
+	if c.Token != "" {
+		token = "*******"
+	}
+
+	return fmt.Sprintf("%s - %s:%s key:%s", c.Host, c.user(), token, c.KeyPath)
+}
+
+func (c *Credential) user() string {
+	if c.User == "" {
+		return defaultAuthUser
+	}
+
+	return c.User
+}
+
+// LoadCredentials reads a JSON file containing a list of credentials.
+func LoadCredentials(filename string) ([]*Credential, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var creds []*Credential
+	if err := json.NewDecoder(f).Decode(&creds); err != nil {
+		return nil, err
+	}
+
+	for _, c := range creds {
+		if _, err := path.Match(c.Host, ""); err != nil {
+			return nil, ErrInvalidCredentials.New(c.Host, err)
+		}
+	}
+
+	return creds, nil
+}
+
+type credentialsAuthProvider struct {
+	creds []*Credential
+}
+
+// NewCredentialsAuthProvider returns an AuthProvider that uses the first of
+// the given credentials whose host pattern matches the endpoint host. The auth
+// method is selected by the endpoint scheme. Endpoints without a matching
+// credential are accessed anonymously.
+func NewCredentialsAuthProvider(creds []*Credential) AuthProvider {
+	return &credentialsAuthProvider{creds}
+}
+
+func (p *credentialsAuthProvider) Auth(endpoint string) (transport.AuthMethod, error) {
+	ep, err := transport.NewEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	c := p.match(ep.Host())
+	if c == nil {
+		return nil, nil
+	}
+
+	switch ep.Protocol() {
+	case "http", "https":
+		if c.Token == "" {
+			return nil, nil
+		}
+
+		return githttp.NewBasicAuth(c.user(), c.Token), nil
+	case "ssh":
+		if c.KeyPath == "" {
+			return nil, nil
+		}
+
+		auth, err := ssh.NewPublicKeysFromFile(c.user(), c.KeyPath, c.KeyPassword)
+		if err != nil {
+			return nil, ErrInvalidCredentials.New(c.Host, err)
+		}
+
+		return auth, nil
+	default:
+		return nil, nil
+	}
+}
+
+func (p *credentialsAuthProvider) match(host string) *Credential {
+	for _, c := range p.creds {
+		if ok, _ := path.Match(c.Host, host); ok {
+			return c
+		}
+	}
+
+	return nil
+}
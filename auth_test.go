@@ -0,0 +1,67 @@
+package borges
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+func TestCredentialsAuthProvider(t *testing.T) {
+	require := require.New(t)
+
+	p := NewCredentialsAuthProvider([]*Credential{
+		{Host: "github.com", Token: "secret"},
+		{Host: "*.example.com", User: "foo", Token: "bar"},
+		{Host: "gitlab.com", KeyPath: "/does/not/exist"},
+	})
+
+	auth, err := p.Auth("https://github.com/src-d/borges.git")
+	require.NoError(err)
+	require.Equal(githttp.NewBasicAuth("git", "secret"), auth)
+	require.NotContains(auth.String(), "secret")
+
+	auth, err = p.Auth("https://git.example.com/foo/bar.git")
+	require.NoError(err)
+	require.Equal(githttp.NewBasicAuth("foo", "bar"), auth)
+
+	auth, err = p.Auth("https://bitbucket.org/foo/bar.git")
+	require.NoError(err)
+	require.Nil(auth)
+
+	auth, err = p.Auth("git://github.com/src-d/borges.git")
+	require.NoError(err)
+	require.Nil(auth)
+
+	auth, err = p.Auth("https://gitlab.com/foo/bar.git")
+	require.NoError(err)
+	require.Nil(auth)
+
+	_, err = p.Auth("git@gitlab.com:foo/bar.git")
+	require.True(ErrInvalidCredentials.Is(err))
+}
+
+func TestLoadCredentials(t *testing.T) {
+	require := require.New(t)
+
+	f, err := ioutil.TempFile("", "borges-credentials")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`[
+		{"host": "github.com", "token": "secret"},
+		{"host": "gitlab.com", "user": "foo", "key_path": "/foo/id_rsa"}
+	]`)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	creds, err := LoadCredentials(f.Name())
+	require.NoError(err)
+	require.Equal([]*Credential{
+		{Host: "github.com", Token: "secret"},
+		{Host: "gitlab.com", User: "foo", KeyPath: "/foo/id_rsa"},
+	}, creds)
+	require.NotContains(creds[0].String(), "secret")
+}
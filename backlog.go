@@ -0,0 +1,93 @@
+package borges
+
+import (
+	"net/url"
+
+	"github.com/streadway/amqp"
+	"gopkg.in/src-d/go-errors.v0"
+)
+
+// buriedQueueSuffix is the suffix of the name of the queue where the AMQP
+// brokers of the framework bury the jobs rejected without requeueing them.
+const buriedQueueSuffix = ".buriedQueue"
+
+// ErrBacklogNotSupported is returned when the backlog of the queues of a broker
+// cannot be read.
+var ErrBacklogNotSupported = errors.NewKind("reading the backlog of the queues of %s brokers is not supported")
+
+// QueueBacklog is the number of messages waiting in a queue of a broker.
+type QueueBacklog struct {
+	// Queue is the name of the queue.
+	Queue string `json:"queue"`
+	// Messages is the number of messages ready to be delivered, which does
+	// not include the ones delivered and not acknowledged yet.
+	Messages int `json:"messages"`
+	// Consumers is the number of consumers of the queue.
+	Consumers int `json:"consumers"`
+	// Buried is the number of messages rejected from the queue without
+	// requeueing them, waiting in its buried queue.
+	Buried int `json:"buried"`
+}
+
+// ReadQueueBacklogs returns the backlog of the queues with the given names in
+// the broker at the given URL, which must be an AMQP one, by declaring them
+// passively, so no queue is created. A queue that does not exist has no
+// messages.
+func ReadQueueBacklogs(brokerURL string, names []string) ([]*QueueBacklog, error) {
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "amqp" && u.Scheme != "amqps" {
+		return nil, ErrBacklogNotSupported.New(u.Scheme)
+	}
+
+	conn, err := amqp.Dial(brokerURL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var backlogs []*QueueBacklog
+	for _, name := range names {
+		b := &QueueBacklog{Queue: name}
+		q, err := inspectQueue(conn, name)
+		if err != nil {
+			return nil, err
+		}
+
+		b.Messages, b.Consumers = q.Messages, q.Consumers
+		buried, err := inspectQueue(conn, name+buriedQueueSuffix)
+		if err != nil {
+			return nil, err
+		}
+
+		b.Buried = buried.Messages
+		backlogs = append(backlogs, b)
+	}
+
+	return backlogs, nil
+}
+
+// inspectQueue returns the state of the queue with the given name, which is
+// empty if it does not exist. Each queue is inspected in a channel of its own,
+// since the broker closes the channel when the queue is not found.
+func inspectQueue(conn *amqp.Connection, name string) (amqp.Queue, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	q, err := ch.QueueInspect(name)
+	if aErr, ok := err.(*amqp.Error); ok && aErr.Code == amqp.NotFound {
+		return amqp.Queue{Name: name}, nil
+	}
+
+	if err != nil {
+		_ = ch.Close()
+		return amqp.Queue{}, err
+	}
+
+	return q, ch.Close()
+}
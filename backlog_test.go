@@ -0,0 +1,14 @@
+package borges
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadQueueBacklogs_NotSupported(t *testing.T) {
+	require := require.New(t)
+
+	_, err := ReadQueueBacklogs("memory://", []string{"borges"})
+	require.True(ErrBacklogNotSupported.Is(err), "%v", err)
+}
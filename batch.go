@@ -0,0 +1,94 @@
+package borges
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/framework.v0/queue"
+)
+
+// batchEntry is a job waiting in a batch to be published to a queue.
+type batchEntry struct {
+	job *Job
+	qj  *queue.Job
+	q   queue.Queue
+}
+
+// jobBatch is a set of jobs that are published together, in a transaction per
+// queue, instead of one by one.
+type jobBatch struct {
+	m       sync.Mutex
+	entries []*batchEntry
+	started time.Time
+}
+
+// add adds a job to the batch and returns the number of jobs in it.
+func (b *jobBatch) add(e *batchEntry) int {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if len(b.entries) == 0 {
+		b.started = time.Now()
+	}
+
+	b.entries = append(b.entries, e)
+	return len(b.entries)
+}
+
+// age returns how long ago the oldest job of the batch was added, or zero if
+// the batch is empty.
+func (b *jobBatch) age() time.Duration {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if len(b.entries) == 0 {
+		return 0
+	}
+
+	return time.Since(b.started)
+}
+
+// publish publishes all the jobs of the batch and empties it. The transaction
+// of each queue is run by the given retry function, which can run it again if
+// it fails. It calls done for every job with the error of the transaction of
+// its queue, if any. The batch is locked while publishing, so batches are
+// published in order.
+func (b *jobBatch) publish(retry func(func() error) error, done func(*Job, error)) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if len(b.entries) == 0 {
+		return
+	}
+
+	var queues []queue.Queue
+	byQueue := make(map[queue.Queue][]*batchEntry)
+	for _, e := range b.entries {
+		if _, ok := byQueue[e.q]; !ok {
+			queues = append(queues, e.q)
+		}
+
+		byQueue[e.q] = append(byQueue[e.q], e)
+	}
+
+	for _, q := range queues {
+		entries := byQueue[q]
+		err := retry(func() error {
+			return q.Transaction(func(tx queue.Queue) error {
+				for _, e := range entries {
+					if err := tx.Publish(e.qj); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+		})
+
+		for _, e := range entries {
+			done(e.job, err)
+		}
+	}
+
+	b.entries = nil
+}
@@ -0,0 +1,75 @@
+package borges
+
+import (
+	"sort"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// blobFilter leaves the blobs bigger than a maximum size out of the pushes of
+// a temporary repository, keeping the hashes of the ones left out. All the
+// methods can be called on a nil filter, which filters nothing.
+type blobFilter struct {
+	max      int64
+	filtered map[plumbing.Hash]bool
+}
+
+// newBlobFilter returns a blobFilter of the blobs bigger than max bytes, or
+// nil if max is zero or less.
+func newBlobFilter(max int64) *blobFilter {
+	if max <= 0 {
+		return nil
+	}
+
+	return &blobFilter{max: max, filtered: make(map[plumbing.Hash]bool)}
+}
+
+// skip returns whether the blob o must be left out, recording it if so.
+func (f *blobFilter) skip(o plumbing.EncodedObject) bool {
+	if f == nil || o.Size() <= f.max {
+		return false
+	}
+
+	f.filtered[o.Hash()] = true
+	return true
+}
+
+// skipMissing returns whether the blob with the given hash, which is not in
+// the repository, can be left out, recording it if so. Only filtered
+// repositories can miss blobs: the ones of incremental clones whose rooted
+// repositories were archived with the blob filtered.
+func (f *blobFilter) skipMissing(h plumbing.Hash) bool {
+	if f == nil {
+		return false
+	}
+
+	f.filtered[h] = true
+	return true
+}
+
+// len returns the number of blobs left out so far.
+func (f *blobFilter) len() int {
+	if f == nil {
+		return 0
+	}
+
+	return len(f.filtered)
+}
+
+// Filtered returns the sorted hashes of the blobs left out so far.
+func (f *blobFilter) Filtered() []plumbing.Hash {
+	if f == nil {
+		return nil
+	}
+
+	hashes := make([]plumbing.Hash, 0, len(f.filtered))
+	for h := range f.filtered {
+		hashes = append(hashes, h)
+	}
+
+	sort.Slice(hashes, func(i, j int) bool {
+		return hashes[i].String() < hashes[j].String()
+	})
+
+	return hashes
+}
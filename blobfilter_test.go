@@ -0,0 +1,166 @@
+package borges
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+	"gopkg.in/src-d/go-billy.v3/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// TestArchiverDo_MaxBlobSize archives a repository with a big file, leaving it
+// out of the rooted repository, and then incrementally a new commit that keeps
+// it and adds another big one, which are both recorded, without rewriting the
+// rooted repository.
+func TestArchiverDo_MaxBlobSize(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("", "borges-max-blob-size")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	fs := osfs.New(tmp)
+	store, err := OpenBoltRepositoryStore(fs.Join(tmp, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+	require.NoError(MigrateArchiveStats(store))
+
+	rootedFs, err := fs.Chroot("rooted")
+	require.NoError(err)
+	txFs, err := fs.Chroot("tx")
+	require.NoError(err)
+	tmpFs, err := fs.Chroot("tmp")
+	require.NoError(err)
+
+	a := NewArchiver(store, NewSivaRootedTransactioner(rootedFs, txFs, SivaOptions{}),
+		NewTemporaryCloner(tmpFs, CloneOptions{MaxBlobSize: 10}))
+	a.Options.Incremental = true
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	big := strings.Repeat("big file ", 10)
+	root, blobs := commitFiles(t, r, map[string]string{"README": "foo", "big": big})
+
+	mr := model.NewRepository()
+	err = WithInProcRepository(r, func(url string) error {
+		mr.Endpoints = []string{url}
+		require.NoError(store.Create(mr))
+		require.NoError(a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)}))
+
+		stats, err := store.ArchiveStats(mr.ID)
+		require.NoError(err)
+		require.Equal([]string{blobs["big"].String()}, stats.FilteredBlobs)
+		requireObjectsInSiva(t, rootedFs, root,
+			[]plumbing.Hash{blobs["README"]}, []plumbing.Hash{blobs["big"]})
+
+		// a reference of another repository, which is lost if the rooted
+		// repository is rewritten instead of fetched incrementally
+		other := plumbing.NewHashReference(plumbing.ReferenceName(
+			"refs/heads/master/"+uuid.NewV4().String()), root)
+		tx, err := a.RootedTransactioner.Begin(root)
+		require.NoError(err)
+		require.NoError(tx.Storer().SetReference(other))
+		require.NoError(tx.Commit())
+
+		_, newBlobs := commitFiles(t, r, map[string]string{
+			"README": "bar", "big": big, "other": big + "other",
+		}, root)
+		require.NoError(a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)}))
+
+		tx, err = a.RootedTransactioner.Begin(root)
+		require.NoError(err)
+		ref, err := tx.Storer().Reference(other.Name())
+		require.NoError(err)
+		require.Equal(root, ref.Hash())
+		require.NoError(tx.Rollback())
+
+		stats, err = store.ArchiveStats(mr.ID)
+		require.NoError(err)
+		filtered := []string{blobs["big"].String(), newBlobs["other"].String()}
+		if filtered[0] > filtered[1] {
+			filtered[0], filtered[1] = filtered[1], filtered[0]
+		}
+
+		require.Equal(filtered, stats.FilteredBlobs)
+		requireObjectsInSiva(t, rootedFs, root,
+			[]plumbing.Hash{blobs["README"], newBlobs["README"]},
+			[]plumbing.Hash{blobs["big"], newBlobs["other"]})
+		return nil
+	})
+	require.NoError(err)
+}
+
+// commitFiles commits a tree with the given files on top of the given parents
+// to the master branch of r, returning the commit and the blobs by file name.
+func commitFiles(t *testing.T, r *git.Repository, files map[string]string,
+	parents ...plumbing.Hash) (plumbing.Hash, map[string]plumbing.Hash) {
+	require := require.New(t)
+
+	blobs := make(map[string]plumbing.Hash)
+	tree := &object.Tree{}
+	for _, name := range []string{"README", "big", "other"} {
+		content, ok := files[name]
+		if !ok {
+			continue
+		}
+
+		blob := r.Storer.NewEncodedObject()
+		blob.SetType(plumbing.BlobObject)
+		w, err := blob.Writer()
+		require.NoError(err)
+		_, err = w.Write([]byte(content))
+		require.NoError(err)
+		require.NoError(w.Close())
+		blobs[name], err = r.Storer.SetEncodedObject(blob)
+		require.NoError(err)
+
+		tree.Entries = append(tree.Entries,
+			object.TreeEntry{Name: name, Mode: filemode.Regular, Hash: blobs[name]})
+	}
+
+	sig := object.Signature{Name: "foo", Email: "foo@example.com", When: time.Now()}
+	commit := storeObject(t, r, &object.Commit{
+		Author:       sig,
+		Committer:    sig,
+		Message:      "commit files",
+		TreeHash:     storeObject(t, r, tree),
+		ParentHashes: parents,
+	})
+
+	require.NoError(r.Storer.SetReference(
+		plumbing.NewHashReference("refs/heads/master", commit)))
+	return commit, blobs
+}
+
+// requireObjectsInSiva checks that the rooted repository h in fs has the
+// present objects and not the missing ones.
+func requireObjectsInSiva(t *testing.T, fs billy.Filesystem, h plumbing.Hash,
+	present, missing []plumbing.Hash) {
+	require := require.New(t)
+
+	tx, err := NewSivaRootedTransactioner(fs, memfs.New(), SivaOptions{}).Begin(h)
+	require.NoError(err)
+	defer func() { require.NoError(tx.Rollback()) }()
+
+	for _, o := range present {
+		_, err := tx.Storer().EncodedObject(plumbing.AnyObject, o)
+		require.NoError(err, o.String())
+	}
+
+	for _, o := range missing {
+		_, err := tx.Storer().EncodedObject(plumbing.AnyObject, o)
+		require.Equal(plumbing.ErrObjectNotFound, err, o.String())
+	}
+}
@@ -0,0 +1,316 @@
+package borges
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+var (
+	// boltRepositoriesBucket holds the repositories, encoded as JSON, by
+	// their ID, so they are sorted by ID.
+	boltRepositoriesBucket = []byte("repositories")
+	// boltEndpointsBucket indexes the repositories by their endpoints. Its
+	// keys are the endpoint, a zero byte and the ID of the repository.
+	boltEndpointsBucket = []byte("endpoints")
+	// boltRootsBucket is the RootIndex. Its keys are the endpoints and its
+	// values the roots, one after the other.
+	boltRootsBucket = []byte("roots")
+	// boltArchiveStatsBucket holds the ArchiveStats of the repositories,
+	// encoded as JSON, by their ID.
+	boltArchiveStatsBucket = []byte("archive_stats")
+)
+
+// boltOpenTimeout is the time to wait for the lock of the database file,
+// which can only be opened by a process at a time.
+const boltOpenTimeout = 5 * time.Second
+
+// BoltRepositoryStore is a RepositoryStore that stores the repositories in an
+// embedded BoltDB database file, for single node setups without a SQL
+// database. Only one process can use the file at a time.
+type BoltRepositoryStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltRepositoryStore opens the BoltRepositoryStore at the given path,
+// creating it if it does not exist. It must be closed once it is not used
+// anymore.
+func OpenBoltRepositoryStore(path string) (*BoltRepositoryStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{
+			boltRepositoriesBucket, boltEndpointsBucket, boltRootsBucket,
+			boltArchiveStatsBucket,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &BoltRepositoryStore{db}, nil
+}
+
+// Close closes the database file.
+func (s *BoltRepositoryStore) Close() error {
+	return s.db.Close()
+}
+
+// Get implements the RepositoryStore interface.
+func (s *BoltRepositoryStore) Get(id kallax.ULID) (*model.Repository, error) {
+	var r *model.Repository
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		r, err = boltGet(tx, id)
+		return err
+	})
+
+	return r, err
+}
+
+// FindByEndpoint implements the RepositoryStore interface.
+func (s *BoltRepositoryStore) FindByEndpoint(endpoint string) ([]*model.Repository, error) {
+	var result []*model.Repository
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := boltEndpointKey(endpoint, nil)
+		c := tx.Bucket(boltEndpointsBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			var id kallax.ULID
+			copy(id[:], k[len(prefix):])
+			r, err := boltGet(tx, id)
+			if err != nil {
+				return err
+			}
+
+			result = append(result, r)
+		}
+
+		return nil
+	})
+
+	return result, err
+}
+
+// Find implements the RepositoryStore interface. The repositories are sorted
+// by ID in the database, so for any other order all of them are read to find
+// the ones of the page, although only the page is kept in memory.
+func (s *BoltRepositoryStore) Find(q *RepositoryQuery, after *model.Repository,
+	limit uint64) ([]*model.Repository, error) {
+	match, err := q.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	var page []*model.Repository
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltRepositoriesBucket).Cursor()
+		k, v := c.First()
+		if q.Order == OrderByID && after != nil {
+			k, v = c.Seek(after.ID[:])
+		}
+
+		for ; k != nil; k, v = c.Next() {
+			if q.Order == OrderByID && limit > 0 && uint64(len(page)) >= limit {
+				return nil
+			}
+
+			r, err := boltDecode(v)
+			if err != nil {
+				return err
+			}
+
+			if !match(r) || (after != nil && !q.less(after, r)) {
+				continue
+			}
+
+			page = insertSorted(q, page, r, limit)
+		}
+
+		return nil
+	})
+
+	return page, err
+}
+
+// insertSorted inserts r in the page, sorted by the order of the query, and
+// truncates it to the given limit, unless it is zero.
+func insertSorted(q *RepositoryQuery, page []*model.Repository, r *model.Repository,
+	limit uint64) []*model.Repository {
+	i := sort.Search(len(page), func(i int) bool { return q.less(r, page[i]) })
+	if limit > 0 && uint64(i) >= limit {
+		return page
+	}
+
+	page = append(page, nil)
+	copy(page[i+1:], page[i:])
+	page[i] = r
+	if limit > 0 && uint64(len(page)) > limit {
+		page = page[:limit]
+	}
+
+	return page
+}
+
+// Create implements the RepositoryStore interface.
+func (s *BoltRepositoryStore) Create(r *model.Repository) error {
+	if err := r.BeforeSave(); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, r, nil)
+	})
+}
+
+// UpdateStatus implements the RepositoryStore interface. All the fields of
+// the repository are stored, not only the given columns.
+func (s *BoltRepositoryStore) UpdateStatus(r *model.Repository,
+	status model.FetchStatus, cols ...kallax.SchemaField) error {
+
+	prevStatus, prevUpdatedAt := r.Status, r.UpdatedAt
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		current, err := boltGet(tx, r.ID)
+		if err != nil {
+			return err
+		}
+
+		if current.Status != prevStatus || !current.UpdatedAt.Equal(prevUpdatedAt) {
+			return ErrStaleRepository.New(r.ID, prevStatus)
+		}
+
+		r.Status = status
+		r.UpdatedAt = time.Now()
+		return boltPut(tx, r, current.Endpoints)
+	})
+	if err != nil {
+		r.Status, r.UpdatedAt = prevStatus, prevUpdatedAt
+	}
+
+	return err
+}
+
+// Roots implements the RootIndex interface.
+func (s *BoltRepositoryStore) Roots(endpoint string) ([]model.SHA1, error) {
+	var roots []model.SHA1
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltRootsBucket).Get([]byte(endpoint))
+		for len(v) >= len(model.SHA1{}) {
+			var root model.SHA1
+			v = v[copy(root[:], v):]
+			roots = append(roots, root)
+		}
+
+		return nil
+	})
+
+	return roots, err
+}
+
+// SetRoots implements the RootIndex interface.
+func (s *BoltRepositoryStore) SetRoots(endpoint string, roots []model.SHA1) error {
+	v := make([]byte, 0, len(roots)*len(model.SHA1{}))
+	for _, root := range roots {
+		v = append(v, root[:]...)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRootsBucket).Put([]byte(endpoint), v)
+	})
+}
+
+// ArchiveStats implements the ArchiveStatsStore interface.
+func (s *BoltRepositoryStore) ArchiveStats(id kallax.ULID) (*ArchiveStats, error) {
+	var stats *ArchiveStats
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltArchiveStatsBucket).Get(id[:])
+		if v == nil {
+			return nil
+		}
+
+		stats = &ArchiveStats{}
+		return json.Unmarshal(v, stats)
+	})
+
+	return stats, err
+}
+
+// SetArchiveStats implements the ArchiveStatsStore interface.
+func (s *BoltRepositoryStore) SetArchiveStats(id kallax.ULID, stats *ArchiveStats) error {
+	v, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltArchiveStatsBucket).Put(id[:], v)
+	})
+}
+
+// boltGet returns the repository with the given ID.
+func boltGet(tx *bolt.Tx, id kallax.ULID) (*model.Repository, error) {
+	v := tx.Bucket(boltRepositoriesBucket).Get(id[:])
+	if v == nil {
+		return nil, ErrRepositoryIDNotFound.New(id)
+	}
+
+	return boltDecode(v)
+}
+
+func boltDecode(v []byte) (*model.Repository, error) {
+	r := &model.Repository{}
+	if err := json.Unmarshal(v, r); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// boltPut stores the repository, replacing the given endpoints it had before
+// in the endpoints index by its current ones.
+func boltPut(tx *bolt.Tx, r *model.Repository, prevEndpoints []string) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(boltRepositoriesBucket).Put(r.ID[:], v); err != nil {
+		return err
+	}
+
+	endpoints := tx.Bucket(boltEndpointsBucket)
+	for _, e := range prevEndpoints {
+		if err := endpoints.Delete(boltEndpointKey(e, r.ID[:])); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range r.Endpoints {
+		if err := endpoints.Put(boltEndpointKey(e, r.ID[:]), []byte{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func boltEndpointKey(endpoint string, id []byte) []byte {
+	k := make([]byte, 0, len(endpoint)+1+len(id))
+	k = append(k, endpoint...)
+	k = append(k, 0)
+	return append(k, id...)
+}
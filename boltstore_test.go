@@ -0,0 +1,146 @@
+package borges
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+func TestBoltRepositoryStore(t *testing.T) {
+	suite.Run(t, new(BoltRepositoryStoreSuite))
+}
+
+type BoltRepositoryStoreSuite struct {
+	suite.Suite
+	dir   string
+	store *BoltRepositoryStore
+}
+
+func (s *BoltRepositoryStoreSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "borges-bolt")
+	s.NoError(err)
+
+	s.store, err = OpenBoltRepositoryStore(filepath.Join(s.dir, "repositories.db"))
+	s.NoError(err)
+}
+
+func (s *BoltRepositoryStoreSuite) TearDownTest() {
+	s.NoError(s.store.Close())
+	s.NoError(os.RemoveAll(s.dir))
+}
+
+func (s *BoltRepositoryStoreSuite) TestGet() {
+	r := s.newRepository("https://github.com/foo/bar")
+
+	stored, err := s.store.Get(r.ID)
+	s.NoError(err)
+	s.Equal(r.ID, stored.ID)
+	s.Equal(r.Endpoints, stored.Endpoints)
+	s.Equal(model.FetchStatus(model.Pending), stored.Status)
+	s.False(stored.CreatedAt.IsZero())
+
+	_, err = s.store.Get(kallax.NewULID())
+	s.True(ErrRepositoryIDNotFound.Is(err))
+}
+
+func (s *BoltRepositoryStoreSuite) TestFindByEndpoint() {
+	r := s.newRepository("https://github.com/foo/bar", "git://github.com/foo/bar")
+	s.newRepository("https://github.com/foo/bar.git")
+
+	rs, err := s.store.FindByEndpoint("git://github.com/foo/bar")
+	s.NoError(err)
+	s.Len(rs, 1)
+	s.Equal(r.ID, rs[0].ID)
+
+	rs, err = s.store.FindByEndpoint("https://github.com/foo")
+	s.NoError(err)
+	s.Empty(rs)
+
+	id, err := RepositoryID("https://github.com/foo/bar", s.store)
+	s.NoError(err)
+	s.Equal(uuid.UUID(r.ID), id)
+
+	id, err = RepositoryID("https://github.com/foo/baz", s.store)
+	s.NoError(err)
+	rs, err = s.store.FindByEndpoint("https://github.com/foo/baz")
+	s.NoError(err)
+	s.Len(rs, 1)
+	s.Equal(id, uuid.UUID(rs[0].ID))
+}
+
+func (s *BoltRepositoryStoreSuite) TestUpdateStatus() {
+	r := s.newRepository("https://github.com/foo/bar")
+	stale, err := s.store.Get(r.ID)
+	s.NoError(err)
+
+	s.NoError(UpdateRepositoryStatus(s.store, r, Fetching))
+	s.Equal(Fetching, r.Status)
+
+	r.References = []*model.Reference{{Name: "refs/heads/master"}}
+	s.NoError(UpdateRepositoryStatus(s.store, r, model.Fetched,
+		model.Schema.Repository.References))
+	stored, err := s.store.Get(r.ID)
+	s.NoError(err)
+	s.Equal(model.FetchStatus(model.Fetched), stored.Status)
+	s.True(stored.UpdatedAt.Equal(r.UpdatedAt))
+	s.Len(stored.References, 1)
+
+	err = UpdateRepositoryStatus(s.store, stale, Errored)
+	s.True(ErrStaleRepository.Is(err))
+	s.Equal(model.FetchStatus(model.Pending), stale.Status)
+}
+
+func (s *BoltRepositoryStoreSuite) TestStoreJobIter() {
+	var pending []uuid.UUID
+	for i := 0; i < 5; i++ {
+		pending = append(pending, uuid.UUID(s.newRepository("https://github.com/foo/bar").ID))
+	}
+
+	errored := s.newRepository("https://github.com/foo/baz")
+	s.NoError(UpdateRepositoryStatus(s.store, errored, Errored))
+
+	iter := NewStoreJobIter(s.store, 2, model.Pending)
+	var ids []uuid.UUID
+	for {
+		j, err := iter.Next(context.Background())
+		if err == io.EOF {
+			break
+		}
+
+		s.NoError(err)
+		ids = append(ids, j.RepositoryID)
+	}
+
+	s.Equal(sortedIDs(pending), ids)
+}
+
+func (s *BoltRepositoryStoreSuite) TestArchiveStats() {
+	r := s.newRepository("https://github.com/foo/bar")
+
+	stats, err := s.store.ArchiveStats(r.ID)
+	s.NoError(err)
+	s.Nil(stats)
+
+	s.NoError(s.store.SetArchiveStats(r.ID, &ArchiveStats{Objects: 3, References: 1, SivaSize: 10}))
+	s.NoError(s.store.SetArchiveStats(r.ID, &ArchiveStats{Objects: 5, References: 2, SivaSize: 20}))
+
+	stats, err = s.store.ArchiveStats(r.ID)
+	s.NoError(err)
+	s.Equal(&ArchiveStats{Objects: 5, References: 2, SivaSize: 20}, stats)
+}
+
+func (s *BoltRepositoryStoreSuite) newRepository(endpoints ...string) *model.Repository {
+	r := model.NewRepository()
+	r.Endpoints = endpoints
+	s.NoError(s.store.Create(r))
+	return r
+}
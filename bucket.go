@@ -0,0 +1,16 @@
+package borges
+
+import (
+	"gopkg.in/src-d/go-billy.v3"
+)
+
+// NewBucketFilesystem returns a billy.Filesystem that stores the files at the
+// root of the given filesystem in buckets of the given size, see BucketNaming.
+// If size is zero or less, the filesystem is returned as is.
+func NewBucketFilesystem(fs billy.Filesystem, size int) billy.Filesystem {
+	if size <= 0 {
+		return fs
+	}
+
+	return NewNamingFilesystem(fs, BucketNaming(size))
+}
@@ -0,0 +1,43 @@
+package borges
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+	"gopkg.in/src-d/go-billy.v3/util"
+)
+
+func TestBucketFilesystem(t *testing.T) {
+	require := require.New(t)
+
+	fs := memfs.New()
+	bfs := NewBucketFilesystem(fs, 2)
+
+	const name = "f7b877701fbf855b44c0a9e86f3fdce2c298b07f.siva"
+	require.NoError(util.WriteFile(bfs, name, []byte("foo"), 0644))
+
+	_, err := fs.Stat("f7/" + name)
+	require.NoError(err)
+
+	f, err := bfs.Open(name)
+	require.NoError(err)
+	content, err := ioutil.ReadAll(f)
+	require.NoError(err)
+	require.NoError(f.Close())
+	require.Equal("foo", string(content))
+
+	require.NoError(util.WriteFile(bfs, "dir/"+name, []byte("bar"), 0644))
+	_, err = fs.Stat("dir/" + name)
+	require.NoError(err)
+
+	require.NoError(bfs.Remove(name))
+	_, err = fs.Stat("f7/" + name)
+	require.Error(err)
+}
+
+func TestBucketFilesystem_NoBuckets(t *testing.T) {
+	fs := memfs.New()
+	require.Equal(t, fs, NewBucketFilesystem(fs, 0))
+}
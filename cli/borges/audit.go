@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/src-d/borges"
+)
+
+const (
+	auditCmdName      = "audit"
+	auditCmdShortDesc = "find siva files and repositories that do not match"
+	auditCmdLongDesc  = "Cross-references the repositories in the database with the siva files of the rooted repositories, printing the siva files no repository has references in (orphan) and the repositories with references in siva files that do not exist (dangling). With --fix, the orphan siva files are removed and the dangling repositories are marked as errored, so the requeue command archives them again. With --immutable-store, the manifests of the versions of the siva files are audited instead, and fixing an orphan removes all its versions."
+)
+
+type auditCmd struct {
+	cmd
+	storageOptions
+	rootedLayoutOptions
+	Fix          bool          `long:"fix" description:"remove the orphan siva files and mark the dangling repositories as errored"`
+	OrphanMinAge time.Duration `long:"orphan-min-age" default:"24h" description:"time since their last modification the siva files must have to be orphans, so the ones being committed while auditing are not removed"`
+}
+
+func (c *auditCmd) Execute(args []string) error {
+	c.ChangeLogLevel()
+
+	store, closeStore, err := c.repositoryStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	fs, layouts, err := c.rootedStorage()
+	if err != nil {
+		return err
+	}
+
+	naming, err := c.sivaNaming()
+	if err != nil {
+		return err
+	}
+
+	report, err := borges.Audit(store, fs, borges.AuditOptions{
+		Naming:    naming,
+		Layouts:   layouts,
+		MinAge:    c.OrphanMinAge,
+		Immutable: c.ImmutableStore,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range report.Orphans {
+		fmt.Fprintf(os.Stdout, "orphan\t%s\n", p)
+	}
+
+	for _, d := range report.Dangling {
+		fmt.Fprintf(os.Stdout, "dangling\t%s\t%s\n", d.Repository.ID,
+			strings.Join(d.Missing, ", "))
+	}
+
+	log.Info("audit finished", "orphans", len(report.Orphans),
+		"dangling", len(report.Dangling))
+	if !c.Fix {
+		return nil
+	}
+
+	if err := report.Fix(store, fs); err != nil {
+		return err
+	}
+
+	log.Info("orphan siva files removed and dangling repositories marked as errored")
+	return nil
+}
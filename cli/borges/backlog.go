@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/src-d/borges"
+)
+
+const (
+	backlogCmdName      = "backlog"
+	backlogCmdShortDesc = "print the number of messages waiting in the queues"
+	backlogCmdLongDesc  = "Connects to the broker and prints the number of messages waiting in the queue of the jobs, the priority queue if given, and the queue of the mentions, along with their consumers and the messages buried in each one, without creating any queue. Only AMQP brokers are supported."
+
+	// brokerEnvVar is the environment variable the broker URL is read from
+	// by all the commands.
+	brokerEnvVar = "CONFIG_BROKER"
+	// defaultBroker is the broker URL used by all the commands if it is not
+	// set in brokerEnvVar.
+	defaultBroker = "amqp://localhost:5672"
+)
+
+type backlogCmd struct {
+	cmd
+	Broker        string `long:"broker" description:"URL of the broker, read from the CONFIG_BROKER environment variable as in the other commands if not set"`
+	Queue         string `long:"queue" default:"borges" description:"queue name"`
+	PriorityQueue string `long:"priority-queue" description:"queue name for high priority jobs, not printed if not set"`
+	MentionsQueue string `long:"mentionsqueue" default:"rovers" description:"queue name of the mentions, not printed if empty"`
+	Format        string `long:"format" default:"text" description:"output format (text or json)"`
+}
+
+func (c *backlogCmd) Execute(args []string) error {
+	c.ChangeLogLevel()
+
+	if c.Format != "text" && c.Format != "json" {
+		return fmt.Errorf("invalid format: %s", c.Format)
+	}
+
+	names := []string{c.Queue}
+	for _, name := range []string{c.PriorityQueue, c.MentionsQueue} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	backlogs, err := borges.ReadQueueBacklogs(c.brokerURL(), names)
+	if err != nil {
+		return err
+	}
+
+	if c.Format == "json" {
+		return json.NewEncoder(os.Stdout).Encode(backlogs)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "QUEUE\tMESSAGES\tCONSUMERS\tBURIED")
+	for _, b := range backlogs {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", b.Queue, b.Messages, b.Consumers, b.Buried)
+	}
+
+	return w.Flush()
+}
+
+// brokerURL returns the URL of the broker given or, if none, the one the
+// other commands use.
+func (c *backlogCmd) brokerURL() string {
+	if c.Broker != "" {
+		return c.Broker
+	}
+
+	if url := os.Getenv(brokerEnvVar); url != "" {
+		return url
+	}
+
+	return defaultBroker
+}
@@ -1,54 +1,461 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/src-d/borges"
 
 	"gopkg.in/src-d/core-retrieval.v0"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/framework.v0/queue"
 )
 
 const (
 	consumerCmdName      = "consumer"
 	consumerCmdShortDesc = "consume jobs from a queue a process them."
 	consumerCmdLongDesc  = ""
+
+	// workersEnvVar is the environment variable the number of workers is
+	// read from on SIGHUP.
+	workersEnvVar = "BORGES_WORKERS"
 )
 
 type consumerCmd struct {
-	cmd
-	WorkersCount int `long:"workers" default:"8" description:"number of workers"`
+	queueCmd
+	rootedOptions
+	storageOptions
+	normalizationOptions
+	WorkersCount       int           `long:"workers" default:"8" description:"number of workers"`
+	WorkersFile        string        `long:"workers-file" description:"file to read the number of workers from on SIGHUP, if not set it is read from the BORGES_WORKERS environment variable"`
+	FetchRetries       int           `long:"fetch-retries" default:"3" description:"number of times a clone failing with a transient error is retried"`
+	FetchRetryBackoff  time.Duration `long:"fetch-retry-backoff" default:"1s" description:"base time to wait before retrying a clone, doubled on each retry"`
+	DeadLetterQueue    string        `long:"dead-letter-queue" description:"queue name where failed jobs are published along with their error, if not set they are just rejected"`
+	CloneDepth         int           `long:"clone-depth" default:"0" description:"number of commits fetched from the tip of each reference, 0 fetches the whole history"`
+	CloneTimeout       time.Duration `long:"clone-timeout" default:"0" description:"maximum time spent cloning a repository, 0 means no timeout"`
+	MaxTimeout         time.Duration `long:"max-timeout" default:"24h" description:"maximum clone timeout that jobs can set for themselves, overriding --clone-timeout, 0 means no limit"`
+	AdaptiveTimeout    float64       `long:"adaptive-timeout" default:"0" description:"clone timeout of the repositories fetched before, as a multiple of the duration of their last fetch recorded in the database, capped by --max-timeout, 0 uses --clone-timeout for all of them"`
+	MinAdaptiveTimeout time.Duration `long:"min-adaptive-timeout" default:"1m" description:"minimum clone timeout set by --adaptive-timeout"`
+	SkipIfFresher      time.Duration `long:"skip-if-fresher-than" default:"0" description:"skip the repositories successfully fetched less than this long ago, 0 never skips them"`
+	Incremental        bool          `long:"incremental" description:"fetch only the objects missing from the rooted repositories of the repositories archived before"`
+	Submodules         string        `long:"submodules" default:"ignore" description:"what to do with the submodules of the repositories: ignore them, record their URLs in the log, or fetch them queueing a job to archive each one as a repository on its own"`
+	DetectLFS          bool          `long:"detect-lfs" description:"warn about the repositories using Git LFS, whose LFS files are archived as pointers"`
+	PerHostConcurrency int           `long:"per-host-concurrency" default:"0" description:"maximum number of clones running at once from the same host, jobs from busy hosts are requeued, 0 means no limit"`
+	RateLimitBackoff   time.Duration `long:"rate-limit-backoff" default:"1m" description:"delay of the jobs rate limited by their remote when it does not say how long to wait, only with --ack-policy=after-processing"`
+	RecoverPanics      bool          `long:"recover-panics" description:"fail only the job whose processing panics, logging its stack, instead of crashing the consumer along with the other jobs in flight"`
+	AffinityDispatch   bool          `long:"affinity-dispatch" description:"dispatch the jobs of repositories with the same root commit to the same worker while it is idle or busy with one of them, so they are processed one after the other, any idle worker takes them otherwise"`
+	SingleFlight       bool          `long:"single-flight" description:"make a worker taking a job of a repository being fetched by another worker wait for it and finish with its result instead of cloning the repository again"`
+	CloneBandwidth     int           `long:"clone-bandwidth" default:"0" description:"maximum bytes per second downloaded by all the workers together, 0 means no limit"`
+	MinFreeSpace       uint64        `long:"min-free-space" default:"0" description:"minimum bytes free in the temporary directory to start a job, jobs are requeued while there is less, 0 disables the check"`
+	TempHighWatermark  uint64        `long:"temp-high-watermark" default:"0" description:"bytes used by all the clones in the temporary directory at which the workers stop taking new jobs, 0 disables it"`
+	TempLowWatermark   uint64        `long:"temp-low-watermark" default:"0" description:"bytes used in the temporary directory below which the workers take new jobs again after reaching --temp-high-watermark, 0 means 80% of it"`
+	MaxTransactions    int           `long:"max-transactions" default:"0" description:"maximum number of transactions on rooted repositories open at once by all the workers together, the workers wait for a free one, with --incremental it must be higher than --workers, 0 means no limit"`
+	WorkerTempDirs     bool          `long:"worker-temp-dirs" description:"clone into a temporary directory of each worker, emptied after each job"`
+	CleanTempDirsAge   time.Duration `long:"clean-temp-dirs-older-than" default:"0" description:"on startup, remove the temporary directories of other consumers not modified for this long whose process is not alive, 0 disables it"`
+	MaxRepoSize        int64         `long:"max-repo-size" default:"0" description:"maximum bytes downloaded for a repository, bigger ones are aborted and their jobs rejected, 0 means no limit"`
+	MaxBlobSize        int64         `long:"max-blob-size" default:"0" description:"maximum size in bytes of the blobs archived, bigger ones are left out of the siva files and recorded in the archive stats of the repository, 0 means no limit"`
+	RefInclude         []string      `long:"ref-include" description:"pattern of the references fetched, such as refs/heads/*, can be given several times, all of them are fetched if not set"`
+	RefExclude         []string      `long:"ref-exclude" description:"pattern of the references not fetched, such as refs/pull/*, can be given several times"`
+	SingleBranch       bool          `long:"single-branch" description:"fetch only the branch the HEAD of each remote points to"`
+	MaxRefs            int           `long:"max-refs" default:"0" description:"maximum number of references fetched for a repository, counting only the ones allowed by --ref-include, --ref-exclude and --single-branch, the ones with more are aborted before fetching and marked as too_many_refs, 0 means no limit"`
+	Checkout           bool          `long:"checkout" description:"check out the branch HEAD points to in a working tree of each clone, the clones are bare otherwise"`
+	CloneProxy         string        `long:"clone-proxy" description:"URL of the proxy used to clone http and https endpoints (http, https or socks5), if not set HTTP_PROXY, HTTPS_PROXY and NO_PROXY are used"`
+	AllowSchemes       []string      `long:"allow-schemes" description:"scheme of the endpoints allowed to be cloned, such as https or ssh, can be given several times, all of them are allowed if not set"`
+	AllowHosts         []string      `long:"allow-hosts" description:"pattern of the hosts allowed to be cloned from, such as github.com or *.example.com, can be given several times, all of them are allowed if not set"`
+	DenyHosts          []string      `long:"deny-hosts" description:"pattern of the hosts not allowed to be cloned from, even if allowed by --allow-hosts, can be given several times"`
+	DenyPrivateIPs     bool          `long:"deny-private-ips" description:"do not clone from hosts resolving to loopback, private or link-local addresses, nor local repositories"`
+	Credentials        string        `long:"credentials" description:"path to a JSON file with the credentials used to clone private repositories, matched by host"`
+	ReconnectBackoff   time.Duration `long:"reconnect-backoff" default:"5s" description:"base of the exponential backoff between the attempts to consume from the queue again when the connection to the broker is lost"`
+	MaxReconnects      int           `long:"max-reconnects" default:"0" description:"number of attempts in a row to consume from the queue again that can fail before the consumer exits, 0 means retrying forever"`
+	IdleTimeout        time.Duration `long:"idle-timeout" default:"0" description:"time without receiving any job, with none being processed, after which the consumer stops and exits, 0 means running until stopped"`
+	MaxJobs            int           `long:"max-jobs" default:"0" description:"number of jobs processed, whether they succeed or fail, after which the consumer stops and exits, 0 means running until stopped"`
+	ShutdownTimeout    time.Duration `long:"shutdown-timeout" default:"30s" description:"time to wait for the jobs being processed to finish when stopping, the ones not finished are requeued"`
+	AckPolicy          string        `long:"ack-policy" default:"after-processing" description:"when jobs are acknowledged: after-processing, once their rooted repositories are committed, processes every job at least once; on-receipt processes them at most once, losing the jobs of a crashed consumer and never retrying failed ones, for a higher throughput"`
+	MaxJobRetries      int           `long:"max-job-retries" default:"3" description:"number of times a failed job is requeued to retry it before it is rejected or sent to the dead letter queue, only with --ack-policy=after-processing"`
+	HealthAddr         string        `long:"health-addr" description:"address where the /healthz and /readyz health checks are served, disabled if not set"`
+	StatsInterval      time.Duration `long:"stats-interval" default:"0" description:"interval between the summaries of the jobs processed written to the log, 0 disables them"`
+	WebhookURL         string        `long:"webhook-url" description:"URL where the result of every job is posted as JSON once it finishes, with its repository, status, error and durations, disabled if not set"`
+	WebhookRetries     int           `long:"webhook-retries" default:"3" description:"number of times a post to --webhook-url failing with a network error or a 5xx or 429 status is retried"`
+	WebhookQueueSize   int           `long:"webhook-queue-size" default:"1000" description:"maximum number of results waiting to be posted to --webhook-url, the results of the jobs finishing while it is full are dropped"`
+
+	metrics *consumerMetrics
+	// queue is where the jobs of the submodules are published.
+	queue queue.Queue
+	// webhook posts the results of the jobs, nil without --webhook-url.
+	webhook *borges.WebhookNotifier
 }
 
 func (c *consumerCmd) Execute(args []string) error {
 	c.ChangeLogLevel()
 
+	ackPolicy, err := borges.ParseAckPolicy(c.AckPolicy)
+	if err != nil {
+		return err
+	}
+
+	submodules, err := borges.ParseSubmodulePolicy(c.Submodules)
+	if err != nil {
+		return err
+	}
+
+	c.metrics = newConsumerMetrics()
+	if c.MetricsAddr != "" {
+		srv := startMetricsServer(c.MetricsAddr,
+			newMetricsRegistry(c.metrics.collectors()...))
+		defer srv.Close()
+	}
+
+	if c.WebhookURL != "" {
+		c.webhook = borges.NewWebhookNotifier(c.WebhookURL, borges.WebhookOptions{
+			QueueSize: c.WebhookQueueSize,
+			Retries:   c.WebhookRetries,
+		})
+		c.webhook.Notifiers.Error = c.webhookErrorNotifier
+		defer c.webhook.Close()
+	}
+
+	if err := c.setupTemporaryDir(); err != nil {
+		return err
+	}
+
+	if err := c.setupNormalization(); err != nil {
+		return err
+	}
+
+	store, closeStore, err := c.repositoryStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
 	b := core.Broker()
 	defer b.Close()
 	q, err := b.Queue(c.Queue)
 	if err != nil {
 		return err
 	}
+	c.queue = q
+
+	if err := borges.InstallCloneProxy(c.CloneProxy); err != nil {
+		return err
+	}
+
+	if len(c.AllowSchemes) > 0 || len(c.AllowHosts) > 0 || len(c.DenyHosts) > 0 ||
+		c.DenyPrivateIPs {
+		borges.InstallEndpointPolicy(&borges.EndpointPolicy{
+			AllowSchemes:   c.AllowSchemes,
+			AllowHosts:     c.AllowHosts,
+			DenyHosts:      c.DenyHosts,
+			DenyPrivateIPs: c.DenyPrivateIPs,
+		})
+	}
+
+	for _, patterns := range [][]string{c.RefInclude, c.RefExclude} {
+		if err := borges.ValidateRefPatterns(patterns); err != nil {
+			return err
+		}
+	}
+
+	cloneOpts := borges.CloneOptions{
+		Depth:        c.CloneDepth,
+		Timeout:      c.CloneTimeout,
+		Bandwidth:    c.CloneBandwidth,
+		MaxSize:      c.MaxRepoSize,
+		MaxBlobSize:  c.MaxBlobSize,
+		RefInclude:   c.RefInclude,
+		RefExclude:   c.RefExclude,
+		SingleBranch: c.SingleBranch,
+		MaxRefs:      c.MaxRefs,
+		Checkout:     c.Checkout,
+	}
+	if c.Credentials != "" {
+		creds, err := borges.LoadCredentials(c.Credentials)
+		if err != nil {
+			return err
+		}
+
+		cloneOpts.Auth = borges.NewCredentialsAuthProvider(creds)
+	}
+
+	limiter := borges.NewTransactionLimiter(c.MaxTransactions)
+	if limiter != nil {
+		limiter.Notifiers.Wait = c.transactionWaitNotifier
+	}
+
+	tx, err := c.rootedTransactioner(limiter)
+	if err != nil {
+		return err
+	}
 
 	wp := borges.NewArchiverWorkerPool(
-		core.ModelRepositoryStore(),
-		core.RootedTransactioner(),
-		borges.NewTemporaryCloner(core.TemporaryFilesystem()),
-		c.startNotifier, c.stopNotifier, c.warnNotifier)
+		store,
+		tx,
+		borges.NewTemporaryCloner(core.TemporaryFilesystem(), cloneOpts),
+		borges.ArchiverOptions{
+			FetchRetries:       c.FetchRetries,
+			FetchRetryBackoff:  c.FetchRetryBackoff,
+			MaxJobTimeout:      c.MaxTimeout,
+			AdaptiveTimeout:    c.AdaptiveTimeout,
+			MinAdaptiveTimeout: c.MinAdaptiveTimeout,
+			SkipIfFresherThan:  c.SkipIfFresher,
+			Incremental:        c.Incremental,
+			Submodules:         submodules,
+			DetectLFS:          c.DetectLFS,
+			PerHostConcurrency: c.PerHostConcurrency,
+			WorkerTempDirs:     c.WorkerTempDirs,
+		})
+	wp.Notifiers.Start = c.startNotifier
+	wp.Notifiers.Stop = c.stopNotifier
+	wp.Notifiers.Warn = c.warnNotifier
+	wp.Notifiers.PhaseStart = c.phaseStartNotifier
+	wp.Notifiers.PhaseDone = c.phaseDoneNotifier
+	wp.Notifiers.Submodules = c.submodulesNotifier
+	wp.Notifiers.Gone = c.goneNotifier
+	wp.Notifiers.Done = c.doneNotifier
+	if c.MinFreeSpace > 0 {
+		wp.Preflight = borges.NewMinFreeSpaceCheck(core.TemporaryFilesystem(), c.MinFreeSpace)
+	}
+
+	if c.TempHighWatermark > 0 {
+		bp, err := borges.NewTempUsageBackpressure(core.TemporaryFilesystem(),
+			c.TempHighWatermark, c.TempLowWatermark)
+		if err != nil {
+			return err
+		}
+
+		bp.Notifiers.Usage = c.tempUsageNotifier
+		wp.Backpressure = bp.Paused
+	}
+
+	wp.RateLimitBackoff = c.RateLimitBackoff
+	wp.RecoverPanics = c.RecoverPanics
+	if c.AffinityDispatch {
+		wp.Affinity = borges.NewRootAffinity(store)
+	}
+
+	if c.SingleFlight {
+		wp.SingleFlight = borges.NewRootSingleFlight(store)
+	}
+
 	wp.SetWorkerCount(c.WorkersCount)
 
 	ac := borges.NewConsumer(q, wp)
+	ac.ShutdownTimeout = c.ShutdownTimeout
+	ac.AckPolicy = ackPolicy
+	ac.MaxRetries = c.MaxJobRetries
 	ac.Notifiers.QueueError = c.queueErrorNotifier
-	ac.Start()
+	ac.Notifiers.Reconnect = c.reconnectNotifier
+	ac.Notifiers.Malformed = c.malformedNotifier
+	ac.ReconnectBackoff = c.ReconnectBackoff
+	ac.MaxReconnects = c.MaxReconnects
+	ac.MaxJobs = c.MaxJobs
+	ac.IdleTimeout = c.IdleTimeout
+	if c.PriorityQueue != "" {
+		ac.PriorityQueue, err = b.Queue(c.PriorityQueue)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.DeadLetterQueue != "" {
+		ac.DeadLetter, err = b.Queue(c.DeadLetterQueue)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.HealthAddr != "" {
+		srv := startHealthServer(c.HealthAddr, func() bool {
+			return ac.IsConnected() && wp.Len() > 0
+		})
+		defer srv.Close()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	go c.resizeOnSignal(wp)
+	go dumpStatusOnSignal(wp, ac)
+	if c.StatsInterval > 0 {
+		go logStats(wp, c.StatsInterval)
+	}
+
+	started := make(chan error, 1)
+	go func() { started <- ac.Start() }()
+
+	select {
+	case s := <-stop:
+		log.Info("signal received, stopping consumer", "signal", s,
+			"timeout", c.ShutdownTimeout)
+		ac.Stop()
+		return nil
+	case err := <-started:
+		if err == nil {
+			log.Info("consumer finished, stopping", "max-jobs", c.MaxJobs,
+				"idle-timeout", c.IdleTimeout)
+			ac.Stop()
+			return nil
+		}
+
+		log.Error("could not reconnect to the queue, stopping consumer", "error", err,
+			"timeout", c.ShutdownTimeout)
+		ac.Stop()
+		return err
+	}
+}
+
+// resizeOnSignal changes the number of workers of the pool every time the
+// process receives a SIGHUP.
+func (c *consumerCmd) resizeOnSignal(wp *borges.WorkerPool) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		n, err := c.workerCount()
+		if err != nil {
+			log.Error("cannot read the number of workers", "error", err)
+			continue
+		}
+
+		log.Info("changing the number of workers", "from", wp.Len(), "to", n)
+		wp.SetWorkerCount(n)
+	}
+}
+
+// dumpStatusOnSignal writes to the log what every worker of the pool is doing,
+// along with the jobs in flight and the clones running per host, every time
+// the process receives a SIGUSR1. It only reads snapshots, so it does not stop
+// the workers.
+func dumpStatusOnSignal(wp *borges.WorkerPool, ac *borges.Consumer) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	for range sig {
+		now := time.Now()
+		for _, s := range wp.Status() {
+			if s.Job == nil {
+				log.Info("worker status", "WorkerID", s.ID, "state", "idle")
+				continue
+			}
+
+			log.Info("worker status", "WorkerID", s.ID, "state", "busy",
+				"RepositoryID", s.Job.RepositoryID, "endpoint", s.Endpoint,
+				"phase", s.Phase, "elapsed", now.Sub(s.Started),
+				"phase-elapsed", phaseElapsed(s, now))
+		}
+
+		stats := wp.Stats()
+		log.Info("consumer status", "workers", wp.Len(),
+			"connected", ac.IsConnected(), "in-flight", ac.InFlight(),
+			"processed", stats.Processed, "failed", stats.Failed,
+			"requeued", stats.Requeued, "panics", stats.Panics,
+			"collapsed", stats.Collapsed)
+
+		for host, n := range wp.RunningClones() {
+			log.Info("host clones", "host", host, "running", n)
+		}
+	}
+}
+
+func phaseElapsed(s borges.WorkerStatus, now time.Time) time.Duration {
+	if s.Phase == "" {
+		return 0
+	}
+
+	return now.Sub(s.PhaseStarted)
+}
+
+// logStats writes a summary of the statistics of the pool to the log at the
+// given interval.
+func logStats(wp *borges.WorkerPool, interval time.Duration) {
+	for range time.Tick(interval) {
+		s := wp.Stats()
+		ctx := []interface{}{
+			"processed", s.Processed, "failed", s.Failed, "requeued", s.Requeued,
+			"panics", s.Panics, "collapsed", s.Collapsed, "in-flight", s.InFlight,
+			"average", s.AverageDuration,
+		}
+
+		for _, p := range []borges.Phase{borges.FetchPhase, borges.PackPhase, borges.StorePhase} {
+			if d, ok := s.AveragePhaseDuration[p]; ok {
+				ctx = append(ctx, string(p), d)
+			}
+		}
+
+		log.Info("jobs stats", ctx...)
+	}
+}
+
+// workerCount reads the number of workers from the workers file or, if not
+// set, the BORGES_WORKERS environment variable.
+func (c *consumerCmd) workerCount() (int, error) {
+	value := os.Getenv(workersEnvVar)
+	if c.WorkersFile != "" {
+		content, err := ioutil.ReadFile(c.WorkersFile)
+		if err != nil {
+			return 0, err
+		}
+
+		value = string(content)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 1 {
+		return 0, fmt.Errorf("invalid number of workers: %d", n)
+	}
+
+	return n, nil
+}
+
+// setupTemporaryDir locks the temporary directory of the consumer and removes
+// the orphaned ones of other consumers, if enabled.
+func (c *consumerCmd) setupTemporaryDir() error {
+	tmpFs := core.TemporaryFilesystem()
+	if err := borges.LockTemporaryDir(tmpFs); err != nil {
+		return err
+	}
+
+	if c.CleanTempDirsAge <= 0 {
+		return nil
+	}
+
+	removed, err := borges.CleanOrphanTemporaryDirs(
+		filepath.Dir(tmpFs.Root()), c.CleanTempDirsAge)
+	for _, dir := range removed {
+		log.Info("orphaned temporary directory removed", "dir", dir)
+	}
 
-	return nil
+	return err
 }
 
 func (c *consumerCmd) startNotifier(ctx *borges.WorkerContext, j *borges.Job) {
+	c.metrics.activeWorkers.Inc()
+	c.webhook.Start(ctx, j)
 	log.Debug("job started", "WorkerID", ctx.ID, "RepositoryID", j.RepositoryID)
 }
 
 func (c *consumerCmd) stopNotifier(ctx *borges.WorkerContext, j *borges.Job, err error) {
+	c.metrics.activeWorkers.Dec()
+	c.webhook.Stop(ctx, j, err)
+	if borges.ErrJobPanic.Is(err) {
+		c.metrics.panics.Inc()
+	}
+
 	if err != nil {
+		c.metrics.failed.Inc()
 		log.Error("job errored", "WorkerID", ctx.ID, "RepositoryID", j.RepositoryID, "error", err)
 	} else {
+		c.metrics.processed.Inc()
 		log.Info("job done", "WorkerID", ctx.ID, "RepositoryID", j.RepositoryID)
 	}
 }
@@ -57,6 +464,79 @@ func (c *consumerCmd) warnNotifier(ctx *borges.WorkerContext, j *borges.Job, err
 	log.Warn("job warning", "WorkerID", ctx.ID, "RepositoryID", j.RepositoryID, "error", err)
 }
 
+func (c *consumerCmd) phaseStartNotifier(ctx *borges.WorkerContext, j *borges.Job, p borges.Phase, endpoint string) {
+	c.webhook.PhaseStart(ctx, j, p, endpoint)
+}
+
+func (c *consumerCmd) phaseDoneNotifier(ctx *borges.WorkerContext, j *borges.Job, p borges.Phase, d time.Duration) {
+	c.metrics.phaseDuration.WithLabelValues(string(p)).Observe(d.Seconds())
+	c.webhook.PhaseDone(ctx, j, p, d)
+	log.Debug("job phase done", "WorkerID", ctx.ID, "RepositoryID", j.RepositoryID,
+		"phase", p, "duration", d)
+}
+
+func (c *consumerCmd) submodulesNotifier(ctx *borges.WorkerContext, j *borges.Job, subs []*borges.Submodule) {
+	for _, s := range subs {
+		log.Info("submodule found", "WorkerID", ctx.ID, "RepositoryID", j.RepositoryID,
+			"endpoint", s.Endpoint)
+		if s.Job == nil {
+			continue
+		}
+
+		qj := queue.NewJob()
+		err := qj.Encode(s.Job)
+		if err == nil {
+			err = c.queue.Publish(qj)
+		}
+
+		if err != nil {
+			log.Error("error queueing submodule job", "WorkerID", ctx.ID,
+				"RepositoryID", j.RepositoryID, "endpoint", s.Endpoint, "error", err)
+		}
+	}
+}
+
 func (c *consumerCmd) queueErrorNotifier(err error) {
+	c.metrics.queueErrors.Inc()
 	log.Error("queue error", "error", err)
 }
+
+func (c *consumerCmd) tempUsageNotifier(usage uint64) {
+	c.metrics.tempUsage.Set(float64(usage))
+}
+
+func (c *consumerCmd) reconnectNotifier(attempt int, err error) {
+	c.metrics.reconnects.Inc()
+}
+
+func (c *consumerCmd) malformedNotifier(j *queue.Job, err error) {
+	c.metrics.malformed.Inc()
+}
+
+func (c *consumerCmd) webhookErrorNotifier(r *borges.JobResult, err error) {
+	c.metrics.webhookErrors.Inc()
+	log.Warn("error posting job result to webhook", "RepositoryID", r.RepositoryID,
+		"error", err)
+}
+
+func (c *consumerCmd) transactionWaitNotifier(d time.Duration) {
+	c.metrics.transactionWait.Observe(d.Seconds())
+}
+
+func (c *consumerCmd) goneNotifier(ctx *borges.WorkerContext, j *borges.Job, r *model.Repository) {
+	c.metrics.gone.Inc()
+	c.webhook.Gone(ctx, j, r)
+	log.Info("repository gone", "WorkerID", ctx.ID, "RepositoryID", j.RepositoryID,
+		"gone", r.ID, "endpoints", r.Endpoints)
+}
+
+func (c *consumerCmd) doneNotifier(ctx *borges.WorkerContext, j *borges.Job,
+	r *model.Repository, s *borges.ArchiveStats) {
+	c.webhook.Done(ctx, j, r, s)
+	if s == nil {
+		return
+	}
+
+	log.Info("repository archived", "WorkerID", ctx.ID, "RepositoryID", r.ID,
+		"objects", s.Objects, "references", s.References, "siva-size", s.SivaSize)
+}
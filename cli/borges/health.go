@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+)
+
+// startHealthServer serves the liveness probe at /healthz and the readiness
+// probe at /readyz on the given address. The readiness probe fails with a
+// 503 status whenever ready returns false. The returned server must be closed
+// when done.
+func startHealthServer(addr string, ready func() bool) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte("ok"))
+	})
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		log.Info("serving health checks", "address", addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error("health server failed", "error", err)
+		}
+	}()
+
+	return srv
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/src-d/borges"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+)
+
+const (
+	listCmdName      = "list"
+	listCmdShortDesc = "list the repositories in the database"
+	listCmdLongDesc  = "Prints the repositories stored in the database with their endpoints, fetch status and last update time, optionally filtered by status and provider."
+)
+
+type listCmd struct {
+	cmd
+	storageOptions
+	Status   string `long:"status" description:"only list repositories with this fetch status (pending, fetching, fetched, errored, gone, too_many_refs or not_found)"`
+	Provider string `long:"provider" description:"only list repositories with an endpoint in this host, such as github.com"`
+	Limit    uint64 `long:"limit" default:"100" description:"maximum number of repositories listed, 0 lists all of them"`
+	Offset   uint64 `long:"offset" default:"0" description:"number of repositories skipped before listing"`
+	Format   string `long:"format" default:"text" description:"output format (text or json)"`
+}
+
+type listedRepository struct {
+	ID        string            `json:"id"`
+	Endpoints []string          `json:"endpoints"`
+	Status    model.FetchStatus `json:"status"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+func (c *listCmd) Execute(args []string) error {
+	c.ChangeLogLevel()
+
+	q, err := c.query()
+	if err != nil {
+		return err
+	}
+
+	store, closeStore, err := c.repositoryStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	var (
+		repos   []*listedRepository
+		skipped uint64
+	)
+	err = borges.NewRepositoryIter(store, q, c.pageSize()).ForEach(func(r *model.Repository) error {
+		if skipped < c.Offset {
+			skipped++
+			return nil
+		}
+
+		if c.Limit > 0 && uint64(len(repos)) >= c.Limit {
+			return errListFull
+		}
+
+		repos = append(repos, &listedRepository{
+			ID:        r.ID.String(),
+			Endpoints: r.Endpoints,
+			Status:    r.Status,
+			UpdatedAt: r.UpdatedAt,
+		})
+		return nil
+	})
+	if err != nil && err != errListFull {
+		return err
+	}
+
+	switch c.Format {
+	case "json":
+		return json.NewEncoder(os.Stdout).Encode(repos)
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTATUS\tUPDATED\tENDPOINTS")
+		for _, r := range repos {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.ID, r.Status,
+				r.UpdatedAt.Format(time.RFC3339), strings.Join(r.Endpoints, ", "))
+		}
+
+		return w.Flush()
+	}
+}
+
+// errListFull stops the iteration of the repositories once the limit is
+// reached.
+var errListFull = errors.New("list full")
+
+func (c *listCmd) query() (*borges.RepositoryQuery, error) {
+	if c.Format != "text" && c.Format != "json" {
+		return nil, fmt.Errorf("invalid format: %s", c.Format)
+	}
+
+	q := &borges.RepositoryQuery{
+		Provider: c.Provider,
+		Order:    borges.OrderByCreatedAt,
+	}
+
+	if c.Status != "" {
+		switch s := model.FetchStatus(c.Status); s {
+		case model.Pending, model.Fetched, model.NotFound, borges.Fetching, borges.Errored,
+			borges.Gone, borges.TooManyRefs:
+			q.Statuses = []model.FetchStatus{s}
+		default:
+			return nil, fmt.Errorf("invalid status: %s", c.Status)
+		}
+	}
+
+	return q, nil
+}
+
+// pageSize returns the number of repositories read from the store at once,
+// which is just the ones needed if there are only a few.
+func (c *listCmd) pageSize() uint64 {
+	if n := c.Offset + c.Limit + 1; c.Limit > 0 && n < borges.DefaultRepositoryPageSize {
+		return n
+	}
+
+	return borges.DefaultRepositoryPageSize
+}
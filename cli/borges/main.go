@@ -20,9 +20,18 @@ var (
 )
 
 type cmd struct {
-	Queue    string `long:"queue" default:"borges" description:"queue name"`
-	LogLevel string `short:"" long:"loglevel" description:"max log level enabled" default:"info"`
-	LogFile  string `short:"" long:"logfile" description:"path to file where logs will be stored" default:""`
+	LogLevel  string `short:"" long:"loglevel" description:"max log level enabled" default:"info"`
+	LogFile   string `short:"" long:"logfile" description:"path to file where logs will be stored" default:""`
+	LogFormat string `short:"" long:"log-format" description:"format of the logs (text or json)" default:"text"`
+}
+
+// queueCmd holds the options of the commands running as services on top of
+// the queue.
+type queueCmd struct {
+	cmd
+	Queue         string `long:"queue" default:"borges" description:"queue name"`
+	PriorityQueue string `long:"priority-queue" description:"queue name for high priority jobs, such as the ones of small repositories, disabled if not set"`
+	MetricsAddr   string `long:"metrics-addr" description:"address where Prometheus metrics are served at /metrics, disabled if not set"`
 }
 
 func (c *cmd) ChangeLogLevel() {
@@ -31,10 +40,20 @@ func (c *cmd) ChangeLogLevel() {
 		panic(fmt.Sprintf("unknown level name %q", c.LogLevel))
 	}
 
-	handlers := []log15.Handler{log15.CallerFileHandler(log15.StdoutHandler)}
+	stdout, file := log15.StdoutHandler, log15.LogfmtFormat()
+	switch c.LogFormat {
+	case "text":
+	case "json":
+		stdout = log15.StreamHandler(os.Stdout, log15.JsonFormat())
+		file = log15.JsonFormat()
+	default:
+		panic(fmt.Sprintf("unknown log format %q", c.LogFormat))
+	}
+
+	handlers := []log15.Handler{log15.CallerFileHandler(stdout)}
 	if c.LogFile != "" {
 		handlers = append(handlers,
-			log15.CallerFileHandler(log15.Must.FileHandler(c.LogFile, log15.LogfmtFormat())))
+			log15.CallerFileHandler(log15.Must.FileHandler(c.LogFile, file)))
 	}
 	log15.Root().SetHandler(log15.LvlFilterHandler(lvl, log15.MultiHandler(handlers...)))
 }
@@ -62,6 +81,51 @@ func main() {
 		panic(err)
 	}
 
+	if _, err := parser.AddCommand(packCmdName, packCmdShortDesc,
+		packCmdLongDesc, &packCmd{}); err != nil {
+		panic(err)
+	}
+
+	if _, err := parser.AddCommand(unpackCmdName, unpackCmdShortDesc,
+		unpackCmdLongDesc, &unpackCmd{}); err != nil {
+		panic(err)
+	}
+
+	if _, err := parser.AddCommand(validateCmdName, validateCmdShortDesc,
+		validateCmdLongDesc, &validateCmd{}); err != nil {
+		panic(err)
+	}
+
+	if _, err := parser.AddCommand(listCmdName, listCmdShortDesc,
+		listCmdLongDesc, &listCmd{}); err != nil {
+		panic(err)
+	}
+
+	if _, err := parser.AddCommand(requeueCmdName, requeueCmdShortDesc,
+		requeueCmdLongDesc, &requeueCmd{}); err != nil {
+		panic(err)
+	}
+
+	if _, err := parser.AddCommand(migrateCmdName, migrateCmdShortDesc,
+		migrateCmdLongDesc, &migrateCmd{}); err != nil {
+		panic(err)
+	}
+
+	if _, err := parser.AddCommand(auditCmdName, auditCmdShortDesc,
+		auditCmdLongDesc, &auditCmd{}); err != nil {
+		panic(err)
+	}
+
+	if _, err := parser.AddCommand(rootidCmdName, rootidCmdShortDesc,
+		rootidCmdLongDesc, &rootidCmd{}); err != nil {
+		panic(err)
+	}
+
+	if _, err := parser.AddCommand(backlogCmdName, backlogCmdShortDesc,
+		backlogCmdLongDesc, &backlogCmd{}); err != nil {
+		panic(err)
+	}
+
 	if _, err := parser.Parse(); err != nil {
 		if err, ok := err.(*flags.Error); ok {
 			if err.Type == flags.ErrHelp {
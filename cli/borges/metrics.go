@@ -0,0 +1,210 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace is the prefix of all the metrics exposed by borges.
+const metricsNamespace = "borges"
+
+// newMetricsRegistry creates a registry with the given collectors plus the
+// default process and Go runtime ones.
+func newMetricsRegistry(cs ...prometheus.Collector) *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(
+		prometheus.NewProcessCollector(os.Getpid(), metricsNamespace),
+		prometheus.NewGoCollector(),
+	)
+	r.MustRegister(cs...)
+	return r
+}
+
+// startMetricsServer serves the metrics of the given registry at /metrics on
+// the given address. The returned server must be closed when done.
+func startMetricsServer(addr string, r *prometheus.Registry) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(r, promhttp.HandlerOpts{}))
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		log.Info("serving metrics", "address", addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error("metrics server failed", "error", err)
+		}
+	}()
+
+	return srv
+}
+
+// consumerMetrics are the metrics exposed by the consumer.
+type consumerMetrics struct {
+	processed     prometheus.Counter
+	failed        prometheus.Counter
+	phaseDuration *prometheus.HistogramVec
+	activeWorkers prometheus.Gauge
+	queueErrors   prometheus.Counter
+	tempUsage     prometheus.Gauge
+	gone          prometheus.Counter
+	reconnects    prometheus.Counter
+	panics        prometheus.Counter
+	malformed     prometheus.Counter
+	webhookErrors prometheus.Counter
+	// transactionWait is the time waited for a free transaction, only
+	// with --max-transactions.
+	transactionWait prometheus.Histogram
+}
+
+func newConsumerMetrics() *consumerMetrics {
+	return &consumerMetrics{
+		processed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "consumer",
+			Name:      "jobs_processed_total",
+			Help:      "Number of jobs processed successfully.",
+		}),
+		failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "consumer",
+			Name:      "jobs_failed_total",
+			Help:      "Number of jobs that failed.",
+		}),
+		phaseDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "consumer",
+			Name:      "phase_duration_seconds",
+			Help:      "Time spent on each phase of a job: fetch, pack and store.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 15),
+		}, []string{"phase"}),
+		activeWorkers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "consumer",
+			Name:      "active_workers",
+			Help:      "Number of workers currently processing a job.",
+		}),
+		queueErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "consumer",
+			Name:      "queue_errors_total",
+			Help:      "Number of errors consuming jobs from the queue.",
+		}),
+		tempUsage: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "consumer",
+			Name:      "temp_usage_bytes",
+			Help:      "Bytes used in the temporary directory by the clones, measured only with --temp-high-watermark.",
+		}),
+		gone: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "consumer",
+			Name:      "repositories_gone_total",
+			Help:      "Number of repositories found to no longer exist, marked as gone.",
+		}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "consumer",
+			Name:      "reconnects_total",
+			Help:      "Number of attempts to consume from the queue again after the connection was lost or consuming failed.",
+		}),
+		panics: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "consumer",
+			Name:      "jobs_panicked_total",
+			Help:      "Number of jobs whose processing panicked, recovered with --recover-panics.",
+		}),
+		malformed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "consumer",
+			Name:      "malformed_jobs_total",
+			Help:      "Number of jobs whose payload could not be decoded, rejected without requeueing them.",
+		}),
+		webhookErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "consumer",
+			Name:      "webhook_errors_total",
+			Help:      "Number of job results not posted to --webhook-url, because posting them failed or its queue was full.",
+		}),
+		transactionWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "consumer",
+			Name:      "transaction_wait_seconds",
+			Help:      "Time waited for a free transaction on the rooted repositories, measured only with --max-transactions.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 15),
+		}),
+	}
+}
+
+func (m *consumerMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.processed,
+		m.failed,
+		m.phaseDuration,
+		m.activeWorkers,
+		m.queueErrors,
+		m.tempUsage,
+		m.gone,
+		m.reconnects,
+		m.panics,
+		m.malformed,
+		m.webhookErrors,
+		m.transactionWait,
+	}
+}
+
+// producerMetrics are the metrics exposed by the producer.
+type producerMetrics struct {
+	produced    prometheus.Counter
+	skipped     prometheus.Counter
+	errors      prometheus.Counter
+	retries     prometheus.Counter
+	iterLatency prometheus.Histogram
+}
+
+func newProducerMetrics() *producerMetrics {
+	return &producerMetrics{
+		produced: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "producer",
+			Name:      "jobs_produced_total",
+			Help:      "Number of jobs published to the queue.",
+		}),
+		skipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "producer",
+			Name:      "jobs_skipped_total",
+			Help:      "Number of jobs skipped because they were published recently.",
+		}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "producer",
+			Name:      "publish_errors_total",
+			Help:      "Number of errors publishing jobs or reading from the job source.",
+		}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "producer",
+			Name:      "publish_retries_total",
+			Help:      "Number of retries of jobs or batches whose publication failed, such as when the connection to the broker was lost.",
+		}),
+		iterLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "producer",
+			Name:      "iterator_latency_seconds",
+			Help:      "Time spent obtaining the next job from the job source.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+		}),
+	}
+}
+
+func (m *producerMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.produced,
+		m.skipped,
+		m.errors,
+		m.retries,
+		m.iterLatency,
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/src-d/borges"
+)
+
+const (
+	migrateCmdName      = "migrate"
+	migrateCmdShortDesc = "migrate the repository storage"
+	migrateCmdLongDesc  = "Creates the index of the roots of the rooted repositories of each endpoint, used to fetch incrementally the endpoints archived before, and fills it from the references of the repositories already stored. It also creates the storage of the objects, references and siva size of the repositories archived. It can be run again safely."
+)
+
+type migrateCmd struct {
+	cmd
+	storageOptions
+}
+
+func (c *migrateCmd) Execute(args []string) error {
+	c.ChangeLogLevel()
+
+	store, closeStore, err := c.repositoryStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	n, err := borges.MigrateRootIndex(store)
+	if err != nil {
+		return err
+	}
+
+	log.Info("root index migrated", "repositories", n)
+	if err := borges.MigrateArchiveStats(store); err != nil {
+		return err
+	}
+
+	log.Info("archive stats migrated")
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/src-d/borges"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-billy.v3/osfs"
+)
+
+const (
+	packCmdName      = "pack"
+	packCmdShortDesc = "pack a single repository into siva files"
+	packCmdLongDesc  = "Clones a repository and pushes its references to the rooted repositories in the output directory, the same way the consumer does, without using the queue or the database."
+)
+
+type packCmd struct {
+	cmd
+	BucketSize  int    `long:"bucket-size" default:"0" description:"number of characters of the root commit hash used as directory to store each siva file, 0 stores them at the root of the output directory"`
+	SivaNaming  string `long:"siva-naming" default:"hash" description:"where each siva file is stored, as in the consumer: hash, bucketed or date"`
+	CloneDepth  int    `long:"clone-depth" default:"0" description:"number of commits fetched from the tip of each reference, 0 fetches the whole history"`
+	Compression string `long:"compression-level" default:"default" description:"zlib compression level of the objects stored in the siva files: default, none to store them uncompressed, or from 1 (fastest) to 9 (smallest)"`
+	DeltaWindow int    `long:"delta-window" default:"0" description:"number of objects tried as delta base of each object when repacking the packfiles stored in the siva files, as in git repack, larger windows make smaller files at a higher CPU cost, 0 stores them as pushed"`
+	DeltaDepth  int    `long:"delta-depth" default:"50" description:"maximum length of the chains of deltas of the packfiles repacked with --delta-window"`
+	MaxBlobSize int64  `long:"max-blob-size" default:"0" description:"maximum size in bytes of the blobs packed, bigger ones are left out of the siva files, 0 means no limit"`
+
+	Args struct {
+		URL    string `positional-arg-name:"url" description:"URL of the repository to pack"`
+		Output string `positional-arg-name:"output" description:"directory where the siva files are written"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *packCmd) Execute(args []string) error {
+	c.ChangeLogLevel()
+
+	compression, err := borges.ParseCompressionLevel(c.Compression)
+	if err != nil {
+		return err
+	}
+
+	naming, err := borges.NewSivaNaming(c.SivaNaming, c.BucketSize)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := ioutil.TempDir("", "borges-pack")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpFs := osfs.New(tmpDir)
+	txFs, err := tmpFs.Chroot("transactioner")
+	if err != nil {
+		return err
+	}
+
+	a := borges.NewArchiver(nil,
+		borges.NewSivaRootedTransactioner(
+			borges.NewNamingFilesystem(osfs.New(c.Args.Output), naming),
+			txFs,
+			borges.SivaOptions{
+				Compression: compression,
+				DeltaWindow: c.DeltaWindow,
+				DeltaDepth:  c.DeltaDepth,
+			},
+		),
+		borges.NewTemporaryCloner(tmpFs, borges.CloneOptions{
+			Depth:       c.CloneDepth,
+			MaxBlobSize: c.MaxBlobSize,
+		}),
+	)
+	a.Notifiers.Warn = func(j *borges.Job, err error) {
+		log.Warn("pack warning", "error", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	go func() {
+		if s, ok := <-stop; ok {
+			log.Info("signal received, stopping pack", "signal", s)
+			cancel()
+		}
+	}()
+
+	r, err := a.PackContext(ctx, c.Args.URL)
+	if err != nil {
+		return err
+	}
+
+	for init, refs := range refsByInit(r.References) {
+		log.Info("rooted repository packed", "init", init, "references", refs)
+	}
+
+	return nil
+}
+
+func refsByInit(refs []*model.Reference) map[string]int {
+	m := make(map[string]int)
+	for _, ref := range refs {
+		m[ref.Init.String()]++
+	}
+
+	return m
+}
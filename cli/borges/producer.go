@@ -3,10 +3,12 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/src-d/borges"
 
 	"gopkg.in/src-d/core-retrieval.v0"
+	"gopkg.in/src-d/core-retrieval.v0/model"
 	"gopkg.in/src-d/framework.v0/queue"
 	"gopkg.in/src-d/go-git.v4/utils/ioutil"
 )
@@ -15,18 +17,51 @@ const (
 	producerCmdName      = "producer"
 	producerCmdShortDesc = "create new jobs and put them into the queue"
 	producerCmdLongDesc  = ""
+
+	// providerTokenEnvVar is the environment variable the access token of
+	// the provider API is read from if not given as an option.
+	providerTokenEnvVar = "BORGES_PROVIDER_TOKEN"
 )
 
 type producerCmd struct {
-	cmd
-	Source        string `long:"source" default:"mentions" description:"source to produce jobs from (mentions, file)"`
-	MentionsQueue string `long:"mentionsqueue" default:"rovers" description:"queue name used to obtain mentions if the source type is 'mentions'"`
-	File          string `long:"file" description:"path to a file to read URLs from, used with --source=file"`
+	queueCmd
+	storageOptions
+	normalizationOptions
+	Source           string        `long:"source" default:"mentions" description:"source to produce jobs from (mentions, file, store, provider, refresh)"`
+	MentionsQueue    string        `long:"mentionsqueue" default:"rovers" description:"queue name used to obtain mentions if the source type is 'mentions'"`
+	File             string        `long:"file" description:"path to a file to read URLs from, used with --source=file, - reads them from the standard input"`
+	FromFile         string        `long:"from-file" description:"path to a file to read URLs from, - reads them from the standard input, same as --source=file --file=path"`
+	Status           []string      `long:"status" description:"status of the repositories to produce jobs for if the source type is 'store' or 'refresh', can be given several times, all repositories are used if not set"`
+	PageSize         uint64        `long:"page-size" default:"1000" description:"number of repositories read from the database at once if the source type is 'store' or 'refresh'"`
+	RefreshEvery     time.Duration `long:"refresh-interval" default:"0" description:"time between the passes queueing the repositories fetched before --refresh-older-than, with their jobs spread over it, setting it also sets the source type to 'refresh'"`
+	RefreshOlder     time.Duration `long:"refresh-older-than" default:"24h" description:"how long ago the repositories must have been last fetched to be refreshed if the source type is 'refresh'"`
+	Provider         string        `long:"provider" description:"provider whose API lists the repositories of --org if the source type is 'provider' (github, gitlab), setting it also sets the source type"`
+	Org              string        `long:"org" description:"organization or user whose repositories are listed if the source type is 'provider'"`
+	ProviderURL      string        `long:"provider-url" description:"URL of the API of the provider for GitHub Enterprise or self-hosted GitLab, such as https://gitlab.example.com/api/v4, if not set the one of github.com or gitlab.com is used"`
+	ProviderToken    string        `long:"provider-token" description:"access token of the API of the provider, if not set it is read from the BORGES_PROVIDER_TOKEN environment variable"`
+	CursorFile       string        `long:"cursor-file" description:"file where the page being listed is saved if the source type is 'provider', so a restart resumes the listing from it"`
+	CheckpointFile   string        `long:"checkpoint-file" description:"file where the IDs of the last mentions acknowledged are saved if the source type is 'mentions', so a restart skips the mentions whose jobs were already queued"`
+	DedupWindow      int           `long:"dedup-window" default:"0" description:"number of recently queued repositories to remember to skip duplicated jobs, 0 disables it"`
+	DedupTTL         time.Duration `long:"dedup-ttl" default:"1h" description:"time a queued repository is remembered for deduplication, 0 means forever"`
+	DryRun           bool          `long:"dry-run" description:"log the jobs that would be queued instead of queueing them"`
+	BatchSize        int           `long:"batch-size" default:"1" description:"number of jobs queued together in a single transaction, 1 disables batching"`
+	BatchFlush       time.Duration `long:"batch-flush-interval" default:"1s" description:"maximum time a job waits for its batch to be full before it is queued, 0 waits until the batch is full or the producer stops"`
+	PublishRetries   int           `long:"publish-retries" default:"5" description:"number of times queueing a job, or a batch, is retried if it fails, such as when the connection to the broker is lost, before the job is reported as failed"`
+	ReconnectBackoff time.Duration `long:"reconnect-backoff" default:"1s" description:"base of the exponential backoff between the retries of queueing a job"`
+
+	metrics *producerMetrics
 }
 
 func (c *producerCmd) Execute(args []string) error {
 	c.ChangeLogLevel()
 
+	c.metrics = newProducerMetrics()
+	if c.MetricsAddr != "" {
+		srv := startMetricsServer(c.MetricsAddr,
+			newMetricsRegistry(c.metrics.collectors()...))
+		defer srv.Close()
+	}
+
 	b := core.Broker()
 	defer b.Close()
 	q, err := b.Queue(c.Queue)
@@ -34,20 +69,57 @@ func (c *producerCmd) Execute(args []string) error {
 		return err
 	}
 
-	ji, err := c.jobIter(b)
+	if err := c.setupNormalization(); err != nil {
+		return err
+	}
+
+	store, closeStore, err := c.repositoryStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	ji, err := c.jobIter(b, store)
 	if err != nil {
 		return err
 	}
 	defer ioutil.CheckClose(ji, &err)
 
 	p := borges.NewProducer(ji, q)
+	p.SetDedupWindow(c.DedupWindow, c.DedupTTL)
+	p.DryRun = c.DryRun
+	p.BatchSize = c.BatchSize
+	p.BatchFlushInterval = c.BatchFlush
+	p.PublishRetries = c.PublishRetries
+	p.ReconnectBackoff = c.ReconnectBackoff
+	if c.PriorityQueue != "" {
+		p.PriorityQueue, err = b.Queue(c.PriorityQueue)
+		if err != nil {
+			return err
+		}
+	}
+
 	p.Notifiers.Done = c.notifier
+	p.Notifiers.Skipped = c.skippedNotifier
+	p.Notifiers.QueueError = c.queueErrorNotifier
+	p.Notifiers.Next = c.nextNotifier
+	p.Notifiers.Reconnect = c.reconnectNotifier
 	p.Start()
 	return err
 }
 
-func (c *producerCmd) jobIter(b queue.Broker) (borges.JobIter, error) {
-	storer := core.ModelRepositoryStore()
+func (c *producerCmd) jobIter(b queue.Broker, storer borges.RepositoryStore) (borges.JobIter, error) {
+	if c.FromFile != "" {
+		return borges.NewFileJobIter(c.FromFile, storer)
+	}
+
+	if c.Provider != "" {
+		c.Source = "provider"
+	}
+
+	if c.RefreshEvery > 0 {
+		c.Source = "refresh"
+	}
 
 	switch c.Source {
 	case "mentions":
@@ -55,22 +127,87 @@ func (c *producerCmd) jobIter(b queue.Broker) (borges.JobIter, error) {
 		if err != nil {
 			return nil, err
 		}
-		return borges.NewMentionJobIter(q, storer), nil
+		return borges.NewMentionJobIter(q, storer, borges.MentionJobIterOptions{
+			Window:         c.BatchSize,
+			CheckpointFile: c.CheckpointFile,
+		}), nil
 	case "file":
-		f, err := os.Open(c.File)
-		if err != nil {
-			return nil, err
+		return borges.NewFileJobIter(c.File, storer)
+	case "store":
+		return borges.NewStoreJobIter(storer, c.PageSize, c.statuses()...), nil
+	case "provider":
+		return c.providerJobIter(storer)
+	case "refresh":
+		if c.RefreshEvery <= 0 {
+			return nil, fmt.Errorf("--refresh-interval is required with the refresh source")
 		}
-		return borges.NewLineJobIter(f, storer), nil
+
+		return borges.NewRefreshJobIter(storer, borges.RefreshOptions{
+			Interval:  c.RefreshEvery,
+			OlderThan: c.RefreshOlder,
+			Statuses:  c.statuses(),
+			PageSize:  c.PageSize,
+		}), nil
 	default:
 		return nil, fmt.Errorf("invalid source: %s", c.Source)
 	}
 }
 
+func (c *producerCmd) statuses() []model.FetchStatus {
+	var statuses []model.FetchStatus
+	for _, s := range c.Status {
+		statuses = append(statuses, model.FetchStatus(s))
+	}
+
+	return statuses
+}
+
+func (c *producerCmd) providerJobIter(storer borges.RepositoryStore) (borges.JobIter, error) {
+	provider, err := borges.ParseProvider(c.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Org == "" {
+		return nil, fmt.Errorf("--org is required with the provider source")
+	}
+
+	token := c.ProviderToken
+	if token == "" {
+		token = os.Getenv(providerTokenEnvVar)
+	}
+
+	return borges.NewProviderJobIter(provider, c.Org, storer, borges.ProviderJobIterOptions{
+		Token:      token,
+		BaseURL:    c.ProviderURL,
+		CursorFile: c.CursorFile,
+	}), nil
+}
+
 func (c *producerCmd) notifier(j *borges.Job, err error) {
 	if err != nil {
+		c.metrics.errors.Inc()
 		log.Error("job queue error", "RepositoryID", j.RepositoryID, "error", err)
 	} else {
+		c.metrics.produced.Inc()
 		log.Info("job queued", "RepositoryID", j.RepositoryID)
 	}
 }
+
+func (c *producerCmd) skippedNotifier(j *borges.Job) {
+	c.metrics.skipped.Inc()
+	log.Debug("job skipped, already queued recently", "RepositoryID", j.RepositoryID)
+}
+
+func (c *producerCmd) queueErrorNotifier(err error) {
+	c.metrics.errors.Inc()
+	log.Error("job source error", "error", err)
+}
+
+func (c *producerCmd) nextNotifier(d time.Duration) {
+	c.metrics.iterLatency.Observe(d.Seconds())
+}
+
+func (c *producerCmd) reconnectNotifier(attempt int, err error) {
+	c.metrics.retries.Inc()
+}
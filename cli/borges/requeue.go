@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/src-d/borges"
+
+	"gopkg.in/src-d/core-retrieval.v0"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/framework.v0/queue"
+)
+
+const (
+	requeueCmdName      = "requeue"
+	requeueCmdShortDesc = "queue again the repositories that failed to be fetched"
+	requeueCmdLongDesc  = "Publishes a new job to the queue for every repository in the errored status, optionally filtered by the time of the error."
+)
+
+type requeueCmd struct {
+	cmd
+	storageOptions
+	Queue     string        `long:"queue" default:"borges" description:"queue name"`
+	OlderThan time.Duration `long:"older-than" default:"0" description:"only requeue repositories that failed at least this long ago"`
+	NewerThan time.Duration `long:"newer-than" default:"0" description:"only requeue repositories that failed less than this long ago, 0 means no limit"`
+	Max       uint64        `long:"max" default:"0" description:"maximum number of repositories requeued, 0 requeues all of them"`
+	DryRun    bool          `long:"dry-run" description:"count the repositories that would be requeued instead of queueing them"`
+}
+
+func (c *requeueCmd) Execute(args []string) error {
+	c.ChangeLogLevel()
+
+	b := core.Broker()
+	defer b.Close()
+	q, err := b.Queue(c.Queue)
+	if err != nil {
+		return err
+	}
+
+	store, closeStore, err := c.repositoryStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	var requeued uint64
+	iter := borges.NewRepositoryIter(store, c.query(time.Now()), 0)
+	err = iter.ForEach(func(r *model.Repository) error {
+		if c.Max > 0 && requeued >= c.Max {
+			return errRequeueMax
+		}
+
+		requeued++
+		if c.DryRun {
+			return nil
+		}
+
+		j := queue.NewJob()
+		if err := j.Encode(&borges.Job{RepositoryID: uuid.UUID(r.ID)}); err != nil {
+			return err
+		}
+
+		if err := q.Publish(j); err != nil {
+			return err
+		}
+
+		log.Debug("job queued", "RepositoryID", r.ID)
+		return nil
+	})
+	if err != nil && err != errRequeueMax {
+		return err
+	}
+
+	if c.DryRun {
+		log.Info("dry run, jobs not queued", "repositories", requeued)
+	} else {
+		log.Info("errored repositories requeued", "repositories", requeued)
+	}
+
+	return nil
+}
+
+// errRequeueMax stops the iteration of the repositories once the maximum
+// number of them is requeued.
+var errRequeueMax = errors.New("maximum repositories requeued")
+
+func (c *requeueCmd) query(now time.Time) *borges.RepositoryQuery {
+	q := &borges.RepositoryQuery{
+		Statuses: []model.FetchStatus{borges.Errored},
+		Order:    borges.OrderByFetchErrorAt,
+	}
+
+	if c.OlderThan > 0 {
+		q.FetchErrorBefore = now.Add(-c.OlderThan)
+	}
+
+	if c.NewerThan > 0 {
+		q.FetchErrorAfter = now.Add(-c.NewerThan)
+	}
+
+	return q
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/src-d/borges"
+
+	"gopkg.in/src-d/core-retrieval.v0"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/framework.v0/configurable"
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-billy.v3/osfs"
+)
+
+// transactionerLocalDir is the directory of the temporary filesystem where
+// the transactions on rooted repositories are stored, the same one used by
+// core.RootedTransactioner.
+const transactionerLocalDir = "transactioner"
+
+// rootedConfig reads the location of the rooted repositories from the same
+// environment variable as core-retrieval, which does not export it.
+type rootedConfig struct {
+	configurable.BasicConfiguration
+	RootRepositoriesDir string `default:"/tmp/root-repositories"`
+}
+
+// rootedLayoutOptions holds the options setting where the rooted repositories
+// are stored.
+type rootedLayoutOptions struct {
+	RootDirs       string `long:"root-repositories-dir" description:"comma-separated list of directories where the rooted repositories are stored, each siva file being written to all of them and read from the first one, read from the CONFIG_ROOT_REPOSITORIES_DIR environment variable as in core-retrieval if not set"`
+	BucketSize     int    `long:"bucket-size" default:"0" description:"number of characters of the root commit hash used as directory to store each siva file, 0 stores them at the root of the rooted repositories directory"`
+	SivaNaming     string `long:"siva-naming" default:"hash" description:"where each siva file is stored: hash names it after the root commit hash, bucketed if --bucket-size is set, bucketed stores it in the directory named after the first --bucket-size characters of the hash, 2 if not set, and date in the year/month directory it is first created in"`
+	Layouts        string `long:"layouts" description:"path to a JSON file with the root directory and bucket size of the siva files of the repositories, matched by host"`
+	ImmutableStore bool   `long:"immutable-store" description:"write a new version of the siva file of a rooted repository on each commit instead of replacing it, listing the versions in a manifest next to them"`
+}
+
+// sivaNaming returns the naming of the rooted repositories of the endpoints
+// without a layout.
+func (o *rootedLayoutOptions) sivaNaming() (borges.SivaNaming, error) {
+	return borges.NewSivaNaming(o.SivaNaming, o.BucketSize)
+}
+
+// rootedStorage returns the filesystem of the rooted repositories, which
+// writes to all the directories, and their layouts.
+func (o *rootedLayoutOptions) rootedStorage() (billy.Filesystem, []*borges.Layout, error) {
+	fss, layouts, err := o.rootedStorages()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return borges.NewFanOutFilesystem(fss...), layouts, nil
+}
+
+// rootedStorages returns the filesystem of each directory of the rooted
+// repositories, the first one being the one they are read from, and their
+// layouts.
+func (o *rootedLayoutOptions) rootedStorages() ([]billy.Filesystem, []*borges.Layout, error) {
+	dirs := o.RootDirs
+	if dirs == "" {
+		config := &rootedConfig{}
+		configurable.InitConfig(config)
+		dirs = config.RootRepositoriesDir
+	}
+
+	var fss []billy.Filesystem
+	for _, dir := range strings.Split(dirs, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			fss = append(fss, osfs.New(dir))
+		}
+	}
+
+	if len(fss) == 0 {
+		return nil, nil, fmt.Errorf("no root repositories directory given")
+	}
+
+	var layouts []*borges.Layout
+	if o.Layouts != "" {
+		var err error
+		layouts, err = borges.LoadLayouts(o.Layouts)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return fss, layouts, nil
+}
+
+// rootedOptions holds the options of the commands storing rooted
+// repositories.
+type rootedOptions struct {
+	rootedLayoutOptions
+	VerifyUploads bool   `long:"verify-uploads" description:"check the size and checksum of the siva files after writing them to the rooted repositories storage"`
+	UploadRetries int    `long:"upload-retries" default:"0" description:"number of times the upload of a siva file to the rooted repositories storage is resumed if it fails"`
+	Compression   string `long:"compression-level" default:"default" description:"zlib compression level of the objects stored in the siva files: default, none to store them uncompressed, or from 1 (fastest) to 9 (smallest)"`
+	KeepVersions  int    `long:"keep-versions" default:"0" description:"number of versions of each siva file kept with --immutable-store, removing the oldest ones, 0 keeps all of them"`
+	DeltaWindow   int    `long:"delta-window" default:"0" description:"number of objects tried as delta base of each object when repacking the packfiles stored in the siva files, as in git repack, larger windows make smaller files at a higher CPU cost, 0 stores them as pushed"`
+	DeltaDepth    int    `long:"delta-depth" default:"50" description:"maximum length of the chains of deltas of the packfiles repacked with --delta-window"`
+}
+
+// rootedTransactioner returns the RootedTransactioner used to store the rooted
+// repositories according to the options, with the transactions limited by the
+// given limiter, which can be nil.
+func (o *rootedOptions) rootedTransactioner(limiter *borges.TransactionLimiter) (repository.RootedTransactioner, error) {
+	compression, err := borges.ParseCompressionLevel(o.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	txFs, err := core.TemporaryFilesystem().Chroot(transactionerLocalDir)
+	if err != nil {
+		return nil, err
+	}
+
+	fss, layouts, err := o.rootedStorages()
+	if err != nil {
+		return nil, err
+	}
+
+	if o.VerifyUploads {
+		for i, fs := range fss {
+			fss[i] = borges.NewVerifiedFilesystem(fs)
+		}
+	}
+
+	fs := borges.NewFanOutFilesystem(fss...)
+
+	naming, err := o.sivaNaming()
+	if err != nil {
+		return nil, err
+	}
+
+	return borges.NewLayoutTransactioner(fs, txFs, naming, layouts,
+		borges.SivaOptions{
+			Compression:  compression,
+			Retries:      o.UploadRetries,
+			Limiter:      limiter,
+			Immutable:    o.ImmutableStore,
+			KeepVersions: o.KeepVersions,
+			DeltaWindow:  o.DeltaWindow,
+			DeltaDepth:   o.DeltaDepth,
+		})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/src-d/borges"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-billy.v3/osfs"
+)
+
+const (
+	rootidCmdName      = "rootid"
+	rootidCmdShortDesc = "print the root commits of a repository"
+	rootidCmdLongDesc  = "Clones a repository into a temporary directory and prints the normalized endpoint it is stored with and, for each root commit its references are pushed to, the siva file of the rooted repository and the references, without using the queue or the database. The whole history is fetched, since the root commits are the first ones."
+)
+
+type rootidCmd struct {
+	cmd
+	normalizationOptions
+	RefInclude   []string `long:"ref-include" description:"pattern of the references fetched, such as refs/heads/*, can be given several times, all of them are fetched if not set"`
+	RefExclude   []string `long:"ref-exclude" description:"pattern of the references not fetched, such as refs/pull/*, can be given several times"`
+	SingleBranch bool     `long:"single-branch" description:"fetch only the branch the HEAD of the remote points to"`
+	Credentials  string   `long:"credentials" description:"path to a JSON file with the credentials used to clone private repositories, matched by host"`
+	Format       string   `long:"format" default:"text" description:"output format (text or json)"`
+
+	Args struct {
+		URL string `positional-arg-name:"url" description:"URL of the repository"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// repositoryRoot is a root commit of a repository along with the rooted
+// repository and the references pushed to it.
+type repositoryRoot struct {
+	Root       string   `json:"root"`
+	SivaFile   string   `json:"siva_file"`
+	References []string `json:"references"`
+}
+
+type repositoryRoots struct {
+	Endpoint string            `json:"endpoint"`
+	Roots    []*repositoryRoot `json:"roots"`
+}
+
+func (c *rootidCmd) Execute(args []string) error {
+	c.ChangeLogLevel()
+
+	if c.Format != "text" && c.Format != "json" {
+		return fmt.Errorf("invalid format: %s", c.Format)
+	}
+
+	if err := c.setupNormalization(); err != nil {
+		return err
+	}
+
+	for _, patterns := range [][]string{c.RefInclude, c.RefExclude} {
+		if err := borges.ValidateRefPatterns(patterns); err != nil {
+			return err
+		}
+	}
+
+	opts := borges.CloneOptions{
+		RefInclude:   c.RefInclude,
+		RefExclude:   c.RefExclude,
+		SingleBranch: c.SingleBranch,
+	}
+	if c.Credentials != "" {
+		creds, err := borges.LoadCredentials(c.Credentials)
+		if err != nil {
+			return err
+		}
+
+		opts.Auth = borges.NewCredentialsAuthProvider(creds)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "borges-rootid")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	go func() {
+		if s, ok := <-stop; ok {
+			log.Info("signal received, stopping rootid", "signal", s)
+			cancel()
+		}
+	}()
+
+	endpoint := borges.NormalizeEndpoint(c.Args.URL)
+	tr, err := borges.NewTemporaryCloner(osfs.New(tmpDir), opts).Clone(ctx, "rootid", endpoint)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	refs, err := tr.References()
+	if err != nil {
+		return err
+	}
+
+	roots := &repositoryRoots{Endpoint: endpoint, Roots: rootsOfReferences(refs)}
+	if c.Format == "json" {
+		return json.NewEncoder(os.Stdout).Encode(roots)
+	}
+
+	fmt.Printf("endpoint: %s\n", roots.Endpoint)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ROOT\tSIVA FILE\tREFERENCES")
+	for _, r := range roots.Roots {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Root, r.SivaFile, strings.Join(r.References, ", "))
+	}
+
+	return w.Flush()
+}
+
+// rootsOfReferences returns the root commits the references are pushed to,
+// which is their Init, sorted by hash, with the names of their references
+// sorted too.
+func rootsOfReferences(refs []*model.Reference) []*repositoryRoot {
+	byRoot := make(map[string]*repositoryRoot)
+	var roots []*repositoryRoot
+	for _, ref := range refs {
+		init := ref.Init.String()
+		r, ok := byRoot[init]
+		if !ok {
+			r = &repositoryRoot{Root: init, SivaFile: init + ".siva"}
+			byRoot[init] = r
+			roots = append(roots, r)
+		}
+
+		r.References = append(r.References, ref.Name)
+	}
+
+	sort.Slice(roots, func(i, j int) bool { return roots[i].Root < roots[j].Root })
+	for _, r := range roots {
+		sort.Strings(r.References)
+	}
+
+	return roots
+}
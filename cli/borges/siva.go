@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/src-d/borges"
+
+	"gopkg.in/src-d/go-billy.v3/osfs"
+	"gopkg.in/src-d/go-git.v4/storage"
+)
+
+// sivaReadOptions sets how the commands reading siva files read them.
+type sivaReadOptions struct {
+	IndexCacheSize int64 `long:"index-cache-size" default:"67108864" description:"maximum bytes of memory used to cache the indexes of the siva files read, so the ones read several times are only indexed once, 0 disables the cache"`
+
+	cache *borges.SivaIndexCache
+}
+
+// openRootedRepository opens the siva file at path as a read-only storer of a
+// rooted repository. The file is read in place, so
+// it must not be modified meanwhile.
+func (o *sivaReadOptions) openRootedRepository(path string) (storage.Storer, error) {
+	if o.cache == nil && o.IndexCacheSize > 0 {
+		o.cache = borges.NewSivaIndexCache(o.IndexCacheSize)
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return borges.OpenSivaStorer(osfs.New("/"), path, o.cache)
+}
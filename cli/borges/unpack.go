@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/src-d/borges"
+
+	"gopkg.in/src-d/go-billy.v3/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+const (
+	unpackCmdName      = "unpack"
+	unpackCmdShortDesc = "extract a git repository from a siva file"
+	unpackCmdLongDesc  = "Creates a bare git repository with the objects and references of the rooted repository with the given init commit stored in a siva file. If a repository ID is given, only its references are extracted, with their original names. Otherwise, the references of all the repositories are stored under refs/remotes/<repository id>/."
+)
+
+type unpackCmd struct {
+	cmd
+	sivaReadOptions
+	RepositoryID string `long:"repository-id" description:"ID of the repository whose references are extracted, all of them if not set"`
+	BucketSize   int    `long:"bucket-size" default:"0" description:"bucket size of the siva files in the directory given instead of a siva file, as in the consumer"`
+	SivaNaming   string `long:"siva-naming" default:"hash" description:"naming of the siva files in the directory given instead of a siva file, as in the consumer"`
+
+	Args struct {
+		File   string `positional-arg-name:"siva-file" description:"siva file of the rooted repository, or directory of the rooted repositories where it is found with --siva-naming"`
+		Init   string `positional-arg-name:"init" description:"hash of the init commit of the rooted repository"`
+		Output string `positional-arg-name:"output" description:"directory where the git repository is created"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *unpackCmd) Execute(args []string) error {
+	c.ChangeLogLevel()
+
+	init := plumbing.NewHash(c.Args.Init)
+	if init.IsZero() || init.String() != c.Args.Init {
+		return fmt.Errorf("invalid init commit hash: %s", c.Args.Init)
+	}
+
+	file, err := c.sivaFile(init)
+	if err != nil {
+		return err
+	}
+
+	rooted, err := c.openRootedRepository(file)
+	if err != nil {
+		return fmt.Errorf("invalid siva file %s: %s", file, err)
+	}
+
+	r, err := git.PlainInit(c.Args.Output, true)
+	if err != nil {
+		return err
+	}
+
+	if err := borges.Unpack(rooted, init, r.Storer, c.RepositoryID); err != nil {
+		_ = os.RemoveAll(c.Args.Output)
+		return err
+	}
+
+	log.Info("repository unpacked", "init", init, "path", c.Args.Output)
+	return nil
+}
+
+// sivaFile returns the siva file given or, if it is a directory of rooted
+// repositories, the one of the rooted repository of init in it.
+func (c *unpackCmd) sivaFile(init plumbing.Hash) (string, error) {
+	fi, err := os.Stat(c.Args.File)
+	if err != nil || !fi.IsDir() {
+		return c.Args.File, nil
+	}
+
+	naming, err := borges.NewSivaNaming(c.SivaNaming, c.BucketSize)
+	if err != nil {
+		return "", err
+	}
+
+	p, err := naming.Path(osfs.New(c.Args.File), init.String()+".siva")
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(c.Args.File, p), nil
+}
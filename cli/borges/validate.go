@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/src-d/borges"
+)
+
+const (
+	validateCmdName      = "validate"
+	validateCmdShortDesc = "check the integrity of siva files"
+	validateCmdLongDesc  = "Checks the index of the given siva files, or of all the siva files found in the given directories, and that the objects they contain are present and match their hashes. It fails if any of them is corrupt."
+)
+
+type validateCmd struct {
+	cmd
+	sivaReadOptions
+
+	AllowMissingBlobs bool `long:"allow-missing-blobs" description:"do not report the blobs missing from the siva files as corrupt, such as the ones left out by --max-blob-size"`
+
+	Args struct {
+		Paths []string `positional-arg-name:"path" description:"siva files or directories containing siva files"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *validateCmd) Execute(args []string) error {
+	c.ChangeLogLevel()
+
+	files, err := sivaFiles(c.Args.Paths)
+	if err != nil {
+		return err
+	}
+
+	var corrupt int
+	for _, f := range files {
+		report, err := c.validateSivaFile(f)
+		if err != nil {
+			corrupt++
+			fmt.Printf("CORRUPT %s: %s\n", f, err)
+			continue
+		}
+
+		fmt.Printf("OK %s: %d objects, repositories: %s\n", f, report.Objects,
+			strings.Join(report.RepositoryIDs(), ", "))
+	}
+
+	fmt.Printf("%d healthy, %d corrupt\n", len(files)-corrupt, corrupt)
+	if corrupt > 0 {
+		return fmt.Errorf("%d corrupt siva files found", corrupt)
+	}
+
+	return nil
+}
+
+func (c *validateCmd) validateSivaFile(path string) (*borges.RootedRepositoryReport, error) {
+	s, err := c.openRootedRepository(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return borges.ValidateRootedRepository(s, borges.ValidateOptions{
+		AllowMissingBlobs: c.AllowMissingBlobs,
+	})
+}
+
+// sivaFiles returns the given files plus all the siva files found in the given
+// directories and their subdirectories, such as the ones used as buckets.
+func sivaFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		err := filepath.Walk(p, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if path == p && !fi.IsDir() {
+				files = append(files, path)
+			} else if !fi.IsDir() && strings.HasSuffix(path, ".siva") {
+				files = append(files, path)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
@@ -1,17 +1,18 @@
 package borges
 
 import (
+	"context"
 	stderrors "errors"
 	"fmt"
 	"io"
 	"strings"
+	"time"
 
 	"github.com/inconshreveable/log15"
 	"github.com/satori/go.uuid"
 	"gopkg.in/src-d/core-retrieval.v0"
 	"gopkg.in/src-d/core-retrieval.v0/model"
 	"gopkg.in/src-d/go-errors.v0"
-	"gopkg.in/src-d/go-kallax.v1"
 )
 
 var (
@@ -29,41 +30,105 @@ var (
 // Job represents a borges job to fetch and archive a repository.
 type Job struct {
 	RepositoryID uuid.UUID
+	// Forks are the IDs of other repositories sharing roots with the
+	// repository, such as its forks. They are archived in the same job, so
+	// the rooted repositories they share are only written once. A failure
+	// archiving a fork does not make the job fail, it is reported as a
+	// warning instead.
+	Forks []uuid.UUID
+	// Priority of the job. High priority jobs are published to the priority
+	// queue, if any, which consumers drain before the normal one.
+	Priority JobPriority
+	// Timeout, if not zero, is the maximum time spent cloning the
+	// repository, overriding the default clone timeout of the consumer. It
+	// is capped by the MaxJobTimeout of the archiver.
+	Timeout time.Duration
+	// Retries is the number of times the job failed and was published again
+	// to be retried, see the MaxRetries of the consumer.
+	Retries int
 }
 
+// JobPriority is the priority of a job.
+type JobPriority uint8
+
+const (
+	// NormalPriority is the default priority of jobs.
+	NormalPriority JobPriority = iota
+	// HighPriority is the priority of jobs that should be processed
+	// before the normal ones, such as the ones of small repositories.
+	HighPriority
+)
+
 // JobIter is an iterator of Job.
 type JobIter interface {
 	io.Closer
 	// Next returns the next job. It returns io.EOF if there are no more
 	// jobs. If there are no more jobs at the moment, but there can be
-	// in the future, it returns an error of kind ErrWaitForJobs.
-	Next() (*Job, error)
+	// in the future, it returns an error of kind ErrWaitForJobs. If the
+	// given context is cancelled while waiting for the next job, it returns
+	// the context error as soon as possible.
+	Next(ctx context.Context) (*Job, error)
+}
+
+// AckingJobIter is a JobIter whose jobs come from messages that must be
+// acknowledged once the jobs are published, such as the mentions of a queue,
+// so they are not lost if the producer stops before publishing them. The
+// Producer calls Ack with every job returned by Next once it is published, or
+// is skipped, with the error of its publication, if any.
+type AckingJobIter interface {
+	JobIter
+	// Ack acknowledges the message of the job if err is nil, and sends it
+	// back to be returned again otherwise.
+	Ack(j *Job, err error) error
+}
+
+// EndpointJobIter is a JobIter that knows the endpoints its jobs were
+// generated for, such as the endpoints of the mentions of a queue.
+type EndpointJobIter interface {
+	JobIter
+	// Endpoint returns the endpoint of a job returned by Next and not
+	// acknowledged yet, or an empty string if it is not known.
+	Endpoint(j *Job) string
+}
+
+// RepositoryID tries to find a repository by the endpoint into the store.
+// If no repository is found, it creates a new one and returns the ID. The
+// endpoint is normalized first, see SetEndpointNormalizer, so the equivalent
+// endpoints of a repository get the same ID. Repositories stored before with
+// the endpoint as it is are found too.
+func RepositoryID(endpoint string, storer RepositoryStore) (uuid.UUID, error) {
+	return repositoryID(endpoint, NormalizeEndpoint(endpoint), storer)
+}
+
+// ProviderRepositoryID is like RepositoryID for the endpoint of a repository
+// of the given provider, which is normalized with NormalizeProviderEndpoint,
+// so the endpoints of the self-hosted instances of the provider are
+// normalized too.
+func ProviderRepositoryID(endpoint, provider string, storer RepositoryStore) (uuid.UUID, error) {
+	return repositoryID(endpoint, NormalizeProviderEndpoint(endpoint, provider), storer)
 }
 
-// RepositoryID tries to find a repository by the endpoint into the database.
-// If no repository is found, it creates a new one and returns the ID.
-func RepositoryID(endpoint string, storer *model.RepositoryStore) (uuid.UUID, error) {
-	rs, err := storer.Find(
-		model.NewRepositoryQuery().
-			Where(kallax.And(kallax.ArrayContains(
-				model.Schema.Repository.Endpoints, endpoint,
-			))),
-	)
+func repositoryID(endpoint, normalized string, storer RepositoryStore) (uuid.UUID, error) {
+	repositories, err := storer.FindByEndpoint(normalized)
 	if err != nil {
 		return uuid.Nil, err
 	}
 
-	repositories, err := rs.All()
-	if err != nil {
-		return uuid.Nil, err
+	if len(repositories) == 0 && normalized != endpoint {
+		repositories, err = storer.FindByEndpoint(endpoint)
+		if err != nil {
+			return uuid.Nil, err
+		}
 	}
 
+	endpoint = normalized
+
 	l := len(repositories)
 	switch {
 	case l == 0:
 		r := model.NewRepository()
 		r.Endpoints = []string{endpoint}
-		if _, err := storer.Save(r); err != nil {
+		if err := storer.Create(r); err != nil {
 			return uuid.Nil, err
 		}
 
@@ -0,0 +1,261 @@
+package borges
+
+import (
+	"bufio"
+	"compress/zlib"
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+
+	"gopkg.in/src-d/go-errors.v0"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/utils/binary"
+)
+
+var (
+	ErrInvalidCompressionLevel = errors.NewKind("invalid compression level: %s")
+)
+
+// CompressionLevel is the zlib compression level of the objects in the
+// packfiles stored in the rooted repositories. Higher levels make smaller siva
+// files but take longer to pack, and lower ones the other way around.
+type CompressionLevel int
+
+const (
+	// DefaultCompression stores the packfiles as they are pushed, with the
+	// objects compressed with the default level of zlib. It is the default.
+	DefaultCompression CompressionLevel = 0
+	// NoCompression stores the objects uncompressed.
+	NoCompression CompressionLevel = -1
+	// BestSpeed is the fastest zlib level, 1.
+	BestSpeed CompressionLevel = 1
+	// BestCompression is the zlib level making the smallest files, 9.
+	BestCompression CompressionLevel = 9
+)
+
+// ParseCompressionLevel returns the CompressionLevel with the given name,
+// which can be "default", "none" or a zlib level from 1 to 9.
+func ParseCompressionLevel(name string) (CompressionLevel, error) {
+	switch name {
+	case "default":
+		return DefaultCompression, nil
+	case "none":
+		return NoCompression, nil
+	}
+
+	l, err := strconv.Atoi(name)
+	if err != nil || l < int(BestSpeed) || l > int(BestCompression) {
+		return 0, ErrInvalidCompressionLevel.New(name)
+	}
+
+	return CompressionLevel(l), nil
+}
+
+func (l CompressionLevel) String() string {
+	switch {
+	case l == DefaultCompression:
+		return "default"
+	case l == NoCompression:
+		return "none"
+	case l >= BestSpeed && l <= BestCompression:
+		return strconv.Itoa(int(l))
+	default:
+		return "unknown"
+	}
+}
+
+// zlibLevel returns the level of compress/zlib for l.
+func (l CompressionLevel) zlibLevel() int {
+	switch l {
+	case DefaultCompression:
+		return zlib.DefaultCompression
+	case NoCompression:
+		return zlib.NoCompression
+	default:
+		return int(l)
+	}
+}
+
+// compressingStorer is a Storer whose packfiles are written with the objects
+// compressed with the given level, whatever level they were compressed with.
+type compressingStorer struct {
+	storage.Storer
+	level CompressionLevel
+}
+
+// withCompressionLevel returns a Storer writing the packfiles to s with the
+// objects compressed with the given level. With DefaultCompression, or if s
+// does not write packfiles directly, s itself is returned.
+func withCompressionLevel(s storage.Storer, level CompressionLevel) storage.Storer {
+	if _, ok := s.(storer.PackfileWriter); !ok || level == DefaultCompression {
+		return s
+	}
+
+	return &compressingStorer{Storer: s, level: level}
+}
+
+// PackfileWriter implements the storer.PackfileWriter interface.
+func (s *compressingStorer) PackfileWriter() (io.WriteCloser, error) {
+	w, err := s.Storer.(storer.PackfileWriter).PackfileWriter()
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := recompressPackfile(w, pr, s.level.zlibLevel())
+		_ = pr.CloseWithError(err)
+		checkClose(w, &err)
+		done <- err
+	}()
+
+	return &recompressWriter{PipeWriter: pw, done: done}, nil
+}
+
+// recompressWriter is the writer of a packfile being recompressed. Closing it
+// waits until the recompressed packfile is written.
+type recompressWriter struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func (w *recompressWriter) Close() error {
+	if err := w.PipeWriter.Close(); err != nil {
+		return err
+	}
+
+	return <-w.done
+}
+
+// recompressPackfile writes to w the packfile read from r, with the same
+// objects in the same order, but compressed with the given zlib level. The
+// objects are not resolved, so the deltas stay deltas, only with the offsets
+// of their bases updated. Nothing is written if r is empty.
+func recompressPackfile(w io.Writer, r io.Reader, level int) error {
+	sc := packfile.NewScanner(r)
+	_, count, err := sc.Header()
+	if err == packfile.ErrEmptyPackfile {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	pw := newPackWriter(w)
+	zw, err := zlib.NewWriterLevel(pw, level)
+	if err != nil {
+		return err
+	}
+
+	if err := pw.header(count); err != nil {
+		return err
+	}
+
+	// offsets has the offsets in w of the objects by their offset in r
+	offsets := make(map[int64]int64, count)
+	for i := uint32(0); i < count; i++ {
+		h, err := sc.NextObjectHeader()
+		if err != nil {
+			return err
+		}
+
+		offsets[h.Offset] = pw.offset
+		if err := pw.objectHeader(h, offsets); err != nil {
+			return err
+		}
+
+		zw.Reset(pw)
+		if _, _, err := sc.NextObject(zw); err != nil {
+			return err
+		}
+
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := sc.Checksum(); err != nil {
+		return err
+	}
+
+	return pw.footer()
+}
+
+// packWriter writes a packfile, keeping its offset and checksum.
+type packWriter struct {
+	w      *bufio.Writer
+	hasher hash.Hash
+	offset int64
+}
+
+func newPackWriter(w io.Writer) *packWriter {
+	return &packWriter{w: bufio.NewWriter(w), hasher: sha1.New()}
+}
+
+func (w *packWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.hasher.Write(p[:n])
+	w.offset += int64(n)
+	return n, err
+}
+
+func (w *packWriter) header(count uint32) error {
+	if _, err := w.Write([]byte("PACK")); err != nil {
+		return err
+	}
+
+	if err := binary.WriteUint32(w, 2); err != nil {
+		return err
+	}
+
+	return binary.WriteUint32(w, count)
+}
+
+// objectHeader writes the header of the object with header h, the base of
+// which, if it is an offset delta, has already been written at its offset in
+// offsets.
+func (w *packWriter) objectHeader(h *packfile.ObjectHeader, offsets map[int64]int64) error {
+	offset := w.offset
+	size := h.Length
+	c := int64(h.Type)<<4 | size&0x0f
+	size >>= 4
+	var header []byte
+	for size != 0 {
+		header = append(header, byte(c|0x80))
+		c = size & 0x7f
+		size >>= 7
+	}
+
+	if _, err := w.Write(append(header, byte(c))); err != nil {
+		return err
+	}
+
+	switch h.Type {
+	case plumbing.OFSDeltaObject:
+		base, ok := offsets[h.OffsetReference]
+		if !ok {
+			return fmt.Errorf("delta base at offset %d not found", h.OffsetReference)
+		}
+
+		return binary.WriteVariableWidthInt(w, offset-base)
+	case plumbing.REFDeltaObject:
+		return binary.Write(w, h.Reference)
+	default:
+		return nil
+	}
+}
+
+func (w *packWriter) footer() error {
+	if _, err := w.Write(w.hasher.Sum(nil)); err != nil {
+		return err
+	}
+
+	return w.w.Flush()
+}
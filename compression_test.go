@@ -0,0 +1,167 @@
+package borges
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestParseCompressionLevel(t *testing.T) {
+	require := require.New(t)
+
+	for _, l := range []CompressionLevel{DefaultCompression, NoCompression, BestSpeed, 5, BestCompression} {
+		parsed, err := ParseCompressionLevel(l.String())
+		require.NoError(err)
+		require.Equal(l, parsed)
+	}
+
+	for _, name := range []string{"", "0", "10", "-1", "best"} {
+		_, err := ParseCompressionLevel(name)
+		require.True(ErrInvalidCompressionLevel.Is(err), name)
+	}
+
+	require.Equal("unknown", CompressionLevel(10).String())
+}
+
+// TestSivaRootedTransactioner_CompressionLevel pushes the same repository to a
+// siva file with each compression level and checks that the objects can be
+// read back, and that less compression makes bigger files. With the fixture, a
+// text file with a long history, the siva file takes about 3 times the space
+// of the default level with the objects stored uncompressed, and a 25% more
+// with level 1, while level 9 is about the same as the default one. The time
+// to push such a small repository is mostly spent finding the deltas, so it
+// barely changes between levels. The sizes and times are logged with -v.
+func TestSivaRootedTransactioner_CompressionLevel(t *testing.T) {
+	require := require.New(t)
+
+	src, blobs := compressionFixture(t)
+	h := plumbing.NewHash("e41f091c11a338f62796a738c83d879936a508ec")
+
+	sizes := make(map[CompressionLevel]int64)
+	levels := []CompressionLevel{NoCompression, BestSpeed, DefaultCompression, BestCompression}
+	for _, l := range levels {
+		fs := memfs.New()
+		rtx := NewSivaRootedTransactioner(fs, memfs.New(), SivaOptions{Compression: l})
+
+		tx, err := rtx.Begin(h)
+		require.NoError(err)
+		rr, err := git.Open(tx.Storer(), nil)
+		require.NoError(err)
+
+		start := time.Now()
+		require.NoError(WithInProcRepository(rr, func(url string) error {
+			remote, err := src.CreateRemote(&config.RemoteConfig{Name: l.String(), URL: url})
+			if err != nil {
+				return err
+			}
+
+			return remote.Push(&git.PushOptions{RefSpecs: []config.RefSpec{
+				"refs/heads/master:refs/heads/master",
+			}})
+		}))
+		elapsed := time.Since(start)
+		require.NoError(tx.Commit())
+
+		fi, err := fs.Stat(h.String() + ".siva")
+		require.NoError(err)
+		sizes[l] = fi.Size()
+		t.Logf("compression level %s: %d bytes in %s", l, fi.Size(), elapsed)
+
+		requireBlobsInSiva(t, fs, h, blobs)
+	}
+
+	require.True(sizes[NoCompression] > sizes[BestSpeed], "%v", sizes)
+	require.True(sizes[BestSpeed] >= sizes[BestCompression], "%v", sizes)
+}
+
+func TestRecompressPackfile_Empty(t *testing.T) {
+	require := require.New(t)
+
+	var buf bytes.Buffer
+	require.NoError(recompressPackfile(&buf, &bytes.Buffer{}, BestSpeed.zlibLevel()))
+	require.Zero(buf.Len())
+}
+
+// compressionFixture returns a repository with a master branch of a hundred
+// commits, each one changing some lines of a text file, so pushing it sends
+// deltas, along with the contents of the file in every commit by its hash.
+func compressionFixture(t *testing.T) (*git.Repository, map[plumbing.Hash][]byte) {
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(t, err)
+
+	blobs := make(map[plumbing.Hash][]byte)
+	var parent plumbing.Hash
+	for rev := 0; rev < 100; rev++ {
+		var content bytes.Buffer
+		for line := 0; line < 1000; line++ {
+			fmt.Fprintf(&content, "line %d of the file, changed in revision %d\n",
+				line, rev-(line+rev)%10)
+		}
+
+		blob := r.Storer.NewEncodedObject()
+		blob.SetType(plumbing.BlobObject)
+		w, err := blob.Writer()
+		require.NoError(t, err)
+		_, err = w.Write(content.Bytes())
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		blobHash, err := r.Storer.SetEncodedObject(blob)
+		require.NoError(t, err)
+		blobs[blobHash] = content.Bytes()
+
+		tree := &object.Tree{Entries: []object.TreeEntry{
+			{Name: "file.txt", Mode: filemode.Regular, Hash: blobHash},
+		}}
+
+		sig := object.Signature{Name: "foo", Email: "foo@example.com", When: time.Unix(int64(rev), 0)}
+		commit := &object.Commit{
+			Author:    sig,
+			Committer: sig,
+			Message:   fmt.Sprintf("revision %d", rev),
+			TreeHash:  storeObject(t, r, tree),
+		}
+		if rev > 0 {
+			commit.ParentHashes = []plumbing.Hash{parent}
+		}
+
+		parent = storeObject(t, r, commit)
+	}
+
+	require.NoError(t, r.Storer.SetReference(
+		plumbing.NewHashReference("refs/heads/master", parent)))
+	return r, blobs
+}
+
+// requireBlobsInSiva checks that the rooted repository h in fs has the given
+// blobs.
+func requireBlobsInSiva(t *testing.T, fs billy.Filesystem, h plumbing.Hash,
+	blobs map[plumbing.Hash][]byte) {
+	tx, err := NewSivaRootedTransactioner(fs, memfs.New(), SivaOptions{}).Begin(h)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, tx.Rollback()) }()
+
+	r, err := git.Open(tx.Storer(), nil)
+	require.NoError(t, err)
+	for hash, content := range blobs {
+		b, err := r.BlobObject(hash)
+		require.NoError(t, err)
+		rd, err := b.Reader()
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(rd)
+		require.NoError(t, err)
+		require.NoError(t, rd.Close())
+		require.Equal(t, content, buf.Bytes())
+	}
+}
@@ -1,10 +1,26 @@
 package borges
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/satori/go.uuid"
 	"gopkg.in/src-d/framework.v0/queue"
+	"gopkg.in/src-d/go-errors.v0"
+)
+
+var (
+	ErrReconnectsExhausted = errors.NewKind("could not consume from the queue after %d attempts")
+)
+
+const (
+	// DefaultReconnectBackoff is the default base of the backoff between
+	// the attempts to consume from the queue again after failing to.
+	DefaultReconnectBackoff = 5 * time.Second
+	// maxReconnectBackoff is the longest time waited between two attempts
+	// to consume from the queue.
+	maxReconnectBackoff = 5 * time.Minute
 )
 
 // Consumer consumes jobs from a queue and uses multiple workers to process
@@ -12,87 +28,524 @@ import (
 type Consumer struct {
 	Notifiers struct {
 		QueueError func(error)
+		// Reconnect function, if set, is called before every attempt
+		// to consume from the queue again after the connection was
+		// lost or consuming failed, with the number of the attempt,
+		// starting at 1, and the error, if any.
+		Reconnect func(attempt int, err error)
+		// Malformed function, if set, is called with every job whose
+		// payload could not be decoded and the decoding error, after
+		// rejecting it.
+		Malformed func(j *queue.Job, err error)
 	}
 	WorkerPool *WorkerPool
 	Queue      queue.Queue
+	// PriorityQueue, if set, is a queue consumed along with Queue whose jobs
+	// are always processed first when both queues have jobs available.
+	PriorityQueue queue.Queue
+	// DeadLetter, if set, is the queue where jobs that failed permanently are
+	// published as DeadLetterJob, instead of just being rejected.
+	DeadLetter queue.Queue
+	// ShutdownTimeout is the maximum time Stop waits for the jobs being
+	// processed to finish. Jobs still running after it are requeued. Zero
+	// means waiting until all of them finish.
+	ShutdownTimeout time.Duration
+	// AckPolicy sets when the jobs are acknowledged. By default, they are
+	// acknowledged after they are processed, see AckPolicy.
+	AckPolicy AckPolicy
+	// MaxRetries is the number of times a failed job is published again to
+	// the queue it was taken from to retry it, before it is rejected or sent
+	// to the DeadLetter queue. It only applies to the AckAfterProcessing
+	// policy. Zero means failed jobs are not retried.
+	MaxRetries int
+	// InFlightRegistry keeps track of the repositories whose jobs are
+	// being processed. A job for a repository already in flight, such as
+	// one redelivered by the broker while another worker is processing it,
+	// is requeued right away, without doing anything for it. NewConsumer
+	// sets a registry local to the consumer. If nil, jobs are never
+	// considered duplicated.
+	InFlightRegistry InFlightRegistry
+	// ReconnectBackoff is the base of the exponential backoff between the
+	// attempts to consume from the queue again after failing to, such as
+	// when the connection to the broker is lost. If zero,
+	// DefaultReconnectBackoff is used. The jobs being processed are kept,
+	// but the broker redelivers them once its connection is lost, so they
+	// may be processed again.
+	ReconnectBackoff time.Duration
+	// MaxReconnects is the number of attempts in a row to consume from the
+	// queue that can fail before Start gives up. Zero means retrying
+	// forever.
+	MaxReconnects int
+	// MaxJobs, if greater than zero, is the number of jobs after which the
+	// consumer stops consuming: once that many jobs were processed,
+	// whether they succeeded or failed, Start returns, and the consumer
+	// must still be stopped. The jobs requeued without being processed,
+	// such as the ones of busy hosts, are not counted, and no more jobs
+	// are handed to the workers than the ones left to reach it.
+	MaxJobs int
+	// IdleTimeout, if greater than zero, is the time after which the
+	// consumer stops consuming if it did not receive any job: once no job
+	// was received for that long, and none is being processed, Start
+	// returns, and the consumer must still be stopped. It counts from the
+	// start, and again from every job received. If jobs are still being
+	// processed when it is reached, it is checked again after IdleTimeout.
+	IdleTimeout time.Duration
 
-	running bool
-	quit    chan struct{}
-	done    chan struct{}
-	iter    queue.JobIter
-	m       *sync.Mutex
+	running   bool
+	connected bool
+	quit      chan struct{}
+	done      chan struct{}
+	iter      queue.JobIter
+	priority  queue.JobIter
+	inFlight  *inFlightJobs
+	limit     *jobLimit
+	m         *sync.Mutex
+
+	// received gets a value every time a job is received, for IdleTimeout.
+	received chan struct{}
+	// finished is closed once the consumer stops consuming because of
+	// MaxJobs or IdleTimeout.
+	finished     chan struct{}
+	finishedOnce *sync.Once
 }
 
 // NewConsumer creates a new consumer.
 func NewConsumer(queue queue.Queue, pool *WorkerPool) *Consumer {
 	return &Consumer{
-		WorkerPool: pool,
-		Queue:      queue,
-		m:          &sync.Mutex{},
+		WorkerPool:       pool,
+		Queue:            queue,
+		InFlightRegistry: NewInFlightRegistry(),
+		inFlight:         newInFlightJobs(),
+		m:                &sync.Mutex{},
 	}
 }
 
 // Start initializes the consumer and starts it, blocking until it is stopped.
-func (c *Consumer) Start() {
+// If consuming from the queue fails or stops, such as when the connection to
+// the broker is lost, it is tried again with backoff. If it fails more than
+// MaxReconnects times in a row, Start returns an ErrReconnectsExhausted, and
+// the consumer must still be stopped. With MaxJobs or IdleTimeout, it returns
+// nil once that many jobs were processed or the consumer was idle for that
+// long.
+func (c *Consumer) Start() error {
 	c.m.Lock()
 	c.quit = make(chan struct{})
 	c.done = make(chan struct{})
+	c.limit = newJobLimit(c.MaxJobs)
+	c.received = make(chan struct{}, 1)
+	c.finished = make(chan struct{})
+	c.finishedOnce = &sync.Once{}
 	c.m.Unlock()
 
 	defer func() { close(c.done) }()
-Outer:
+	if c.limit != nil {
+		go c.finishOnLimit()
+	}
+
+	if c.IdleTimeout > 0 {
+		go c.finishOnIdle()
+	}
+
+	var attempt int
 	for {
-		select {
-		case <-c.quit:
-			break Outer
-		default:
-			if err := c.consumeQueue(c.Queue); err != nil {
-				c.notifyQueueError(err)
+		if c.stopping() || c.isFinished() {
+			return nil
+		}
+
+		connected, err := c.consumeQueue()
+		if err != nil {
+			c.notifyQueueError(err)
+		}
+
+		if c.stopping() || c.isFinished() {
+			return nil
+		}
+
+		if connected {
+			attempt = 0
+		}
+
+		attempt++
+		if c.MaxReconnects > 0 && attempt > c.MaxReconnects {
+			if err == nil {
+				return ErrReconnectsExhausted.New(attempt - 1)
 			}
 
-			c.backoff()
+			return ErrReconnectsExhausted.Wrap(err, attempt-1)
 		}
+
+		log.Warn("not consuming from the queue, reconnecting", "module", "consumer",
+			"attempt", attempt, "error", err)
+		c.notifyReconnect(attempt, err)
+		c.backoff(attempt)
 	}
+}
 
-	return
+// stopping returns whether Stop was called.
+func (c *Consumer) stopping() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
 }
 
 // Stop stops the consumer. Note that it does not close the underlying queue
-// and worker pool. It blocks until the consumer has actually stopped.
+// and worker pool. It stops consuming new jobs and waits, up to the
+// ShutdownTimeout, for the jobs being processed to finish. The ones that did
+// not finish in time are requeued. It blocks until the consumer has actually
+// stopped.
 func (c *Consumer) Stop() {
 	c.m.Lock()
 	close(c.quit)
-	if err := c.iter.Close(); err != nil {
-		c.notifyQueueError(err)
+	c.m.Unlock()
+
+	if !c.inFlight.Wait(c.ShutdownTimeout) {
+		n := c.inFlight.RequeueAll()
+		log.Warn("shutdown timeout reached, jobs requeued",
+			"module", "consumer", "jobs", n)
+	}
+
+	c.m.Lock()
+	for _, iter := range []queue.JobIter{c.iter, c.priority} {
+		if iter == nil {
+			continue
+		}
+
+		if err := iter.Close(); err != nil {
+			c.notifyQueueError(err)
+		}
 	}
 	c.m.Unlock()
 	<-c.done
 }
 
-func (c *Consumer) backoff() {
-	time.Sleep(time.Second * 5)
+// finishOnLimit finishes consuming once MaxJobs jobs were processed, unless
+// the consumer is stopped before.
+func (c *Consumer) finishOnLimit() {
+	select {
+	case <-c.limit.Done():
+		c.finish()
+	case <-c.quit:
+	}
+}
+
+// finishOnIdle finishes consuming once no job was received for IdleTimeout
+// and none is in flight, unless the consumer is stopped before.
+func (c *Consumer) finishOnIdle() {
+	timer := time.NewTimer(c.IdleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.received:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+			if c.inFlight.Len() == 0 {
+				log.Info("no jobs received, stopping consuming", "module", "consumer",
+					"timeout", c.IdleTimeout)
+				c.finish()
+				return
+			}
+		case <-c.finished:
+			return
+		case <-c.quit:
+			return
+		}
+
+		timer.Reset(c.IdleTimeout)
+	}
+}
+
+// touch records that a job was received, for IdleTimeout.
+func (c *Consumer) touch() {
+	select {
+	case c.received <- struct{}{}:
+	default:
+	}
+}
+
+// finish makes the consumer stop consuming, closing the job iterators, so
+// Start returns. It can be called several times.
+func (c *Consumer) finish() {
+	c.finishedOnce.Do(func() {
+		c.m.Lock()
+		defer c.m.Unlock()
+		close(c.finished)
+		for _, iter := range []queue.JobIter{c.iter, c.priority} {
+			if iter == nil {
+				continue
+			}
+
+			if err := iter.Close(); err != nil {
+				c.notifyQueueError(err)
+			}
+		}
+
+		c.iter, c.priority = nil, nil
+	})
+}
+
+// isFinished returns whether the consumer stopped consuming because of
+// MaxJobs or IdleTimeout.
+func (c *Consumer) isFinished() bool {
+	select {
+	case <-c.finished:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsConnected returns true if the consumer is currently consuming jobs from
+// the queue, that is, the last attempt to consume from it succeeded and has not
+// failed since.
+func (c *Consumer) IsConnected() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.connected
 }
 
-func (c *Consumer) reject(j *queue.Job, origErr error) {
-	c.notifyQueueError(origErr)
+// InFlight returns the number of jobs taken from the queues that are not
+// acknowledged or rejected yet, including the ones waiting for a worker.
+func (c *Consumer) InFlight() int {
+	return c.inFlight.Len()
+}
+
+func (c *Consumer) setConnected(connected bool) {
+	c.m.Lock()
+	c.connected = connected
+	c.m.Unlock()
+}
+
+// backoff waits before the given attempt to consume from the queue again, or
+// until the consumer is stopped.
+func (c *Consumer) backoff(attempt int) {
+	select {
+	case <-time.After(reconnectBackoff(c.ReconnectBackoff, attempt)):
+	case <-c.quit:
+	case <-c.finished:
+	}
+}
+
+// reconnectBackoff returns the time to wait before the given attempt to use
+// the queue again after failing to, with the given base, or
+// DefaultReconnectBackoff if it is zero.
+func reconnectBackoff(base time.Duration, attempt int) time.Duration {
+	if base == 0 {
+		base = DefaultReconnectBackoff
+	}
+
+	d := retryBackoff(base, attempt)
+	if d > maxReconnectBackoff {
+		d = maxReconnectBackoff
+	}
+
+	return d
+}
+
+// maxMalformedPayload is the maximum length of the payload of a malformed job
+// that is logged.
+const maxMalformedPayload = 256
+
+// rejectMalformed rejects a job whose payload could not be decoded without
+// requeueing it, since it would fail the same way on every delivery, so it
+// ends up in the buried queue of the broker, where it can be inspected.
+func (c *Consumer) rejectMalformed(j *queue.Job, err error) {
+	log.Warn("malformed job, rejecting it", "module", "consumer",
+		"job", j.ID, "payload", malformedPayload(j), "error", err)
 	if err := j.Reject(false); err != nil {
 		c.notifyQueueError(err)
 	}
+
+	c.notifyMalformed(j, err)
+}
+
+// malformedPayload returns the payload of a job that could not be decoded as a
+// Job to log it, as generic data, truncated to maxMalformedPayload.
+func malformedPayload(j *queue.Job) string {
+	var payload interface{}
+	if err := j.Decode(&payload); err != nil {
+		return fmt.Sprintf("<undecodable: %s>", err)
+	}
+
+	s := fmt.Sprintf("%v", payload)
+	if len(s) > maxMalformedPayload {
+		s = s[:maxMalformedPayload] + "..."
+	}
+
+	return s
 }
 
-func (c *Consumer) consumeQueue(q queue.Queue) error {
+// consumeQueue consumes the jobs of the queues until their iterators are
+// closed or fail. It returns whether it started consuming from them.
+func (c *Consumer) consumeQueue() (bool, error) {
 	var err error
 	c.m.Lock()
+	if c.isFinished() {
+		c.m.Unlock()
+		return false, nil
+	}
+
 	c.iter, err = c.Queue.Consume(c.WorkerPool.Len())
+	if err == nil && c.PriorityQueue != nil {
+		c.priority, err = c.PriorityQueue.Consume(c.WorkerPool.Len())
+		if err != nil {
+			_ = c.iter.Close()
+		}
+	}
+	c.connected = err == nil
+	iter, priority := c.iter, c.priority
 	c.m.Unlock()
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	return c.consumeJobIter(c.iter)
+	defer c.setConnected(false)
+	if c.PriorityQueue == nil {
+		return true, c.consumeJobIter(iter, c.Queue)
+	}
+
+	return true, c.consumeJobIters(priority, iter)
+}
+
+type iterResult struct {
+	job      *queue.Job
+	err      error
+	priority bool
 }
 
-func (c *Consumer) consumeJobIter(iter queue.JobIter) error {
+// consumeJobIters consumes the jobs of both iterators, processing the ones of
+// the priority iterator first. A job of the normal iterator waiting for a free
+// worker is overtaken by any job of the priority iterator received meanwhile.
+// It returns when any of the iterators is closed or fails, closing the other
+// one.
+func (c *Consumer) consumeJobIters(priority, normal queue.JobIter) (err error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	var pending *WorkerJob
+	defer func() {
+		if pending != nil {
+			if rErr := pending.Acknowledger.Reject(true); rErr != nil {
+				c.notifyQueueError(rErr)
+			}
+		}
+
+		_ = priority.Close()
+		_ = normal.Close()
+	}()
+
+	priorityJobs := iterJobs(priority, true, done)
+	normalJobs := iterJobs(normal, false, done)
+	for {
+		if pending == nil {
+			var r iterResult
+			select {
+			case r = <-priorityJobs:
+			default:
+				select {
+				case r = <-priorityJobs:
+				case r = <-normalJobs:
+				}
+			}
+
+			if r.job == nil {
+				if stop, err := c.iterError(r.err); stop {
+					return err
+				}
+
+				continue
+			}
+
+			if !r.priority {
+				pending, err = c.newWorkerJob(r.job, c.Queue)
+				if err != nil {
+					c.notifyQueueError(err)
+				}
+
+				continue
+			}
+
+			if err := c.consumeJob(r.job, c.PriorityQueue); err != nil {
+				c.notifyQueueError(err)
+			}
+
+			continue
+		}
+
+		if c.WorkerPool.dispatchByAffinity(pending) {
+			pending = nil
+			continue
+		}
+
+		select {
+		case c.WorkerPool.jobChannel <- pending:
+			pending = nil
+		case r := <-priorityJobs:
+			if r.job == nil {
+				if stop, err := c.iterError(r.err); stop {
+					return err
+				}
+
+				continue
+			}
+
+			if err := c.consumeJob(r.job, c.PriorityQueue); err != nil {
+				c.notifyQueueError(err)
+			}
+		case <-c.quit:
+			// the consumer is stopping, the pending job is given back to
+			// the queue on return
+			return nil
+		}
+	}
+}
+
+// iterError handles an error returned by a job iterator. It returns true if
+// the iterator cannot be used anymore, along with the error to return, if any.
+func (c *Consumer) iterError(err error) (bool, error) {
+	switch err {
+	case queue.ErrEmptyJob:
+		c.notifyQueueError(err)
+		return false, nil
+	case queue.ErrAlreadyClosed:
+		return true, nil
+	default:
+		return true, err
+	}
+}
+
+// iterJobs sends the jobs returned by the iterator to the returned channel
+// until the iterator fails or done is closed. A job is only taken from the
+// iterator once the previous one has been received.
+func iterJobs(iter queue.JobIter, priority bool, done <-chan struct{}) <-chan iterResult {
+	ch := make(chan iterResult)
+	go func() {
+		for {
+			j, err := iter.Next()
+			select {
+			case ch <- iterResult{j, err, priority}:
+			case <-done:
+				if j != nil {
+					_ = j.Reject(true)
+				}
+
+				return
+			}
+
+			if err != nil && err != queue.ErrEmptyJob {
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+func (c *Consumer) consumeJobIter(iter queue.JobIter, q queue.Queue) error {
 	for {
 		j, err := iter.Next()
 		if err == queue.ErrEmptyJob {
@@ -108,23 +561,261 @@ func (c *Consumer) consumeJobIter(iter queue.JobIter) error {
 			return err
 		}
 
-		if err := c.consumeJob(j); err != nil {
+		if err := c.consumeJob(j, q); err != nil {
 			c.notifyQueueError(err)
 		}
 	}
 }
 
-func (c *Consumer) consumeJob(j *queue.Job) error {
+func (c *Consumer) consumeJob(j *queue.Job, q queue.Queue) error {
+	wj, err := c.newWorkerJob(j, q)
+	if wj == nil {
+		return err
+	}
+
+	if !c.WorkerPool.doOrCancel(wj, c.quit) {
+		// the consumer is stopping, give the job back to the queue
+		return wj.Acknowledger.Reject(true)
+	}
+
+	return nil
+}
+
+// newWorkerJob decodes the job taken from q and starts tracking it as in
+// flight. It returns a nil WorkerJob if the job was rejected because it could
+// not be decoded, the consumer is stopping or its repository is already in
+// flight. With MaxJobs, it waits until the job can take a slot, and rejects it
+// if MaxJobs jobs were processed meanwhile. With the AckOnReceipt policy, the
+// job is acknowledged right away.
+func (c *Consumer) newWorkerJob(j *queue.Job, q queue.Queue) (*WorkerJob, error) {
+	c.touch()
 	job := &Job{}
 	if err := j.Decode(job); err != nil {
-		c.reject(j, err)
-		return err
+		c.rejectMalformed(j, err)
+		return nil, nil
+	}
+
+	select {
+	case <-c.quit:
+		// the consumer is stopping, give the job back to the queue
+		return nil, j.Reject(true)
+	default:
 	}
 
-	c.WorkerPool.Do(&WorkerJob{job, j})
+	release, ok := c.acquire(job)
+	if !ok {
+		log.Debug("repository already in flight, requeueing job",
+			"module", "consumer", "RepositoryID", job.RepositoryID)
+		return nil, j.Reject(true)
+	}
+
+	if !c.limit.take(c.quit) {
+		release()
+		return nil, j.Reject(true)
+	}
+
+	if c.AckPolicy == AckOnReceipt {
+		if err := j.Ack(); err != nil {
+			c.limit.finish(true)
+			release()
+			return nil, err
+		}
+
+		return &WorkerJob{
+			Job:          job,
+			Acknowledger: c.limit.wrap(c.inFlight.Add(ackedJob{}, release)),
+			deadLetter:   c.DeadLetter,
+		}, nil
+	}
+
+	return &WorkerJob{
+		Job:          job,
+		Acknowledger: c.limit.wrap(c.inFlight.Add(j, release)),
+		deadLetter:   c.DeadLetter,
+		retryQueue:   q,
+		maxRetries:   c.MaxRetries,
+	}, nil
+}
+
+// acquire marks the repository of the job as in flight in the registry of the
+// consumer. It returns false if it already was, and otherwise the function
+// that releases it. If the registry fails, the job is processed anyway.
+func (c *Consumer) acquire(j *Job) (func(), bool) {
+	r := c.InFlightRegistry
+	if r == nil {
+		return func() {}, true
+	}
+
+	ok, err := r.Acquire(j.RepositoryID)
+	if err != nil {
+		c.notifyQueueError(err)
+		return func() {}, true
+	}
+
+	if !ok {
+		return nil, false
+	}
+
+	return func() {
+		if err := r.Release(j.RepositoryID); err != nil {
+			c.notifyQueueError(err)
+		}
+	}, true
+}
+
+// InFlightRegistry keeps track of the repositories being processed, see the
+// InFlightRegistry of the Consumer. A registry shared by the consumers of
+// several hosts, such as one backed by a distributed lock, deduplicates the
+// jobs across all of them. Such a registry must expire the repositories of
+// the consumers that died without releasing them.
+type InFlightRegistry interface {
+	// Acquire marks the repository as in flight and returns true, or
+	// returns false if it already was.
+	Acquire(id uuid.UUID) (bool, error)
+	// Release marks the repository as not in flight anymore.
+	Release(id uuid.UUID) error
+}
+
+type inFlightRegistry struct {
+	m     sync.Mutex
+	repos map[uuid.UUID]struct{}
+}
+
+// NewInFlightRegistry returns an InFlightRegistry local to the process.
+func NewInFlightRegistry() InFlightRegistry {
+	return &inFlightRegistry{repos: make(map[uuid.UUID]struct{})}
+}
+
+func (r *inFlightRegistry) Acquire(id uuid.UUID) (bool, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if _, ok := r.repos[id]; ok {
+		return false, nil
+	}
+
+	r.repos[id] = struct{}{}
+	return true, nil
+}
+
+func (r *inFlightRegistry) Release(id uuid.UUID) error {
+	r.m.Lock()
+	delete(r.repos, id)
+	r.m.Unlock()
 	return nil
 }
 
+// inFlightJobs keeps track of the jobs handed to the worker pool that are
+// not acknowledged or rejected yet.
+type inFlightJobs struct {
+	m    sync.Mutex
+	wg   sync.WaitGroup
+	jobs map[*inFlightJob]struct{}
+}
+
+func newInFlightJobs() *inFlightJobs {
+	return &inFlightJobs{jobs: make(map[*inFlightJob]struct{})}
+}
+
+// Add starts tracking the given acknowledger until it is acknowledged or
+// rejected through the returned one, which calls release then.
+func (f *inFlightJobs) Add(ack queue.Acknowledger, release func()) queue.Acknowledger {
+	j := &inFlightJob{Acknowledger: ack, jobs: f, release: release}
+	f.m.Lock()
+	f.jobs[j] = struct{}{}
+	f.wg.Add(1)
+	f.m.Unlock()
+	return j
+}
+
+// Wait waits until there are no jobs in flight or the timeout is reached, in
+// which case it returns false. A timeout of zero means no timeout.
+func (f *inFlightJobs) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+
+	if timeout <= 0 {
+		<-done
+		return true
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Len returns the number of jobs in flight.
+func (f *inFlightJobs) Len() int {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return len(f.jobs)
+}
+
+// RequeueAll rejects with requeue all the jobs in flight and returns how
+// many of them were requeued. Acknowledging or rejecting them afterwards is
+// a no-op.
+func (f *inFlightJobs) RequeueAll() int {
+	f.m.Lock()
+	jobs := make([]*inFlightJob, 0, len(f.jobs))
+	for j := range f.jobs {
+		jobs = append(jobs, j)
+	}
+	f.m.Unlock()
+
+	var n int
+	for _, j := range jobs {
+		if j.finish(func(a queue.Acknowledger) error { return a.Reject(true) }) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (f *inFlightJobs) remove(j *inFlightJob) {
+	f.m.Lock()
+	delete(f.jobs, j)
+	f.m.Unlock()
+	f.wg.Done()
+}
+
+type inFlightJob struct {
+	queue.Acknowledger
+	jobs    *inFlightJobs
+	release func()
+	once    sync.Once
+	err     error
+}
+
+func (j *inFlightJob) Ack() error {
+	j.finish(queue.Acknowledger.Ack)
+	return j.err
+}
+
+func (j *inFlightJob) Reject(requeue bool) error {
+	j.finish(func(a queue.Acknowledger) error { return a.Reject(requeue) })
+	return j.err
+}
+
+// finish calls f with the underlying acknowledger only the first time it is
+// called, and returns whether f was called.
+func (j *inFlightJob) finish(f func(queue.Acknowledger) error) bool {
+	var called bool
+	j.once.Do(func() {
+		called = true
+		j.err = f(j.Acknowledger)
+		j.release()
+		j.jobs.remove(j)
+	})
+
+	return called
+}
+
 func (c *Consumer) notifyQueueError(err error) {
 	if c.Notifiers.QueueError == nil {
 		return
@@ -132,3 +823,19 @@ func (c *Consumer) notifyQueueError(err error) {
 
 	c.Notifiers.QueueError(err)
 }
+
+func (c *Consumer) notifyMalformed(j *queue.Job, err error) {
+	if c.Notifiers.Malformed == nil {
+		return
+	}
+
+	c.Notifiers.Malformed(j, err)
+}
+
+func (c *Consumer) notifyReconnect(attempt int, err error) {
+	if c.Notifiers.Reconnect == nil {
+		return
+	}
+
+	c.Notifiers.Reconnect(attempt, err)
+}
@@ -3,6 +3,8 @@ package borges
 import (
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -82,6 +84,21 @@ func (s *ConsumerSuite) TestConsumer_StartStop_EmptyQueue() {
 	c.Stop()
 }
 
+func (s *ConsumerSuite) TestConsumer_IsConnected() {
+	require := require.New(s.T())
+	c := s.newConsumer()
+	require.False(c.IsConnected())
+
+	c.WorkerPool.SetWorkerCount(1)
+	go c.Start()
+
+	time.Sleep(time.Millisecond * 100)
+	require.True(c.IsConnected())
+
+	c.Stop()
+	require.False(c.IsConnected())
+}
+
 func (s *ConsumerSuite) TestConsumer_StartStop() {
 	assert := assert.New(s.T())
 	c := s.newConsumer()
@@ -117,6 +134,689 @@ func (s *ConsumerSuite) TestConsumer_StartStop() {
 	assert.Equal(1, processed)
 }
 
+func (s *ConsumerSuite) TestConsumer_StartStop_DeadLetter() {
+	require := require.New(s.T())
+	c := s.newConsumer()
+
+	dlq, err := s.broker.Queue(s.queueName + "_dead_letter")
+	require.NoError(err)
+	c.DeadLetter = dlq
+
+	id := uuid.NewV4()
+	done := make(chan struct{}, 1)
+	c.WorkerPool.do = func(*WorkerContext, *Job) error {
+		defer func() { done <- struct{}{} }()
+		return &RetryError{Attempts: 3, Err: errors.New("SOME ERROR")}
+	}
+
+	job := queue.NewJob()
+	require.NoError(job.Encode(&Job{RepositoryID: id}))
+	require.NoError(s.queue.Publish(job))
+
+	c.WorkerPool.SetWorkerCount(1)
+	go c.Start()
+
+	require.NoError(timeoutChan(done, time.Second*10))
+	c.Stop()
+
+	iter, err := dlq.Consume(1)
+	require.NoError(err)
+	dj, err := iter.Next()
+	require.NoError(err)
+	require.NoError(iter.Close())
+
+	var dead DeadLetterJob
+	require.NoError(dj.Decode(&dead))
+	require.Equal(id, dead.RepositoryID)
+	require.Equal(3, dead.Attempts)
+	require.Equal("failed after 3 attempts: SOME ERROR", dead.Error)
+}
+
+func (s *ConsumerSuite) TestConsumer_StartStop_Retries() {
+	require := require.New(s.T())
+	c := s.newConsumer()
+	c.MaxRetries = 2
+
+	retries := make(chan int, 10)
+	c.WorkerPool.do = func(w *WorkerContext, j *Job) error {
+		retries <- j.Retries
+		return errors.New("SOME ERROR")
+	}
+
+	job := queue.NewJob()
+	require.NoError(job.Encode(&Job{RepositoryID: uuid.NewV4()}))
+	require.NoError(s.queue.Publish(job))
+
+	c.WorkerPool.SetWorkerCount(1)
+	go c.Start()
+
+	for i := 0; i <= c.MaxRetries; i++ {
+		select {
+		case r := <-retries:
+			require.Equal(i, r)
+		case <-time.After(time.Second * 10):
+			require.FailNow("timeout waiting for job retry")
+		}
+	}
+
+	select {
+	case r := <-retries:
+		require.Fail("job retried too many times", "retries: %d", r)
+	case <-time.After(time.Second * 3):
+	}
+
+	c.Stop()
+}
+
+func (s *ConsumerSuite) TestConsumer_AckOnReceipt() {
+	require := require.New(s.T())
+	c := s.newConsumer()
+	c.AckPolicy = AckOnReceipt
+	c.MaxRetries = 2
+	c.ShutdownTimeout = 100 * time.Millisecond
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	c.WorkerPool.do = func(*WorkerContext, *Job) error {
+		started <- struct{}{}
+		<-release
+		return errors.New("SOME ERROR")
+	}
+
+	job := queue.NewJob()
+	require.NoError(job.Encode(&Job{RepositoryID: uuid.NewV4()}))
+	require.NoError(s.queue.Publish(job))
+
+	c.WorkerPool.SetWorkerCount(1)
+	go c.Start()
+
+	require.NoError(timeoutChan(started, time.Second*10))
+	c.Stop()
+	close(release)
+
+	// the job was acknowledged on receipt, so it was neither requeued on
+	// stop nor retried after failing
+	iter, err := s.queue.Consume(1)
+	require.NoError(err)
+	next := make(chan *queue.Job, 1)
+	go func() {
+		if j, err := iter.Next(); err == nil {
+			next <- j
+		}
+	}()
+
+	select {
+	case <-next:
+		require.Fail("job acknowledged on receipt was requeued")
+	case <-time.After(time.Second * 3):
+	}
+
+	require.NoError(iter.Close())
+}
+
+func (s *ConsumerSuite) TestConsumer_Stop_WaitsInFlightJobs() {
+	require := require.New(s.T())
+	c := s.newConsumer()
+
+	started := make(chan struct{}, 1)
+	finished := false
+	c.WorkerPool.do = func(*WorkerContext, *Job) error {
+		started <- struct{}{}
+		time.Sleep(200 * time.Millisecond)
+		finished = true
+		return nil
+	}
+
+	job := queue.NewJob()
+	require.NoError(job.Encode(&Job{RepositoryID: uuid.NewV4()}))
+	require.NoError(s.queue.Publish(job))
+
+	c.WorkerPool.SetWorkerCount(1)
+	go c.Start()
+
+	require.NoError(timeoutChan(started, time.Second*10))
+	c.Stop()
+	require.True(finished)
+}
+
+func (s *ConsumerSuite) TestConsumer_Stop_RequeuesUnfinishedJobs() {
+	require := require.New(s.T())
+	c := s.newConsumer()
+	c.ShutdownTimeout = 100 * time.Millisecond
+
+	id := uuid.NewV4()
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	c.WorkerPool.do = func(*WorkerContext, *Job) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+
+	job := queue.NewJob()
+	require.NoError(job.Encode(&Job{RepositoryID: id}))
+	require.NoError(s.queue.Publish(job))
+
+	c.WorkerPool.SetWorkerCount(1)
+	go c.Start()
+
+	require.NoError(timeoutChan(started, time.Second*10))
+	c.Stop()
+	close(release)
+
+	iter, err := s.queue.Consume(1)
+	require.NoError(err)
+	j, err := iter.Next()
+	require.NoError(err)
+	require.NoError(iter.Close())
+
+	var requeued Job
+	require.NoError(j.Decode(&requeued))
+	require.Equal(id, requeued.RepositoryID)
+}
+
+func (s *ConsumerSuite) TestConsumer_PriorityQueue() {
+	require := require.New(s.T())
+	c := s.newConsumer()
+
+	pq, err := s.broker.Queue(s.queueName + "_priority")
+	require.NoError(err)
+	c.PriorityQueue = pq
+
+	publish := func(q queue.Queue, id uuid.UUID) {
+		job := queue.NewJob()
+		require.NoError(job.Encode(&Job{RepositoryID: id}))
+		require.NoError(q.Publish(job))
+	}
+
+	// the first job keeps the only worker busy until the others are received
+	first, normal, priority := uuid.NewV4(), uuid.NewV4(), uuid.NewV4()
+	publish(s.queue, first)
+
+	release := make(chan struct{})
+	processed := make(chan uuid.UUID, 3)
+	c.WorkerPool.do = func(_ *WorkerContext, j *Job) error {
+		if j.RepositoryID == first {
+			<-release
+		}
+
+		processed <- j.RepositoryID
+		return nil
+	}
+
+	c.WorkerPool.SetWorkerCount(1)
+	go c.Start()
+
+	time.Sleep(100 * time.Millisecond)
+	publish(s.queue, normal)
+	time.Sleep(1500 * time.Millisecond)
+	publish(pq, priority)
+	time.Sleep(1500 * time.Millisecond)
+	close(release)
+
+	var ids []uuid.UUID
+	for i := 0; i < 3; i++ {
+		select {
+		case id := <-processed:
+			ids = append(ids, id)
+		case <-time.After(10 * time.Second):
+			require.FailNow("timeout waiting for jobs")
+		}
+	}
+
+	c.Stop()
+	require.Equal([]uuid.UUID{first, priority, normal}, ids)
+}
+
+func (s *ConsumerSuite) TestConsumer_PriorityQueue_Affinity() {
+	require := require.New(s.T())
+	c := s.newConsumer()
+
+	pq, err := s.broker.Queue(s.queueName + "_priority")
+	require.NoError(err)
+	c.PriorityQueue = pq
+
+	workers := make(chan int, 1)
+	c.WorkerPool.do = func(ctx *WorkerContext, j *Job) error {
+		workers <- ctx.ID
+		return nil
+	}
+
+	c.WorkerPool.Affinity = func(*Job) string { return "foo" }
+	c.WorkerPool.SetWorkerCount(2)
+	go c.Start()
+	defer c.Stop()
+
+	// the jobs of the normal queue go to the worker of their key too
+	var ids []int
+	for i := 0; i < 5; i++ {
+		job := queue.NewJob()
+		require.NoError(job.Encode(&Job{RepositoryID: uuid.NewV4()}))
+		require.NoError(s.queue.Publish(job))
+
+		select {
+		case id := <-workers:
+			ids = append(ids, id)
+		case <-time.After(10 * time.Second):
+			require.FailNow("timeout waiting for jobs")
+		}
+	}
+
+	for _, id := range ids {
+		require.Equal(ids[0], id)
+	}
+}
+
+func (s *ConsumerSuite) TestConsumer_InFlightDuplicate() {
+	require := require.New(s.T())
+	c := s.newConsumer()
+
+	id := uuid.NewV4()
+	for i := 0; i < 2; i++ {
+		job := queue.NewJob()
+		require.NoError(job.Encode(&Job{RepositoryID: id}))
+		require.NoError(s.queue.Publish(job))
+	}
+
+	var m sync.Mutex
+	var running, maxRunning int
+	release := make(chan struct{})
+	processed := make(chan struct{}, 2)
+	c.WorkerPool.do = func(*WorkerContext, *Job) error {
+		m.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		m.Unlock()
+
+		<-release
+		m.Lock()
+		running--
+		m.Unlock()
+		processed <- struct{}{}
+		return nil
+	}
+
+	c.WorkerPool.SetWorkerCount(2)
+	go c.Start()
+
+	time.Sleep(1500 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(timeoutChan(processed, time.Second*10))
+	}
+
+	c.Stop()
+	require.Equal(1, maxRunning)
+}
+
+func TestInFlightRegistry(t *testing.T) {
+	require := require.New(t)
+
+	r := NewInFlightRegistry()
+	id := uuid.NewV4()
+	ok, err := r.Acquire(id)
+	require.NoError(err)
+	require.True(ok)
+
+	ok, err = r.Acquire(id)
+	require.NoError(err)
+	require.False(ok)
+
+	ok, err = r.Acquire(uuid.NewV4())
+	require.NoError(err)
+	require.True(ok)
+
+	require.NoError(r.Release(id))
+	ok, err = r.Acquire(id)
+	require.NoError(err)
+	require.True(ok)
+}
+
+func TestInFlightJobs_Release(t *testing.T) {
+	require := require.New(t)
+
+	var released int
+	f := newInFlightJobs()
+	ack := f.Add(ackedJob{}, func() { released++ })
+	require.Equal(1, f.Len())
+
+	require.NoError(ack.Ack())
+	require.NoError(ack.Reject(true))
+	require.Equal(1, released)
+	require.Zero(f.Len())
+}
+
+func TestConsumer_Reconnect(t *testing.T) {
+	require := require.New(t)
+
+	q, err := queue.NewMemoryBroker().Queue("reconnect")
+	require.NoError(err)
+	fq := &flakyQueue{Queue: q, fails: 2, iters: make(chan queue.JobIter, 3)}
+
+	processed := make(chan struct{}, 2)
+	wp := NewWorkerPool(func(*WorkerContext, *Job) error {
+		processed <- struct{}{}
+		return nil
+	})
+	wp.SetWorkerCount(1)
+
+	c := NewConsumer(fq, wp)
+	c.ReconnectBackoff = time.Millisecond
+	var m sync.Mutex
+	var attempts []int
+	c.Notifiers.Reconnect = func(attempt int, err error) {
+		m.Lock()
+		attempts = append(attempts, attempt)
+		m.Unlock()
+	}
+
+	go c.Start()
+
+	publish := func() {
+		j := queue.NewJob()
+		require.NoError(j.Encode(&Job{RepositoryID: uuid.NewV4()}))
+		require.NoError(q.Publish(j))
+	}
+
+	publish()
+	iter := <-fq.iters
+	require.NoError(timeoutChan(processed, 10*time.Second))
+
+	// the connection is lost
+	require.NoError(iter.Close())
+	<-fq.iters
+	publish()
+	require.NoError(timeoutChan(processed, 10*time.Second))
+
+	c.Stop()
+	m.Lock()
+	defer m.Unlock()
+	require.Equal([]int{1, 2, 1}, attempts)
+}
+
+func TestConsumer_MaxReconnects(t *testing.T) {
+	require := require.New(t)
+
+	q, err := queue.NewMemoryBroker().Queue("reconnect")
+	require.NoError(err)
+
+	wp := NewWorkerPool(func(*WorkerContext, *Job) error { return nil })
+	wp.SetWorkerCount(1)
+	c := NewConsumer(&flakyQueue{Queue: q, fails: -1}, wp)
+	c.ReconnectBackoff = time.Millisecond
+	c.MaxReconnects = 2
+
+	var queueErrors int
+	c.Notifiers.QueueError = func(error) { queueErrors++ }
+
+	err = c.Start()
+	require.True(ErrReconnectsExhausted.Is(err), "%v", err)
+	require.Equal(3, queueErrors)
+	c.Stop()
+}
+
+// TestConsumer_MaxJobs processes jobs with several workers until MaxJobs of
+// them finished, some of them failing and one requeued once because its host
+// was busy, which is not counted, and checks that the jobs left are still in
+// the queue.
+func TestConsumer_MaxJobs(t *testing.T) {
+	require := require.New(t)
+
+	q, err := queue.NewMemoryBroker().Queue("max-jobs")
+	require.NoError(err)
+
+	ids := make(map[uuid.UUID]bool)
+	var busy uuid.UUID
+	for i := 0; i < 10; i++ {
+		id := uuid.NewV4()
+		if i == 0 {
+			busy = id
+		}
+
+		ids[id] = true
+		j := queue.NewJob()
+		require.NoError(j.Encode(&Job{RepositoryID: id}))
+		require.NoError(q.Publish(j))
+	}
+
+	var m sync.Mutex
+	processed := make(map[uuid.UUID]bool)
+	var calls int
+	wp := NewWorkerPool(func(_ *WorkerContext, j *Job) error {
+		m.Lock()
+		defer m.Unlock()
+		calls++
+		if j.RepositoryID == busy && calls == 1 {
+			return ErrHostBusy.New("example.com")
+		}
+
+		require.False(processed[j.RepositoryID])
+		processed[j.RepositoryID] = true
+		if len(processed)%2 == 0 {
+			return errors.New("SOME ERROR")
+		}
+
+		return nil
+	})
+	wp.SetWorkerCount(3)
+
+	c := NewConsumer(q, wp)
+	c.MaxJobs = 5
+	started := make(chan error, 1)
+	go func() { started <- c.Start() }()
+
+	select {
+	case err := <-started:
+		require.NoError(err)
+	case <-time.After(30 * time.Second):
+		require.FailNow("consumer not stopped after processing the jobs")
+	}
+	c.Stop()
+	require.NoError(wp.Close())
+
+	m.Lock()
+	require.Len(processed, 5)
+	m.Unlock()
+
+	iter, err := q.Consume(1)
+	require.NoError(err)
+	for i := 0; i < 5; i++ {
+		j, err := iter.Next()
+		require.NoError(err)
+		var job Job
+		require.NoError(j.Decode(&job))
+		require.True(ids[job.RepositoryID])
+		require.False(processed[job.RepositoryID])
+		delete(ids, job.RepositoryID)
+	}
+	require.NoError(iter.Close())
+}
+
+// TestConsumer_Malformed publishes a job whose payload is not a Job before two
+// valid ones, the second one only once the first is processed, so it would
+// follow the malformed job if it was requeued.
+func TestConsumer_Malformed(t *testing.T) {
+	require := require.New(t)
+
+	q, err := queue.NewMemoryBroker().Queue("malformed")
+	require.NoError(err)
+
+	publish := func(payload interface{}) {
+		j := queue.NewJob()
+		require.NoError(j.Encode(payload))
+		require.NoError(q.Publish(j))
+	}
+
+	publish("garbage")
+	publish(&Job{RepositoryID: uuid.NewV4()})
+
+	processed := make(chan struct{}, 2)
+	wp := NewWorkerPool(func(*WorkerContext, *Job) error {
+		processed <- struct{}{}
+		return nil
+	})
+	wp.SetWorkerCount(1)
+	defer func() { require.NoError(wp.Close()) }()
+
+	var malformed int32
+	c := NewConsumer(q, wp)
+	c.MaxJobs = 2
+	c.Notifiers.Malformed = func(j *queue.Job, err error) {
+		require.Error(err)
+		atomic.AddInt32(&malformed, 1)
+	}
+
+	started := make(chan error, 1)
+	go func() { started <- c.Start() }()
+	defer c.Stop()
+
+	select {
+	case <-processed:
+	case <-time.After(10 * time.Second):
+		require.FailNow("valid job not processed")
+	}
+	publish(&Job{RepositoryID: uuid.NewV4()})
+
+	select {
+	case err := <-started:
+		require.NoError(err)
+	case <-time.After(10 * time.Second):
+		require.FailNow("consumer not stopped after processing the jobs")
+	}
+	require.Equal(int32(1), atomic.LoadInt32(&malformed))
+
+	// the malformed job was buried
+	require.NoError(q.RepublishBuried())
+	iter, err := q.Consume(1)
+	require.NoError(err)
+	j, err := iter.Next()
+	require.NoError(err)
+	var payload string
+	require.NoError(j.Decode(&payload))
+	require.Equal("garbage", payload)
+	require.NoError(iter.Close())
+}
+
+// TestConsumer_IdleTimeout sends jobs to the consumer before its idle timeout
+// is reached, which must restart it, and checks that it does not stop while
+// a job is in flight, but does once there are no jobs for the timeout.
+func TestConsumer_IdleTimeout(t *testing.T) {
+	require := require.New(t)
+
+	mq, err := queue.NewMemoryBroker().Queue("idle")
+	require.NoError(err)
+	mi, err := mq.Consume(1)
+	require.NoError(err)
+	q := &chanQueue{Queue: mq, jobs: make(chan *queue.Job)}
+
+	send := func() {
+		j := queue.NewJob()
+		require.NoError(j.Encode(&Job{RepositoryID: uuid.NewV4()}))
+		require.NoError(mq.Publish(j))
+		j, err := mi.Next()
+		require.NoError(err)
+		q.jobs <- j
+	}
+
+	release := make(chan struct{})
+	var calls int32
+	wp := NewWorkerPool(func(*WorkerContext, *Job) error {
+		if atomic.AddInt32(&calls, 1) == 2 {
+			<-release
+		}
+
+		return nil
+	})
+	wp.SetWorkerCount(1)
+	defer func() { require.NoError(wp.Close()) }()
+
+	c := NewConsumer(q, wp)
+	c.IdleTimeout = 500 * time.Millisecond
+	started := make(chan error, 1)
+	go func() { started <- c.Start() }()
+	defer c.Stop()
+
+	notStarted := func(d time.Duration) {
+		select {
+		case err := <-started:
+			require.FailNow("consumer stopped before the idle timeout", "%v", err)
+		case <-time.After(d):
+		}
+	}
+
+	notStarted(300 * time.Millisecond)
+	send()
+	notStarted(300 * time.Millisecond)
+	send()
+	// the second job is in flight past the idle timeout
+	notStarted(time.Second)
+	close(release)
+
+	select {
+	case err := <-started:
+		require.NoError(err)
+	case <-time.After(5 * time.Second):
+		require.FailNow("consumer not stopped after the idle timeout")
+	}
+	require.Equal(int32(2), atomic.LoadInt32(&calls))
+}
+
+// chanQueue is a queue.Queue whose iterators return the jobs sent to jobs.
+type chanQueue struct {
+	queue.Queue
+	jobs chan *queue.Job
+}
+
+func (q *chanQueue) Consume(int) (queue.JobIter, error) {
+	return &chanJobIter{jobs: q.jobs, closed: make(chan struct{})}, nil
+}
+
+type chanJobIter struct {
+	jobs   chan *queue.Job
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (i *chanJobIter) Next() (*queue.Job, error) {
+	select {
+	case j := <-i.jobs:
+		return j, nil
+	case <-i.closed:
+		return nil, queue.ErrAlreadyClosed
+	}
+}
+
+func (i *chanJobIter) Close() error {
+	i.once.Do(func() { close(i.closed) })
+	return nil
+}
+
+// flakyQueue is a queue.Queue that fails to consume the first given number of
+// times, or always if it is negative, and sends the iterators it returns to
+// iters, if set.
+type flakyQueue struct {
+	queue.Queue
+	fails int
+	iters chan queue.JobIter
+}
+
+func (q *flakyQueue) Consume(advertisedWindow int) (queue.JobIter, error) {
+	if q.fails != 0 {
+		q.fails--
+		return nil, errors.New("connection refused")
+	}
+
+	iter, err := q.Queue.Consume(advertisedWindow)
+	if err == nil && q.iters != nil {
+		q.iters <- iter
+	}
+
+	return iter, err
+}
+
 func timeoutChan(done chan struct{}, d time.Duration) error {
 	ticker := time.NewTicker(d)
 	defer ticker.Stop()
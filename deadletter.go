@@ -0,0 +1,38 @@
+package borges
+
+import "gopkg.in/src-d/framework.v0/queue"
+
+// DeadLetterJob is the payload published to the dead letter queue when a job
+// failed permanently. It contains the failed job along with the error and the
+// number of attempts made to process it, so it can be inspected and replayed.
+type DeadLetterJob struct {
+	*Job
+	// Error is the message of the error that made the job fail.
+	Error string
+	// Attempts is the number of times the job processing was attempted.
+	Attempts int
+}
+
+// NewDeadLetterJob creates a DeadLetterJob for a job that failed with the
+// given error.
+func NewDeadLetterJob(j *Job, err error) *DeadLetterJob {
+	attempts := 1
+	if rerr, ok := err.(*RetryError); ok {
+		attempts = rerr.Attempts
+	}
+
+	return &DeadLetterJob{
+		Job:      j,
+		Error:    err.Error(),
+		Attempts: attempts,
+	}
+}
+
+func publishDeadLetter(q queue.Queue, j *Job, err error) error {
+	qj := queue.NewJob()
+	if err := qj.Encode(NewDeadLetterJob(j, err)); err != nil {
+		return err
+	}
+
+	return q.Publish(qj)
+}
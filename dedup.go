@@ -0,0 +1,80 @@
+package borges
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// repositoryIDCache is a fixed size LRU cache of repository IDs whose entries
+// expire after a given TTL. It is not thread-safe.
+type repositoryIDCache struct {
+	size    int
+	ttl     time.Duration
+	entries *list.List
+	byID    map[uuid.UUID]*list.Element
+}
+
+type repositoryIDCacheEntry struct {
+	id      uuid.UUID
+	addedAt time.Time
+}
+
+// newRepositoryIDCache creates a new cache holding up to size IDs. If ttl is
+// zero, entries only leave the cache when they are evicted.
+func newRepositoryIDCache(size int, ttl time.Duration) *repositoryIDCache {
+	return &repositoryIDCache{
+		size:    size,
+		ttl:     ttl,
+		entries: list.New(),
+		byID:    make(map[uuid.UUID]*list.Element),
+	}
+}
+
+// Contains returns true if the ID is in the cache and it is not expired.
+func (c *repositoryIDCache) Contains(id uuid.UUID) bool {
+	e, ok := c.byID[id]
+	if !ok {
+		return false
+	}
+
+	entry := e.Value.(*repositoryIDCacheEntry)
+	if c.ttl > 0 && time.Since(entry.addedAt) > c.ttl {
+		c.remove(e)
+		return false
+	}
+
+	c.entries.MoveToFront(e)
+	return true
+}
+
+// Add adds the ID to the cache, evicting the least recently used entry if the
+// cache is full.
+func (c *repositoryIDCache) Add(id uuid.UUID) {
+	if e, ok := c.byID[id]; ok {
+		e.Value.(*repositoryIDCacheEntry).addedAt = time.Now()
+		c.entries.MoveToFront(e)
+		return
+	}
+
+	c.byID[id] = c.entries.PushFront(&repositoryIDCacheEntry{
+		id:      id,
+		addedAt: time.Now(),
+	})
+
+	if c.entries.Len() > c.size {
+		c.remove(c.entries.Back())
+	}
+}
+
+// Len returns the number of entries in the cache, including expired ones
+// that were not evicted yet.
+func (c *repositoryIDCache) Len() int {
+	return c.entries.Len()
+}
+
+func (c *repositoryIDCache) remove(e *list.Element) {
+	c.entries.Remove(e)
+	delete(c.byID, e.Value.(*repositoryIDCacheEntry).id)
+}
@@ -0,0 +1,43 @@
+package borges
+
+import (
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepositoryIDCache(t *testing.T) {
+	require := require.New(t)
+	c := newRepositoryIDCache(2, 0)
+
+	a, b, d := uuid.NewV4(), uuid.NewV4(), uuid.NewV4()
+	require.False(c.Contains(a))
+
+	c.Add(a)
+	c.Add(b)
+	require.True(c.Contains(a))
+	require.True(c.Contains(b))
+
+	// b is now the least recently used
+	require.True(c.Contains(a))
+	c.Add(d)
+	require.Equal(2, c.Len())
+	require.True(c.Contains(a))
+	require.False(c.Contains(b))
+	require.True(c.Contains(d))
+}
+
+func TestRepositoryIDCache_TTL(t *testing.T) {
+	require := require.New(t)
+	c := newRepositoryIDCache(10, 50*time.Millisecond)
+
+	id := uuid.NewV4()
+	c.Add(id)
+	require.True(c.Contains(id))
+
+	time.Sleep(100 * time.Millisecond)
+	require.False(c.Contains(id))
+	require.Equal(0, c.Len())
+}
@@ -0,0 +1,250 @@
+package borges
+
+import (
+	"context"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-errors.v0"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+var (
+	ErrBlockedEndpoint = errors.NewKind("endpoint %s is blocked: %s")
+)
+
+// EndpointPolicy restricts the endpoints the repositories are cloned from, so
+// a crafted mention cannot make the consumers connect to internal services.
+// The zero value allows every endpoint.
+type EndpointPolicy struct {
+	// AllowSchemes, if not empty, are the only schemes of the endpoints
+	// allowed, such as https or ssh. The scp-like endpoints have the ssh
+	// scheme and the local paths the file one.
+	AllowSchemes []string
+	// AllowHosts, if not empty, are patterns, as in path.Match, of the
+	// only hosts allowed, such as github.com or *.example.com.
+	AllowHosts []string
+	// DenyHosts are patterns of hosts that are not allowed, even if they
+	// match AllowHosts.
+	DenyHosts []string
+	// DenyPrivateIPs blocks the endpoints whose host is, or resolves to, a
+	// loopback, private, link-local or unspecified address, as well as
+	// the local paths and file endpoints.
+	DenyPrivateIPs bool
+}
+
+// privateNetworks are the networks, besides the loopback, link-local and
+// unspecified addresses, not reachable from the internet.
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"fc00::/7",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets
+}
+
+// isPrivateIP returns whether the address is not reachable from the
+// internet.
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check returns an ErrBlockedEndpoint if the endpoint is not allowed by the
+// policy. The host is resolved if the private addresses are denied, and the
+// endpoint is blocked if any of its addresses is private. A nil policy allows
+// every endpoint.
+func (p *EndpointPolicy) Check(ctx context.Context, endpoint string) error {
+	if p == nil {
+		return nil
+	}
+
+	ep, err := transport.NewEndpoint(endpoint)
+	if err != nil {
+		return ErrBlockedEndpoint.New(endpoint, err)
+	}
+
+	scheme := strings.ToLower(ep.Protocol())
+	if len(p.AllowSchemes) > 0 && !containsFold(p.AllowSchemes, scheme) {
+		return ErrBlockedEndpoint.New(endpoint, "scheme "+scheme+" not allowed")
+	}
+
+	host := strings.ToLower(ep.Host())
+	if len(p.AllowHosts) > 0 && !matchAnyHost(p.AllowHosts, host) {
+		return ErrBlockedEndpoint.New(endpoint, "host not allowed")
+	}
+
+	if matchAnyHost(p.DenyHosts, host) {
+		return ErrBlockedEndpoint.New(endpoint, "host denied")
+	}
+
+	if !p.DenyPrivateIPs {
+		return nil
+	}
+
+	if scheme == "file" || host == "" {
+		return ErrBlockedEndpoint.New(endpoint, "local repositories not allowed")
+	}
+
+	ips, err := lookupIP(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	return checkPublicIPs(endpoint, ips)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchAnyHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookupIP returns the addresses of the host, which can be an address itself.
+func lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+
+	return ips, nil
+}
+
+// checkPublicIPs returns an ErrBlockedEndpoint if any of the addresses of the
+// endpoint is private.
+func checkPublicIPs(endpoint string, ips []net.IP) error {
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return ErrBlockedEndpoint.New(endpoint, "private address "+ip.String())
+		}
+	}
+
+	return nil
+}
+
+// publicDialer is the dialer of the clones of http and https endpoints when
+// the private addresses are denied. It resolves the host itself and connects
+// to the addresses it checked, so a host resolving to a public address when
+// the endpoint is checked and to a private one when it is dialed cannot be
+// used to reach the private one.
+var publicDialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+func dialPublic(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := lookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkPublicIPs(addr, ips); err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = publicDialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+var (
+	endpointPolicy   *EndpointPolicy
+	endpointPolicyMu sync.RWMutex
+)
+
+// InstallEndpointPolicy makes every TemporaryCloner check the endpoints with
+// the given policy before cloning them, failing with ErrBlockedEndpoint
+// without connecting to the blocked ones. If the policy denies the private
+// addresses, the clones of http and https endpoints also check the address
+// they connect to, so the host cannot be made to resolve to a private address
+// after the check. The git and ssh transports resolve the host themselves,
+// so only the check before cloning applies to them. A nil policy allows
+// every endpoint, which is the default.
+//
+// Like InstallCloneProxy, it applies to the whole process. The proxy given to
+// InstallCloneProxy, if any, is always allowed, but the ones set in the
+// environment must have a public address.
+func InstallEndpointPolicy(p *EndpointPolicy) {
+	endpointPolicyMu.Lock()
+	endpointPolicy = p
+	endpointPolicyMu.Unlock()
+
+	installCloneTransports()
+}
+
+// checkEndpointPolicy checks the endpoint with the policy installed with
+// InstallEndpointPolicy.
+func checkEndpointPolicy(ctx context.Context, endpoint string) error {
+	endpointPolicyMu.RLock()
+	p := endpointPolicy
+	endpointPolicyMu.RUnlock()
+	return p.Check(ctx, endpoint)
+}
+
+// denyPrivateIPs returns whether the policy installed denies the private
+// addresses.
+func denyPrivateIPs() bool {
+	endpointPolicyMu.RLock()
+	defer endpointPolicyMu.RUnlock()
+	return endpointPolicy != nil && endpointPolicy.DenyPrivateIPs
+}
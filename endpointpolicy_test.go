@@ -0,0 +1,96 @@
+package borges
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+)
+
+func TestEndpointPolicy_Check(t *testing.T) {
+	require := require.New(t)
+
+	p := &EndpointPolicy{
+		AllowSchemes:   []string{"https", "SSH"},
+		AllowHosts:     []string{"github.com", "*.example.com", "93.184.216.34", "127.0.0.1"},
+		DenyHosts:      []string{"internal.example.com"},
+		DenyPrivateIPs: true,
+	}
+
+	ctx := context.Background()
+	for _, e := range []string{
+		"https://93.184.216.34/foo/bar",
+		"ssh://git@93.184.216.34/foo/bar",
+		"git@93.184.216.34:foo/bar",
+	} {
+		require.NoError(p.Check(ctx, e), e)
+	}
+
+	for _, e := range []string{
+		"git://93.184.216.34/foo/bar",
+		"http://93.184.216.34/foo/bar",
+		"https://gitlab.com/foo/bar",
+		"https://internal.example.com/foo/bar",
+		"https://127.0.0.1/foo/bar",
+		"/var/lib/repos/foo",
+		"file:///var/lib/repos/foo",
+	} {
+		err := p.Check(ctx, e)
+		require.True(ErrBlockedEndpoint.Is(err), "%s: %v", e, err)
+	}
+
+	var nilPolicy *EndpointPolicy
+	require.NoError(nilPolicy.Check(ctx, "file:///foo"))
+	require.NoError((&EndpointPolicy{}).Check(ctx, "http://127.0.0.1/foo"))
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	require := require.New(t)
+
+	for _, ip := range []string{
+		"127.0.0.1", "10.1.2.3", "172.16.0.1", "172.31.255.255", "192.168.1.1",
+		"169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "::", "fe80::1",
+		"fd00::1", "::ffff:10.0.0.1",
+	} {
+		require.True(isPrivateIP(net.ParseIP(ip)), ip)
+	}
+
+	for _, ip := range []string{"8.8.8.8", "172.32.0.1", "93.184.216.34", "2606:4700::1"} {
+		require.False(isPrivateIP(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestInstallEndpointPolicy(t *testing.T) {
+	require := require.New(t)
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	InstallEndpointPolicy(&EndpointPolicy{DenyPrivateIPs: true})
+	defer InstallEndpointPolicy(nil)
+
+	tc := NewTemporaryCloner(memfs.New(), CloneOptions{})
+	_, err := tc.Clone(context.Background(), "foo", srv.URL+"/foo/bar")
+	require.True(ErrBlockedEndpoint.Is(err), "%v", err)
+	require.Zero(atomic.LoadInt32(&requests))
+
+	// a host resolving to a private address once the endpoint was checked
+	_, err = dialPublic(context.Background(), "tcp", strings.TrimPrefix(srv.URL, "http://"))
+	require.True(ErrBlockedEndpoint.Is(err), "%v", err)
+
+	InstallEndpointPolicy(nil)
+	_, err = tc.Clone(context.Background(), "foo", srv.URL+"/foo/bar")
+	require.Error(err)
+	require.False(ErrBlockedEndpoint.Is(err))
+	require.Equal(int32(1), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,318 @@
+package borges
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-errors.v0"
+)
+
+var (
+	ErrFanOutMismatch = errors.NewKind("file %s differs between the storage backends: %s")
+)
+
+// NewFanOutFilesystem returns a billy.Filesystem that writes the files to all
+// the given filesystems, at least one, and reads them from the first one, the
+// primary. It is used to store the rooted repositories in several backends
+// at once, such as to migrate them or for redundancy.
+//
+// Every write must succeed in all the backends: the files are created in all
+// of them, or none, and a write to a file fails if it fails in any of them.
+// Renames, which is how the siva files are committed, are done in the other
+// backends first and in the primary last, and they are undone in all of them
+// if any fails, so a commit that fails leaves every backend as it was. The
+// file replaced in the other backends is moved aside until every rename
+// succeeds, so it is missing there meanwhile, but never in the primary.
+//
+// The backends are not updated at the same instant: a process that dies while
+// renaming leaves the new version in some backends and the previous one in
+// the rest, the primary being the last one updated. Since the transactions
+// start from the version in the primary, the lagging backends are brought up
+// to date by the next commit of the rooted repository. A backend that is not
+// available makes every commit fail, instead of letting it lag behind.
+func NewFanOutFilesystem(fss ...billy.Filesystem) billy.Filesystem {
+	if len(fss) == 1 {
+		return fss[0]
+	}
+
+	return &fanOutFilesystem{Filesystem: fss[0], mirrors: fss[1:]}
+}
+
+type fanOutFilesystem struct {
+	billy.Filesystem
+	// mirrors are the backends written along with the primary one, which
+	// is the embedded one.
+	mirrors []billy.Filesystem
+}
+
+func (fs *fanOutFilesystem) Create(filename string) (billy.File, error) {
+	return fs.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *fanOutFilesystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return fs.Filesystem.OpenFile(filename, flag, perm)
+	}
+
+	f := &fanOutFile{}
+	var created []billy.Filesystem
+	for _, b := range fs.backends() {
+		_, statErr := b.Stat(filename)
+		bf, err := b.OpenFile(filename, flag, perm)
+		if err != nil {
+			f.abort(created, filename)
+			return nil, err
+		}
+
+		f.files = append(f.files, bf)
+		if os.IsNotExist(statErr) {
+			created = append(created, b)
+		}
+	}
+
+	if flag&os.O_APPEND != 0 {
+		if err := fs.checkSizes(filename); err != nil {
+			f.abort(created, filename)
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// checkSizes checks that the file has the same size in every backend, so the
+// bytes appended to it end up at the same offset.
+func (fs *fanOutFilesystem) checkSizes(filename string) error {
+	fi, err := fs.Filesystem.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range fs.mirrors {
+		mfi, err := b.Stat(filename)
+		if err != nil {
+			return err
+		}
+
+		if mfi.Size() != fi.Size() {
+			return ErrFanOutMismatch.New(filename,
+				fmt.Sprintf("%d bytes in the primary, %d in a mirror", fi.Size(), mfi.Size()))
+		}
+	}
+
+	return nil
+}
+
+// TempFile is not supported, since the temporary files could not have the
+// same name in every backend.
+func (fs *fanOutFilesystem) TempFile(dir, prefix string) (billy.File, error) {
+	return nil, billy.ErrNotSupported
+}
+
+// Rename renames the file in the mirrors and then in the primary. If any of
+// the renames fails, the ones done are undone.
+func (fs *fanOutFilesystem) Rename(from, to string) error {
+	var renamed []*fanOutRename
+	for _, b := range fs.backends() {
+		r, err := renameAside(b, from, to, b != fs.Filesystem)
+		if err != nil {
+			for i := len(renamed) - 1; i >= 0; i-- {
+				renamed[i].undo()
+			}
+
+			return err
+		}
+
+		renamed = append(renamed, r)
+	}
+
+	for _, r := range renamed {
+		r.done()
+	}
+
+	return nil
+}
+
+func (fs *fanOutFilesystem) Remove(filename string) error {
+	for _, b := range fs.mirrors {
+		if err := b.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return fs.Filesystem.Remove(filename)
+}
+
+func (fs *fanOutFilesystem) MkdirAll(filename string, perm os.FileMode) error {
+	for _, b := range fs.backends() {
+		if err := b.MkdirAll(filename, perm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *fanOutFilesystem) Symlink(target, link string) error {
+	for _, b := range fs.backends() {
+		if err := b.Symlink(target, link); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *fanOutFilesystem) Chroot(path string) (billy.Filesystem, error) {
+	var chroots []billy.Filesystem
+	for _, b := range fs.backends() {
+		c, err := b.Chroot(path)
+		if err != nil {
+			return nil, err
+		}
+
+		chroots = append(chroots, c)
+	}
+
+	return NewFanOutFilesystem(chroots...), nil
+}
+
+// backends returns the mirrors followed by the primary.
+func (fs *fanOutFilesystem) backends() []billy.Filesystem {
+	return append(append([]billy.Filesystem(nil), fs.mirrors...), fs.Filesystem)
+}
+
+// fanOutRename is a rename done in a backend, which can be undone until it is
+// done.
+type fanOutRename struct {
+	fs       billy.Filesystem
+	from, to string
+	// aside is the path the replaced file was moved to, if any.
+	aside string
+}
+
+// renameAside renames the file in the backend. If keepReplaced is true, the
+// file replaced, if any, is moved aside first, so the rename can be undone.
+func renameAside(fs billy.Filesystem, from, to string, keepReplaced bool) (*fanOutRename, error) {
+	r := &fanOutRename{fs: fs, from: from, to: to}
+	if _, err := fs.Stat(to); err == nil && keepReplaced {
+		r.aside = fmt.Sprintf("%s.%d.replaced", to, time.Now().UnixNano())
+		if err := fs.Rename(to, r.aside); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := fs.Rename(from, to); err != nil {
+		r.restore()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// undo renames the file back and restores the one it replaced, if any.
+func (r *fanOutRename) undo() {
+	if err := r.fs.Rename(r.to, r.from); err != nil {
+		log.Error("error undoing rename in storage backend",
+			"from", r.from, "to", r.to, "error", err)
+		return
+	}
+
+	r.restore()
+}
+
+func (r *fanOutRename) restore() {
+	if r.aside == "" {
+		return
+	}
+
+	if err := r.fs.Rename(r.aside, r.to); err != nil {
+		log.Error("error restoring file replaced in storage backend",
+			"file", r.to, "error", err)
+	}
+}
+
+// done removes the file replaced, if any.
+func (r *fanOutRename) done() {
+	if r.aside == "" {
+		return
+	}
+
+	if err := r.fs.Remove(r.aside); err != nil && !os.IsNotExist(err) {
+		log.Warn("error removing file replaced in storage backend",
+			"file", r.aside, "error", err)
+	}
+}
+
+// fanOutFile is a file written to every backend of a fanOutFilesystem and
+// read from the primary one, which is the last.
+type fanOutFile struct {
+	files []billy.File
+}
+
+func (f *fanOutFile) Name() string {
+	return f.primary().Name()
+}
+
+func (f *fanOutFile) primary() billy.File {
+	return f.files[len(f.files)-1]
+}
+
+func (f *fanOutFile) Write(p []byte) (int, error) {
+	for _, bf := range f.files {
+		n, err := bf.Write(p)
+		if err != nil {
+			return 0, err
+		}
+
+		if n != len(p) {
+			return 0, fmt.Errorf("short write to %s: %d bytes of %d", bf.Name(), n, len(p))
+		}
+	}
+
+	return len(p), nil
+}
+
+func (f *fanOutFile) Read(p []byte) (int, error) {
+	return f.primary().Read(p)
+}
+
+func (f *fanOutFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.primary().ReadAt(p, off)
+}
+
+// Seek seeks in every backend, so the next writes go to the same offset in
+// all of them.
+func (f *fanOutFile) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	for _, bf := range f.files {
+		var err error
+		if pos, err = bf.Seek(offset, whence); err != nil {
+			return 0, err
+		}
+	}
+
+	return pos, nil
+}
+
+func (f *fanOutFile) Close() error {
+	var firstErr error
+	for _, bf := range f.files {
+		if err := bf.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// abort closes the files opened and removes the file from the backends where
+// it was created by OpenFile.
+func (f *fanOutFile) abort(created []billy.Filesystem, filename string) {
+	_ = f.Close()
+	for _, b := range created {
+		_ = b.Remove(filename)
+	}
+}
@@ -0,0 +1,152 @@
+package borges
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+	"gopkg.in/src-d/go-billy.v3/osfs"
+	"gopkg.in/src-d/go-billy.v3/util"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestFanOutFilesystem(t *testing.T) {
+	require := require.New(t)
+
+	primary, mirror, clean := newFanOutBackends(t)
+	defer clean()
+	fs := NewFanOutFilesystem(primary, mirror)
+
+	require.NoError(util.WriteFile(fs, "foo.siva.upload", []byte("foo"), 0644))
+	require.NoError(fs.Rename("foo.siva.upload", "foo.siva"))
+	require.NoError(util.WriteFile(fs, "foo.siva.upload", []byte("bar"), 0644))
+	require.NoError(fs.Rename("foo.siva.upload", "foo.siva"))
+	for _, b := range []billy.Filesystem{primary, mirror} {
+		requireFileContent(t, b, "foo.siva", "bar")
+		requireFiles(t, b, "foo.siva")
+	}
+
+	dir, err := fs.Chroot("bar")
+	require.NoError(err)
+	require.NoError(util.WriteFile(dir, "bar.siva", []byte("bar"), 0644))
+	requireFileContent(t, primary, "bar/bar.siva", "bar")
+	requireFileContent(t, mirror, "bar/bar.siva", "bar")
+
+	require.NoError(fs.Remove("foo.siva"))
+	for _, b := range []billy.Filesystem{primary, mirror} {
+		_, err := b.Stat("foo.siva")
+		require.True(os.IsNotExist(err))
+	}
+
+	require.Equal(primary, NewFanOutFilesystem(primary))
+}
+
+func TestFanOutFilesystem_RenameFails(t *testing.T) {
+	require := require.New(t)
+
+	primary, mirror, clean := newFanOutBackends(t)
+	defer clean()
+	fs := NewFanOutFilesystem(&failingFilesystem{Filesystem: primary, rename: true}, mirror)
+	for _, b := range []billy.Filesystem{primary, mirror} {
+		require.NoError(util.WriteFile(b, "foo.siva", []byte("foo"), 0644))
+	}
+
+	require.NoError(util.WriteFile(fs, "foo.siva.upload", []byte("bar"), 0644))
+	require.Error(fs.Rename("foo.siva.upload", "foo.siva"))
+
+	// the mirror keeps the previous version too
+	for _, b := range []billy.Filesystem{primary, mirror} {
+		requireFileContent(t, b, "foo.siva", "foo")
+		requireFileContent(t, b, "foo.siva.upload", "bar")
+		requireFiles(t, b, "foo.siva", "foo.siva.upload")
+	}
+}
+
+func TestFanOutFilesystem_OpenFails(t *testing.T) {
+	require := require.New(t)
+
+	primary, mirror := memfs.New(), memfs.New()
+	fs := NewFanOutFilesystem(&failingFilesystem{Filesystem: primary, open: true}, mirror)
+	_, err := fs.Create("foo.siva")
+	require.Error(err)
+	requireFiles(t, primary)
+	requireFiles(t, mirror)
+}
+
+func TestFanOutFilesystem_AppendMismatch(t *testing.T) {
+	require := require.New(t)
+
+	primary, mirror := memfs.New(), memfs.New()
+	require.NoError(util.WriteFile(primary, "foo.siva.upload", []byte("foo"), 0644))
+	require.NoError(util.WriteFile(mirror, "foo.siva.upload", []byte("f"), 0644))
+
+	fs := NewFanOutFilesystem(primary, mirror)
+	_, err := fs.OpenFile("foo.siva.upload", os.O_WRONLY|os.O_APPEND, 0644)
+	require.True(ErrFanOutMismatch.Is(err), "%v", err)
+}
+
+func TestSivaRootedTransactioner_FanOut(t *testing.T) {
+	require := require.New(t)
+
+	primary, mirror, local := memfs.New(), memfs.New(), memfs.New()
+	rtx := NewSivaRootedTransactioner(NewFanOutFilesystem(primary, mirror),
+		local, SivaOptions{})
+	h := plumbing.NewHash("e41f091c11a338f62796a738c83d879936a508ec")
+
+	tx, err := rtx.Begin(h)
+	require.NoError(err)
+	commitToTx(t, tx.Storer())
+	require.NoError(tx.Commit())
+
+	requireFiles(t, primary, h.String()+".siva")
+	requireFiles(t, mirror, h.String()+".siva")
+	f, err := primary.Open(h.String() + ".siva")
+	require.NoError(err)
+	content, err := ioutil.ReadAll(f)
+	require.NoError(err)
+	require.NoError(f.Close())
+	requireFileContent(t, mirror, h.String()+".siva", string(content))
+}
+
+// newFanOutBackends returns two filesystems in a temporary directory, removed
+// by the returned function. The renames of memfs also move the files whose
+// name starts with the one renamed, such as foo.siva.upload when renaming
+// foo.siva, so the backends are in the local filesystem.
+func newFanOutBackends(t *testing.T) (primary, mirror billy.Filesystem, clean func()) {
+	tmp, err := ioutil.TempDir("", "borges-fanout")
+	require.NoError(t, err)
+
+	fs := osfs.New(tmp)
+	primary, err = fs.Chroot("primary")
+	require.NoError(t, err)
+	mirror, err = fs.Chroot("mirror")
+	require.NoError(t, err)
+
+	return primary, mirror, func() { require.NoError(t, os.RemoveAll(tmp)) }
+}
+
+// failingFilesystem is a filesystem whose renames or writable opens fail.
+type failingFilesystem struct {
+	billy.Filesystem
+	rename, open bool
+}
+
+func (fs *failingFilesystem) Rename(from, to string) error {
+	if fs.rename {
+		return errors.New("rename failed")
+	}
+
+	return fs.Filesystem.Rename(from, to)
+}
+
+func (fs *failingFilesystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if fs.open && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, errors.New("open failed")
+	}
+
+	return fs.Filesystem.OpenFile(filename, flag, perm)
+}
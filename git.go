@@ -1,6 +1,7 @@
 package borges
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"math/rand"
@@ -8,6 +9,7 @@ import (
 	"strconv"
 	"time"
 
+	"golang.org/x/time/rate"
 	"gopkg.in/src-d/core-retrieval.v0/model"
 	"gopkg.in/src-d/go-billy.v3"
 	"gopkg.in/src-d/go-billy.v3/util"
@@ -15,9 +17,11 @@ import (
 	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	"gopkg.in/src-d/go-git.v4/storage"
 	"gopkg.in/src-d/go-git.v4/storage/filesystem"
 	"gopkg.in/src-d/go-git.v4/storage/memory"
 )
@@ -32,8 +36,38 @@ type TemporaryRepository interface {
 	Push(url string, refspecs []config.RefSpec) error
 }
 
+// BlobFilteringRepository is a TemporaryRepository that leaves some blobs out
+// of the packfiles it pushes, see CloneOptions.MaxBlobSize.
+type BlobFilteringRepository interface {
+	TemporaryRepository
+	// FilteredBlobs returns the sorted hashes of the blobs left out of the
+	// pushes made so far.
+	FilteredBlobs() []plumbing.Hash
+}
+
+// RefCountingRepository is a TemporaryRepository that knows how many
+// references its remote had when it was cloned, see CloneOptions.MaxRefs.
+type RefCountingRepository interface {
+	TemporaryRepository
+	// RemoteReferences returns the number of references of the remote
+	// that were to be fetched, or zero if they were not listed.
+	RemoteReferences() int
+}
+
 type TemporaryCloner interface {
-	Clone(id, url string) (TemporaryRepository, error)
+	// Clone fetches the repository at the given url into a temporary
+	// repository. The fetch is aborted when the context is done.
+	Clone(ctx context.Context, id, url string) (TemporaryRepository, error)
+}
+
+// BlobFilteringCloner is a TemporaryCloner whose clones may be
+// BlobFilteringRepositories, so the rooted repositories they are pushed to
+// can miss some blobs.
+type BlobFilteringCloner interface {
+	TemporaryCloner
+	// FiltersBlobs returns whether the clones leave blobs out of their
+	// pushes.
+	FiltersBlobs() bool
 }
 
 // NewGitReferencer takes a *git.Repository and returns a Referencer that
@@ -54,6 +88,11 @@ func (r gitReferencer) References() ([]*model.Reference, error) {
 		return nil, err
 	}
 
+	shallows, err := r.Repository.Storer.Shallow()
+	if err != nil {
+		return nil, err
+	}
+
 	var refs []*model.Reference
 	return refs, iter.ForEach(func(ref *plumbing.Reference) error {
 		//TODO: add tags support
@@ -70,7 +109,7 @@ func (r gitReferencer) References() ([]*model.Reference, error) {
 			return err
 		}
 
-		roots, err := rootCommits(r.Repository, c.Hash)
+		roots, err := rootCommits(r.Repository, c.Hash, shallows)
 		if err != nil {
 			return err
 		}
@@ -86,7 +125,51 @@ func (r gitReferencer) References() ([]*model.Reference, error) {
 	})
 }
 
-func rootCommits(r *git.Repository, from plumbing.Hash) ([]model.SHA1, error) {
+// rootCommits returns all the root commits reachable from the given commit,
+// in the order they are found following the first parent first. Shallow
+// commits are considered root commits, since their parents are not available.
+func rootCommits(r *git.Repository, from plumbing.Hash, shallows []plumbing.Hash) ([]model.SHA1, error) {
+	if len(shallows) == 0 {
+		return fullRootCommits(r, from)
+	}
+
+	isShallow := make(map[plumbing.Hash]bool, len(shallows))
+	for _, h := range shallows {
+		isShallow[h] = true
+	}
+
+	var roots []model.SHA1
+	seen := make(map[plumbing.Hash]bool)
+	pending := []plumbing.Hash{from}
+	for len(pending) > 0 {
+		h := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if seen[h] {
+			continue
+		}
+
+		seen[h] = true
+		c, err := r.CommitObject(h)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.NumParents() == 0 || isShallow[h] {
+			roots = append(roots, model.SHA1(h))
+			continue
+		}
+
+		// parents are pushed in reverse order so the first parent is
+		// visited first
+		for i := len(c.ParentHashes) - 1; i >= 0; i-- {
+			pending = append(pending, c.ParentHashes[i])
+		}
+	}
+
+	return roots, nil
+}
+
+func fullRootCommits(r *git.Repository, from plumbing.Hash) ([]model.SHA1, error) {
 	var roots []model.SHA1
 
 	cIter, err := r.Log(&git.LogOptions{From: from})
@@ -126,12 +209,148 @@ func ResolveCommit(r *git.Repository, h plumbing.Hash) (*object.Commit, error) {
 	}
 }
 
-func NewTemporaryCloner(tmpFs billy.Filesystem) TemporaryCloner {
-	return &temporaryRepositoryBuilder{tmpFs}
+// CloneOptions holds optional settings of a TemporaryCloner. The zero value
+// is valid and performs full clones.
+type CloneOptions struct {
+	// Depth limits the clone to the given number of commits from the tip of
+	// each reference. Zero means no limit. The commits at the depth limit
+	// are considered root commits, so references of shallow clones end up
+	// in the rooted repositories of those commits. Note that a shallow
+	// clone cannot be deepened later in the same run.
+	Depth int
+	// Auth provides the credentials used to clone each endpoint. If nil,
+	// all endpoints are cloned anonymously.
+	Auth AuthProvider
+	// Timeout bounds the time spent fetching a repository. When it expires
+	// the clone fails with ErrCloneTimeout. It only applies to clones whose
+	// context has no deadline, such as the ones of jobs without their own
+	// timeout. Zero means no timeout.
+	Timeout time.Duration
+	// Bandwidth is the maximum number of bytes per second downloaded by
+	// all the clones made by the TemporaryCloner together, so it can be
+	// shared by several workers to limit their aggregate bandwidth. Zero
+	// means no limit.
+	Bandwidth int
+	// MaxSize is the maximum size in bytes of the packfile fetched for a
+	// repository. Clones exceeding it are aborted as soon as the limit is
+	// reached and fail with ErrRepoTooLarge. Zero means no limit.
+	MaxSize int64
+	// RefInclude, if not empty, limits the references fetched to the ones
+	// matching any of these patterns, see ValidateRefPatterns. The objects
+	// only reachable from other references are never downloaded.
+	RefInclude []string
+	// RefExclude are patterns of references that are not fetched, even if
+	// they match RefInclude. References archived before that are filtered
+	// out are removed from the rooted repositories on the next fetch.
+	RefExclude []string
+	// SingleBranch limits the clone to the branch the HEAD of the remote
+	// points to, which keeps its name, so it is archived with the same
+	// reference name as in a full clone. Tags are not fetched. It can be
+	// combined with Depth to get the smallest possible clone.
+	SingleBranch bool
+	// MaxRefs is the maximum number of references a repository can have
+	// to be cloned, counting only the ones allowed by RefInclude,
+	// RefExclude and SingleBranch, so the repositories with too many
+	// references, such as the ones of bots creating one per build, can
+	// still be archived partially by filtering them. The references of
+	// the remote are listed before fetching anything and, if there are
+	// more, the clone fails with a TooManyRefsError right away. Either
+	// way, their number is recorded in the ArchiveStats of the repository.
+	// Zero means no limit.
+	MaxRefs int
+	// Checkout makes the clones check out the branch HEAD points to in a
+	// working tree, with the git directory in its .git directory. The
+	// archiver only needs the objects, so by default the clones are bare
+	// and no file of the repository is written to the temporary
+	// filesystem.
+	Checkout bool
+	// MaxBlobSize is the maximum size in bytes of the blobs pushed from
+	// the clones. Bigger blobs are left out of the rooted repositories,
+	// whose trees still reference them, as in a partial clone, and their
+	// hashes are recorded in the ArchiveStats of the repository, see
+	// BlobFilteringRepository. The rooted repositories are fine to read
+	// the history and the rest of the files from, and their missing blobs
+	// are allowed when they are validated before fetching incrementally,
+	// see BlobFilteringCloner. Zero means no limit.
+	MaxBlobSize int64
+}
+
+// NewTemporaryCloner creates a TemporaryCloner that clones repositories into
+// the given filesystem using the given options.
+func NewTemporaryCloner(tmpFs billy.Filesystem, opts CloneOptions) TemporaryCloner {
+	return &temporaryRepositoryBuilder{
+		TempFilesystem: tmpFs,
+		Options:        opts,
+		limiter:        newBandwidthLimiter(opts.Bandwidth),
+	}
 }
 
 type temporaryRepositoryBuilder struct {
 	TempFilesystem billy.Filesystem
+	Options        CloneOptions
+
+	limiter *rate.Limiter
+}
+
+// fetch runs the given fetch until it finishes or the context is done.
+// Fetches cannot be cancelled, so in that case the fetch is left running in
+// the background and the directory is removed when it finishes.
+func (b *temporaryRepositoryBuilder) fetch(
+	ctx context.Context,
+	remote *git.Remote,
+	s storer.ReferenceStorer,
+	o *git.FetchOptions,
+	endpoint, dir string,
+) (int, error) {
+	type result struct {
+		refs int
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		refs, err := b.fetchRefs(remote, s, o, endpoint)
+		done <- result{refs, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.refs, r.err
+	case <-ctx.Done():
+		go func() {
+			<-done
+			_ = util.RemoveAll(b.TempFilesystem, dir)
+		}()
+
+		if ctx.Err() == context.DeadlineExceeded {
+			return 0, ErrCloneTimeout.New(endpoint)
+		}
+
+		return 0, ctx.Err()
+	}
+}
+
+// fetchRefs fetches the references allowed by the RefInclude, RefExclude and
+// SingleBranch options. If there are none, it returns
+// transport.ErrEmptyRemoteRepository. It returns the number of references of
+// the remote to fetch, zero if they were not listed, see fetchRefSpecs.
+func (b *temporaryRepositoryBuilder) fetchRefs(remote *git.Remote, s storer.ReferenceStorer,
+	o *git.FetchOptions, endpoint string) (int, error) {
+	specs, allowed, refs, err := b.fetchRefSpecs(endpoint, o.Auth)
+	if err != nil {
+		return refs, err
+	}
+
+	if len(specs) == 0 {
+		return refs, transport.ErrEmptyRemoteRepository
+	}
+
+	o.RefSpecs = specs
+	if err := remote.Fetch(o); err != nil {
+		return refs, err
+	}
+
+	return refs, removeFilteredRefs(s, allowed)
 }
 
 type temporaryRepository struct {
@@ -139,9 +358,39 @@ type temporaryRepository struct {
 	Repository     *git.Repository
 	TempFilesystem billy.Filesystem
 	TempPath       string
+	// Endpoint is the URL the repository was cloned from.
+	Endpoint string
+
+	filter *blobFilter
+	// remoteRefs is the number of references of the remote to fetch, zero
+	// if they were not listed.
+	remoteRefs int
 }
 
-func (b *temporaryRepositoryBuilder) Clone(id, endpoint string) (TemporaryRepository, error) {
+// FiltersBlobs implements the BlobFilteringCloner interface.
+func (b *temporaryRepositoryBuilder) FiltersBlobs() bool {
+	return b.Options.MaxBlobSize > 0
+}
+
+func (b *temporaryRepositoryBuilder) Clone(ctx context.Context, id, endpoint string) (TemporaryRepository, error) {
+	return b.clone(ctx, id, endpoint, nil, nil)
+}
+
+// clone fetches the endpoint into a new temporary repository. If base is
+// given, the objects missing from the repository are read from it and the
+// haves are sent to the remote, see CloneIncremental.
+func (b *temporaryRepositoryBuilder) clone(ctx context.Context, id, endpoint string,
+	base []storer.EncodedObjectStorer, haves []plumbing.Hash) (TemporaryRepository, error) {
+	if err := checkEndpointPolicy(ctx, endpoint); err != nil {
+		return nil, err
+	}
+
+	if _, ok := ctx.Deadline(); !ok && b.Options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.Options.Timeout)
+		defer cancel()
+	}
+
 	dir := filepath.Join("local_repos", id,
 		strconv.FormatInt(time.Now().UnixNano(), 10))
 
@@ -150,12 +399,37 @@ func (b *temporaryRepositoryBuilder) Clone(id, endpoint string) (TemporaryReposi
 		return nil, err
 	}
 
-	s, err := filesystem.NewStorage(tmpFs)
+	gitFs, worktree, err := b.cloneFilesystems(tmpFs)
 	if err != nil {
 		return nil, err
 	}
 
-	r, err := git.Init(s, nil)
+	defer func() {
+		if r := recover(); r != nil {
+			_ = util.RemoveAll(b.TempFilesystem, dir)
+			panic(r)
+		}
+	}()
+
+	fsStorage, err := filesystem.NewStorage(gitFs)
+	if err != nil {
+		return nil, err
+	}
+
+	var s storage.Storer = fsStorage
+	if b.limiter != nil {
+		s = &throttledStorage{Storage: fsStorage, ctx: ctx, limiter: b.limiter}
+	}
+
+	if b.Options.MaxSize > 0 {
+		s = &sizeLimitedStorage{Storer: s, endpoint: endpoint, maxSize: b.Options.MaxSize}
+	}
+
+	if len(base) > 0 {
+		s = &layeredStorage{Storer: s, base: base}
+	}
+
+	r, err := git.Init(s, worktree)
 	if err != nil {
 		_ = util.RemoveAll(b.TempFilesystem, dir)
 		return nil, err
@@ -171,11 +445,44 @@ func (b *temporaryRepositoryBuilder) Clone(id, endpoint string) (TemporaryReposi
 	}
 
 	o := &git.FetchOptions{
-		RefSpecs: []config.RefSpec{FetchRefSpec},
+		Depth: b.Options.Depth,
+	}
+
+	if b.Options.Auth != nil {
+		o.Auth, err = b.Options.Auth.Auth(endpoint)
+		if err != nil {
+			_ = util.RemoveAll(b.TempFilesystem, dir)
+			return nil, err
+		}
 	}
-	err = remote.Fetch(o)
+
+	if err := setHaves(s, haves); err != nil {
+		_ = util.RemoveAll(b.TempFilesystem, dir)
+		return nil, err
+	}
+
+	remoteRefs, err := b.fetch(ctx, remote, s, o, endpoint, dir)
+	if rlErr := newRateLimitError(endpoint, err); rlErr != nil {
+		err = rlErr
+	}
+
+	if isRepositoryGone(err) {
+		err = ErrRepositoryGone.Wrap(err, endpoint)
+	}
+
+	if ErrCloneTimeout.Is(err) || err == context.Canceled {
+		// the directory is removed once the fetch finishes
+		return nil, err
+	}
+
+	if rErr := removeHaves(s, haves); rErr != nil && err == nil {
+		err = rErr
+	}
+
 	if err == git.NoErrAlreadyUpToDate || err == transport.ErrEmptyRemoteRepository {
 		r, err = git.Init(memory.NewStorage(), nil)
+	} else if err == nil && worktree != nil {
+		err = checkoutHead(r)
 	}
 
 	if err != nil {
@@ -188,10 +495,65 @@ func (b *temporaryRepositoryBuilder) Clone(id, endpoint string) (TemporaryReposi
 		Repository:     r,
 		TempFilesystem: b.TempFilesystem,
 		TempPath:       dir,
+		Endpoint:       endpoint,
+		filter:         newBlobFilter(b.Options.MaxBlobSize),
+		remoteRefs:     remoteRefs,
 	}, nil
 }
 
+// cloneFilesystems returns the filesystems of the git directory and the
+// working tree of a clone into fs. The working tree is nil for bare clones,
+// which are the ones made unless the Checkout option is set.
+func (b *temporaryRepositoryBuilder) cloneFilesystems(fs billy.Filesystem) (billy.Filesystem, billy.Filesystem, error) {
+	if !b.Options.Checkout {
+		return fs, nil, nil
+	}
+
+	gitFs, err := fs.Chroot(".git")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return gitFs, fs, nil
+}
+
+// checkoutHead checks out the branch HEAD points to in the working tree of the
+// repository. Nothing is checked out if the branch was not fetched.
+func checkoutHead(r *git.Repository) error {
+	head, err := r.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+
+	return w.Checkout(&git.CheckoutOptions{Branch: head.Name(), Force: true})
+}
+
 func (r *temporaryRepository) Push(url string, refspecs []config.RefSpec) error {
+	shallows, err := r.Repository.Storer.Shallow()
+	if err != nil {
+		return err
+	}
+
+	if len(shallows) > 0 || r.filter != nil {
+		filtered := r.filter.len()
+		err := pushReachable(r.Repository.Storer, shallows, r.filter, url, refspecs)
+		if n := r.filter.len() - filtered; n > 0 {
+			log.Info("blobs bigger than the maximum size left out of the push",
+				"endpoint", r.Endpoint, "blobs", n)
+		}
+
+		return err
+	}
+
 	const remoteName = "tmp"
 	defer func() { _ = r.Repository.DeleteRemote(remoteName) }()
 	remote, err := r.Repository.CreateRemote(&config.RemoteConfig{
@@ -205,6 +567,52 @@ func (r *temporaryRepository) Push(url string, refspecs []config.RefSpec) error
 	return remote.Push(&git.PushOptions{RefSpecs: refspecs})
 }
 
+// RemoteReferences implements the RefCountingRepository interface.
+func (r *temporaryRepository) RemoteReferences() int {
+	return r.remoteRefs
+}
+
+// FilteredBlobs implements the BlobFilteringRepository interface.
+func (r *temporaryRepository) FilteredBlobs() []plumbing.Hash {
+	return r.filter.Filtered()
+}
+
+// forEachBranchFile calls f with the content of the file with the given path
+// in the commit of every branch of the repository that has it.
+func (r *temporaryRepository) forEachBranchFile(path string, f func(string) error) error {
+	refs, err := r.Repository.References()
+	if err != nil {
+		return err
+	}
+
+	return refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference || !ref.IsBranch() {
+			return nil
+		}
+
+		c, err := r.Repository.CommitObject(ref.Hash())
+		if err != nil {
+			return err
+		}
+
+		file, err := c.File(path)
+		if err == object.ErrFileNotFound {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		content, err := file.Contents()
+		if err != nil {
+			return err
+		}
+
+		return f(content)
+	})
+}
+
 func (r *temporaryRepository) Close() error {
 	r.Repository = nil
 	return util.RemoveAll(r.TempFilesystem, r.TempPath)
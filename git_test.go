@@ -1,9 +1,15 @@
 package borges
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/src-d/go-git-fixtures"
 	"github.com/stretchr/testify/assert"
@@ -12,8 +18,11 @@ import (
 	"gopkg.in/src-d/go-billy.v3/memfs"
 	"gopkg.in/src-d/go-billy.v3/osfs"
 	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
 )
 
 func TestNewGitReferencer(t *testing.T) {
@@ -85,7 +94,7 @@ func (s *TemporaryClonerSuite) SetupTest() {
 	require.NoError(err)
 
 	tmpFs := osfs.New(s.tmpDir)
-	s.cloner = NewTemporaryCloner(tmpFs)
+	s.cloner = NewTemporaryCloner(tmpFs, CloneOptions{})
 }
 
 func (s *TemporaryClonerSuite) TearDownTest() {
@@ -102,7 +111,7 @@ func (s *TemporaryClonerSuite) TestCloneRepository() {
 
 func (s *TemporaryClonerSuite) testBasicRepository(url string) {
 	require := s.Require()
-	gr, err := s.cloner.Clone("foo", url)
+	gr, err := s.cloner.Clone(context.Background(), "foo", url)
 	require.NoError(err)
 	refs, err := gr.References()
 	require.NoError(err)
@@ -111,6 +120,180 @@ func (s *TemporaryClonerSuite) testBasicRepository(url string) {
 	require.NoError(err)
 }
 
+func (s *TemporaryClonerSuite) TestCloneBare() {
+	dir := s.cloneWithReadme(CloneOptions{})
+	_, err := os.Stat(filepath.Join(dir, "README"))
+	s.True(os.IsNotExist(err), "%v", err)
+	_, err = os.Stat(filepath.Join(dir, "HEAD"))
+	s.NoError(err)
+}
+
+func (s *TemporaryClonerSuite) TestCloneCheckout() {
+	dir := s.cloneWithReadme(CloneOptions{Checkout: true})
+	content, err := ioutil.ReadFile(filepath.Join(dir, "README"))
+	s.NoError(err)
+	s.Equal("foo", string(content))
+	_, err = os.Stat(filepath.Join(dir, ".git", "HEAD"))
+	s.NoError(err)
+}
+
+// cloneWithReadme clones a repository with a README file with the given
+// options and returns the directory of the clone, which is not removed.
+func (s *TemporaryClonerSuite) cloneWithReadme(opts CloneOptions) string {
+	require := s.Require()
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	commitFile(s.T(), r, "README", "foo")
+
+	var dir string
+	s.cloner = NewTemporaryCloner(osfs.New(s.tmpDir), opts)
+	err = WithInProcRepository(r, func(url string) error {
+		gr, err := s.cloner.Clone(context.Background(), "foo", url)
+		require.NoError(err)
+		refs, err := gr.References()
+		require.NoError(err)
+		require.Len(refs, 1)
+
+		dir = filepath.Join(s.tmpDir, gr.(*temporaryRepository).TempPath)
+		return nil
+	})
+	require.NoError(err)
+	return dir
+}
+
+func (s *TemporaryClonerSuite) TestCloneShallowRepository() {
+	require := s.Require()
+	s.cloner = NewTemporaryCloner(osfs.New(s.tmpDir), CloneOptions{Depth: 1})
+	gr, err := s.cloner.Clone(context.Background(), "foo", "https://github.com/git-fixtures/basic.git")
+	require.NoError(err)
+	refs, err := gr.References()
+	require.NoError(err)
+	require.Len(refs, 3)
+	for _, ref := range refs {
+		require.Len(ref.Roots, 1)
+		require.Equal(ref.Hash, ref.Init)
+	}
+
+	err = gr.Close()
+	require.NoError(err)
+}
+
+func (s *TemporaryClonerSuite) TestCloneTimeout() {
+	require := s.Require()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+
+	go func() {
+		// accept connections and never answer
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	s.cloner = NewTemporaryCloner(osfs.New(s.tmpDir), CloneOptions{
+		Timeout: 100 * time.Millisecond,
+	})
+
+	url := fmt.Sprintf("http://%s/foo.git", l.Addr())
+	gr, err := s.cloner.Clone(context.Background(), "foo", url)
+	require.True(ErrCloneTimeout.Is(err))
+	require.Nil(gr)
+}
+
+func (s *TemporaryClonerSuite) TestCloneTimeout_ContextDeadline() {
+	require := s.Require()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+
+	go func() {
+		// accept connections and never answer
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// the deadline of the context overrides the clone timeout
+	s.cloner = NewTemporaryCloner(osfs.New(s.tmpDir), CloneOptions{
+		Timeout: time.Hour,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s/foo.git", l.Addr())
+	gr, err := s.cloner.Clone(ctx, "foo", url)
+	require.True(ErrCloneTimeout.Is(err))
+	require.Nil(gr)
+}
+
+func (s *TemporaryClonerSuite) TestCloneIncremental() {
+	require := s.Require()
+
+	repo, err := defaultRepository()
+	require.NoError(err)
+
+	err = WithInProcRepository(repo, func(url string) error {
+		gr, err := s.cloner.Clone(context.Background(), "foo", url)
+		require.NoError(err)
+		defer func() { require.NoError(gr.Close()) }()
+
+		refs, err := gr.References()
+		require.NoError(err)
+		require.NotEmpty(refs)
+
+		var haves []plumbing.Hash
+		for _, ref := range refs {
+			haves = append(haves, plumbing.Hash(ref.Hash))
+		}
+
+		base := []storer.EncodedObjectStorer{gr.(*temporaryRepository).Repository.Storer}
+		ic := s.cloner.(IncrementalCloner)
+		inc, err := ic.CloneIncremental(context.Background(), "foo", url, base, haves)
+		require.NoError(err)
+		defer func() { require.NoError(inc.Close()) }()
+
+		incRefs, err := inc.References()
+		require.NoError(err)
+		require.Equal(refsByName(refs), refsByName(incRefs))
+
+		// nothing was fetched, all the objects are read from the base
+		ls := inc.(*temporaryRepository).Repository.Storer.(*layeredStorage)
+		iter, err := ls.Storer.IterEncodedObjects(plumbing.AnyObject)
+		require.NoError(err)
+		_, err = iter.Next()
+		require.Equal(io.EOF, err)
+		return nil
+	})
+	require.NoError(err)
+}
+
+func (s *TemporaryClonerSuite) TestCloneMaxSize() {
+	require := s.Require()
+
+	repo, err := defaultRepository()
+	require.NoError(err)
+
+	s.cloner = NewTemporaryCloner(osfs.New(s.tmpDir), CloneOptions{MaxSize: 100})
+	err = WithInProcRepository(repo, func(url string) error {
+		gr, err := s.cloner.Clone(context.Background(), "foo", url)
+		require.True(ErrRepoTooLarge.Is(err))
+		require.Nil(gr)
+		return nil
+	})
+	require.NoError(err)
+
+	checkNoFiles(s.T(), osfs.New(s.tmpDir))
+}
+
 func (s *TemporaryClonerSuite) TestCloneEmptyRepository() {
 	s.testEmptyRepository("https://github.com/git-fixtures/empty.git")
 	s.testEmptyRepository("git://github.com/git-fixtures/empty.git")
@@ -118,7 +301,7 @@ func (s *TemporaryClonerSuite) TestCloneEmptyRepository() {
 
 func (s *TemporaryClonerSuite) testEmptyRepository(url string) {
 	require := s.Require()
-	gr, err := s.cloner.Clone("foo", url)
+	gr, err := s.cloner.Clone(context.Background(), "foo", url)
 	require.NoError(err)
 	refs, err := gr.References()
 	require.NoError(err)
@@ -134,7 +317,7 @@ func (s *TemporaryClonerSuite) TestCloneNonExistentRepository() {
 
 func (s *TemporaryClonerSuite) testNonExistentRepository(url string) {
 	require := s.Require()
-	gr, err := s.cloner.Clone("foo", url)
+	gr, err := s.cloner.Clone(context.Background(), "foo", url)
 	require.True(err == transport.ErrAuthenticationRequired ||
 		err == transport.ErrRepositoryNotFound)
 
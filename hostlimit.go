@@ -0,0 +1,94 @@
+package borges
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-errors.v0"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+var (
+	ErrHostBusy = errors.NewKind("too many clones running from host %s")
+)
+
+// hostBusyBackoff is the time a worker waits after requeueing a job whose
+// host is busy. It is short compared to a clone, so the worker is not kept
+// idle, but it keeps the workers from spinning when all the queued jobs are
+// for busy hosts.
+const hostBusyBackoff = time.Second
+
+// hostLimiter limits the number of clones running at the same time from each
+// host. It is safe for concurrent use.
+type hostLimiter struct {
+	max     int
+	m       sync.Mutex
+	running map[string]int
+}
+
+// newHostLimiter returns a limiter of max clones per host, or nil if max is
+// not positive, which means no limit.
+func newHostLimiter(max int) *hostLimiter {
+	if max <= 0 {
+		return nil
+	}
+
+	return &hostLimiter{max: max, running: make(map[string]int)}
+}
+
+// acquire takes a slot of the host of the endpoint, without waiting for it.
+// If the host has no free slot, it fails with ErrHostBusy. Otherwise, it
+// returns the function that frees the slot, which must be called once the
+// clone finishes. A nil limiter, as well as an invalid endpoint, whose clone
+// is going to fail anyway, always get a slot.
+func (l *hostLimiter) acquire(endpoint string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	ep, err := transport.NewEndpoint(endpoint)
+	if err != nil {
+		return func() {}, nil
+	}
+
+	host := ep.Host()
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.running[host] >= l.max {
+		return nil, ErrHostBusy.New(host)
+	}
+
+	l.running[host]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.m.Lock()
+			defer l.m.Unlock()
+
+			l.running[host]--
+			if l.running[host] == 0 {
+				delete(l.running, host)
+			}
+		})
+	}, nil
+}
+
+// runningClones returns a copy of the number of clones running from each host,
+// or nil if l is nil.
+func (l *hostLimiter) runningClones() map[string]int {
+	if l == nil {
+		return nil
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	running := make(map[string]int, len(l.running))
+	for host, n := range l.running {
+		running[host] = n
+	}
+
+	return running
+}
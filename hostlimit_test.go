@@ -0,0 +1,51 @@
+package borges
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostLimiter(t *testing.T) {
+	require := require.New(t)
+
+	l := newHostLimiter(2)
+	r1, err := l.acquire("https://github.com/foo/bar")
+	require.NoError(err)
+	r2, err := l.acquire("git@github.com:foo/baz.git")
+	require.NoError(err)
+
+	_, err = l.acquire("git://github.com/foo/qux")
+	require.True(ErrHostBusy.Is(err))
+
+	r3, err := l.acquire("https://gitlab.com/foo/bar")
+	require.NoError(err)
+	r3()
+
+	require.Equal(map[string]int{"github.com": 2}, l.runningClones())
+
+	r1()
+	r1()
+	r4, err := l.acquire("https://github.com/foo/qux")
+	require.NoError(err)
+
+	_, err = l.acquire("https://github.com/foo/qux")
+	require.True(ErrHostBusy.Is(err))
+
+	r2()
+	r4()
+	require.Empty(l.running)
+}
+
+func TestHostLimiter_NoLimit(t *testing.T) {
+	require := require.New(t)
+
+	l := newHostLimiter(0)
+	require.Nil(l)
+	require.Nil(l.runningClones())
+
+	for i := 0; i < 10; i++ {
+		_, err := l.acquire("https://github.com/foo/bar")
+		require.NoError(err)
+	}
+}
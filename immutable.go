@@ -0,0 +1,149 @@
+package borges
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-billy.v3/util"
+	"gopkg.in/src-d/go-errors.v0"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+var (
+	ErrSivaVersionExists = errors.NewKind("version %s of the siva file already exists")
+)
+
+// versionsExt is the extension of the manifests of the rooted repositories
+// stored immutably, see SivaOptions.
+const versionsExt = ".versions"
+
+// versionsPath returns the path of the manifest of the versions of the siva
+// file of the rooted repository with the given root.
+func versionsPath(h plumbing.Hash) string {
+	return h.String() + versionsExt
+}
+
+// sivaVersionPath returns the path of a new version of the siva file of the
+// rooted repository with the given root, named after the time it is created
+// so the versions sort by name in the order they were committed.
+func sivaVersionPath(h plumbing.Hash, now time.Time) string {
+	return fmt.Sprintf("%s.%019d%s", h, now.UnixNano(), sivaExt)
+}
+
+// readSivaVersions returns the names of the versions of the siva file listed
+// in the manifest at path in fs, from the oldest to the current one, or none
+// if there is no manifest.
+func readSivaVersions(fs billy.Filesystem, path string) (versions []string, err error) {
+	f, err := fs.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer checkClose(f, &err)
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v := strings.TrimSpace(sc.Text()); v != "" {
+			versions = append(versions, v)
+		}
+	}
+
+	return versions, sc.Err()
+}
+
+// writeSivaVersions replaces the manifest at path in fs with one listing the
+// given versions. It is written to a temporary file that is then renamed, so
+// the manifest is never left half written. It is the only file that is
+// replaced in an immutable store.
+func writeSivaVersions(fs billy.Filesystem, path string, versions []string) error {
+	var buf bytes.Buffer
+	for _, v := range versions {
+		buf.WriteString(v)
+		buf.WriteByte('\n')
+	}
+
+	tmp := fmt.Sprintf("%s.%d.tmp", path, time.Now().UnixNano())
+	if err := util.WriteFile(fs, tmp, buf.Bytes(), 0644); err != nil {
+		_ = fs.Remove(tmp)
+		return err
+	}
+
+	if err := fs.Rename(tmp, path); err != nil {
+		_ = fs.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// currentSivaPath returns the path of the current siva file of the rooted
+// repository with the given root, or an empty path if an immutable store has
+// no version of it yet.
+func (t *sivaTransactioner) currentSivaPath(h plumbing.Hash) (string, error) {
+	if !t.opts.Immutable {
+		return h.String() + sivaExt, nil
+	}
+
+	versions, err := readSivaVersions(t.fs, versionsPath(h))
+	if err != nil || len(versions) == 0 {
+		return "", err
+	}
+
+	return versions[len(versions)-1], nil
+}
+
+// commitVersion adds the version written by the transaction to the manifest
+// of its rooted repository, removing the oldest ones beyond the KeepVersions
+// option. The new version is removed if it cannot be added.
+func (tx *sivaTx) commitVersion() error {
+	versions := append(tx.versions, tx.destPath)
+	var expired []string
+	if keep := tx.opts.KeepVersions; keep > 0 && len(versions) > keep {
+		expired, versions = versions[:len(versions)-keep], versions[len(versions)-keep:]
+	}
+
+	if err := writeSivaVersions(tx.fs, tx.manifest, versions); err != nil {
+		_ = tx.fs.Remove(tx.destPath)
+		return err
+	}
+
+	for _, v := range expired {
+		if err := tx.fs.Remove(v); err != nil && !os.IsNotExist(err) {
+			log.Warn("error removing expired version of siva file",
+				"file", v, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// removeVersionedSivaFiles removes the manifest at path in fs and all the
+// versions of the siva file it lists, which are in its same directory.
+func removeVersionedSivaFiles(fs billy.Filesystem, p string) error {
+	versions, err := readSivaVersions(fs, p)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		err := fs.Remove(path.Join(path.Dir(p), v))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := fs.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
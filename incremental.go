@@ -0,0 +1,96 @@
+package borges
+
+import (
+	"context"
+	"io"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage"
+)
+
+// havesRefPrefix is the prefix of the references set in a temporary
+// repository before an incremental fetch, so the commits they point to are
+// sent to the remote as the ones already available.
+const havesRefPrefix = "refs/borges/haves/"
+
+// IncrementalCloner is a TemporaryCloner that can fetch only the objects of a
+// repository that are missing from other repositories, such as the rooted
+// repositories where it was archived before.
+type IncrementalCloner interface {
+	TemporaryCloner
+	// CloneIncremental fetches the repository at the given url into a
+	// temporary repository like Clone does, but telling the remote that the
+	// commits in haves, and everything reachable from them, are already
+	// available. The objects that are not fetched are read from the base
+	// storers, which must contain them and stay open until the returned
+	// repository is closed.
+	CloneIncremental(ctx context.Context, id, url string,
+		base []storer.EncodedObjectStorer, haves []plumbing.Hash) (TemporaryRepository, error)
+}
+
+// CloneIncremental implements the IncrementalCloner interface. Shallow clones
+// cannot be incremental, so if the Depth option is set it clones the whole
+// repository, as Clone does.
+func (b *temporaryRepositoryBuilder) CloneIncremental(ctx context.Context, id, endpoint string,
+	base []storer.EncodedObjectStorer, haves []plumbing.Hash) (TemporaryRepository, error) {
+	if b.Options.Depth > 0 {
+		return b.Clone(ctx, id, endpoint)
+	}
+
+	return b.clone(ctx, id, endpoint, base, haves)
+}
+
+// layeredStorage is a storage that reads the objects it does not have from a
+// set of base storers. Only EncodedObject is layered, iterating the objects
+// returns just the ones in the storage itself. The wrapped storage must
+// implement storer.PackfileWriter.
+type layeredStorage struct {
+	storage.Storer
+	base []storer.EncodedObjectStorer
+}
+
+func (s *layeredStorage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, err := s.Storer.EncodedObject(t, h)
+	if err != plumbing.ErrObjectNotFound {
+		return obj, err
+	}
+
+	for _, b := range s.base {
+		obj, err = b.EncodedObject(t, h)
+		if err != plumbing.ErrObjectNotFound {
+			return obj, err
+		}
+	}
+
+	return nil, plumbing.ErrObjectNotFound
+}
+
+func (s *layeredStorage) PackfileWriter() (io.WriteCloser, error) {
+	return s.Storer.(storer.PackfileWriter).PackfileWriter()
+}
+
+// setHaves sets a reference for each one of the given hashes, so they are sent
+// to the remote as haves in the next fetch.
+func setHaves(s storer.ReferenceStorer, haves []plumbing.Hash) error {
+	for _, h := range haves {
+		name := plumbing.ReferenceName(havesRefPrefix + h.String())
+		if err := s.SetReference(plumbing.NewHashReference(name, h)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeHaves removes the references set by setHaves.
+func removeHaves(s storer.ReferenceStorer, haves []plumbing.Hash) error {
+	for _, h := range haves {
+		name := plumbing.ReferenceName(havesRefPrefix + h.String())
+		if err := s.RemoveReference(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
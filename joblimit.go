@@ -0,0 +1,115 @@
+package borges
+
+import (
+	"sync"
+
+	"gopkg.in/src-d/framework.v0/queue"
+)
+
+// jobLimit counts the jobs processed by a Consumer with MaxJobs. A job takes
+// a slot when it is handed to the worker pool, and gives it back if it is
+// requeued without being processed, so no more than max jobs are processed
+// in total. All the methods can be called on a nil limit, which has no
+// limit.
+type jobLimit struct {
+	max   int
+	slots chan struct{}
+	done  chan struct{}
+
+	m        sync.Mutex
+	finished int
+}
+
+// newJobLimit returns a jobLimit of max jobs, or nil if max is zero or less.
+func newJobLimit(max int) *jobLimit {
+	if max <= 0 {
+		return nil
+	}
+
+	return &jobLimit{
+		max:   max,
+		slots: make(chan struct{}, max),
+		done:  make(chan struct{}),
+	}
+}
+
+// take waits for a free slot for a job. It returns false if the limit was
+// reached or quit was closed meanwhile.
+func (l *jobLimit) take(quit <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case <-l.done:
+		return false
+	default:
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-l.done:
+		return false
+	case <-quit:
+		return false
+	}
+}
+
+// finish frees the slot of a job if it was requeued, or counts it as
+// processed otherwise, closing Done once max jobs were processed.
+func (l *jobLimit) finish(requeued bool) {
+	if l == nil {
+		return
+	}
+
+	if requeued {
+		<-l.slots
+		return
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.finished++
+	if l.finished == l.max {
+		close(l.done)
+	}
+}
+
+// Done returns a channel closed once max jobs were processed, which is never
+// closed on a nil limit.
+func (l *jobLimit) Done() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+
+	return l.done
+}
+
+// wrap returns an acknowledger finishing the job that took a slot when it is
+// acknowledged or rejected, only the first time.
+func (l *jobLimit) wrap(ack queue.Acknowledger) queue.Acknowledger {
+	if l == nil {
+		return ack
+	}
+
+	return &limitedJob{Acknowledger: ack, limit: l}
+}
+
+type limitedJob struct {
+	queue.Acknowledger
+	limit *jobLimit
+	once  sync.Once
+}
+
+func (j *limitedJob) Ack() error {
+	err := j.Acknowledger.Ack()
+	j.once.Do(func() { j.limit.finish(false) })
+	return err
+}
+
+func (j *limitedJob) Reject(requeue bool) error {
+	err := j.Acknowledger.Reject(requeue)
+	j.once.Do(func() { j.limit.finish(requeue) })
+	return err
+}
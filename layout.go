@@ -0,0 +1,159 @@
+package borges
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-errors.v0"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+var (
+	ErrInvalidLayout = errors.NewKind("invalid layout for host %s: %s")
+)
+
+// EndpointTransactioner is a RootedTransactioner that can store the rooted
+// repositories in different places depending on the endpoint of the
+// repositories pushed to them.
+type EndpointTransactioner interface {
+	repository.RootedTransactioner
+	// ForEndpoint returns the RootedTransactioner used for the rooted
+	// repositories of the repositories fetched from the given endpoint.
+	ForEndpoint(endpoint string) (repository.RootedTransactioner, error)
+}
+
+// Layout sets where the rooted repositories of the repositories hosted at the
+// hosts matching its Host pattern are stored.
+type Layout struct {
+	// Host is a pattern, as in path.Match, matched against the endpoint host.
+	Host string `json:"host"`
+	// Root is the directory where the rooted repositories are stored,
+	// relative to the root of the rooted repositories filesystem.
+	Root string `json:"root,omitempty"`
+	// BucketSize is the bucket size of the rooted repositories, see
+	// NewBucketFilesystem.
+	BucketSize int `json:"bucket_size,omitempty"`
+	// Naming is the name of the naming of the rooted repositories, as in
+	// NewSivaNaming, HashNamingName if empty.
+	Naming string `json:"naming,omitempty"`
+}
+
+// SivaNaming returns the naming of the rooted repositories of the layout.
+func (l *Layout) SivaNaming() (SivaNaming, error) {
+	name := l.Naming
+	if name == "" {
+		name = HashNamingName
+	}
+
+	return NewSivaNaming(name, l.BucketSize)
+}
+
+// LoadLayouts reads a JSON file containing a list of layouts.
+func LoadLayouts(filename string) ([]*Layout, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var layouts []*Layout
+	if err := json.NewDecoder(f).Decode(&layouts); err != nil {
+		return nil, err
+	}
+
+	for _, l := range layouts {
+		if _, err := path.Match(l.Host, ""); err != nil {
+			return nil, ErrInvalidLayout.New(l.Host, err)
+		}
+
+		if l.BucketSize < 0 {
+			return nil, ErrInvalidLayout.New(l.Host, "negative bucket size")
+		}
+
+		if _, err := l.SivaNaming(); err != nil {
+			return nil, ErrInvalidLayout.New(l.Host, err)
+		}
+	}
+
+	return layouts, nil
+}
+
+type layoutTransactioner struct {
+	repository.RootedTransactioner
+	layouts []*Layout
+	txs     []repository.RootedTransactioner
+}
+
+// NewLayoutTransactioner returns an EndpointTransactioner that stores the
+// rooted repositories in fs, using the first of the given layouts whose host
+// pattern matches the endpoint host. The rooted repositories of endpoints
+// without a matching layout are stored at the root of fs with the given
+// naming, HashNaming if nil. The transactions are stored in local and the siva files are
+// uploaded with the given options, as in NewSivaRootedTransactioner.
+func NewLayoutTransactioner(fs, local billy.Filesystem, naming SivaNaming,
+	layouts []*Layout, opts SivaOptions) (EndpointTransactioner, error) {
+	t := &layoutTransactioner{
+		RootedTransactioner: NewSivaRootedTransactioner(
+			NewNamingFilesystem(fs, naming), local, opts),
+		layouts: layouts,
+	}
+
+	for _, l := range layouts {
+		root, err := fs.Chroot(l.Root)
+		if err != nil {
+			return nil, err
+		}
+
+		naming, err := l.SivaNaming()
+		if err != nil {
+			return nil, ErrInvalidLayout.New(l.Host, err)
+		}
+
+		t.txs = append(t.txs, NewSivaRootedTransactioner(
+			NewNamingFilesystem(root, naming), local, opts))
+	}
+
+	return t, nil
+}
+
+// Abort implements the Aborter interface, for the transactions begun by any of
+// the transactioners of the layouts.
+func (t *layoutTransactioner) Abort(tx repository.Tx) error {
+	return abortTx(t.RootedTransactioner, tx)
+}
+
+func (t *layoutTransactioner) ForEndpoint(endpoint string) (repository.RootedTransactioner, error) {
+	l, err := matchLayout(t.layouts, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range t.layouts {
+		if t.layouts[i] == l {
+			return t.txs[i], nil
+		}
+	}
+
+	return t.RootedTransactioner, nil
+}
+
+// matchLayout returns the first of the layouts whose host pattern matches the
+// host of the endpoint, or nil if there is none.
+func matchLayout(layouts []*Layout, endpoint string) (*Layout, error) {
+	ep, err := transport.NewEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, l := range layouts {
+		if ok, _ := path.Match(l.Host, ep.Host()); ok {
+			return l, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,80 @@
+package borges
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestLoadLayouts(t *testing.T) {
+	require := require.New(t)
+
+	f, err := ioutil.TempFile("", "borges-layouts")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`[
+		{"host": "github.com", "root": "github", "bucket_size": 2},
+		{"host": "*.gitlab.com"},
+		{"host": "bitbucket.org", "naming": "date"}
+	]`)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	layouts, err := LoadLayouts(f.Name())
+	require.NoError(err)
+	require.Equal([]*Layout{
+		{Host: "github.com", Root: "github", BucketSize: 2},
+		{Host: "*.gitlab.com"},
+		{Host: "bitbucket.org", Naming: DateNamingName},
+	}, layouts)
+}
+
+func TestLoadLayouts_InvalidNaming(t *testing.T) {
+	require := require.New(t)
+
+	f, err := ioutil.TempFile("", "borges-layouts")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`[{"host": "github.com", "naming": "foo"}]`)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	_, err = LoadLayouts(f.Name())
+	require.True(ErrInvalidLayout.Is(err), "%v", err)
+}
+
+func TestLayoutTransactioner(t *testing.T) {
+	require := require.New(t)
+
+	fs := memfs.New()
+	layouts := []*Layout{{Host: "github.com", Root: "github", BucketSize: 2}}
+	et, err := NewLayoutTransactioner(fs, memfs.New(), BucketNaming(1), layouts, SivaOptions{})
+	require.NoError(err)
+
+	h := plumbing.NewHash("f7b877701fbf855b44c0a9e86f3fdce2c298b07f")
+	for _, endpoint := range []string{
+		"https://github.com/foo/bar",
+		"git@gitlab.com:foo/bar.git",
+	} {
+		rtx, err := et.ForEndpoint(endpoint)
+		require.NoError(err)
+		tx, err := rtx.Begin(h)
+		require.NoError(err)
+		require.NoError(tx.Commit())
+	}
+
+	_, err = fs.Stat("github/f7/" + h.String() + ".siva")
+	require.NoError(err)
+	_, err = fs.Stat("f/" + h.String() + ".siva")
+	require.NoError(err)
+
+	tx, err := et.Begin(h)
+	require.NoError(err)
+	require.NoError(tx.Rollback())
+}
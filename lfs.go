@@ -0,0 +1,75 @@
+package borges
+
+import (
+	"strings"
+
+	"gopkg.in/src-d/go-errors.v0"
+)
+
+var (
+	ErrLFSRepository = errors.NewKind("repository %s uses Git LFS, the files tracked by it are archived as LFS pointers")
+)
+
+// gitattributesFile is the file where the attributes of the paths of a
+// repository are set, including the filters used to store them.
+const gitattributesFile = ".gitattributes"
+
+// LFSRepository is a TemporaryRepository that can tell whether it uses Git
+// LFS. The objects stored by LFS are not part of the repository, so only the
+// pointers to them are archived.
+type LFSRepository interface {
+	TemporaryRepository
+	// UsesLFS returns whether the .gitattributes file at the root of any
+	// of the branches of the repository tracks some path with LFS.
+	UsesLFS() (bool, error)
+}
+
+// UsesLFS implements the LFSRepository interface.
+func (r *temporaryRepository) UsesLFS() (bool, error) {
+	var lfs bool
+	err := r.forEachBranchFile(gitattributesFile, func(content string) error {
+		lfs = lfs || hasLFSFilter(content)
+		return nil
+	})
+
+	return lfs, err
+}
+
+// hasLFSFilter returns whether any of the patterns of the given .gitattributes
+// content uses the lfs filter.
+func hasLFSFilter(gitattributes string) bool {
+	for _, line := range strings.Split(gitattributes, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		for _, attr := range fields[1:] {
+			if attr == "filter=lfs" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// checkLFS reports a warning if the DetectLFS option is set and the temporary
+// repository of the remote uses Git LFS.
+func (a *Archiver) checkLFS(j *Job, rm *remote) {
+	lr, ok := rm.tr.(LFSRepository)
+	if !a.Options.DetectLFS || !ok {
+		return
+	}
+
+	lfs, err := lr.UsesLFS()
+	if err != nil {
+		rm.log.Warn("error looking for Git LFS attributes", "error", err)
+		return
+	}
+
+	if lfs {
+		rm.log.Warn("repository uses Git LFS", "lfs", true)
+		a.notifyWarn(j, ErrLFSRepository.New(rm.id.String()))
+	}
+}
@@ -0,0 +1,57 @@
+package borges
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestHasLFSFilter(t *testing.T) {
+	require := require.New(t)
+
+	require.True(hasLFSFilter("*.psd filter=lfs diff=lfs merge=lfs -text\n"))
+	require.True(hasLFSFilter("*.txt text\n\n  data/** filter=lfs -text\n"))
+	require.False(hasLFSFilter("*.txt text eol=lf\n"))
+	require.False(hasLFSFilter("# *.psd filter=lfs\n"))
+	require.False(hasLFSFilter(""))
+}
+
+func TestTemporaryRepositoryUsesLFS(t *testing.T) {
+	require := require.New(t)
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+
+	tr := &temporaryRepository{Repository: r}
+	lfs, err := tr.UsesLFS()
+	require.NoError(err)
+	require.False(lfs)
+
+	commitFile(t, r, gitattributesFile, "*.bin filter=lfs diff=lfs merge=lfs -text\n")
+	lfs, err = tr.UsesLFS()
+	require.NoError(err)
+	require.True(lfs)
+}
+
+func TestArchiverCheckLFS(t *testing.T) {
+	require := require.New(t)
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	commitFile(t, r, gitattributesFile, "*.bin filter=lfs -text\n")
+	rm := &remote{log: log, tr: &temporaryRepository{Repository: r}}
+
+	var warnings []error
+	a := NewArchiver(nil, nil, nil)
+	a.Notifiers.Warn = func(j *Job, err error) { warnings = append(warnings, err) }
+
+	a.checkLFS(&Job{}, rm)
+	require.Empty(warnings)
+
+	a.Options.DetectLFS = true
+	a.checkLFS(&Job{}, rm)
+	require.Len(warnings, 1)
+	require.True(ErrLFSRepository.Is(warnings[0]))
+}
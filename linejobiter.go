@@ -2,22 +2,44 @@ package borges
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
-
-	"gopkg.in/src-d/core-retrieval.v0/model"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
+// NewFileJobIter returns a JobIter like NewLineJobIter that reads the file at
+// the given path, or the standard input if path is "-".
+func NewFileJobIter(path string, storer RepositoryStore) (JobIter, error) {
+	if path == "-" {
+		return NewLineJobIter(ioutil.NopCloser(os.Stdin), storer), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewLineJobIter(f, storer), nil
+}
+
 type lineJobIter struct {
-	storer *model.RepositoryStore
+	storer RepositoryStore
 	*bufio.Scanner
 	r io.ReadCloser
 }
 
 // NewLineJobIter returns a JobIter that returns jobs generated from a reader
-// with a list of repository URLs, one per line.
-func NewLineJobIter(r io.ReadCloser, storer *model.RepositoryStore) JobIter {
+// with a list of repository URLs, one per line, or absolute paths of local
+// repositories, which are cloned from the filesystem of the consumers. A line
+// can have more fields after the URL separated by whitespace, such as the
+// provider of the repository, which are ignored. Empty lines and lines
+// starting with # are skipped.
+func NewLineJobIter(r io.ReadCloser, storer RepositoryStore) JobIter {
 	return &lineJobIter{
 		storer:  storer,
 		Scanner: bufio.NewScanner(r),
@@ -25,23 +47,23 @@ func NewLineJobIter(r io.ReadCloser, storer *model.RepositoryStore) JobIter {
 	}
 }
 
-func (i *lineJobIter) Next() (*Job, error) {
-	if !i.Scan() {
-		if err := i.Err(); err != nil {
-			return nil, err
-		}
+func (i *lineJobIter) Next(ctx context.Context) (*Job, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-		return nil, io.EOF
+	line, err := i.nextLine()
+	if err != nil {
+		return nil, err
 	}
 
-	line := string(i.Bytes())
 	u, err := url.Parse(line)
 	if err != nil {
 		return nil, err
 	}
 
-	if !u.IsAbs() {
-		return nil, fmt.Errorf("expected absolute URL: %s", line)
+	if !u.IsAbs() && !filepath.IsAbs(line) {
+		return nil, fmt.Errorf("expected absolute URL or path: %s", line)
 	}
 
 	ID, err := RepositoryID(line, i.storer)
@@ -52,6 +74,24 @@ func (i *lineJobIter) Next() (*Job, error) {
 	return &Job{RepositoryID: ID}, nil
 }
 
+// nextLine returns the URL in the next line that is not empty or a comment.
+func (i *lineJobIter) nextLine() (string, error) {
+	for i.Scan() {
+		fields := strings.Fields(i.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		return fields[0], nil
+	}
+
+	if err := i.Err(); err != nil {
+		return "", err
+	}
+
+	return "", io.EOF
+}
+
 // Close closes the underlying reader.
 func (i *lineJobIter) Close() error {
 	return i.r.Close()
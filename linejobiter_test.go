@@ -1,18 +1,52 @@
 package borges
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"gopkg.in/src-d/core-retrieval.v0/model"
 	"gopkg.in/src-d/core-retrieval.v0/test"
 	"gopkg.in/src-d/go-kallax.v1"
 )
 
+func TestNewFileJobIter_NotFound(t *testing.T) {
+	_, err := NewFileJobIter("/does/not/exist", nil)
+	require.Error(t, err)
+}
+
+func TestLineJobIter_LocalPath(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("", "borges-line")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	store, err := OpenBoltRepositoryStore(filepath.Join(tmp, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	text := "/srv/git/foo\nsrv/git/bar\n"
+	iter := NewLineJobIter(ioutil.NopCloser(strings.NewReader(text)), store)
+
+	j, err := iter.Next(context.Background())
+	require.NoError(err)
+	r, err := store.Get(kallax.ULID(j.RepositoryID))
+	require.NoError(err)
+	require.Equal([]string{"/srv/git/foo"}, r.Endpoints)
+
+	_, err = iter.Next(context.Background())
+	require.Error(err)
+	require.NotEqual(io.EOF, err)
+}
+
 func TestLineJobIter(t *testing.T) {
 	suite.Run(t, new(LineJobIterSuite))
 }
@@ -36,25 +70,54 @@ https://foo/baz.git`
 
 	storer := model.NewRepositoryStore(s.DB)
 
-	iter := NewLineJobIter(r, storer)
+	iter := NewLineJobIter(r, NewSQLRepositoryStore(storer))
 
-	j, err := iter.Next()
+	j, err := iter.Next(context.Background())
 	s.NoError(err)
 	ID, err := getIDByEndpoint("git://foo/bar.git", storer)
 	s.NoError(err)
 	s.Equal(&Job{RepositoryID: ID}, j)
 
-	j, err = iter.Next()
+	j, err = iter.Next(context.Background())
 	s.NoError(err)
 	ID, err = getIDByEndpoint("https://foo/baz.git", storer)
 	s.NoError(err)
 	s.Equal(&Job{RepositoryID: ID}, j)
 
-	j, err = iter.Next()
+	j, err = iter.Next(context.Background())
+	s.Equal(io.EOF, err)
+	s.Nil(j)
+
+	j, err = iter.Next(context.Background())
 	s.Equal(io.EOF, err)
 	s.Nil(j)
+}
+
+func (s *LineJobIterSuite) TestCommentsAndProviders() {
+	text := `# repositories to backfill
+git://foo/bar.git github
+
+  https://foo/baz.git	gitlab
+`
+	r := ioutil.NopCloser(strings.NewReader(text))
+
+	storer := model.NewRepositoryStore(s.DB)
+
+	iter := NewLineJobIter(r, NewSQLRepositoryStore(storer))
+
+	j, err := iter.Next(context.Background())
+	s.NoError(err)
+	ID, err := getIDByEndpoint("git://foo/bar.git", storer)
+	s.NoError(err)
+	s.Equal(&Job{RepositoryID: ID}, j)
+
+	j, err = iter.Next(context.Background())
+	s.NoError(err)
+	ID, err = getIDByEndpoint("https://foo/baz.git", storer)
+	s.NoError(err)
+	s.Equal(&Job{RepositoryID: ID}, j)
 
-	j, err = iter.Next()
+	j, err = iter.Next(context.Background())
 	s.Equal(io.EOF, err)
 	s.Nil(j)
 }
@@ -63,11 +126,11 @@ func (s *LineJobIterSuite) TestEmpty() {
 	r := ioutil.NopCloser(strings.NewReader(""))
 	iter := NewLineJobIter(r, nil)
 
-	j, err := iter.Next()
+	j, err := iter.Next(context.Background())
 	s.Equal(io.EOF, err)
 	s.Nil(j)
 
-	j, err = iter.Next()
+	j, err = iter.Next(context.Background())
 	s.Equal(io.EOF, err)
 	s.Nil(j)
 }
@@ -78,17 +141,17 @@ func (s *LineJobIterSuite) TestNonAbsoluteURL() {
 
 	storer := model.NewRepositoryStore(s.DB)
 
-	iter := NewLineJobIter(r, storer)
+	iter := NewLineJobIter(r, NewSQLRepositoryStore(storer))
 
-	j, err := iter.Next()
+	j, err := iter.Next(context.Background())
 	s.Error(err)
 	s.NotEqual(io.EOF, err)
 
-	j, err = iter.Next()
+	j, err = iter.Next(context.Background())
 	s.Equal(io.EOF, err)
 	s.Nil(j)
 
-	j, err = iter.Next()
+	j, err = iter.Next(context.Background())
 	s.Equal(io.EOF, err)
 	s.Nil(j)
 }
@@ -99,17 +162,17 @@ func (s *LineJobIterSuite) TestBadURL() {
 
 	storer := model.NewRepositoryStore(s.DB)
 
-	iter := NewLineJobIter(r, storer)
+	iter := NewLineJobIter(r, NewSQLRepositoryStore(storer))
 
-	j, err := iter.Next()
+	j, err := iter.Next(context.Background())
 	s.Error(err)
 	s.NotEqual(io.EOF, err)
 
-	j, err = iter.Next()
+	j, err = iter.Next(context.Background())
 	s.Equal(io.EOF, err)
 	s.Nil(j)
 
-	j, err = iter.Next()
+	j, err = iter.Next(context.Background())
 	s.Equal(io.EOF, err)
 	s.Nil(j)
 }
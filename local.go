@@ -0,0 +1,46 @@
+package borges
+
+import (
+	"path/filepath"
+
+	"gopkg.in/src-d/go-billy.v3/osfs"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+)
+
+// The repositories of the file endpoints, such as file:///srv/git/foo.git, and
+// the local paths, such as /srv/git/foo, are served in process instead of
+// running the git-upload-pack binary, which is not available in the images of
+// borges. The clones of the rest of the schemes use the transports of go-git:
+// http, https, ssh and git, the latter being the one of git daemon.
+func init() {
+	client.InstallProtocol("file", server.NewClient(localLoader{}))
+}
+
+// localLoader is a server.Loader of the repositories in the local filesystem,
+// either bare or with a worktree, found at the path of the endpoint, which
+// is relative to the working directory if it is not absolute.
+type localLoader struct{}
+
+func (localLoader) Load(ep transport.Endpoint) (storer.Storer, error) {
+	path, err := filepath.Abs(ep.Path())
+	if err != nil {
+		return nil, err
+	}
+
+	fs := osfs.New(path)
+	if fi, err := fs.Stat(".git"); err == nil && fi.IsDir() {
+		if fs, err = fs.Chroot(".git"); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := fs.Stat("objects"); err != nil {
+		return nil, transport.ErrRepositoryNotFound
+	}
+
+	return filesystem.NewStorage(fs)
+}
@@ -0,0 +1,78 @@
+package borges
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestArchiverDo_Local(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		bare     bool
+		endpoint func(path string) string
+	}{
+		{"file", false, func(p string) string { return "file://" + p }},
+		{"file bare", true, func(p string) string { return "file://" + p }},
+		{"path", false, func(p string) string { return p }},
+		{"path bare", true, func(p string) string { return p }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			require := require.New(t)
+
+			tmp, err := ioutil.TempDir("", "borges-local")
+			require.NoError(err)
+			defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+			store, rootedFs, a := newStepsArchiver(t, tmp)
+			defer func() { require.NoError(store.Close()) }()
+
+			path := filepath.Join(tmp, "repo")
+			r, err := git.PlainInit(path, c.bare)
+			require.NoError(err)
+			commitFile(t, r, "README", "foo")
+			head, err := r.Reference(plumbing.ReferenceName("refs/heads/master"), true)
+			require.NoError(err)
+
+			mr := model.NewRepository()
+			mr.Endpoints = []string{c.endpoint(path)}
+			require.NoError(store.Create(mr))
+			require.NoError(a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)}))
+
+			stored, err := store.Get(mr.ID)
+			require.NoError(err)
+			require.Equal(model.FetchStatus(model.Fetched), stored.Status)
+			require.Len(stored.References, 1)
+			require.Equal(model.SHA1(head.Hash()), stored.References[0].Init)
+
+			requireObjectsInSiva(t, rootedFs, head.Hash(), []plumbing.Hash{head.Hash()}, nil)
+		})
+	}
+}
+
+func TestArchiverDo_LocalNotFound(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("", "borges-local")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	store, _, a := newStepsArchiver(t, tmp)
+	defer func() { require.NoError(store.Close()) }()
+
+	mr := model.NewRepository()
+	mr.Endpoints = []string{"file://" + filepath.Join(tmp, "missing")}
+	require.NoError(store.Create(mr))
+	require.NoError(a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)}))
+
+	stored, err := store.Get(mr.ID)
+	require.NoError(err)
+	require.Equal(Gone, stored.Status)
+}
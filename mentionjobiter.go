@@ -1,56 +1,170 @@
 package borges
 
 import (
-	"gopkg.in/src-d/core-retrieval.v0/model"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	rmodel "gopkg.in/src-d/core-retrieval.v0/model"
 	"gopkg.in/src-d/framework.v0/queue"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 )
 
+// MentionJobIterOptions are the options of the JobIter of NewMentionJobIter.
+// The zero value is receiving the mentions one by one, without checkpoint.
+type MentionJobIterOptions struct {
+	// Window is the number of mentions received from the queue and not
+	// acknowledged yet at once. The mentions are acknowledged once their
+	// jobs are published, so it must be at least the number of jobs that
+	// the producer publishes together, such as its BatchSize. Zero means
+	// one.
+	Window int
+	// CheckpointFile, if set, is the file where the IDs of the last
+	// mentions acknowledged are saved, as many as Window, before
+	// acknowledging them. A new iterator with the same file skips the
+	// mentions with those IDs, which are the ones delivered again if the
+	// producer stopped after publishing their jobs and before
+	// acknowledging them, so their jobs are not published twice.
+	CheckpointFile string
+}
+
 type mentionJobIter struct {
-	storer *model.RepositoryStore
+	storer RepositoryStore
 	q      queue.Queue
+	opts   MentionJobIterOptions
 	iter   queue.JobIter
+
+	m          sync.Mutex
+	pending    map[*Job]*pendingMention
+	checkpoint *mentionCheckpoint
+}
+
+// pendingMention is the mention of a job returned by Next and not
+// acknowledged yet.
+type pendingMention struct {
+	job      *queue.Job
+	endpoint string
 }
 
 // NewMentionJobIter returns a JobIter that returns jobs generated from
-// mentions received from a queue (e.g. from rovers).
-func NewMentionJobIter(q queue.Queue, storer *model.RepositoryStore) JobIter {
+// mentions received from a queue (e.g. from rovers). It is an AckingJobIter:
+// the mentions are acknowledged once their jobs are published, so they are
+// delivered again if the producer stops before. It is also an EndpointJobIter.
+func NewMentionJobIter(q queue.Queue, storer RepositoryStore,
+	opts MentionJobIterOptions) JobIter {
+	if opts.Window <= 0 {
+		opts.Window = 1
+	}
+
 	return &mentionJobIter{
-		storer: storer,
-		q:      q,
+		storer:  storer,
+		q:       q,
+		opts:    opts,
+		pending: make(map[*Job]*pendingMention),
 	}
 }
 
-func (i *mentionJobIter) Next() (*Job, error) {
+func (i *mentionJobIter) Next(ctx context.Context) (*Job, error) {
 	if err := i.initIter(); err != nil {
 		return nil, err
 	}
 
-	endpoint, j, err := i.getEndpoint()
+	for {
+		mention, j, err := i.getMention(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		i.m.Lock()
+		queued := i.checkpoint.contains(j.ID)
+		i.m.Unlock()
+		if queued {
+			log.Debug("mention already queued, skipped", "module", "producer",
+				"mention", j.ID, "endpoint", mention.Endpoint)
+			if err := j.Ack(); err != nil {
+				return nil, err
+			}
 
-	if err != nil {
-		return nil, err
+			continue
+		}
+
+		endpoint := MentionEndpoint(mention)
+		ID, err := ProviderRepositoryID(endpoint, mention.Provider, i.storer)
+		if err != nil {
+			return nil, err
+		}
+
+		bj := &Job{
+			RepositoryID: ID,
+			Priority:     mentionPriority(mention),
+			Timeout:      mentionTimeout(mention),
+		}
+
+		i.m.Lock()
+		i.pending[bj] = &pendingMention{job: j, endpoint: endpoint}
+		i.m.Unlock()
+		return bj, nil
+	}
+}
+
+// Ack acknowledges the mention of the job, saving its ID in the checkpoint
+// first, or requeues it if the job could not be published.
+func (i *mentionJobIter) Ack(j *Job, err error) error {
+	i.m.Lock()
+	defer i.m.Unlock()
+
+	pm, ok := i.pending[j]
+	if !ok {
+		return nil
 	}
 
-	ID, err := RepositoryID(endpoint, i.storer)
+	delete(i.pending, j)
 	if err != nil {
-		return nil, err
+		return pm.job.Reject(true)
 	}
 
-	bj := &Job{RepositoryID: ID}
+	// the mention is acknowledged even if the checkpoint cannot be saved,
+	// since its job is already published
+	saveErr := i.checkpoint.save(pm.job.ID)
+	if err := pm.job.Ack(); err != nil {
+		return err
+	}
 
-	if err := j.Ack(); err != nil {
-		return nil, err
+	return saveErr
+}
+
+// Endpoint returns the endpoint of the mention of the job.
+func (i *mentionJobIter) Endpoint(j *Job) string {
+	i.m.Lock()
+	defer i.m.Unlock()
+
+	if pm, ok := i.pending[j]; ok {
+		return pm.endpoint
 	}
 
-	return bj, nil
+	return ""
 }
 
-// initIter initialize the iterator if it is not already initialized.
+// initIter initialize the iterator if it is not already initialized, loading
+// the checkpoint the first time.
 func (i *mentionJobIter) initIter() error {
+	if i.checkpoint == nil {
+		c, err := loadMentionCheckpoint(i.opts.CheckpointFile, i.opts.Window)
+		if err != nil {
+			return err
+		}
+
+		i.checkpoint = c
+	}
+
 	if i.iter == nil {
-		awnd := 1
-		iter, err := i.q.Consume(awnd)
+		iter, err := i.q.Consume(i.opts.Window)
 		if err != nil {
 			return err
 		}
@@ -61,23 +175,159 @@ func (i *mentionJobIter) initIter() error {
 	return nil
 }
 
-// getEndpoint obtains the next Job from the queue and decodes the mention on it.
-// If success, the endpoint into the mention is returned. Also the job itself is
-// returned, to be able to send back the ACK.
-func (i *mentionJobIter) getEndpoint() (string, *queue.Job, error) {
-	j, err := i.iter.Next()
+// getMention obtains the next Job from the queue and decodes the mention on it.
+// Also the job itself is returned, to be able to send back the ACK. If the
+// queue iterator was closed, io.EOF is returned.
+func (i *mentionJobIter) getMention(ctx context.Context) (*rmodel.Mention, *queue.Job, error) {
+	j, err := i.nextJob(ctx)
+	if err == queue.ErrAlreadyClosed {
+		return nil, nil, io.EOF
+	}
+
 	if err != nil {
-		return "", nil, err
+		return nil, nil, err
 	}
 	var mention rmodel.Mention
 	if err := j.Decode(&mention); err != nil {
-		return "", nil, err
+		return nil, nil, err
+	}
+	return &mention, j, nil
+}
+
+type nextJobResult struct {
+	job *queue.Job
+	err error
+}
+
+// nextJob obtains the next Job from the queue iterator. If the context is
+// cancelled before, the queue iterator is closed, the job returned by it
+// afterwards, if any, is sent back to the queue and the context error is
+// returned. A new queue iterator is created in the next call.
+func (i *mentionJobIter) nextJob(ctx context.Context) (*queue.Job, error) {
+	iter := i.iter
+	ch := make(chan nextJobResult, 1)
+	go func() {
+		j, err := iter.Next()
+		ch <- nextJobResult{j, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.job, r.err
+	case <-ctx.Done():
+		i.iter = nil
+		if err := iter.Close(); err != nil {
+			log.Warn("error closing mention iterator", "err", err)
+		}
+
+		go func() {
+			if r := <-ch; r.job != nil {
+				_ = r.job.Reject(true)
+			}
+		}()
+
+		return nil, ctx.Err()
+	}
+}
+
+const (
+	// MentionSizeKey is the key of the mention context holding the size of
+	// the repository in kilobytes, as reported by its provider.
+	MentionSizeKey = "size"
+	// MentionHostKey is the key of the mention context holding the host of
+	// the self-hosted instance of the provider the repository is in, such
+	// as gitlab.example.com.
+	MentionHostKey = "host"
+	// SmallRepositorySize is the maximum size in kilobytes of the
+	// repositories whose jobs are given HighPriority.
+	SmallRepositorySize = 10 * 1024
+	// LargeRepositorySize is the minimum size in kilobytes of the
+	// repositories whose jobs are given LargeRepositoryTimeout.
+	LargeRepositorySize = 1024 * 1024
+	// LargeRepositoryTimeout is the timeout of the jobs of large
+	// repositories, which usually take longer than the default one.
+	LargeRepositoryTimeout = 6 * time.Hour
+)
+
+// MentionEndpoint returns the endpoint the repository of the mention is cloned
+// from. The mentions of a provider such as github, gitlab or bitbucket can have
+// only the path of the repository as their endpoint, such as foo/bar, or
+// group/subgroup/bar in GitLab, which is made an https URL of the host in the
+// MentionHostKey context key, if any, or the one of the public instance of
+// the provider, which can also be at the start of the path. Other endpoints
+// are returned as they are.
+func MentionEndpoint(m *rmodel.Mention) string {
+	p := m.Endpoint
+	if strings.HasPrefix(p, "/") || strings.HasPrefix(p, ".") {
+		return p
+	}
+
+	if ep, err := transport.NewEndpoint(p); err != nil || ep.Protocol() != "file" {
+		return p
+	}
+
+	host := m.Context[MentionHostKey]
+	if host == "" {
+		host = providerHost(m.Provider)
+	}
+
+	path := strings.Trim(p, "/")
+	if host == "" || path == "" {
+		return p
+	}
+
+	// endpoints with the host but without scheme, such as gitlab.com/foo/bar
+	if strings.HasPrefix(strings.ToLower(path), strings.ToLower(host)+"/") {
+		path = path[len(host)+1:]
+	}
+
+	u := &url.URL{Scheme: "https", Host: host, Path: "/" + path}
+	return u.String()
+}
+
+// mentionSize returns the size of the repository in kilobytes reported by the
+// provider, if any.
+func mentionSize(m *rmodel.Mention) (uint64, bool) {
+	size, err := strconv.ParseUint(m.Context[MentionSizeKey], 10, 64)
+	return size, err == nil
+}
+
+// mentionPriority returns HighPriority if the provider reported that the
+// repository is small, and NormalPriority otherwise.
+func mentionPriority(m *rmodel.Mention) JobPriority {
+	size, ok := mentionSize(m)
+	if !ok || size > SmallRepositorySize {
+		return NormalPriority
 	}
-	// TODO normalize mention endpoint
-	return mention.Endpoint, j, nil
+
+	return HighPriority
+}
+
+// mentionTimeout returns LargeRepositoryTimeout if the provider reported that
+// the repository is large, and zero otherwise, which means using the default
+// timeout.
+func mentionTimeout(m *rmodel.Mention) time.Duration {
+	size, ok := mentionSize(m)
+	if !ok || size < LargeRepositorySize {
+		return 0
+	}
+
+	return LargeRepositoryTimeout
 }
 
+// Close sends back to the queue the mentions whose jobs were not acknowledged
+// and closes the queue iterator.
 func (i *mentionJobIter) Close() error {
+	i.m.Lock()
+	for j, pm := range i.pending {
+		if err := pm.job.Reject(true); err != nil {
+			log.Warn("error requeueing mention", "mention", pm.job.ID, "err", err)
+		}
+
+		delete(i.pending, j)
+	}
+	i.m.Unlock()
+
 	if i.iter != nil {
 		if err := i.iter.Close(); err != nil {
 			return err
@@ -86,3 +336,69 @@ func (i *mentionJobIter) Close() error {
 
 	return nil
 }
+
+// mentionCheckpoint is the set of the IDs of the last mentions acknowledged,
+// saved in a file, one per line, with the oldest first.
+type mentionCheckpoint struct {
+	path string
+	size int
+	ids  []string
+}
+
+// loadMentionCheckpoint returns the checkpoint saved in the given file, which
+// keeps the given number of IDs. If path is empty, the checkpoint keeps
+// nothing.
+func loadMentionCheckpoint(path string, size int) (*mentionCheckpoint, error) {
+	c := &mentionCheckpoint{path: path, size: size}
+	if path == "" {
+		return c, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.ids = strings.Fields(string(content))
+	if len(c.ids) > 0 {
+		log.Info("resuming from the mentions checkpoint", "module", "producer",
+			"file", path, "last", c.ids[len(c.ids)-1])
+	}
+
+	return c, nil
+}
+
+func (c *mentionCheckpoint) contains(id string) bool {
+	for _, cid := range c.ids {
+		if cid == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// save adds the ID to the checkpoint, dropping the oldest ones beyond its
+// size, and writes it to its file.
+func (c *mentionCheckpoint) save(id string) error {
+	if c.path == "" {
+		return nil
+	}
+
+	c.ids = append(c.ids, id)
+	if len(c.ids) > c.size {
+		c.ids = c.ids[len(c.ids)-c.size:]
+	}
+
+	tmp := c.path + ".tmp"
+	content := strings.Join(c.ids, "\n") + "\n"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, c.path)
+}
@@ -0,0 +1,233 @@
+package borges
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/framework.v0/queue"
+)
+
+func TestMentionJobIterSuite(t *testing.T) {
+	suite.Run(t, new(MentionJobIterSuite))
+}
+
+type MentionJobIterSuite struct {
+	BaseQueueSuite
+	storer *model.RepositoryStore
+}
+
+func (s *MentionJobIterSuite) SetupTest() {
+	s.BaseQueueSuite.SetupTest()
+	DropTables("repository")
+	DropIndexes("idx_endpoints")
+	CreateRepositoryTable()
+	s.storer = core.ModelRepositoryStore()
+}
+
+func (s *MentionJobIterSuite) publishMention(endpoint string) {
+	j := queue.NewJob()
+	s.NoError(j.Encode(&model.Mention{
+		VCS:      model.GIT,
+		Provider: "TEST_PROVIDER",
+		Endpoint: endpoint,
+	}))
+	s.NoError(s.queue.Publish(j))
+}
+
+func (s *MentionJobIterSuite) TestNext() {
+	require := require.New(s.T())
+	s.publishMention(testEndpoint)
+
+	iter := NewMentionJobIter(s.queue, NewSQLRepositoryStore(s.storer), MentionJobIterOptions{})
+	j, err := iter.Next(context.Background())
+	require.NoError(err)
+
+	ID, err := getIDByEndpoint(testEndpoint, s.storer)
+	require.NoError(err)
+	require.Equal(&Job{RepositoryID: ID}, j)
+
+	require.NoError(iter.Close())
+}
+
+func (s *MentionJobIterSuite) TestNext_SameEndpoint() {
+	require := require.New(s.T())
+	s.publishMention(testEndpoint)
+	s.publishMention(testEndpoint)
+
+	iter := NewMentionJobIter(s.queue, NewSQLRepositoryStore(s.storer), MentionJobIterOptions{})
+	j1, err := iter.Next(context.Background())
+	require.NoError(err)
+	require.NoError(iter.(AckingJobIter).Ack(j1, nil))
+	j2, err := iter.Next(context.Background())
+	require.NoError(err)
+	require.Equal(j1.RepositoryID, j2.RepositoryID)
+
+	require.NoError(iter.Close())
+}
+
+func (s *MentionJobIterSuite) TestNext_Closed() {
+	require := require.New(s.T())
+	s.publishMention(testEndpoint)
+
+	iter := NewMentionJobIter(s.queue, NewSQLRepositoryStore(s.storer), MentionJobIterOptions{})
+	_, err := iter.Next(context.Background())
+	require.NoError(err)
+	require.NoError(iter.Close())
+
+	j, err := iter.Next(context.Background())
+	require.Equal(io.EOF, err)
+	require.Nil(j)
+}
+
+func TestMentionJobIter_Checkpoint(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("", "borges-mention-checkpoint")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	store, err := OpenBoltRepositoryStore(filepath.Join(tmp, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	q, err := queue.NewMemoryBroker().Queue("mentions")
+	require.NoError(err)
+
+	publish := func(id, endpoint string) {
+		j := queue.NewJob()
+		if id != "" {
+			j.ID = id
+		}
+
+		require.NoError(j.Encode(&model.Mention{VCS: model.GIT, Endpoint: endpoint}))
+		require.NoError(q.Publish(j))
+	}
+
+	repoID := func(endpoint string) string {
+		id, err := RepositoryID(endpoint, store)
+		require.NoError(err)
+		return id.String()
+	}
+
+	publish("mention-1", "git://foo/bar")
+	publish("mention-2", "git://foo/baz")
+
+	checkpoint := filepath.Join(tmp, "checkpoint")
+	opts := MentionJobIterOptions{Window: 2, CheckpointFile: checkpoint}
+	iter := NewMentionJobIter(q, store, opts).(AckingJobIter)
+	j1, err := iter.Next(context.Background())
+	require.NoError(err)
+	j2, err := iter.Next(context.Background())
+	require.NoError(err)
+	require.Equal("git://foo/bar", iter.(EndpointJobIter).Endpoint(j1))
+	require.Equal("git://foo/baz", iter.(EndpointJobIter).Endpoint(j2))
+
+	// the mentions are acknowledged once their jobs are published
+	_, err = os.Stat(checkpoint)
+	require.True(os.IsNotExist(err))
+	require.NoError(iter.Ack(j1, nil))
+	require.NoError(iter.Ack(j2, errors.New("publish error")))
+	require.Empty(iter.(EndpointJobIter).Endpoint(j1))
+	require.NoError(iter.Close())
+
+	content, err := ioutil.ReadFile(checkpoint)
+	require.NoError(err)
+	require.Equal("mention-1\n", string(content))
+
+	// the first mention is delivered again, as it would be if the producer
+	// had stopped before acknowledging it, and is skipped on restart, while
+	// the requeued one is returned again
+	publish("mention-1", "git://foo/bar")
+	publish("", "git://foo/qux")
+
+	iter = NewMentionJobIter(q, store, opts).(AckingJobIter)
+	var ids []string
+	for range []int{1, 2} {
+		j, err := iter.Next(context.Background())
+		require.NoError(err)
+		require.NoError(iter.Ack(j, nil))
+		ids = append(ids, j.RepositoryID.String())
+	}
+
+	require.NoError(iter.Close())
+	require.Equal([]string{repoID("git://foo/baz"), repoID("git://foo/qux")}, ids)
+
+	content, err = ioutil.ReadFile(checkpoint)
+	require.NoError(err)
+	require.Len(strings.Fields(string(content)), 2)
+	require.Equal("mention-2", strings.Fields(string(content))[0])
+}
+
+func TestMentionPriority(t *testing.T) {
+	require := require.New(t)
+
+	m := &model.Mention{Context: map[string]string{MentionSizeKey: "42"}}
+	require.Equal(HighPriority, mentionPriority(m))
+
+	m.Context[MentionSizeKey] = "1048576"
+	require.Equal(NormalPriority, mentionPriority(m))
+
+	m.Context[MentionSizeKey] = "foo"
+	require.Equal(NormalPriority, mentionPriority(m))
+
+	require.Equal(NormalPriority, mentionPriority(&model.Mention{}))
+}
+
+func TestMentionTimeout(t *testing.T) {
+	require := require.New(t)
+
+	m := &model.Mention{Context: map[string]string{MentionSizeKey: "2097152"}}
+	require.Equal(LargeRepositoryTimeout, mentionTimeout(m))
+
+	m.Context[MentionSizeKey] = "42"
+	require.Equal(time.Duration(0), mentionTimeout(m))
+
+	require.Equal(time.Duration(0), mentionTimeout(&model.Mention{}))
+}
+
+func TestMentionEndpoint(t *testing.T) {
+	require := require.New(t)
+
+	selfHosted := map[string]string{MentionHostKey: "git.example.com"}
+	cases := []struct {
+		provider string
+		endpoint string
+		context  map[string]string
+		expected string
+	}{
+		{"github", "foo/bar", nil, "https://github.com/foo/bar"},
+		{"GitHub", "/foo/bar/", nil, "/foo/bar/"},
+		{"github", "github.com/foo/bar", nil, "https://github.com/foo/bar"},
+		{"github", "foo/bar", selfHosted, "https://git.example.com/foo/bar"},
+		{"gitlab", "group/subgroup/bar", nil, "https://gitlab.com/group/subgroup/bar"},
+		{"gitlab", "gitlab.com/group/bar.git", nil, "https://gitlab.com/group/bar.git"},
+		{"gitlab", "group/bar", selfHosted, "https://git.example.com/group/bar"},
+		{"gitlab", "git.example.com/group/bar", selfHosted, "https://git.example.com/group/bar"},
+		{"bitbucket", "foo/bar", nil, "https://bitbucket.org/foo/bar"},
+		{"bitbucket", "scm/proj/bar.git", selfHosted, "https://git.example.com/scm/proj/bar.git"},
+		// full endpoints are kept
+		{"gitlab", "git@gitlab.com:group/bar.git", nil, "git@gitlab.com:group/bar.git"},
+		{"bitbucket", "https://bitbucket.org/foo/bar", selfHosted, "https://bitbucket.org/foo/bar"},
+		// paths of unknown providers and local paths are kept
+		{"TEST_PROVIDER", "foo/bar", nil, "foo/bar"},
+		{"", "foo/bar", nil, "foo/bar"},
+		{"github", "./foo/bar", nil, "./foo/bar"},
+		{"github", "", nil, ""},
+	}
+
+	for _, c := range cases {
+		m := &model.Mention{Provider: c.provider, Endpoint: c.endpoint, Context: c.context}
+		require.Equal(c.expected, MentionEndpoint(m), "%s %s", c.provider, c.endpoint)
+	}
+}
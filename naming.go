@@ -0,0 +1,337 @@
+package borges
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-errors.v0"
+)
+
+var (
+	ErrInvalidNaming = errors.NewKind("invalid siva naming %q: %s")
+)
+
+const (
+	// HashNamingName is the name of the naming of HashNaming.
+	HashNamingName = "hash"
+	// BucketNamingName is the name of the naming of BucketNaming.
+	BucketNamingName = "bucketed"
+	// DateNamingName is the name of the naming of DateNaming.
+	DateNamingName = "date"
+
+	// DefaultBucketSize is the bucket size of the bucketed naming if none
+	// is given.
+	DefaultBucketSize = 2
+	// DefaultDateLayout is the layout of the partitions of the date
+	// naming, one directory per year with one per month inside.
+	DefaultDateLayout = "2006/01"
+)
+
+// SivaNaming sets where the files of the rooted repositories, such as their
+// siva files and the manifests of their versions, are stored in their
+// filesystem, from the names they have at its root, which start with the hash
+// of their root. The same naming must be used to store the files and to look
+// them up. See NewNamingFilesystem.
+type SivaNaming interface {
+	// Path returns the path in fs of the file with the given name: the one
+	// of the file if it exists, or the one where it is created otherwise.
+	Path(fs billy.Filesystem, name string) (string, error)
+	// Walk calls fn with the path and the info of every file stored in fs
+	// following the naming, in no particular order, stopping at the first
+	// error. The directories of the naming are not passed to fn.
+	Walk(fs billy.Filesystem, fn func(path string, fi os.FileInfo) error) error
+}
+
+// NewSivaNaming returns the naming with the given name: HashNamingName,
+// BucketNamingName, with the given bucket size or DefaultBucketSize if it is
+// zero, or DateNamingName, with DefaultDateLayout. For compatibility with the
+// buckets set before the namings existed, hash naming with a bucket size
+// greater than zero is the bucketed one.
+func NewSivaNaming(name string, bucketSize int) (SivaNaming, error) {
+	if bucketSize < 0 {
+		return nil, ErrInvalidNaming.New(name, "negative bucket size")
+	}
+
+	switch name {
+	case HashNamingName:
+		if bucketSize > 0 {
+			return BucketNaming(bucketSize), nil
+		}
+
+		return HashNaming(), nil
+	case BucketNamingName:
+		if bucketSize == 0 {
+			bucketSize = DefaultBucketSize
+		}
+
+		return BucketNaming(bucketSize), nil
+	case DateNamingName:
+		if bucketSize > 0 {
+			return nil, ErrInvalidNaming.New(name, "bucket size not supported")
+		}
+
+		return DateNaming(DefaultDateLayout), nil
+	default:
+		return nil, ErrInvalidNaming.New(name, "unknown naming")
+	}
+}
+
+// HashNaming returns the SivaNaming storing the files at the root of their
+// filesystem, named after the hash of their root.
+func HashNaming() SivaNaming {
+	return hashNaming{}
+}
+
+type hashNaming struct{}
+
+func (hashNaming) Path(fs billy.Filesystem, name string) (string, error) {
+	return name, nil
+}
+
+func (hashNaming) Walk(fs billy.Filesystem, fn func(string, os.FileInfo) error) error {
+	return walkFiles(fs, "", fn)
+}
+
+// BucketNaming returns the SivaNaming storing the files in directories named
+// after the first size characters of their name, so a rooted repository
+// stored as f7b877701fbf855b44c0a9e86f3fdce2c298b07f.siva ends up in
+// f7/f7b877701fbf855b44c0a9e86f3fdce2c298b07f.siva with a size of 2. This
+// keeps the number of files per directory low when storing many rooted
+// repositories. If size is zero or less, it is HashNaming.
+func BucketNaming(size int) SivaNaming {
+	if size <= 0 {
+		return HashNaming()
+	}
+
+	return bucketNaming(size)
+}
+
+type bucketNaming int
+
+func (n bucketNaming) Path(fs billy.Filesystem, name string) (string, error) {
+	if len(name) <= int(n) {
+		return name, nil
+	}
+
+	return path.Join(name[:n], name), nil
+}
+
+func (n bucketNaming) Walk(fs billy.Filesystem, fn func(string, os.FileInfo) error) error {
+	fis, err := readDirIfExists(fs, "")
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range fis {
+		if !fi.IsDir() || len(fi.Name()) != int(n) {
+			continue
+		}
+
+		err := walkFiles(fs, fi.Name(), func(p string, bfi os.FileInfo) error {
+			if !strings.HasPrefix(bfi.Name(), fi.Name()) {
+				return nil
+			}
+
+			return fn(p, bfi)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DateNaming returns the SivaNaming storing the files in directories named
+// after the time they are first created, formatted with the given layout, as
+// in time.Format, whose slashes separate nested directories, such as
+// DefaultDateLayout. The files keep the directory where they were created, so
+// looking one up searches every directory of the layout, which takes a read
+// of each one.
+func DateNaming(layout string) SivaNaming {
+	return &dateNaming{layout: layout, now: time.Now}
+}
+
+type dateNaming struct {
+	layout string
+	now    func() time.Time
+}
+
+func (n *dateNaming) Path(fs billy.Filesystem, name string) (string, error) {
+	var found string
+	err := n.walkPartitions(fs, func(dir string) error {
+		p := path.Join(dir, name)
+		_, err := fs.Stat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		found = p
+		return errStopWalk
+	})
+	if err != nil && err != errStopWalk {
+		return "", err
+	}
+
+	if found != "" {
+		return found, nil
+	}
+
+	return path.Join(n.now().Format(n.layout), name), nil
+}
+
+func (n *dateNaming) Walk(fs billy.Filesystem, fn func(string, os.FileInfo) error) error {
+	return n.walkPartitions(fs, func(dir string) error {
+		return walkFiles(fs, dir, fn)
+	})
+}
+
+// walkPartitions calls fn with every directory of the layout in fs, that is,
+// the ones nested as many levels as the layout has.
+func (n *dateNaming) walkPartitions(fs billy.Filesystem, fn func(dir string) error) error {
+	return walkLevels(fs, "", strings.Count(n.layout, "/")+1, fn)
+}
+
+func walkLevels(fs billy.Filesystem, dir string, levels int, fn func(dir string) error) error {
+	if levels == 0 {
+		return fn(dir)
+	}
+
+	fis, err := readDirIfExists(fs, dir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+
+		if err := walkLevels(fs, path.Join(dir, fi.Name()), levels-1, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// errStopWalk stops a walk before visiting every directory.
+var errStopWalk = fmt.Errorf("walk stopped")
+
+// walkFiles calls fn with the path and the info of the files in the directory
+// dir of fs, which may not exist.
+func walkFiles(fs billy.Filesystem, dir string, fn func(string, os.FileInfo) error) error {
+	fis, err := readDirIfExists(fs, dir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+
+		if err := fn(path.Join(dir, fi.Name()), fi); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NewNamingFilesystem returns a billy.Filesystem that stores the files at the
+// root of the given filesystem where the naming sets, so they are used as if
+// they were at its root. The files in directories are stored as they are. If
+// naming is nil, the filesystem is returned as is.
+func NewNamingFilesystem(fs billy.Filesystem, naming SivaNaming) billy.Filesystem {
+	if naming == nil {
+		return fs
+	}
+
+	return &namingFilesystem{Filesystem: fs, naming: naming}
+}
+
+type namingFilesystem struct {
+	billy.Filesystem
+	naming SivaNaming
+}
+
+func (fs *namingFilesystem) Create(filename string) (billy.File, error) {
+	return fs.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *namingFilesystem) Open(filename string) (billy.File, error) {
+	return fs.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (fs *namingFilesystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	p, err := fs.path(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if flag&os.O_CREATE != 0 {
+		if err := fs.MkdirAll(path.Dir(p), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	return fs.Filesystem.OpenFile(p, flag, perm)
+}
+
+func (fs *namingFilesystem) Stat(filename string) (os.FileInfo, error) {
+	p, err := fs.path(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.Filesystem.Stat(p)
+}
+
+func (fs *namingFilesystem) Rename(from, to string) error {
+	fromPath, err := fs.path(from)
+	if err != nil {
+		return err
+	}
+
+	toPath, err := fs.path(to)
+	if err != nil {
+		return err
+	}
+
+	if dir := path.Dir(toPath); dir != "." {
+		if err := fs.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	return fs.Filesystem.Rename(fromPath, toPath)
+}
+
+func (fs *namingFilesystem) Remove(filename string) error {
+	p, err := fs.path(filename)
+	if err != nil {
+		return err
+	}
+
+	return fs.Filesystem.Remove(p)
+}
+
+// path returns the path of the given file according to the naming. Only the
+// files at the root are named by it.
+func (fs *namingFilesystem) path(filename string) (string, error) {
+	filename = strings.TrimPrefix(filename, "/")
+	if strings.Contains(filename, "/") {
+		return filename, nil
+	}
+
+	return fs.naming.Path(fs.Filesystem, filename)
+}
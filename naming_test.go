@@ -0,0 +1,88 @@
+package borges
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+	"gopkg.in/src-d/go-billy.v3/util"
+)
+
+func TestNewSivaNaming(t *testing.T) {
+	require := require.New(t)
+
+	for _, c := range []struct {
+		name       string
+		bucketSize int
+		expected   SivaNaming
+	}{
+		{HashNamingName, 0, HashNaming()},
+		{HashNamingName, 3, BucketNaming(3)},
+		{BucketNamingName, 0, BucketNaming(DefaultBucketSize)},
+		{BucketNamingName, 1, BucketNaming(1)},
+	} {
+		n, err := NewSivaNaming(c.name, c.bucketSize)
+		require.NoError(err, c.name)
+		require.Equal(c.expected, n, c.name)
+	}
+
+	n, err := NewSivaNaming(DateNamingName, 0)
+	require.NoError(err)
+	require.Equal(DefaultDateLayout, n.(*dateNaming).layout)
+
+	for _, c := range []struct {
+		name       string
+		bucketSize int
+	}{{"foo", 0}, {BucketNamingName, -1}, {DateNamingName, 2}} {
+		_, err := NewSivaNaming(c.name, c.bucketSize)
+		require.True(ErrInvalidNaming.Is(err), "%s: %v", c.name, err)
+	}
+}
+
+func TestDateNaming(t *testing.T) {
+	require := require.New(t)
+
+	fs := memfs.New()
+	naming := DateNaming(DefaultDateLayout).(*dateNaming)
+	naming.now = func() time.Time { return time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC) }
+	nfs := NewNamingFilesystem(fs, naming)
+
+	const name = "f7b877701fbf855b44c0a9e86f3fdce2c298b07f.siva"
+	require.NoError(util.WriteFile(nfs, name, []byte("foo"), 0644))
+	_, err := fs.Stat("2017/07/" + name)
+	require.NoError(err)
+
+	// the files stay where they were created
+	naming.now = func() time.Time { return time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC) }
+	require.NoError(util.WriteFile(nfs, name, []byte("bar"), 0644))
+	require.NoError(util.WriteFile(nfs, name+".tmp", []byte("baz"), 0644))
+	require.NoError(nfs.Rename(name+".tmp", name))
+
+	f, err := nfs.Open(name)
+	require.NoError(err)
+	content, err := ioutil.ReadAll(f)
+	require.NoError(err)
+	require.NoError(f.Close())
+	require.Equal("baz", string(content))
+	_, err = fs.Stat("2018/01/" + name)
+	require.True(os.IsNotExist(err))
+
+	const other = "cc1e2e4a2a2ed9a1a7ac8b4e9e03a9c4fc4e8b4b.siva"
+	require.NoError(util.WriteFile(nfs, other, []byte("foo"), 0644))
+
+	var paths []string
+	require.NoError(naming.Walk(fs, func(p string, fi os.FileInfo) error {
+		paths = append(paths, p)
+		return nil
+	}))
+	sort.Strings(paths)
+	require.Equal([]string{"2017/07/" + name, "2018/01/" + other}, paths)
+
+	require.NoError(nfs.Remove(name))
+	_, err = fs.Stat("2017/07/" + name)
+	require.True(os.IsNotExist(err))
+}
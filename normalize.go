@@ -0,0 +1,236 @@
+package borges
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/src-d/go-errors.v0"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+var (
+	ErrInvalidNormalizationRule = errors.NewKind("invalid normalization rule for host %s: %s")
+)
+
+// NormalizationRule sets how the endpoints of the hosts matching its Host
+// pattern are normalized, see EndpointNormalizer.
+type NormalizationRule struct {
+	// Host is a pattern, as in path.Match, matched against the endpoint host.
+	Host string `json:"host"`
+	// Scheme, if set, is the scheme of the normalized endpoints, such as
+	// https, so the SSH and HTTPS endpoints of a repository are the same.
+	// Only SSH endpoints keep their user. Otherwise, the scheme is kept,
+	// and SCP-like endpoints become ssh:// URLs.
+	Scheme string `json:"scheme,omitempty"`
+	// TrimGitSuffix removes the .git suffix of the path.
+	TrimGitSuffix bool `json:"trim_git_suffix,omitempty"`
+	// Lowercase makes the path lowercase, for the hosts whose paths are
+	// case insensitive. The host is always made lowercase.
+	Lowercase bool `json:"lowercase,omitempty"`
+}
+
+// DefaultNormalizationRules are the rules of the providers whose repositories
+// can be cloned by HTTPS with paths that are case insensitive and have an
+// optional .git suffix.
+var DefaultNormalizationRules = []*NormalizationRule{
+	{Host: "github.com", Scheme: "https", TrimGitSuffix: true, Lowercase: true},
+	{Host: "gitlab.com", Scheme: "https", TrimGitSuffix: true, Lowercase: true},
+	{Host: "bitbucket.org", Scheme: "https", TrimGitSuffix: true, Lowercase: true},
+}
+
+// providerHosts are the hosts of the public instances of the providers, by
+// their name in the mentions.
+var providerHosts = map[string]string{
+	string(GitHubProvider): "github.com",
+	string(GitLabProvider): "gitlab.com",
+	"bitbucket":            "bitbucket.org",
+}
+
+// providerHost returns the host of the public instance of the provider with
+// the given name, which is case insensitive, or an empty string if it is not
+// known.
+func providerHost(provider string) string {
+	return providerHosts[strings.ToLower(provider)]
+}
+
+// LoadNormalizationRules reads a JSON file containing a list of rules.
+func LoadNormalizationRules(filename string) ([]*NormalizationRule, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var rules []*NormalizationRule
+	if err := json.NewDecoder(f).Decode(&rules); err != nil {
+		return nil, err
+	}
+
+	for _, r := range rules {
+		if _, err := path.Match(r.Host, ""); err != nil {
+			return nil, ErrInvalidNormalizationRule.New(r.Host, err)
+		}
+
+		switch r.Scheme {
+		case "", "http", "https", "ssh", "git":
+		default:
+			return nil, ErrInvalidNormalizationRule.New(r.Host,
+				fmt.Sprintf("unsupported scheme %s", r.Scheme))
+		}
+	}
+
+	return rules, nil
+}
+
+// EndpointNormalizer makes the equivalent endpoints of a repository, such as
+// https://github.com/foo/bar, https://github.com/foo/bar.git and
+// git@github.com:foo/bar, the same endpoint, so they get the same repository
+// ID. Each endpoint is normalized by the first rule matching its host. The
+// endpoints of other hosts are left as they are.
+type EndpointNormalizer struct {
+	rules []*NormalizationRule
+}
+
+// NewEndpointNormalizer returns an EndpointNormalizer with the given rules.
+func NewEndpointNormalizer(rules []*NormalizationRule) *EndpointNormalizer {
+	return &EndpointNormalizer{rules: rules}
+}
+
+// Normalize returns the normalized endpoint. Endpoints that cannot be parsed,
+// local ones and the ones of hosts without a rule are returned as they are.
+// A nil normalizer returns every endpoint as it is.
+func (n *EndpointNormalizer) Normalize(endpoint string) string {
+	return n.NormalizeProvider(endpoint, "")
+}
+
+// NormalizeProvider returns the normalized endpoint of a repository of the
+// given provider, such as github, gitlab or bitbucket. Unlike Normalize, the
+// endpoints of hosts without a rule, such as the ones of self-hosted
+// instances of the provider, are normalized by the rule of the public host of
+// the provider, if there is one, but keeping their scheme, as self-hosted
+// instances may serve each scheme in a different path or port.
+func (n *EndpointNormalizer) NormalizeProvider(endpoint, provider string) string {
+	if n == nil {
+		return endpoint
+	}
+
+	ep, err := transport.NewEndpoint(endpoint)
+	if err != nil || ep.Protocol() == "file" {
+		return endpoint
+	}
+
+	host := strings.ToLower(ep.Host())
+	r := n.match(host)
+	if r == nil {
+		if r = n.providerRule(provider); r == nil {
+			return endpoint
+		}
+	}
+
+	u := &url.URL{Scheme: ep.Protocol(), Host: host}
+	if r.Scheme != "" && r.Scheme != u.Scheme {
+		u.Scheme = r.Scheme
+	} else if port := ep.Port(); port != 0 && port != defaultPort(u.Scheme) {
+		u.Host += ":" + strconv.Itoa(port)
+	}
+
+	if u.Scheme == "ssh" && ep.User() != "" {
+		u.User = url.User(ep.User())
+	}
+
+	p := "/" + strings.Trim(ep.Path(), "/")
+	if r.TrimGitSuffix {
+		p = strings.TrimSuffix(p, ".git")
+	}
+
+	if r.Lowercase {
+		p = strings.ToLower(p)
+	}
+
+	u.Path = p
+	return u.String()
+}
+
+// providerRule returns the rule of the public host of the provider, without
+// its scheme, or nil if there is none.
+func (n *EndpointNormalizer) providerRule(provider string) *NormalizationRule {
+	host := providerHost(provider)
+	if host == "" {
+		return nil
+	}
+
+	r := n.match(host)
+	if r == nil {
+		return nil
+	}
+
+	pr := *r
+	pr.Scheme = ""
+	return &pr
+}
+
+func (n *EndpointNormalizer) match(host string) *NormalizationRule {
+	for _, r := range n.rules {
+		if ok, _ := path.Match(r.Host, host); ok {
+			return r
+		}
+	}
+
+	return nil
+}
+
+func defaultPort(scheme string) int {
+	switch scheme {
+	case "http":
+		return 80
+	case "https":
+		return 443
+	case "ssh":
+		return 22
+	case "git":
+		return 9418
+	default:
+		return 0
+	}
+}
+
+var (
+	endpointNormalizer   = NewEndpointNormalizer(DefaultNormalizationRules)
+	endpointNormalizerMu sync.RWMutex
+)
+
+// SetEndpointNormalizer sets the normalizer of the endpoints of the
+// repositories whose ID is looked up by RepositoryID. By default, the one with
+// DefaultNormalizationRules is used. A nil normalizer disables normalization.
+// Like InstallCloneProxy, it applies to the whole process.
+func SetEndpointNormalizer(n *EndpointNormalizer) {
+	endpointNormalizerMu.Lock()
+	endpointNormalizer = n
+	endpointNormalizerMu.Unlock()
+}
+
+// NormalizeEndpoint normalizes the endpoint with the normalizer set with
+// SetEndpointNormalizer.
+func NormalizeEndpoint(endpoint string) string {
+	endpointNormalizerMu.RLock()
+	n := endpointNormalizer
+	endpointNormalizerMu.RUnlock()
+	return n.Normalize(endpoint)
+}
+
+// NormalizeProviderEndpoint normalizes the endpoint of a repository of the
+// given provider with the normalizer set with SetEndpointNormalizer, see
+// EndpointNormalizer.NormalizeProvider.
+func NormalizeProviderEndpoint(endpoint, provider string) string {
+	endpointNormalizerMu.RLock()
+	n := endpointNormalizer
+	endpointNormalizerMu.RUnlock()
+	return n.NormalizeProvider(endpoint, provider)
+}
@@ -1,6 +1,7 @@
 package borges
 
 import (
+	"context"
 	"io"
 	"sync"
 	"time"
@@ -13,13 +14,58 @@ type Producer struct {
 	Notifiers struct {
 		Done       func(*Job, error)
 		QueueError func(error)
+		// Skipped function, if set, is called whenever a job is not
+		// published because it was already published recently.
+		Skipped func(*Job)
+		// Next function, if set, is called whenever the job iterator
+		// returns, with the time it took to return.
+		Next func(time.Duration)
+		// Reconnect function, if set, is called before every retry of
+		// a publication that failed, with the number of the retry,
+		// starting at 1, and the error.
+		Reconnect func(attempt int, err error)
 	}
 
+	// PriorityQueue, if set, is the queue where jobs with HighPriority are
+	// published. Otherwise, they are published to the normal queue.
+	PriorityQueue queue.Queue
+
+	// DryRun, if true, makes the producer log the jobs instead of
+	// publishing them to the queue, with their endpoints if the iterator
+	// is an EndpointJobIter. Notifiers are called as usual.
+	DryRun bool
+
+	// BatchSize, if greater than one, makes the producer publish the jobs
+	// in batches of up to this many jobs, in a transaction per queue,
+	// instead of one by one. The Done notifier is called for every job once
+	// its batch is published, possibly from a different goroutine.
+	BatchSize int
+	// BatchFlushInterval, if set, is the maximum time a job waits in a
+	// batch that is not full before it is published. Otherwise, batches are
+	// only published when they are full or the producer stops.
+	BatchFlushInterval time.Duration
+
+	// PublishRetries is the number of times the publication of a job, or
+	// a batch, is retried if it fails, such as when the connection to the
+	// broker is lost, before the jobs are reported as failed to the Done
+	// notifier. Zero means failed publications are not retried.
+	PublishRetries int
+	// ReconnectBackoff is the base of the exponential backoff between the
+	// retries of a publication, giving the broker time to reconnect. If
+	// zero, DefaultReconnectBackoff is used.
+	ReconnectBackoff time.Duration
+
 	jobIter   JobIter
 	queue     queue.Queue
+	dedup     *repositoryIDCache
+	batch     *jobBatch
 	running   bool
 	startOnce *sync.Once
 	stopOnce  *sync.Once
+	m         *sync.Mutex
+	// cancel cancels the context passed to the iterator, used by Stop() to
+	// unblock it.
+	cancel context.CancelFunc
 
 	// used by Stop() to wait until Start() has finished
 	startIsRunning chan struct{}
@@ -32,12 +78,36 @@ func NewProducer(jobIter JobIter, queue queue.Queue) *Producer {
 		queue:     queue,
 		startOnce: &sync.Once{},
 		stopOnce:  &sync.Once{},
+		m:         &sync.Mutex{},
+		batch:     &jobBatch{},
+	}
+}
+
+// SetDedupWindow makes the producer skip jobs for repositories that were
+// already published among the last size jobs, as long as they were published
+// less than ttl ago. A ttl of zero means no expiration. A size of zero or less
+// disables deduplication, which is the default. It must be called before the
+// producer is started.
+func (p *Producer) SetDedupWindow(size int, ttl time.Duration) {
+	if size <= 0 {
+		p.dedup = nil
+		return
 	}
+
+	p.dedup = newRepositoryIDCache(size, ttl)
 }
 
 // Start starts the producer services. It blocks until Stop is called.
 func (p *Producer) Start() {
-	p.startOnce.Do(p.start)
+	_ = p.StartContext(context.Background())
+}
+
+// StartContext starts the producer services. It blocks until Stop is called
+// or the given context is done. If the context is done, its error is returned.
+func (p *Producer) StartContext(ctx context.Context) error {
+	var err error
+	p.startOnce.Do(func() { err = p.start(ctx) })
+	return err
 }
 
 // Stop stops the producer.
@@ -45,25 +115,61 @@ func (p *Producer) Stop() {
 	p.stopOnce.Do(p.stop)
 }
 
-func (p *Producer) start() {
+func (p *Producer) start(ctx context.Context) error {
 	log := log.New("module", "producer")
+	iterCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	p.m.Lock()
+	if p.jobIter == nil {
+		// the producer was stopped before starting
+		p.m.Unlock()
+		return nil
+	}
+
 	p.running = true
 	p.startIsRunning = make(chan struct{})
-	defer func() { close(p.startIsRunning) }()
+	p.cancel = cancel
+	done := p.startIsRunning
+	iter := p.jobIter
+	p.m.Unlock()
+	defer func() { close(done) }()
+
+	if p.batching() {
+		defer p.publishBatch(ctx)
+		if p.BatchFlushInterval > 0 {
+			stop := make(chan struct{})
+			defer close(stop)
+			go p.publishBatchEvery(ctx, p.BatchFlushInterval, stop)
+		}
+	}
 
 	log.Debug("starting")
-	for {
-		if !p.running {
-			break
+	for p.isRunning() {
+		select {
+		case <-ctx.Done():
+			log.Debug("context done", "err", ctx.Err())
+			return ctx.Err()
+		default:
 		}
 
-		j, err := p.jobIter.Next()
+		start := time.Now()
+		j, err := iter.Next(iterCtx)
+		p.notifyNext(time.Since(start))
 		if err == io.EOF {
 			break
 		}
 
+		if err != nil && iterCtx.Err() != nil {
+			continue
+		}
+
 		if ErrWaitForJobs.Is(err) {
-			time.Sleep(time.Millisecond * 500)
+			select {
+			case <-iterCtx.Done():
+			case <-time.After(time.Millisecond * 500):
+			}
+
 			continue
 		}
 
@@ -73,38 +179,205 @@ func (p *Producer) start() {
 			continue
 		}
 
-		err = p.add(j)
-		p.notifyDone(j, err)
+		if p.dedup != nil && p.dedup.Contains(j.RepositoryID) {
+			p.ack(j, nil)
+			p.notifySkipped(j)
+			continue
+		}
+
+		if p.batching() {
+			p.addToBatch(ctx, j)
+			continue
+		}
+
+		err = p.publish(ctx, func() error { return p.add(j) })
+		if err == nil && p.dedup != nil {
+			p.dedup.Add(j.RepositoryID)
+		}
+
+		p.done(j, err)
 	}
 
 	log.Debug("stopping")
+	return nil
+}
+
+// publish calls f, which publishes jobs, retrying it with backoff up to
+// PublishRetries times if it fails. The broker reconnects on its own when
+// its connection is lost, so the retries publish the jobs once it does. The
+// retries stop when the given context, not the one cancelled by Stop, is
+// done, returning the last error.
+func (p *Producer) publish(ctx context.Context, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt > p.PublishRetries {
+			return err
+		}
+
+		log.Warn("error publishing jobs, retrying", "module", "producer",
+			"attempt", attempt, "error", err)
+		p.notifyReconnect(attempt, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(reconnectBackoff(p.ReconnectBackoff, attempt)):
+		}
+	}
 }
 
 func (p *Producer) add(j *Job) error {
+	if p.DryRun {
+		log.Info("dry run, job not queued", "module", "producer",
+			"RepositoryID", j.RepositoryID, "endpoint", p.endpoint(j))
+		return nil
+	}
+
 	qj := queue.NewJob()
 	if err := qj.Encode(j); err != nil {
 		return err
 	}
 
-	return p.queue.Publish(qj)
+	return p.queueFor(j).Publish(qj)
+}
+
+// queueFor returns the queue where the given job must be published.
+func (p *Producer) queueFor(j *Job) queue.Queue {
+	if j.Priority == HighPriority && p.PriorityQueue != nil {
+		return p.PriorityQueue
+	}
+
+	return p.queue
+}
+
+func (p *Producer) batching() bool {
+	return p.BatchSize > 1 && !p.DryRun
+}
+
+// addToBatch adds the job to the current batch, publishing it if it is full.
+// Jobs are added to the deduplication window as soon as they are batched.
+func (p *Producer) addToBatch(ctx context.Context, j *Job) {
+	qj := queue.NewJob()
+	if err := qj.Encode(j); err != nil {
+		p.done(j, err)
+		return
+	}
+
+	if p.dedup != nil {
+		p.dedup.Add(j.RepositoryID)
+	}
+
+	e := &batchEntry{job: j, qj: qj, q: p.queueFor(j)}
+	if p.batch.add(e) >= p.BatchSize {
+		p.publishBatch(ctx)
+	}
+}
+
+// publishBatch publishes the current batch, retrying each of its
+// transactions as in publish.
+func (p *Producer) publishBatch(ctx context.Context) {
+	p.batch.publish(func(f func() error) error {
+		return p.publish(ctx, f)
+	}, p.done)
+}
+
+// publishBatchEvery publishes the current batch whenever its oldest job has
+// been waiting for the given interval, until stop is closed.
+func (p *Producer) publishBatchEvery(ctx context.Context, interval time.Duration,
+	stop <-chan struct{}) {
+	wait := interval
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+
+		age := p.batch.age()
+		if age < interval {
+			wait = interval - age
+			continue
+		}
+
+		p.publishBatch(ctx)
+		wait = interval
+	}
 }
 
 func (p *Producer) stop() {
+	p.m.Lock()
 	p.running = false
+	done := p.startIsRunning
+	cancel := p.cancel
+	p.m.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+
+	if done != nil {
+		<-done
+	}
+
 	p.closeIter()
-	<-p.startIsRunning
+}
+
+func (p *Producer) isRunning() bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.running
 }
 
 func (p *Producer) closeIter() {
-	if p.jobIter == nil {
+	p.m.Lock()
+	iter := p.jobIter
+	p.jobIter = nil
+	p.m.Unlock()
+
+	if iter == nil {
 		return
 	}
 
-	if err := p.jobIter.Close(); err != nil {
+	if err := iter.Close(); err != nil {
 		p.notifyQueueError(err)
 	}
+}
 
-	p.jobIter = nil
+// done acknowledges the job to the iterator and notifies it as published, or
+// failed if err is not nil.
+func (p *Producer) done(j *Job, err error) {
+	p.ack(j, err)
+	p.notifyDone(j, err)
+}
+
+// ack acknowledges the job to the iterator, if it is an AckingJobIter.
+func (p *Producer) ack(j *Job, err error) {
+	p.m.Lock()
+	iter, ok := p.jobIter.(AckingJobIter)
+	p.m.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if err := iter.Ack(j, err); err != nil {
+		log.Error("error acknowledging job", "module", "producer",
+			"RepositoryID", j.RepositoryID, "error", err)
+		p.notifyQueueError(err)
+	}
+}
+
+// endpoint returns the endpoint of the job, if the iterator is an
+// EndpointJobIter, or an empty string.
+func (p *Producer) endpoint(j *Job) string {
+	p.m.Lock()
+	iter, ok := p.jobIter.(EndpointJobIter)
+	p.m.Unlock()
+
+	if !ok {
+		return ""
+	}
+
+	return iter.Endpoint(j)
 }
 
 func (p *Producer) notifyQueueError(err error) {
@@ -122,3 +395,27 @@ func (p *Producer) notifyDone(j *Job, err error) {
 
 	p.Notifiers.Done(j, err)
 }
+
+func (p *Producer) notifySkipped(j *Job) {
+	if p.Notifiers.Skipped == nil {
+		return
+	}
+
+	p.Notifiers.Skipped(j)
+}
+
+func (p *Producer) notifyReconnect(attempt int, err error) {
+	if p.Notifiers.Reconnect == nil {
+		return
+	}
+
+	p.Notifiers.Reconnect(attempt, err)
+}
+
+func (p *Producer) notifyNext(d time.Duration) {
+	if p.Notifiers.Next == nil {
+		return
+	}
+
+	p.Notifiers.Next(d)
+}
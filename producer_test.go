@@ -1,8 +1,10 @@
 package borges
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"testing"
 	"time"
 
@@ -41,7 +43,7 @@ func (s *ProducerSuite) newProducer() *Producer {
 	CreateRepositoryTable()
 	storer := core.ModelRepositoryStore()
 
-	return NewProducer(NewMentionJobIter(s.mentionsQueue, storer), s.queue)
+	return NewProducer(NewMentionJobIter(s.mentionsQueue, NewSQLRepositoryStore(storer), MentionJobIterOptions{}), s.queue)
 }
 
 func (s *ProducerSuite) newJob() *queue.Job {
@@ -144,6 +146,201 @@ func (s *ProducerSuite) TestStartStop_ErrorNotifier() {
 	assert.True(errorCalled == 1)
 }
 
+func (s *ProducerSuite) TestStart_ErrorNotifierOncePerError() {
+	assert := require.New(s.T())
+	p := NewProducer(&ErrorJobIter{Errors: 3}, s.queue)
+
+	var errorCalled int
+	p.Notifiers.QueueError = func(err error) {
+		errorCalled++
+		assert.Error(err)
+	}
+
+	p.Start()
+	assert.Equal(3, errorCalled)
+
+	p.Stop()
+	assert.Equal(3, errorCalled)
+}
+
+func (s *ProducerSuite) TestStart_EOF() {
+	assert := require.New(s.T())
+	p := NewProducer(&ErrorJobIter{}, s.queue)
+
+	p.Notifiers.QueueError = func(err error) {
+		assert.Fail("no error expected:", err.Error())
+	}
+
+	p.Notifiers.Done = func(j *Job, err error) {
+		assert.Fail("no job expected")
+	}
+
+	p.Start()
+	p.Stop()
+}
+
+func (s *ProducerSuite) TestStartContext_Cancel() {
+	assert := require.New(s.T())
+	p := NewProducer(&DummyJobIter{}, s.queue)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.StartContext(ctx) }()
+
+	time.Sleep(time.Millisecond * 100)
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.Equal(context.Canceled, err)
+	case <-time.After(time.Second * 5):
+		assert.Fail("producer did not stop after cancel")
+	}
+
+	p.Stop()
+}
+
+func (s *ProducerSuite) TestStop_BlockingIter() {
+	assert := require.New(s.T())
+	p := NewProducer(&BlockingJobIter{}, s.queue)
+
+	go p.Start()
+	time.Sleep(time.Millisecond * 100)
+
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 5):
+		assert.Fail("producer did not stop with a blocked iterator")
+	}
+}
+
+func (s *ProducerSuite) TestStop_BeforeStart() {
+	assert := require.New(s.T())
+	p := NewProducer(&DummyJobIter{}, s.queue)
+
+	p.Stop()
+	assert.NoError(p.StartContext(context.Background()))
+}
+
+func (s *ProducerSuite) TestStart_DedupWindow() {
+	assert := require.New(s.T())
+	id := uuid.NewV4()
+	p := NewProducer(&SliceJobIter{
+		Jobs: []*Job{{RepositoryID: id}, {RepositoryID: id}},
+	}, s.queue)
+	p.SetDedupWindow(10, time.Hour)
+
+	var doneCalled, skippedCalled int
+	p.Notifiers.Done = func(j *Job, err error) {
+		doneCalled++
+		assert.NoError(err)
+	}
+
+	p.Notifiers.Skipped = func(j *Job) {
+		skippedCalled++
+		assert.Equal(id, j.RepositoryID)
+	}
+
+	p.Start()
+	p.Stop()
+	assert.Equal(1, doneCalled)
+	assert.Equal(1, skippedCalled)
+}
+
+func (s *ProducerSuite) TestStart_DryRun() {
+	assert := require.New(s.T())
+	q := &countingQueue{Queue: s.queue}
+	p := NewProducer(&SliceJobIter{
+		Jobs: []*Job{{RepositoryID: uuid.NewV4()}, {RepositoryID: uuid.NewV4()}},
+	}, q)
+	p.DryRun = true
+
+	var doneCalled int
+	p.Notifiers.Done = func(j *Job, err error) {
+		doneCalled++
+		assert.NoError(err)
+	}
+
+	p.Start()
+	p.Stop()
+	assert.Equal(2, doneCalled)
+	assert.Equal(0, q.published)
+}
+
+func (s *ProducerSuite) TestStart_PriorityQueue() {
+	assert := require.New(s.T())
+	q := &countingQueue{Queue: s.queue}
+	pq, err := s.broker.Queue(s.queueName + "_priority")
+	assert.NoError(err)
+	cpq := &countingQueue{Queue: pq}
+
+	p := NewProducer(&SliceJobIter{
+		Jobs: []*Job{
+			{RepositoryID: uuid.NewV4(), Priority: HighPriority},
+			{RepositoryID: uuid.NewV4()},
+		},
+	}, q)
+	p.PriorityQueue = cpq
+
+	p.Start()
+	p.Stop()
+	assert.Equal(1, q.published)
+	assert.Equal(1, cpq.published)
+}
+
+func (s *ProducerSuite) TestStart_Batch() {
+	assert := require.New(s.T())
+	q := &countingQueue{Queue: s.queue}
+	iter := &SliceJobIter{}
+	for i := 0; i < 5; i++ {
+		iter.Jobs = append(iter.Jobs, &Job{RepositoryID: uuid.NewV4()})
+	}
+
+	p := NewProducer(iter, q)
+	p.BatchSize = 2
+
+	var doneCalled int
+	p.Notifiers.Done = func(j *Job, err error) {
+		doneCalled++
+		assert.NoError(err)
+	}
+
+	p.Start()
+	p.Stop()
+	assert.Equal(5, doneCalled)
+	assert.Equal(5, q.published)
+	assert.Equal(3, q.transactions)
+}
+
+func (s *ProducerSuite) TestStart_BatchFlushInterval() {
+	assert := require.New(s.T())
+	q := &countingQueue{Queue: s.queue}
+	p := NewProducer(&BlockingJobIter{
+		Jobs: []*Job{{RepositoryID: uuid.NewV4()}},
+	}, q)
+	p.BatchSize = 10
+	p.BatchFlushInterval = 50 * time.Millisecond
+
+	done := make(chan error, 1)
+	p.Notifiers.Done = func(j *Job, err error) { done <- err }
+
+	go p.Start()
+	defer p.Stop()
+
+	select {
+	case err := <-done:
+		assert.NoError(err)
+	case <-time.After(time.Second * 5):
+		assert.Fail("batch was not published after the flush interval")
+	}
+}
+
 func (s *ProducerSuite) TestStartStop_ErrorNoNotifier() {
 	p := NewProducer(&DummyJobIter{}, s.queue)
 
@@ -172,5 +369,228 @@ func (s *ProducerSuite) TestStartStop_noNotifier() {
 
 type DummyJobIter struct{}
 
-func (j DummyJobIter) Close() error        { return errors.New("SOME CLOSE ERROR") }
-func (j DummyJobIter) Next() (*Job, error) { return &Job{RepositoryID: uuid.Nil}, nil }
+func (j DummyJobIter) Close() error                       { return errors.New("SOME CLOSE ERROR") }
+func (j DummyJobIter) Next(context.Context) (*Job, error) { return &Job{RepositoryID: uuid.Nil}, nil }
+
+// BlockingJobIter returns the given Jobs in order and then blocks on Next
+// until the context is cancelled.
+type BlockingJobIter struct {
+	Jobs []*Job
+}
+
+func (j *BlockingJobIter) Close() error { return nil }
+func (j *BlockingJobIter) Next(ctx context.Context) (*Job, error) {
+	if len(j.Jobs) > 0 {
+		job := j.Jobs[0]
+		j.Jobs = j.Jobs[1:]
+		return job, nil
+	}
+
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// ErrorJobIter returns an error on the first Errors calls to Next and io.EOF
+// afterwards.
+type ErrorJobIter struct {
+	Errors int
+}
+
+func (j *ErrorJobIter) Close() error { return nil }
+func (j *ErrorJobIter) Next(context.Context) (*Job, error) {
+	if j.Errors == 0 {
+		return nil, io.EOF
+	}
+
+	j.Errors--
+	return nil, errors.New("SOME NEXT ERROR")
+}
+
+// SliceJobIter returns the given Jobs in order and io.EOF afterwards.
+type SliceJobIter struct {
+	Jobs []*Job
+}
+
+func (j *SliceJobIter) Close() error { return nil }
+func (j *SliceJobIter) Next(context.Context) (*Job, error) {
+	if len(j.Jobs) == 0 {
+		return nil, io.EOF
+	}
+
+	job := j.Jobs[0]
+	j.Jobs = j.Jobs[1:]
+	return job, nil
+}
+
+// countingQueue is a queue.Queue that counts the published jobs and the
+// transactions.
+type countingQueue struct {
+	queue.Queue
+	published    int
+	transactions int
+}
+
+func (q *countingQueue) Transaction(cb queue.TxCallback) error {
+	q.transactions++
+	return q.Queue.Transaction(func(tx queue.Queue) error {
+		ctx := &countingQueue{Queue: tx}
+		err := cb(ctx)
+		q.published += ctx.published
+		return err
+	})
+}
+
+func (q *countingQueue) Publish(j *queue.Job) error {
+	q.published++
+	return q.Queue.Publish(j)
+}
+
+func TestProducer_PublishRetries(t *testing.T) {
+	require := require.New(t)
+
+	q, err := queue.NewMemoryBroker().Queue("retries")
+	require.NoError(err)
+	fq := &failingPublishQueue{Queue: q, fails: 2}
+	p := NewProducer(&SliceJobIter{
+		Jobs: []*Job{{RepositoryID: uuid.NewV4()}},
+	}, fq)
+	p.PublishRetries = 2
+	p.ReconnectBackoff = time.Millisecond
+
+	var attempts []int
+	p.Notifiers.Reconnect = func(attempt int, err error) {
+		attempts = append(attempts, attempt)
+	}
+
+	var errs []error
+	p.Notifiers.Done = func(j *Job, err error) { errs = append(errs, err) }
+
+	p.Start()
+	p.Stop()
+	require.Equal([]int{1, 2}, attempts)
+	require.Equal([]error{nil}, errs)
+	require.Equal(1, fq.published)
+
+	// the retries are exhausted
+	fq.fails = 3
+	p = NewProducer(&SliceJobIter{
+		Jobs: []*Job{{RepositoryID: uuid.NewV4()}},
+	}, fq)
+	p.PublishRetries = 2
+	p.ReconnectBackoff = time.Millisecond
+	errs = nil
+	p.Notifiers.Done = func(j *Job, err error) { errs = append(errs, err) }
+
+	p.Start()
+	p.Stop()
+	require.Len(errs, 1)
+	require.Error(errs[0])
+	require.Equal(1, fq.published)
+}
+
+func TestProducer_PublishRetries_Batch(t *testing.T) {
+	require := require.New(t)
+
+	q, err := queue.NewMemoryBroker().Queue("retries")
+	require.NoError(err)
+	fq := &failingPublishQueue{Queue: q, fails: 1}
+	p := NewProducer(&SliceJobIter{
+		Jobs: []*Job{{RepositoryID: uuid.NewV4()}, {RepositoryID: uuid.NewV4()}},
+	}, fq)
+	p.BatchSize = 2
+	p.PublishRetries = 1
+	p.ReconnectBackoff = time.Millisecond
+
+	var errs []error
+	p.Notifiers.Done = func(j *Job, err error) { errs = append(errs, err) }
+
+	p.Start()
+	p.Stop()
+	require.Equal([]error{nil, nil}, errs)
+	require.Equal(2, fq.published)
+}
+
+func TestProducer_AckingJobIter(t *testing.T) {
+	require := require.New(t)
+
+	q, err := queue.NewMemoryBroker().Queue("acks")
+	require.NoError(err)
+	fq := &failingPublishQueue{Queue: q}
+	published, failed := &Job{RepositoryID: uuid.NewV4()}, &Job{RepositoryID: uuid.NewV4()}
+	iter := &ackingJobIter{SliceJobIter: SliceJobIter{
+		Jobs: []*Job{published, {RepositoryID: published.RepositoryID}, failed},
+	}, published: fq}
+	p := NewProducer(iter, fq)
+	p.SetDedupWindow(10, 0)
+
+	var done []*Job
+	p.Notifiers.Done = func(j *Job, err error) {
+		done = append(done, j)
+		if j == published {
+			fq.fails = 1
+		}
+	}
+
+	p.Start()
+	p.Stop()
+	require.Equal([]*Job{published, failed}, done)
+	require.Len(iter.acks, 3)
+	require.Equal(published, iter.acks[0])
+	require.Equal(published.RepositoryID, iter.acks[1].RepositoryID)
+	require.Equal(failed, iter.acks[2])
+	require.NoError(iter.errs[0])
+	require.NoError(iter.errs[1])
+	require.Error(iter.errs[2])
+	require.Equal([]int{1, 1, 1}, iter.publishedAt)
+}
+
+// ackingJobIter is a SliceJobIter that records the jobs acknowledged, with
+// their errors and the jobs published to the given queue when they were
+// acknowledged.
+type ackingJobIter struct {
+	SliceJobIter
+	published   *failingPublishQueue
+	acks        []*Job
+	errs        []error
+	publishedAt []int
+}
+
+func (j *ackingJobIter) Ack(job *Job, err error) error {
+	j.acks = append(j.acks, job)
+	j.errs = append(j.errs, err)
+	j.publishedAt = append(j.publishedAt, j.published.published)
+	return nil
+}
+
+// failingPublishQueue is a queue.Queue whose publications and transactions
+// fail the given number of times before succeeding. It counts the jobs
+// published.
+type failingPublishQueue struct {
+	queue.Queue
+	fails     int
+	published int
+}
+
+func (q *failingPublishQueue) Publish(j *queue.Job) error {
+	if q.fails > 0 {
+		q.fails--
+		return errors.New("connection lost")
+	}
+
+	q.published++
+	return q.Queue.Publish(j)
+}
+
+func (q *failingPublishQueue) Transaction(cb queue.TxCallback) error {
+	if q.fails > 0 {
+		q.fails--
+		return errors.New("connection lost")
+	}
+
+	return q.Queue.Transaction(func(tx queue.Queue) error {
+		ctx := &failingPublishQueue{Queue: tx}
+		err := cb(ctx)
+		q.published += ctx.published
+		return err
+	})
+}
@@ -0,0 +1,419 @@
+package borges
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-errors.v0"
+)
+
+var (
+	ErrInvalidProvider = errors.NewKind("invalid provider: %s")
+	ErrProviderAPI     = errors.NewKind("error listing the repositories of %s: %s")
+)
+
+// Provider is a git hosting provider whose API can list the repositories of
+// an organization or user, see NewProviderJobIter.
+type Provider string
+
+const (
+	// GitHubProvider is github.com, or a GitHub Enterprise instance.
+	GitHubProvider Provider = "github"
+	// GitLabProvider is gitlab.com, or a self-hosted GitLab instance.
+	GitLabProvider Provider = "gitlab"
+)
+
+// ParseProvider returns the Provider with the given name, which can be
+// "github" or "gitlab".
+func ParseProvider(name string) (Provider, error) {
+	switch p := Provider(name); p {
+	case GitHubProvider, GitLabProvider:
+		return p, nil
+	default:
+		return "", ErrInvalidProvider.New(name)
+	}
+}
+
+func (p Provider) String() string {
+	return string(p)
+}
+
+// defaultBaseURL returns the URL of the public API of the provider.
+func (p Provider) defaultBaseURL() string {
+	if p == GitLabProvider {
+		return "https://gitlab.com/api/v4"
+	}
+
+	return "https://api.github.com"
+}
+
+// ownerURLs returns the URLs of the first page of the repositories of the
+// owner as an organization and as a user, which are tried in that order.
+func (p Provider) ownerURLs(baseURL, owner string) []string {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	owner = url.PathEscape(owner)
+	if p == GitLabProvider {
+		return []string{
+			baseURL + "/groups/" + owner + "/projects?per_page=100&include_subgroups=true",
+			baseURL + "/users/" + owner + "/projects?per_page=100",
+		}
+	}
+
+	return []string{
+		baseURL + "/orgs/" + owner + "/repos?per_page=100",
+		baseURL + "/users/" + owner + "/repos?per_page=100",
+	}
+}
+
+func (p Provider) authorize(req *http.Request, token string) {
+	if token == "" {
+		return
+	}
+
+	if p == GitLabProvider {
+		req.Header.Set("Private-Token", token)
+		return
+	}
+
+	req.Header.Set("Authorization", "token "+token)
+}
+
+// providerRepository holds the clone URLs of a repository in the responses of
+// the providers.
+type providerRepository struct {
+	// CloneURL is the clone URL of GitHub.
+	CloneURL string `json:"clone_url"`
+	// HTTPURLToRepo is the clone URL of GitLab.
+	HTTPURLToRepo string `json:"http_url_to_repo"`
+}
+
+func (r *providerRepository) endpoint() string {
+	if r.CloneURL != "" {
+		return r.CloneURL
+	}
+
+	return r.HTTPURLToRepo
+}
+
+const (
+	// providerRetries is the number of times a request to a provider API
+	// failing with an error other than a rate limit is retried.
+	providerRetries = 5
+	// providerRetryBackoff is the base of the backoff between the retries
+	// of a request to a provider API, also used when a rate limited
+	// response does not say how long to wait.
+	providerRetryBackoff = time.Second
+)
+
+// ProviderJobIterOptions holds optional settings of the JobIter returned by
+// NewProviderJobIter. The zero value is valid and lists the public
+// repositories using the public API of the provider.
+type ProviderJobIterOptions struct {
+	// Token is the access token used with the provider API, so the private
+	// repositories are listed too and the rate limit is higher.
+	Token string
+	// BaseURL is the URL of the API, for GitHub Enterprise or self-hosted
+	// GitLab instances, such as https://gitlab.example.com/api/v4. If
+	// empty, the one of github.com or gitlab.com is used.
+	BaseURL string
+	// CursorFile, if set, is the file where the URL of the page being
+	// listed is saved, so a new iterator with the same file resumes the
+	// listing from that page instead of starting from scratch. The jobs of
+	// the page are returned again. It is removed once the jobs of every
+	// page are returned.
+	CursorFile string
+	// Client is the HTTP client used with the API. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+}
+
+type providerJobIter struct {
+	provider  Provider
+	owner     string
+	storer    RepositoryStore
+	opts      ProviderJobIterOptions
+	started   bool
+	next      string
+	endpoints []string
+}
+
+// NewProviderJobIter returns a JobIter that returns a job for each repository
+// of the owner, an organization or a user, in the given provider, paginating
+// its API. The requests rate limited by the provider are retried once the rate
+// limit is reset.
+func NewProviderJobIter(provider Provider, owner string, storer RepositoryStore,
+	opts ProviderJobIterOptions) JobIter {
+	if opts.BaseURL == "" {
+		opts.BaseURL = provider.defaultBaseURL()
+	}
+
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+
+	return &providerJobIter{
+		provider: provider,
+		owner:    owner,
+		storer:   storer,
+		opts:     opts,
+	}
+}
+
+func (i *providerJobIter) Next(ctx context.Context) (*Job, error) {
+	for len(i.endpoints) == 0 {
+		if i.started && i.next == "" {
+			if err := i.removeCursor(); err != nil {
+				return nil, err
+			}
+
+			return nil, io.EOF
+		}
+
+		if err := i.nextPage(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	endpoint := i.endpoints[0]
+	i.endpoints = i.endpoints[1:]
+	id, err := ProviderRepositoryID(endpoint, string(i.provider), i.storer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Job{RepositoryID: id}, nil
+}
+
+// nextPage lists the next page of repositories, which is the first one or the
+// one in the cursor file if none was listed yet.
+func (i *providerJobIter) nextPage(ctx context.Context) error {
+	if !i.started {
+		return i.firstPage(ctx)
+	}
+
+	if err := i.saveCursor(i.next); err != nil {
+		return err
+	}
+
+	return i.listPage(ctx, i.next)
+}
+
+func (i *providerJobIter) firstPage(ctx context.Context) error {
+	cursor, err := i.loadCursor()
+	if err != nil {
+		return err
+	}
+
+	if cursor != "" {
+		log.Info("resuming the listing of repositories", "provider", i.provider,
+			"owner", i.owner, "cursor", cursor)
+		if err := i.listPage(ctx, cursor); err != nil {
+			return err
+		}
+
+		i.started = true
+		return nil
+	}
+
+	for _, u := range i.provider.ownerURLs(i.opts.BaseURL, i.owner) {
+		err := i.listPage(ctx, u)
+		if err == errProviderNotFound {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		i.started = true
+		return nil
+	}
+
+	return ErrProviderAPI.New(i.owner, "organization or user not found")
+}
+
+// errProviderNotFound is returned by listPage when the page does not exist.
+var errProviderNotFound = fmt.Errorf("not found")
+
+// listPage requests the page at the given URL, retrying it if it is rate
+// limited or fails, and sets the endpoints of its repositories and the URL of
+// the next page.
+func (i *providerJobIter) listPage(ctx context.Context, u string) error {
+	for attempt := 1; ; attempt++ {
+		repos, next, wait, err := i.request(ctx, u)
+		if err == nil {
+			i.endpoints = i.endpoints[:0]
+			for _, r := range repos {
+				if e := r.endpoint(); e != "" {
+					i.endpoints = append(i.endpoints, e)
+				}
+			}
+
+			i.next = next
+			return nil
+		}
+
+		if err == errProviderNotFound || ctx.Err() != nil {
+			return err
+		}
+
+		if wait == 0 {
+			if attempt > providerRetries {
+				return err
+			}
+
+			wait = retryBackoff(providerRetryBackoff, attempt)
+		}
+
+		log.Warn("error listing repositories, retrying", "provider", i.provider,
+			"url", u, "attempt", attempt, "backoff", wait, "error", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// request requests the page at the given URL and returns its repositories
+// and the URL of the next page, if any. If the request was rate limited, it
+// returns the time to wait before trying again along with the error.
+func (i *providerJobIter) request(ctx context.Context, u string) (
+	repos []*providerRepository, next string, wait time.Duration, err error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	i.provider.authorize(req, i.opts.Token)
+	res, err := i.opts.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return nil, "", 0, errProviderNotFound
+	case isProviderRateLimited(res):
+		return nil, "", providerRateLimitWait(res.Header, time.Now()),
+			ErrProviderAPI.New(i.owner, "rate limited")
+	case res.StatusCode != http.StatusOK:
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, "", 0, ErrProviderAPI.New(i.owner,
+			fmt.Sprintf("%s: %s", res.Status, strings.TrimSpace(string(body))))
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&repos); err != nil {
+		return nil, "", 0, ErrProviderAPI.New(i.owner, err)
+	}
+
+	return repos, nextPageURL(res.Header.Get("Link")), 0, nil
+}
+
+// isProviderRateLimited returns whether the response means the request was
+// rate limited, which GitHub can answer with 403 Forbidden.
+func isProviderRateLimited(res *http.Response) bool {
+	switch res.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusForbidden:
+		return res.Header.Get("X-RateLimit-Remaining") == "0"
+	default:
+		return false
+	}
+}
+
+// providerRateLimitWait returns the time to wait until the rate limit is
+// reset according to the headers of a rate limited response, or
+// providerRetryBackoff if they do not say.
+func providerRateLimitWait(h http.Header, now time.Time) time.Duration {
+	if d, ok := parseRetryAfter(h.Get("Retry-After"), now); ok && d > 0 {
+		return d
+	}
+
+	for _, k := range []string{"X-RateLimit-Reset", "RateLimit-Reset"} {
+		reset, err := strconv.ParseInt(h.Get(k), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if d := time.Unix(reset, 0).Sub(now); d > 0 {
+			return d
+		}
+	}
+
+	return providerRetryBackoff
+}
+
+// nextPageURL returns the URL of the next page in the value of a Link header,
+// as returned by GitHub and GitLab, or an empty string if there is none.
+func nextPageURL(link string) string {
+	for _, part := range strings.Split(link, ",") {
+		fields := strings.Split(part, ";")
+		if len(fields) < 2 {
+			continue
+		}
+
+		for _, param := range fields[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				u := strings.TrimSpace(fields[0])
+				return strings.TrimSuffix(strings.TrimPrefix(u, "<"), ">")
+			}
+		}
+	}
+
+	return ""
+}
+
+func (i *providerJobIter) loadCursor() (string, error) {
+	if i.opts.CursorFile == "" {
+		return "", nil
+	}
+
+	content, err := ioutil.ReadFile(i.opts.CursorFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+
+	return strings.TrimSpace(string(content)), err
+}
+
+func (i *providerJobIter) saveCursor(cursor string) error {
+	if i.opts.CursorFile == "" {
+		return nil
+	}
+
+	tmp := i.opts.CursorFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(cursor+"\n"), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, i.opts.CursorFile)
+}
+
+func (i *providerJobIter) removeCursor() error {
+	if i.opts.CursorFile == "" {
+		return nil
+	}
+
+	if err := os.Remove(i.opts.CursorFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Close implements the JobIter interface. There is nothing to close.
+func (i *providerJobIter) Close() error {
+	return nil
+}
@@ -0,0 +1,207 @@
+package borges
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+func TestParseProvider(t *testing.T) {
+	require := require.New(t)
+
+	for _, p := range []Provider{GitHubProvider, GitLabProvider} {
+		parsed, err := ParseProvider(p.String())
+		require.NoError(err)
+		require.Equal(p, parsed)
+	}
+
+	_, err := ParseProvider("bitbucket")
+	require.True(ErrInvalidProvider.Is(err))
+}
+
+// providerServer is a fake GitHub API with the repositories of the user foo in
+// two pages. The first request to the second page is rate limited.
+type providerServer struct {
+	*httptest.Server
+	m        sync.Mutex
+	limited  bool
+	requests []string
+}
+
+func newProviderServer() *providerServer {
+	s := &providerServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *providerServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	s.requests = append(s.requests, r.URL.RequestURI())
+	s.m.Unlock()
+
+	if r.Header.Get("Authorization") != "token secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.RequestURI() {
+	case "/users/foo/repos?per_page=100":
+		w.Header().Set("Link", fmt.Sprintf(
+			`<%s/users/foo/repos?per_page=100&page=2>; rel="next", <%[1]s/users/foo/repos?per_page=100&page=2>; rel="last"`,
+			s.URL))
+		fmt.Fprint(w, `[{"clone_url": "https://github.com/foo/a.git"}, {"clone_url": "https://github.com/foo/b.git"}]`)
+	case "/users/foo/repos?per_page=100&page=2":
+		s.m.Lock()
+		limited := s.limited
+		s.limited = true
+		s.m.Unlock()
+		if !limited {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", fmt.Sprint(time.Now().Unix()))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		fmt.Fprint(w, `[{"clone_url": "https://github.com/foo/c.git"}]`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestProviderJobIter(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "borges-provider")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(dir)) }()
+
+	store, err := OpenBoltRepositoryStore(filepath.Join(dir, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	srv := newProviderServer()
+	defer srv.Close()
+
+	opts := ProviderJobIterOptions{
+		Token:      "secret",
+		BaseURL:    srv.URL,
+		CursorFile: filepath.Join(dir, "cursor"),
+	}
+
+	iter := NewProviderJobIter(GitHubProvider, "foo", store, opts)
+	var endpoints []string
+	for {
+		j, err := iter.Next(context.TODO())
+		if err == io.EOF {
+			break
+		}
+
+		require.NoError(err)
+		r, err := store.Get(kallax.ULID(j.RepositoryID))
+		require.NoError(err)
+		endpoints = append(endpoints, r.Endpoints...)
+	}
+
+	require.NoError(iter.Close())
+	require.Equal([]string{
+		"https://github.com/foo/a",
+		"https://github.com/foo/b",
+		"https://github.com/foo/c",
+	}, endpoints)
+	require.Equal([]string{
+		"/orgs/foo/repos?per_page=100",
+		"/users/foo/repos?per_page=100",
+		"/users/foo/repos?per_page=100&page=2",
+		"/users/foo/repos?per_page=100&page=2",
+	}, srv.requests)
+
+	_, err = os.Stat(opts.CursorFile)
+	require.True(os.IsNotExist(err))
+}
+
+func TestProviderJobIter_Resume(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "borges-provider")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(dir)) }()
+
+	store, err := OpenBoltRepositoryStore(filepath.Join(dir, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	srv := newProviderServer()
+	srv.limited = true
+	defer srv.Close()
+
+	opts := ProviderJobIterOptions{
+		Token:      "secret",
+		BaseURL:    srv.URL,
+		CursorFile: filepath.Join(dir, "cursor"),
+	}
+
+	// the jobs of the first page are returned, then the process dies
+	// while listing the second one
+	iter := NewProviderJobIter(GitHubProvider, "foo", store, opts)
+	for i := 0; i < 3; i++ {
+		_, err := iter.Next(context.TODO())
+		require.NoError(err)
+	}
+
+	srv.requests = nil
+	iter = NewProviderJobIter(GitHubProvider, "foo", store, opts)
+	_, err = iter.Next(context.TODO())
+	require.NoError(err)
+	_, err = iter.Next(context.TODO())
+	require.Equal(io.EOF, err)
+	require.Equal([]string{"/users/foo/repos?per_page=100&page=2"}, srv.requests)
+}
+
+func TestProviderJobIter_NotFound(t *testing.T) {
+	require := require.New(t)
+
+	srv := newProviderServer()
+	defer srv.Close()
+
+	iter := NewProviderJobIter(GitHubProvider, "bar", nil, ProviderJobIterOptions{
+		Token:   "secret",
+		BaseURL: srv.URL,
+	})
+	_, err := iter.Next(context.TODO())
+	require.True(ErrProviderAPI.Is(err))
+}
+
+func TestNextPageURL(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal("https://api.github.com/foo?page=2", nextPageURL(
+		`<https://api.github.com/foo?page=2>; rel="next", <https://api.github.com/foo?page=5>; rel="last"`))
+	require.Equal("https://gitlab.com/foo?page=3", nextPageURL(
+		`<https://gitlab.com/foo?page=1>; rel="prev", <https://gitlab.com/foo?page=3>; rel="next"`))
+	require.Equal("", nextPageURL(`<https://api.github.com/foo?page=1>; rel="first"`))
+	require.Equal("", nextPageURL(""))
+}
+
+func TestProviderRateLimitWait(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	h := http.Header{}
+	require.Equal(providerRetryBackoff, providerRateLimitWait(h, now))
+	h.Set("X-RateLimit-Reset", fmt.Sprint(now.Add(time.Minute).Unix()))
+	wait := providerRateLimitWait(h, now)
+	require.True(wait > 58*time.Second && wait <= time.Minute, "%s", wait)
+	h.Set("Retry-After", "10")
+	require.Equal(10*time.Second, providerRateLimitWait(h, now))
+}
@@ -0,0 +1,78 @@
+package borges
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+
+	"gopkg.in/src-d/go-errors.v0"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+var (
+	ErrInvalidProxy = errors.NewKind("invalid proxy URL %q: %s")
+)
+
+// InstallCloneProxy makes all the clones of http and https endpoints go
+// through the proxy at the given URL, which can have the http, https or
+// socks5 schemes. If proxyURL is empty, the default behaviour is restored,
+// which is using the proxy set in the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables, if any.
+//
+// The transports used to clone are shared by the whole process, so the proxy
+// applies to every TemporaryCloner. Clones of ssh and git endpoints do not
+// support proxies.
+func InstallCloneProxy(proxyURL string) error {
+	var u *url.URL
+	if proxyURL != "" {
+		var err error
+		u, err = url.Parse(proxyURL)
+		if err != nil {
+			return ErrInvalidProxy.New(proxyURL, err)
+		}
+
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return ErrInvalidProxy.New(proxyURL, "unsupported scheme")
+		}
+	}
+
+	cloneProxyMu.Lock()
+	cloneProxy = u
+	cloneProxyMu.Unlock()
+
+	installCloneTransports()
+	return nil
+}
+
+var (
+	cloneProxy   *url.URL
+	cloneProxyMu sync.Mutex
+)
+
+// installCloneTransports installs the transports of the http and https
+// endpoints for the proxy set with InstallCloneProxy and the policy set with
+// InstallEndpointPolicy.
+func installCloneTransports() {
+	cloneProxyMu.Lock()
+	defer cloneProxyMu.Unlock()
+
+	if cloneProxy == nil && !denyPrivateIPs() {
+		client.InstallProtocol("http", githttp.DefaultClient)
+		client.InstallProtocol("https", githttp.DefaultClient)
+		return
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if cloneProxy != nil {
+		transport.Proxy = http.ProxyURL(cloneProxy)
+	} else {
+		transport.DialContext = dialPublic
+	}
+
+	t := githttp.NewClient(&http.Client{Transport: transport})
+	client.InstallProtocol("http", t)
+	client.InstallProtocol("https", t)
+}
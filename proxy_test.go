@@ -0,0 +1,44 @@
+package borges
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+)
+
+func TestInstallCloneProxy(t *testing.T) {
+	require := require.New(t)
+
+	hosts := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case hosts <- r.URL.Host:
+		default:
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer proxy.Close()
+
+	require.NoError(InstallCloneProxy(proxy.URL))
+	defer func() { require.NoError(InstallCloneProxy("")) }()
+
+	tc := NewTemporaryCloner(memfs.New(), CloneOptions{})
+	_, err := tc.Clone(context.Background(), "foo", "http://example.invalid/foo/bar")
+	require.Error(err)
+	require.Equal("example.invalid", <-hosts)
+}
+
+func TestInstallCloneProxy_Invalid(t *testing.T) {
+	require := require.New(t)
+
+	err := InstallCloneProxy("ftp://proxy:21")
+	require.True(ErrInvalidProxy.Is(err))
+
+	err = InstallCloneProxy("http://%zz")
+	require.True(ErrInvalidProxy.Is(err))
+}
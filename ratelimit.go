@@ -0,0 +1,143 @@
+package borges
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/framework.v0/queue"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+// RateLimitError is returned when a remote refuses a clone because too many
+// requests were made to it, such as with an HTTP 429 response. Retrying the
+// clone right away would fail again, so the job is requeued with a delay.
+type RateLimitError struct {
+	// Endpoint is the endpoint that was being cloned.
+	Endpoint string
+	// RetryAfter is the time the remote asked to wait before trying again,
+	// zero if it did not say.
+	RetryAfter time.Duration
+	// Err is the error returned by the remote.
+	Err error
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited by %s, retry after %s: %s", e.Endpoint, e.RetryAfter, e.Err)
+	}
+
+	return fmt.Sprintf("rate limited by %s: %s", e.Endpoint, e.Err)
+}
+
+// rateLimitMessages are the messages of the errors that mean the remote is
+// throttling the requests, such as the ones printed by SSH servers, which
+// have no status codes.
+var rateLimitMessages = []string{
+	"rate limit",
+	"too many requests",
+	"too many connections",
+}
+
+// newRateLimitError returns a RateLimitError if the error returned cloning the
+// endpoint means the remote is throttling the requests, nil otherwise.
+func newRateLimitError(endpoint string, err error) *RateLimitError {
+	if err == nil {
+		return nil
+	}
+
+	e := err
+	if ue, ok := e.(*plumbing.UnexpectedError); ok {
+		e = ue.Err
+	}
+
+	if he, ok := e.(*githttp.Err); ok {
+		code := he.StatusCode()
+		retryAfter, ok := parseRetryAfter(he.Response.Header.Get("Retry-After"), time.Now())
+		if code == http.StatusTooManyRequests ||
+			(code == http.StatusServiceUnavailable && ok) {
+			return &RateLimitError{Endpoint: endpoint, RetryAfter: retryAfter, Err: err}
+		}
+
+		return nil
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, m := range rateLimitMessages {
+		if strings.Contains(msg, m) {
+			return &RateLimitError{Endpoint: endpoint, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// parseRetryAfter parses the value of a Retry-After HTTP header, which can be
+// either a number of seconds or a date, returning the time to wait from now.
+// It returns false if the value is empty or invalid.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+
+		return time.Duration(secs) * time.Second, true
+	}
+
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+
+	return 0, true
+}
+
+// asRateLimitError returns the RateLimitError that caused the given error, if
+// any, looking through the errors wrapping it.
+func asRateLimitError(err error) (*RateLimitError, bool) {
+	for err != nil {
+		switch e := err.(type) {
+		case *RateLimitError:
+			return e, true
+		case *RetryError:
+			err = e.Err
+		case interface {
+			Cause() error
+		}:
+			err = e.Cause()
+		default:
+			return nil, false
+		}
+	}
+
+	return nil, false
+}
+
+// isRateLimitError returns whether the error was caused by a RateLimitError.
+func isRateLimitError(err error) bool {
+	_, ok := asRateLimitError(err)
+	return ok
+}
+
+// delayJob publishes again to q a job that was rate limited, to be delivered
+// after the given delay. Its Retries are not incremented, since it did not
+// fail because of the repository.
+func delayJob(q queue.Queue, j *Job, delay time.Duration) error {
+	qj := queue.NewJob()
+	if err := qj.Encode(j); err != nil {
+		return err
+	}
+
+	return q.PublishDelayed(qj, delay)
+}
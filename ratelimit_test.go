@@ -0,0 +1,100 @@
+package borges
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+func httpError(code int, retryAfter string) error {
+	u, _ := url.Parse("https://github.com/foo/bar/info/refs")
+	res := &http.Response{
+		StatusCode: code,
+		Header:     http.Header{},
+		Request:    &http.Request{URL: u},
+	}
+
+	if retryAfter != "" {
+		res.Header.Set("Retry-After", retryAfter)
+	}
+
+	return plumbing.NewUnexpectedError(&githttp.Err{Response: res})
+}
+
+func TestNewRateLimitError(t *testing.T) {
+	require := require.New(t)
+
+	const endpoint = "https://github.com/foo/bar"
+	cases := []struct {
+		err        error
+		limited    bool
+		retryAfter time.Duration
+	}{
+		{nil, false, 0},
+		{httpError(http.StatusTooManyRequests, ""), true, 0},
+		{httpError(http.StatusTooManyRequests, "120"), true, 2 * time.Minute},
+		{httpError(http.StatusServiceUnavailable, "30"), true, 30 * time.Second},
+		{httpError(http.StatusServiceUnavailable, ""), false, 0},
+		{httpError(http.StatusInternalServerError, ""), false, 0},
+		{fmt.Errorf("ssh: Too many connections, try again later"), true, 0},
+		{fmt.Errorf("connection reset by peer"), false, 0},
+	}
+
+	for i, c := range cases {
+		err := newRateLimitError(endpoint, c.err)
+		if !c.limited {
+			require.Nil(err, "case %d", i)
+			continue
+		}
+
+		require.NotNil(err, "case %d", i)
+		require.Equal(endpoint, err.Endpoint)
+		require.Equal(c.retryAfter, err.RetryAfter, "case %d", i)
+		require.Equal(c.err, err.Err)
+		require.False(isTransientError(err))
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Date(2017, time.July, 1, 12, 0, 0, 0, time.UTC)
+	d, ok := parseRetryAfter("10", now)
+	require.True(ok)
+	require.Equal(10*time.Second, d)
+
+	d, ok = parseRetryAfter("Sat, 01 Jul 2017 12:05:00 GMT", now)
+	require.True(ok)
+	require.Equal(5*time.Minute, d)
+
+	d, ok = parseRetryAfter("Sat, 01 Jul 2017 11:00:00 GMT", now)
+	require.True(ok)
+	require.Equal(time.Duration(0), d)
+
+	for _, v := range []string{"", "-1", "soon"} {
+		_, ok = parseRetryAfter(v, now)
+		require.False(ok, v)
+	}
+}
+
+func TestAsRateLimitError(t *testing.T) {
+	require := require.New(t)
+
+	rlErr := &RateLimitError{Endpoint: "foo", Err: fmt.Errorf("rate limit exceeded")}
+	err, ok := asRateLimitError(ErrClone.Wrap(rlErr, "foo"))
+	require.True(ok)
+	require.Equal(rlErr, err)
+
+	_, ok = asRateLimitError(&RetryError{Attempts: 2, Err: rlErr})
+	require.True(ok)
+
+	_, ok = asRateLimitError(ErrClone.Wrap(fmt.Errorf("foo"), "foo"))
+	require.False(ok)
+	require.False(isRateLimitError(nil))
+}
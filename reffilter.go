@@ -0,0 +1,289 @@
+package borges
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/src-d/go-errors.v0"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+var (
+	ErrInvalidRefPattern = errors.NewKind("invalid reference pattern %q: %s")
+)
+
+// refWildcard is the wildcard of the reference patterns, which matches any
+// sequence of characters, including slashes, as in git refspecs.
+const refWildcard = "*"
+
+// ValidateRefPatterns checks that the given reference patterns, such as the
+// RefInclude and RefExclude clone options, are valid. A pattern is a full
+// reference name with at most one wildcard, * , such as refs/heads/* or
+// refs/tags/v*-stable.
+func ValidateRefPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if !strings.HasPrefix(p, "refs/") {
+			return ErrInvalidRefPattern.New(p, "must start with refs/")
+		}
+
+		if strings.Count(p, refWildcard) > 1 {
+			return ErrInvalidRefPattern.New(p, "more than one wildcard")
+		}
+
+		if strings.Contains(p, ":") {
+			return ErrInvalidRefPattern.New(p, "must not contain :")
+		}
+	}
+
+	return nil
+}
+
+// matchRefPattern returns whether the reference name matches the pattern.
+func matchRefPattern(pattern, name string) bool {
+	i := strings.Index(pattern, refWildcard)
+	if i < 0 {
+		return pattern == name
+	}
+
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	return len(name) > len(prefix)+len(suffix) &&
+		strings.HasPrefix(name, prefix) &&
+		strings.HasSuffix(name, suffix)
+}
+
+// matchRefPatterns returns whether the reference name matches any of the
+// include patterns, or there are none, and none of the exclude patterns.
+func matchRefPatterns(name string, include, exclude []string) bool {
+	included := len(include) == 0
+	for _, p := range include {
+		if matchRefPattern(p, name) {
+			included = true
+			break
+		}
+	}
+
+	if !included {
+		return false
+	}
+
+	for _, p := range exclude {
+		if matchRefPattern(p, name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fetchRefSpecs returns the refspecs to fetch the references of the endpoint
+// allowed by the RefInclude, RefExclude and SingleBranch options, along with
+// the function telling whether a reference is allowed, which is nil if all of
+// them are, and the number of allowed references of the remote, which is zero
+// if they were not listed. The refspecs are built from the include patterns if
+// possible. Otherwise, the references of the remote are listed and an exact
+// refspec is returned for each allowed one, so the objects only reachable from
+// the filtered references are never fetched. If no reference is allowed, it
+// returns no refspecs. With MaxRefs, the references are always listed, and it
+// fails with a TooManyRefsError if more than MaxRefs are allowed.
+func (b *temporaryRepositoryBuilder) fetchRefSpecs(endpoint string,
+	auth transport.AuthMethod) ([]config.RefSpec, func(string) bool, int, error) {
+	include, exclude := b.Options.RefInclude, b.Options.RefExclude
+	filtered := len(include) > 0 || len(exclude) > 0 || b.Options.SingleBranch
+	if !filtered && b.Options.MaxRefs <= 0 {
+		return []config.RefSpec{FetchRefSpec}, nil, 0, nil
+	}
+
+	allowed := func(name string) bool {
+		return matchRefPatterns(name, include, exclude)
+	}
+
+	if !b.Options.SingleBranch && b.Options.MaxRefs <= 0 {
+		if specs, ok := includeRefSpecs(include, exclude); ok {
+			return specs, allowed, 0, nil
+		}
+	}
+
+	ar, err := remoteReferences(endpoint, auth)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	refs, err := ar.AllReferences()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if b.Options.SingleBranch {
+		branch, ok := headBranch(ar, refs)
+		if !ok {
+			return nil, nil, 0, nil
+		}
+
+		matches := allowed
+		allowed = func(name string) bool {
+			return name == branch.String() && matches(name)
+		}
+	}
+
+	var specs []config.RefSpec
+	for _, ref := range refs {
+		n := ref.Name().String()
+		if ref.Type() == plumbing.HashReference && strings.HasPrefix(n, "refs/") && allowed(n) {
+			specs = append(specs, config.RefSpec(n+":"+n))
+		}
+	}
+
+	if max := b.Options.MaxRefs; max > 0 && len(specs) > max {
+		return nil, nil, len(specs), &TooManyRefsError{
+			Endpoint: endpoint,
+			Refs:     len(specs),
+			Max:      max,
+		}
+	}
+
+	if !filtered {
+		return []config.RefSpec{FetchRefSpec}, nil, len(specs), nil
+	}
+
+	return specs, allowed, len(specs), nil
+}
+
+// TooManyRefsError is returned when cloning a repository with more references
+// than allowed by the MaxRefs clone option, before fetching any of them.
+type TooManyRefsError struct {
+	// Endpoint is the endpoint that was being cloned.
+	Endpoint string
+	// Refs is the number of references of the remote that were to be
+	// fetched.
+	Refs int
+	// Max is the maximum number of references allowed.
+	Max int
+}
+
+func (e *TooManyRefsError) Error() string {
+	return fmt.Sprintf("repository %s has %d references, more than the maximum of %d",
+		e.Endpoint, e.Refs, e.Max)
+}
+
+// isTooManyRefsError returns whether the error is a TooManyRefsError.
+func isTooManyRefsError(err error) bool {
+	_, ok := err.(*TooManyRefsError)
+	return ok
+}
+
+// removeFilteredRefs removes from s the references not allowed, such as the
+// tags pointing to the fetched commits, which are always fetched.
+func removeFilteredRefs(s storer.ReferenceStorer, allowed func(string) bool) error {
+	if allowed == nil {
+		return nil
+	}
+
+	iter, err := s.IterReferences()
+	if err != nil {
+		return err
+	}
+
+	var remove []plumbing.ReferenceName
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		n := ref.Name().String()
+		if strings.HasPrefix(n, "refs/") && !strings.HasPrefix(n, havesRefPrefix) &&
+			!allowed(n) {
+			remove = append(remove, ref.Name())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, n := range remove {
+		if err := s.RemoveReference(n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// includeRefSpecs returns a refspec for each include pattern, if they can be
+// used for the fetch as they are, which is when there are no exclude patterns
+// and the wildcards of the include patterns are at the end.
+func includeRefSpecs(include, exclude []string) ([]config.RefSpec, bool) {
+	if len(exclude) > 0 {
+		return nil, false
+	}
+
+	var specs []config.RefSpec
+	for _, p := range include {
+		if i := strings.Index(p, refWildcard); i >= 0 && i != len(p)-1 {
+			return nil, false
+		}
+
+		specs = append(specs, config.RefSpec(p+":"+p))
+	}
+
+	return specs, true
+}
+
+// remoteReferences returns the references advertised by the remote at the
+// given endpoint.
+func remoteReferences(endpoint string, auth transport.AuthMethod) (*packp.AdvRefs, error) {
+	ep, err := transport.NewEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := client.NewClient(ep)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := c.NewUploadPackSession(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	return s.AdvertisedReferences()
+}
+
+// headBranch returns the branch the HEAD of the remote points to, given its
+// advertised references. If the remote does not advertise the target of its
+// HEAD, the branch pointing to the same commit is used, preferring master as
+// git does. It returns false if the remote has no HEAD branch.
+func headBranch(ar *packp.AdvRefs, refs memory.ReferenceStorage) (plumbing.ReferenceName, bool) {
+	if head, ok := refs[plumbing.HEAD]; ok && head.Type() == plumbing.SymbolicReference {
+		_, ok := refs[head.Target()]
+		return head.Target(), ok
+	}
+
+	if ar.Head == nil {
+		return "", false
+	}
+
+	if ref, ok := refs[plumbing.Master]; ok && ref.Hash() == *ar.Head {
+		return plumbing.Master, true
+	}
+
+	var branches []string
+	for n, ref := range refs {
+		if ref.Type() == plumbing.HashReference && ref.IsBranch() && ref.Hash() == *ar.Head {
+			branches = append(branches, n.String())
+		}
+	}
+
+	if len(branches) == 0 {
+		return "", false
+	}
+
+	sort.Strings(branches)
+	return plumbing.ReferenceName(branches[0]), true
+}
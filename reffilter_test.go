@@ -0,0 +1,221 @@
+package borges
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestValidateRefPatterns(t *testing.T) {
+	require := require.New(t)
+
+	require.NoError(ValidateRefPatterns(nil))
+	require.NoError(ValidateRefPatterns([]string{"refs/heads/*", "refs/tags/v*-stable", "refs/heads/master"}))
+
+	for _, p := range []string{"heads/*", "refs/*/foo/*", "refs/heads/*:refs/heads/*"} {
+		err := ValidateRefPatterns([]string{p})
+		require.True(ErrInvalidRefPattern.Is(err), p)
+	}
+}
+
+func TestMatchRefPatterns(t *testing.T) {
+	require := require.New(t)
+
+	require.True(matchRefPattern("refs/heads/*", "refs/heads/feature/foo"))
+	require.True(matchRefPattern("refs/tags/v*-stable", "refs/tags/v1-stable"))
+	require.False(matchRefPattern("refs/tags/v*-stable", "refs/tags/v1-rc"))
+	require.True(matchRefPattern("refs/heads/master", "refs/heads/master"))
+	require.False(matchRefPattern("refs/heads/master", "refs/heads/master2"))
+
+	require.True(matchRefPatterns("refs/pull/1/head", nil, nil))
+	require.False(matchRefPatterns("refs/pull/1/head", nil, []string{"refs/pull/*"}))
+	require.False(matchRefPatterns("refs/pull/1/head", []string{"refs/heads/*"}, nil))
+	require.False(matchRefPatterns("refs/heads/wip", []string{"refs/heads/*"}, []string{"refs/heads/wip"}))
+	require.True(matchRefPatterns("refs/heads/master", []string{"refs/heads/*"}, []string{"refs/heads/wip"}))
+}
+
+func TestIncludeRefSpecs(t *testing.T) {
+	require := require.New(t)
+
+	specs, ok := includeRefSpecs([]string{"refs/heads/*", "refs/tags/v1"}, nil)
+	require.True(ok)
+	require.Equal("refs/heads/*:refs/heads/*", specs[0].String())
+	require.Equal("refs/tags/v1:refs/tags/v1", specs[1].String())
+
+	_, ok = includeRefSpecs([]string{"refs/tags/v*-stable"}, nil)
+	require.False(ok)
+
+	_, ok = includeRefSpecs([]string{"refs/heads/*"}, []string{"refs/heads/wip"})
+	require.False(ok)
+}
+
+func TestTemporaryClonerRefFilters(t *testing.T) {
+	require := require.New(t)
+
+	r := refFilterRepository(t)
+
+	cases := []struct {
+		include, exclude []string
+		expected         []string
+	}{
+		{nil, nil, []string{"refs/heads/master", "refs/heads/wip", "refs/pull/1/head", "refs/tags/v1"}},
+		{[]string{"refs/heads/*"}, nil, []string{"refs/heads/master", "refs/heads/wip"}},
+		{nil, []string{"refs/pull/*"}, []string{"refs/heads/master", "refs/heads/wip", "refs/tags/v1"}},
+		{[]string{"refs/heads/*", "refs/tags/*"}, []string{"refs/heads/wip"}, []string{"refs/heads/master", "refs/tags/v1"}},
+	}
+
+	err := WithInProcRepository(r, func(url string) error {
+		for _, c := range cases {
+			tc := NewTemporaryCloner(memfs.New(), CloneOptions{
+				RefInclude: c.include,
+				RefExclude: c.exclude,
+			})
+
+			tr, err := tc.Clone(context.Background(), "foo", url)
+			require.NoError(err)
+
+			names := hashReferenceNames(t, tr.(*temporaryRepository).Repository)
+			require.Equal(c.expected, names, "include: %v, exclude: %v", c.include, c.exclude)
+			require.NoError(tr.Close())
+		}
+
+		return nil
+	})
+	require.NoError(err)
+}
+
+func TestTemporaryClonerSingleBranch(t *testing.T) {
+	require := require.New(t)
+
+	r := refFilterRepository(t)
+
+	err := WithInProcRepository(r, func(url string) error {
+		tc := NewTemporaryCloner(memfs.New(), CloneOptions{SingleBranch: true})
+		for _, branch := range []plumbing.ReferenceName{"refs/heads/master", "refs/heads/wip"} {
+			require.NoError(r.Storer.SetReference(
+				plumbing.NewSymbolicReference(plumbing.HEAD, branch)))
+
+			tr, err := tc.Clone(context.Background(), "foo", url)
+			require.NoError(err)
+
+			names := hashReferenceNames(t, tr.(*temporaryRepository).Repository)
+			require.Equal([]string{branch.String()}, names)
+			require.NoError(tr.Close())
+		}
+
+		return nil
+	})
+	require.NoError(err)
+}
+
+func TestTemporaryClonerMaxRefs(t *testing.T) {
+	require := require.New(t)
+
+	r := refFilterRepository(t)
+
+	err := WithInProcRepository(r, func(url string) error {
+		tc := NewTemporaryCloner(memfs.New(), CloneOptions{MaxRefs: 4})
+		tr, err := tc.Clone(context.Background(), "foo", url)
+		require.NoError(err)
+		require.Len(hashReferenceNames(t, tr.(*temporaryRepository).Repository), 4)
+		require.Equal(4, tr.(RefCountingRepository).RemoteReferences())
+		require.NoError(tr.Close())
+
+		tc = NewTemporaryCloner(memfs.New(), CloneOptions{MaxRefs: 3})
+		_, err = tc.Clone(context.Background(), "foo", url)
+		require.Equal(&TooManyRefsError{Endpoint: url, Refs: 4, Max: 3}, err)
+
+		// the filtered references are not counted
+		tc = NewTemporaryCloner(memfs.New(), CloneOptions{
+			MaxRefs:    3,
+			RefExclude: []string{"refs/pull/*"},
+		})
+		tr, err = tc.Clone(context.Background(), "foo", url)
+		require.NoError(err)
+		require.Equal([]string{"refs/heads/master", "refs/heads/wip", "refs/tags/v1"},
+			hashReferenceNames(t, tr.(*temporaryRepository).Repository))
+		require.Equal(3, tr.(RefCountingRepository).RemoteReferences())
+		return tr.Close()
+	})
+	require.NoError(err)
+}
+
+func TestHeadBranch(t *testing.T) {
+	require := require.New(t)
+
+	h1 := plumbing.NewHash("1111111111111111111111111111111111111111")
+	h2 := plumbing.NewHash("2222222222222222222222222222222222222222")
+
+	ar := packp.NewAdvRefs()
+	ar.References["refs/heads/master"] = h1
+	ar.References["refs/heads/wip"] = h2
+	ar.References["refs/heads/other"] = h2
+	ar.Head = &h2
+
+	refs, err := ar.AllReferences()
+	require.NoError(err)
+	branch, ok := headBranch(ar, refs)
+	require.True(ok)
+	require.Equal(plumbing.ReferenceName("refs/heads/other"), branch)
+
+	ar.Head = &h1
+	branch, ok = headBranch(ar, refs)
+	require.True(ok)
+	require.Equal(plumbing.Master, branch)
+
+	require.NoError(ar.Capabilities.Add(capability.SymRef, "HEAD:refs/heads/wip"))
+	refs, err = ar.AllReferences()
+	require.NoError(err)
+	branch, ok = headBranch(ar, refs)
+	require.True(ok)
+	require.Equal(plumbing.ReferenceName("refs/heads/wip"), branch)
+
+	_, ok = headBranch(packp.NewAdvRefs(), memory.ReferenceStorage{})
+	require.False(ok)
+}
+
+// refFilterRepository returns a repository with a commit pointed by the
+// master and wip branches, a pull request and a tag.
+func refFilterRepository(t *testing.T) *git.Repository {
+	require := require.New(t)
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	commitFile(t, r, "README", "foo")
+	head, err := r.Reference("refs/heads/master", false)
+	require.NoError(err)
+	for _, n := range []string{"refs/heads/wip", "refs/pull/1/head", "refs/tags/v1"} {
+		require.NoError(r.Storer.SetReference(
+			plumbing.NewHashReference(plumbing.ReferenceName(n), head.Hash())))
+	}
+
+	return r
+}
+
+// hashReferenceNames returns the sorted names of the hash references of r.
+func hashReferenceNames(t *testing.T, r *git.Repository) []string {
+	require := require.New(t)
+
+	refs, err := r.References()
+	require.NoError(err)
+
+	var names []string
+	require.NoError(refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			names = append(names, ref.Name().String())
+		}
+
+		return nil
+	}))
+
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,135 @@
+package borges
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+)
+
+// RefreshOptions sets which repositories are refreshed by the JobIter
+// returned by NewRefreshJobIter, and how often.
+type RefreshOptions struct {
+	// Interval is the time between the starts of two refresh passes. The
+	// jobs of each pass are spread over it. It must be positive.
+	Interval time.Duration
+	// OlderThan is how long ago the repositories must have been last
+	// fetched successfully to be refreshed. Repositories never fetched are
+	// not refreshed.
+	OlderThan time.Duration
+	// Statuses, if not empty, are the statuses of the repositories
+	// refreshed.
+	Statuses []model.FetchStatus
+	// PageSize is the number of repositories read from the store at once.
+	// If it is zero, DefaultStorePageSize is used.
+	PageSize uint64
+}
+
+type refreshJobIter struct {
+	store RepositoryStore
+	opts  RefreshOptions
+	iter  *RepositoryIter
+	// nextPass is the time the next pass starts.
+	nextPass time.Time
+	// delay is the time between the jobs of the current pass.
+	delay time.Duration
+	// nextJob is the time the next job of the current pass is due.
+	nextJob time.Time
+}
+
+// NewRefreshJobIter returns a JobIter that never ends, returning a job for
+// every repository of the store fetched longer ago than the given threshold
+// once every interval, so the archived repositories are kept fresh. Each pass
+// counts the repositories to refresh first and then returns their jobs evenly
+// spread over the interval, instead of all of them at once, so the consumers
+// get a steady stream of jobs. Along with the Incremental option of the
+// archiver, a refresh only fetches the objects pushed since the last fetch.
+func NewRefreshJobIter(store RepositoryStore, opts RefreshOptions) JobIter {
+	return &refreshJobIter{store: store, opts: opts}
+}
+
+func (i *refreshJobIter) Next(ctx context.Context) (*Job, error) {
+	for {
+		if i.iter == nil {
+			if err := waitUntil(ctx, i.nextPass); err != nil {
+				return nil, err
+			}
+
+			if err := i.startPass(); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := waitUntil(ctx, i.nextJob); err != nil {
+			return nil, err
+		}
+
+		r, err := i.iter.Next()
+		if err == io.EOF {
+			i.iter = nil
+			log.Debug("refresh pass done", "next", i.nextPass)
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		i.nextJob = time.Now().Add(i.delay)
+		return &Job{RepositoryID: uuid.UUID(r.ID)}, nil
+	}
+}
+
+// startPass counts the repositories to refresh and starts iterating them.
+func (i *refreshJobIter) startPass() error {
+	now := time.Now()
+	q := &RepositoryQuery{
+		Statuses:      i.opts.Statuses,
+		FetchedBefore: now.Add(-i.opts.OlderThan),
+	}
+
+	var n int64
+	err := NewRepositoryIter(i.store, q, i.opts.PageSize).ForEach(func(*model.Repository) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	i.delay = 0
+	if n > 0 {
+		i.delay = i.opts.Interval / time.Duration(n)
+	}
+
+	log.Info("refresh pass started", "repositories", n, "interval", i.opts.Interval,
+		"delay", i.delay)
+	i.nextPass = now.Add(i.opts.Interval)
+	i.nextJob = now
+	i.iter = NewRepositoryIter(i.store, q, i.opts.PageSize)
+	return nil
+}
+
+// waitUntil waits until the given time, or until the context is done, in which
+// case it returns the context error.
+func waitUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (i *refreshJobIter) Close() error {
+	return nil
+}
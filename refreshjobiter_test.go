@@ -0,0 +1,66 @@
+package borges
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+)
+
+func TestRefreshJobIter(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "borges-refresh")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(dir)) }()
+
+	store, err := OpenBoltRepositoryStore(filepath.Join(dir, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	old, recent := time.Now().Add(-time.Hour), time.Now()
+	stale := make(map[uuid.UUID]bool)
+	for _, fetchedAt := range []*time.Time{&old, &old, &old, &recent, nil} {
+		r := model.NewRepository()
+		r.FetchedAt = fetchedAt
+		require.NoError(store.Create(r))
+		if fetchedAt == &old {
+			stale[uuid.UUID(r.ID)] = true
+		}
+	}
+
+	iter := NewRefreshJobIter(store, RefreshOptions{
+		Interval:  300 * time.Millisecond,
+		OlderThan: time.Minute,
+	})
+
+	start := time.Now()
+	refreshed := make(map[uuid.UUID]bool)
+	for i := 0; i < 3; i++ {
+		j, err := iter.Next(context.TODO())
+		require.NoError(err)
+		refreshed[j.RepositoryID] = true
+	}
+
+	// the jobs are spread over the interval
+	require.Equal(stale, refreshed)
+	require.True(time.Since(start) >= 200*time.Millisecond, "%s", time.Since(start))
+
+	// the next pass starts after the interval
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	_, err = iter.Next(ctx)
+	cancel()
+	require.Equal(context.DeadlineExceeded, err)
+
+	j, err := iter.Next(context.TODO())
+	require.NoError(err)
+	require.True(stale[j.RepositoryID])
+	require.True(time.Since(start) >= 300*time.Millisecond, "%s", time.Since(start))
+	require.NoError(iter.Close())
+}
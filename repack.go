@@ -0,0 +1,275 @@
+package borges
+
+import (
+	"compress/zlib"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-billy.v3/util"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+)
+
+// DefaultDeltaDepth is the default maximum length of the chains of deltas of
+// the repacked packfiles, the same as git repack.
+const DefaultDeltaDepth = 50
+
+// repackingStorer is a Storer whose packfiles are repacked before writing
+// them, choosing the delta of every object again among the given number of
+// objects before it, like git repack does with its window.
+type repackingStorer struct {
+	storage.Storer
+	tmp    billy.Filesystem
+	window int
+	depth  int
+	level  int
+}
+
+// withPacking returns a Storer writing the packfiles to s as set in the
+// options: repacked with their delta window and depth, using tmp to store
+// the packfiles pushed while they are repacked, or only recompressed, see
+// withCompressionLevel.
+func withPacking(s storage.Storer, tmp billy.Filesystem, opts SivaOptions) storage.Storer {
+	if _, ok := s.(storer.PackfileWriter); !ok || opts.DeltaWindow <= 0 {
+		return withCompressionLevel(s, opts.Compression)
+	}
+
+	depth := opts.DeltaDepth
+	if depth <= 0 {
+		depth = DefaultDeltaDepth
+	}
+
+	return &repackingStorer{
+		Storer: s,
+		tmp:    tmp,
+		window: opts.DeltaWindow,
+		depth:  depth,
+		level:  opts.Compression.zlibLevel(),
+	}
+}
+
+// PackfileWriter implements the storer.PackfileWriter interface. The
+// packfile is written to a temporary repository, and repacked to the storer
+// once it is closed.
+func (s *repackingStorer) PackfileWriter() (io.WriteCloser, error) {
+	dir := strconv.FormatInt(time.Now().UnixNano(), 10)
+	fs, err := s.tmp.Chroot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := filesystem.NewStorage(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := tmp.PackfileWriter()
+	if err != nil {
+		return nil, err
+	}
+
+	return &repackWriter{WriteCloser: w, s: s, tmp: tmp, dir: dir}, nil
+}
+
+// repackWriter is the writer of a packfile to repack. Closing it repacks the
+// packfile and removes its temporary repository.
+type repackWriter struct {
+	io.WriteCloser
+	s   *repackingStorer
+	tmp storer.EncodedObjectStorer
+	dir string
+}
+
+func (w *repackWriter) Close() (err error) {
+	defer func() {
+		if rErr := util.RemoveAll(w.s.tmp, w.dir); rErr != nil && err == nil {
+			err = rErr
+		}
+	}()
+
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+
+	pw, err := w.s.Storer.(storer.PackfileWriter).PackfileWriter()
+	if err != nil {
+		return err
+	}
+	defer checkClose(pw, &err)
+
+	return repackObjects(pw, w.tmp, w.s.window, w.s.depth, w.s.level)
+}
+
+// packEntry is an object to repack.
+type packEntry struct {
+	hash plumbing.Hash
+	typ  plumbing.ObjectType
+	size int64
+}
+
+// windowEntry is an object in the delta window, already written at the
+// given index of the packfile, with a chain of deltas of the given depth.
+type windowEntry struct {
+	index int64
+	obj   plumbing.EncodedObject
+	depth int
+}
+
+// repackObjects writes to w a packfile with all the objects of s, compressed
+// with the given zlib level. The objects are sorted by type and decreasing
+// size, and the blobs and trees are stored as a delta of the one of the
+// window objects before them of the same type that gives the smallest delta,
+// if any is worth it, without making chains of deltas longer than depth. Only
+// the objects in the window are kept in memory. Nothing is written if s has no
+// objects.
+func repackObjects(w io.Writer, s storer.EncodedObjectStorer, window, depth, level int) error {
+	entries, err := packEntries(s)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	pw := newPackWriter(w)
+	zw, err := zlib.NewWriterLevel(pw, level)
+	if err != nil {
+		return err
+	}
+
+	if err := pw.header(uint32(len(entries))); err != nil {
+		return err
+	}
+
+	// offsets has the offsets in w of the objects by their index
+	offsets := make(map[int64]int64, len(entries))
+	var win []*windowEntry
+	for i, e := range entries {
+		if len(win) > 0 && win[0].obj.Type() != e.typ {
+			win = nil
+		}
+
+		o, err := s.EncodedObject(e.typ, e.hash)
+		if err != nil {
+			return err
+		}
+
+		var base *windowEntry
+		content := o
+		if e.typ == plumbing.BlobObject || e.typ == plumbing.TreeObject {
+			base, content, err = findDelta(win, o, depth)
+			if err != nil {
+				return err
+			}
+		}
+
+		h := &packfile.ObjectHeader{Type: content.Type(), Length: content.Size()}
+		entry := &windowEntry{index: int64(i), obj: o}
+		if base != nil {
+			h.Type = plumbing.OFSDeltaObject
+			h.OffsetReference = base.index
+			entry.depth = base.depth + 1
+		}
+
+		offsets[int64(i)] = pw.offset
+		if err := pw.objectHeader(h, offsets); err != nil {
+			return err
+		}
+
+		if err := writeObjectContent(zw, pw, content); err != nil {
+			return err
+		}
+
+		win = append(win, entry)
+		if len(win) > window {
+			win = win[1:]
+		}
+	}
+
+	return pw.footer()
+}
+
+// packEntries returns the objects of s sorted by type and decreasing size.
+func packEntries(s storer.EncodedObjectStorer) ([]*packEntry, error) {
+	iter, err := s.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*packEntry
+	err = iter.ForEach(func(o plumbing.EncodedObject) error {
+		entries = append(entries, &packEntry{hash: o.Hash(), typ: o.Type(), size: o.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].typ != entries[j].typ {
+			return entries[i].typ > entries[j].typ
+		}
+
+		if entries[i].size != entries[j].size {
+			return entries[i].size > entries[j].size
+		}
+
+		return entries[i].hash.String() < entries[j].hash.String()
+	})
+
+	return entries, nil
+}
+
+// findDelta returns the entry of the window whose delta to o is the smallest
+// one, along with the delta. It returns o itself and no entry if none is
+// worth it: the deltas must be smaller than half the size of o, and less the
+// deeper their base is, so the chains of deltas do not grow to depth only to
+// save a few bytes, as in git.
+func findDelta(win []*windowEntry, o plumbing.EncodedObject, depth int) (*windowEntry, plumbing.EncodedObject, error) {
+	var base *windowEntry
+	best := o
+	for j := len(win) - 1; j >= 0; j-- {
+		e := win[j]
+		if e.depth >= depth || o.Size() < e.obj.Size()>>4 {
+			continue
+		}
+
+		limit := o.Size() / 2 * int64(depth-e.depth) / int64(depth)
+		if base != nil && best.Size() < limit {
+			limit = best.Size()
+		}
+
+		if limit <= 8 || e.obj.Size()-o.Size() > limit {
+			continue
+		}
+
+		delta, err := packfile.GetDelta(e.obj, o)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if delta.Size() < limit {
+			base, best = e, delta
+		}
+	}
+
+	return base, best, nil
+}
+
+func writeObjectContent(zw *zlib.Writer, w io.Writer, o plumbing.EncodedObject) (err error) {
+	r, err := o.Reader()
+	if err != nil {
+		return err
+	}
+	defer checkClose(r, &err)
+
+	zw.Reset(w)
+	if _, err := io.Copy(zw, r); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
@@ -0,0 +1,92 @@
+package borges
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// TestSivaRootedTransactioner_DeltaWindow pushes the same repository to a siva
+// file repacked with a small and a large delta window, and checks that the
+// objects can be read back and that the larger window makes a smaller file.
+// With the fixture, whose file changes a tenth of its lines in every
+// revision, the best base of each version is rarely the one next to it by
+// size, so a window of one object takes about half again the space of a
+// window of ten, which is also smaller than the packfile as pushed. The sizes
+// are logged with -v.
+func TestSivaRootedTransactioner_DeltaWindow(t *testing.T) {
+	require := require.New(t)
+
+	src, blobs := compressionFixture(t)
+	h := plumbing.NewHash("e41f091c11a338f62796a738c83d879936a508ec")
+
+	sizes := make(map[int]int64)
+	for _, window := range []int{1, 10} {
+		fs := memfs.New()
+		rtx := NewSivaRootedTransactioner(fs, memfs.New(), SivaOptions{DeltaWindow: window})
+
+		tx, err := rtx.Begin(h)
+		require.NoError(err)
+		rr, err := git.Open(tx.Storer(), nil)
+		require.NoError(err)
+
+		require.NoError(WithInProcRepository(rr, func(url string) error {
+			remote, err := src.CreateRemote(&config.RemoteConfig{
+				Name: strconv.Itoa(window),
+				URL:  url,
+			})
+			if err != nil {
+				return err
+			}
+
+			return remote.Push(&git.PushOptions{RefSpecs: []config.RefSpec{
+				"refs/heads/master:refs/heads/master",
+			}})
+		}))
+		require.NoError(tx.Commit())
+
+		fi, err := fs.Stat(h.String() + ".siva")
+		require.NoError(err)
+		sizes[window] = fi.Size()
+		t.Logf("delta window %d: %d bytes", window, fi.Size())
+
+		requireBlobsInSiva(t, fs, h, blobs)
+	}
+
+	require.True(sizes[1] > sizes[10], "%v", sizes)
+}
+
+func TestFindDelta_Depth(t *testing.T) {
+	require := require.New(t)
+
+	content := make([]byte, 1024)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	a := &plumbing.MemoryObject{}
+	a.SetType(plumbing.BlobObject)
+	_, err := a.Write(content)
+	require.NoError(err)
+
+	b := &plumbing.MemoryObject{}
+	b.SetType(plumbing.BlobObject)
+	_, err = b.Write(append(content, 'x'))
+	require.NoError(err)
+
+	e, delta, err := findDelta([]*windowEntry{{index: 3, obj: a}}, b, 2)
+	require.NoError(err)
+	require.NotNil(e)
+	require.Equal(int64(3), e.index)
+	require.True(delta.Size() < b.Size())
+
+	e, delta, err = findDelta([]*windowEntry{{index: 3, obj: a, depth: 2}}, b, 2)
+	require.NoError(err)
+	require.Nil(e)
+	require.Equal(b, delta)
+}
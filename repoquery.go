@@ -0,0 +1,228 @@
+package borges
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+)
+
+// DefaultRepositoryPageSize is the page size used by NewRepositoryIter when it
+// is given a zero page size.
+const DefaultRepositoryPageSize = 1000
+
+// RepositoryOrder is the order of the repositories returned by a query. Ties
+// are always broken by the ID of the repositories, so the order is total and
+// the queries can be paginated by the last repository returned.
+type RepositoryOrder int
+
+const (
+	// OrderByID sorts the repositories by ID. It is the default.
+	OrderByID RepositoryOrder = iota
+	// OrderByCreatedAt sorts the repositories by creation time.
+	OrderByCreatedAt
+	// OrderByUpdatedAt sorts the repositories by update time.
+	OrderByUpdatedAt
+	// OrderByFetchErrorAt sorts the repositories by the time of their last
+	// fetch error. Repositories that never failed are not returned.
+	OrderByFetchErrorAt
+)
+
+// RepositoryQuery selects the repositories returned by RepositoryStore.Find
+// and RepositoryIter, and their order. The zero value selects all of them,
+// sorted by ID.
+type RepositoryQuery struct {
+	// Statuses, if not empty, are the statuses of the repositories
+	// returned.
+	Statuses []model.FetchStatus
+	// Provider, if not empty, only selects the repositories with an
+	// endpoint in this host, such as github.com.
+	Provider string
+	// UpdatedAfter and UpdatedBefore, if not zero, only select the
+	// repositories updated after the first one and at or before the
+	// second one.
+	UpdatedAfter, UpdatedBefore time.Time
+	// FetchErrorAfter and FetchErrorBefore, if not zero, only select the
+	// repositories whose last fetch error was after the first one and at
+	// or before the second one.
+	FetchErrorAfter, FetchErrorBefore time.Time
+	// FetchedAfter and FetchedBefore, if not zero, only select the
+	// repositories whose last successful fetch was after the first one and
+	// at or before the second one.
+	FetchedAfter, FetchedBefore time.Time
+	// Order is the order of the repositories.
+	Order RepositoryOrder
+}
+
+// providerRegexp returns the regular expression matching the endpoints in the
+// host of the query provider. Endpoints can be URLs, such as
+// https://github.com/foo/bar, or scp-like addresses, such as
+// git@github.com:foo/bar.
+func (q *RepositoryQuery) providerRegexp() string {
+	return fmt.Sprintf(`(://|@)([^/@]*@)?%s[:/]`, regexp.QuoteMeta(q.Provider))
+}
+
+// matcher returns a function telling whether a repository is selected by the
+// query, for the stores that filter the repositories themselves.
+func (q *RepositoryQuery) matcher() (func(*model.Repository) bool, error) {
+	statuses := make(map[model.FetchStatus]bool, len(q.Statuses))
+	for _, s := range q.Statuses {
+		statuses[s] = true
+	}
+
+	var provider *regexp.Regexp
+	if q.Provider != "" {
+		var err error
+		if provider, err = regexp.Compile(q.providerRegexp()); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(r *model.Repository) bool {
+		if len(statuses) > 0 && !statuses[r.Status] {
+			return false
+		}
+
+		if provider != nil && !anyMatch(provider, r.Endpoints) {
+			return false
+		}
+
+		if !inTimeRange(&r.UpdatedAt, q.UpdatedAfter, q.UpdatedBefore) ||
+			!inTimeRange(r.FetchErrorAt, q.FetchErrorAfter, q.FetchErrorBefore) ||
+			!inTimeRange(r.FetchedAt, q.FetchedAfter, q.FetchedBefore) {
+			return false
+		}
+
+		return q.Order != OrderByFetchErrorAt || r.FetchErrorAt != nil
+	}, nil
+}
+
+// less returns whether a goes before b in the order of the query.
+func (q *RepositoryQuery) less(a, b *model.Repository) bool {
+	var ta, tb time.Time
+	switch q.Order {
+	case OrderByCreatedAt:
+		ta, tb = a.CreatedAt, b.CreatedAt
+	case OrderByUpdatedAt:
+		ta, tb = a.UpdatedAt, b.UpdatedAt
+	case OrderByFetchErrorAt:
+		ta, tb = *a.FetchErrorAt, *b.FetchErrorAt
+	}
+
+	if !ta.Equal(tb) {
+		return ta.Before(tb)
+	}
+
+	return bytes.Compare(a.ID[:], b.ID[:]) < 0
+}
+
+func anyMatch(re *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inTimeRange returns whether t is after the given time and at or before the
+// given one, ignoring the zero ones. A nil t is only in the range if both of
+// them are zero.
+func inTimeRange(t *time.Time, after, before time.Time) bool {
+	if after.IsZero() && before.IsZero() {
+		return true
+	}
+
+	if t == nil {
+		return false
+	}
+
+	return (after.IsZero() || t.After(after)) && (before.IsZero() || !t.After(before))
+}
+
+// RepositoryIter iterates over the repositories selected by a query, reading
+// them from the store in pages, so they are never loaded all at once. Each
+// page starts after the last repository of the previous one, so repositories
+// changed while iterating are neither skipped nor returned twice, unless
+// their sort key changes.
+type RepositoryIter struct {
+	store    RepositoryStore
+	query    *RepositoryQuery
+	pageSize uint64
+	page     []*model.Repository
+	last     *model.Repository
+	done     bool
+}
+
+// NewRepositoryIter returns a RepositoryIter of the repositories of the store
+// selected by the query, read in pages of pageSize.
+func NewRepositoryIter(store RepositoryStore, q *RepositoryQuery, pageSize uint64) *RepositoryIter {
+	if pageSize == 0 {
+		pageSize = DefaultRepositoryPageSize
+	}
+
+	return &RepositoryIter{store: store, query: q, pageSize: pageSize}
+}
+
+// Next returns the next repository. It returns io.EOF if there are no more.
+func (i *RepositoryIter) Next() (*model.Repository, error) {
+	if len(i.page) == 0 {
+		if err := i.nextPage(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(i.page) == 0 {
+		return nil, io.EOF
+	}
+
+	r := i.page[0]
+	i.page = i.page[1:]
+	return r, nil
+}
+
+// ForEach calls f with every remaining repository, stopping at the first
+// error, which is returned.
+func (i *RepositoryIter) ForEach(f func(*model.Repository) error) error {
+	for {
+		r, err := i.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := f(r); err != nil {
+			return err
+		}
+	}
+}
+
+// nextPage reads the page of repositories after the last one returned.
+func (i *RepositoryIter) nextPage() error {
+	if i.done {
+		return nil
+	}
+
+	var err error
+	i.page, err = i.store.Find(i.query, i.last, i.pageSize)
+	if err != nil {
+		return err
+	}
+
+	if uint64(len(i.page)) < i.pageSize {
+		i.done = true
+	}
+
+	if len(i.page) > 0 {
+		i.last = i.page[len(i.page)-1]
+	}
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package borges
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+func TestRepositoryIter(t *testing.T) {
+	suite.Run(t, new(RepositoryIterSuite))
+}
+
+type RepositoryIterSuite struct {
+	suite.Suite
+	dir     string
+	store   *BoltRepositoryStore
+	now     time.Time
+	created int
+}
+
+func (s *RepositoryIterSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "borges-query")
+	s.NoError(err)
+
+	s.store, err = OpenBoltRepositoryStore(filepath.Join(s.dir, "repositories.db"))
+	s.NoError(err)
+
+	s.now = time.Now().UTC().Truncate(time.Second)
+	s.created = 0
+}
+
+func (s *RepositoryIterSuite) TearDownTest() {
+	s.NoError(s.store.Close())
+	s.NoError(os.RemoveAll(s.dir))
+}
+
+func (s *RepositoryIterSuite) TestEmpty() {
+	iter := NewRepositoryIter(s.store, &RepositoryQuery{}, 2)
+	_, err := iter.Next()
+	s.Equal(io.EOF, err)
+	_, err = iter.Next()
+	s.Equal(io.EOF, err)
+}
+
+func (s *RepositoryIterSuite) TestPageBoundaries() {
+	var ids []kallax.ULID
+	for n := 1; n <= 5; n++ {
+		ids = append(ids, s.put(model.Pending, 0, nil).ID)
+
+		s.Equal(ids, s.iterIDs(&RepositoryQuery{}, 2), "%d repositories", n)
+		s.Equal(ids, s.iterIDs(&RepositoryQuery{}, uint64(n)), "%d repositories", n)
+		s.Equal(ids, s.iterIDs(&RepositoryQuery{Order: OrderByCreatedAt}, 2),
+			"%d repositories", n)
+	}
+}
+
+func (s *RepositoryIterSuite) TestFilters() {
+	errAt := s.now.Add(-time.Hour)
+	pending := s.put(model.Pending, 0, nil)
+	errored := s.put(Errored, time.Minute, &errAt)
+	fetched := s.put(model.Fetched, 2*time.Minute, nil)
+	s.putEndpoints(errored, "git@gitlab.com:foo/bar.git")
+
+	s.Equal([]kallax.ULID{pending.ID, fetched.ID}, s.iterIDs(&RepositoryQuery{
+		Statuses: []model.FetchStatus{model.Pending, model.Fetched},
+	}, 1))
+
+	s.Equal([]kallax.ULID{errored.ID}, s.iterIDs(&RepositoryQuery{
+		Provider: "gitlab.com",
+	}, 1))
+
+	s.Equal([]kallax.ULID{pending.ID, fetched.ID}, s.iterIDs(&RepositoryQuery{
+		Provider: "github.com",
+	}, 1))
+
+	s.Empty(s.iterIDs(&RepositoryQuery{
+		Statuses: []model.FetchStatus{model.NotFound},
+	}, 1))
+
+	s.Equal([]kallax.ULID{errored.ID, fetched.ID}, s.iterIDs(&RepositoryQuery{
+		UpdatedAfter: s.now,
+	}, 1))
+
+	s.Equal([]kallax.ULID{pending.ID, errored.ID}, s.iterIDs(&RepositoryQuery{
+		UpdatedBefore: s.now.Add(time.Minute),
+	}, 1))
+
+	s.Equal([]kallax.ULID{errored.ID}, s.iterIDs(&RepositoryQuery{
+		FetchErrorBefore: errAt,
+	}, 1))
+
+	s.Empty(s.iterIDs(&RepositoryQuery{
+		FetchErrorAfter: errAt,
+	}, 1))
+}
+
+func (s *RepositoryIterSuite) TestFetchedFilter() {
+	old, recent := s.now.Add(-time.Hour), s.now.Add(-time.Minute)
+	s.put(model.Pending, 0, nil)
+	a := s.put(model.Fetched, 0, nil)
+	a.FetchedAt = &old
+	s.putRepository(a, nil)
+	b := s.put(model.Fetched, 0, nil)
+	b.FetchedAt = &recent
+	s.putRepository(b, nil)
+
+	s.Equal([]kallax.ULID{a.ID}, s.iterIDs(&RepositoryQuery{
+		FetchedBefore: s.now.Add(-30 * time.Minute),
+	}, 1))
+	s.Equal([]kallax.ULID{b.ID}, s.iterIDs(&RepositoryQuery{
+		FetchedAfter: old,
+	}, 1))
+}
+
+func (s *RepositoryIterSuite) TestOrder() {
+	errAt := s.now.Add(-time.Hour)
+	laterErrAt := s.now.Add(-time.Minute)
+	a := s.put(Errored, 2*time.Minute, &laterErrAt)
+	b := s.put(Errored, time.Minute, &errAt)
+	c := s.put(model.Fetched, time.Minute, nil)
+	d := s.put(Errored, 0, &errAt)
+
+	s.Equal([]kallax.ULID{a.ID, b.ID, c.ID, d.ID},
+		s.iterIDs(&RepositoryQuery{Order: OrderByID}, 1))
+	s.Equal([]kallax.ULID{d.ID, b.ID, c.ID, a.ID},
+		s.iterIDs(&RepositoryQuery{Order: OrderByUpdatedAt}, 1))
+	s.Equal([]kallax.ULID{b.ID, d.ID, a.ID},
+		s.iterIDs(&RepositoryQuery{Order: OrderByFetchErrorAt}, 2))
+	s.Equal([]kallax.ULID{b.ID, d.ID},
+		s.iterIDs(&RepositoryQuery{
+			Order:            OrderByFetchErrorAt,
+			FetchErrorBefore: errAt,
+		}, 1))
+}
+
+func (s *RepositoryIterSuite) TestForEach() {
+	a := s.put(model.Pending, 0, nil)
+	s.put(model.Pending, 0, nil)
+
+	var ids []kallax.ULID
+	iter := NewRepositoryIter(s.store, &RepositoryQuery{}, 1)
+	err := iter.ForEach(func(r *model.Repository) error {
+		ids = append(ids, r.ID)
+		return io.ErrUnexpectedEOF
+	})
+	s.Equal(io.ErrUnexpectedEOF, err)
+	s.Equal([]kallax.ULID{a.ID}, ids)
+}
+
+// put stores a repository with the given status, updated the given time after
+// s.now, and created in the order of the calls.
+func (s *RepositoryIterSuite) put(status model.FetchStatus, updated time.Duration,
+	fetchErrorAt *time.Time) *model.Repository {
+	r := model.NewRepository()
+	r.Endpoints = []string{"https://github.com/foo/" + r.ID.String()}
+	r.Status = status
+	r.CreatedAt = s.now.Add(time.Duration(s.created) * time.Second)
+	s.created++
+	r.UpdatedAt = s.now.Add(updated)
+	r.FetchErrorAt = fetchErrorAt
+	s.putRepository(r, nil)
+
+	// ULIDs are only sorted by creation time with a millisecond precision
+	time.Sleep(2 * time.Millisecond)
+	return r
+}
+
+func (s *RepositoryIterSuite) putEndpoints(r *model.Repository, endpoints ...string) {
+	prev := r.Endpoints
+	r.Endpoints = endpoints
+	s.putRepository(r, prev)
+}
+
+func (s *RepositoryIterSuite) putRepository(r *model.Repository, prevEndpoints []string) {
+	s.NoError(s.store.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, r, prevEndpoints)
+	}))
+}
+
+func (s *RepositoryIterSuite) iterIDs(q *RepositoryQuery, pageSize uint64) []kallax.ULID {
+	var ids []kallax.ULID
+	s.NoError(NewRepositoryIter(s.store, q, pageSize).ForEach(func(r *model.Repository) error {
+		ids = append(ids, r.ID)
+		return nil
+	}))
+
+	return ids
+}
@@ -0,0 +1,105 @@
+package borges
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+// RetryError is returned when an operation kept failing after being retried
+// the maximum number of times.
+type RetryError struct {
+	// Attempts is the number of times the operation was tried.
+	Attempts int
+	// Err is the error returned by the last attempt.
+	Err error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("failed after %d attempts: %s", e.Attempts, e.Err)
+}
+
+// isTransientError returns true if the given error is caused by a condition
+// that can go away by itself, such as network timeouts or connection resets,
+// so the operation that caused it may succeed if it is retried. Errors such as
+// repository not found or authentication failures are never transient.
+func isTransientError(err error) bool {
+	switch err {
+	case nil,
+		transport.ErrRepositoryNotFound,
+		transport.ErrEmptyRemoteRepository,
+		transport.ErrAuthenticationRequired,
+		transport.ErrAuthorizationFailed,
+		transport.ErrEmptyUploadPackRequest,
+		transport.ErrInvalidAuthMethod:
+		return false
+	case io.ErrUnexpectedEOF,
+		syscall.ECONNRESET,
+		syscall.ECONNREFUSED,
+		syscall.ECONNABORTED,
+		syscall.EPIPE,
+		syscall.ETIMEDOUT:
+		return true
+	}
+
+	switch e := err.(type) {
+	case *plumbing.PermanentError, *RateLimitError:
+		return false
+	case *plumbing.UnexpectedError:
+		return isTransientError(e.Err)
+	case *githttp.Err:
+		code := e.StatusCode()
+		return code >= http.StatusInternalServerError ||
+			code == http.StatusTooManyRequests
+	case *url.Error:
+		return isTransientError(e.Err)
+	case *net.OpError:
+		return true
+	case net.Error:
+		return e.Timeout() || e.Temporary()
+	}
+
+	return false
+}
+
+// isRepositoryGone returns true if the given error means that the repository
+// does not exist at the remote anymore, which is never transient.
+func isRepositoryGone(err error) bool {
+	switch e := err.(type) {
+	case *plumbing.UnexpectedError:
+		return isRepositoryGone(e.Err)
+	case *githttp.Err:
+		return e.StatusCode() == http.StatusGone
+	}
+
+	return err == transport.ErrRepositoryNotFound
+}
+
+// retryBackoff returns the time to wait before the given retry attempt,
+// starting at 1, using exponential backoff with jitter. The returned duration
+// is between half and the whole of base * 2^(attempt-1), which saturates at
+// the longest duration instead of overflowing.
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+
+	shift := uint(attempt - 1)
+	d := base << shift
+	if shift >= 63 || d>>shift != base {
+		d = math.MaxInt64
+	}
+
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
@@ -0,0 +1,82 @@
+package borges
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+func TestIsTransientError(t *testing.T) {
+	require := require.New(t)
+
+	transient := []error{
+		io.ErrUnexpectedEOF,
+		syscall.ECONNRESET,
+		&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED},
+		plumbing.NewUnexpectedError(&url.Error{
+			Op:  "Get",
+			URL: "https://foo/bar",
+			Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET},
+		}),
+	}
+
+	for _, err := range transient {
+		require.True(isTransientError(err), "expected transient: %s", err)
+	}
+
+	permanent := []error{
+		nil,
+		errors.New("SOME ERROR"),
+		transport.ErrRepositoryNotFound,
+		transport.ErrAuthenticationRequired,
+		transport.ErrAuthorizationFailed,
+		plumbing.NewPermanentError(syscall.ECONNRESET),
+		plumbing.NewUnexpectedError(transport.ErrRepositoryNotFound),
+	}
+
+	for _, err := range permanent {
+		require.False(isTransientError(err), "expected permanent: %v", err)
+	}
+}
+
+func TestIsRepositoryGone(t *testing.T) {
+	require := require.New(t)
+
+	require.True(isRepositoryGone(transport.ErrRepositoryNotFound))
+	require.True(isRepositoryGone(githttp.NewErr(&http.Response{StatusCode: http.StatusGone})))
+	require.False(isRepositoryGone(githttp.NewErr(&http.Response{StatusCode: http.StatusBadGateway})))
+	require.False(isRepositoryGone(transport.ErrAuthenticationRequired))
+	require.False(isRepositoryGone(nil))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	require := require.New(t)
+	require.Equal(time.Duration(0), retryBackoff(0, 1))
+
+	base := 100 * time.Millisecond
+	for attempt := 1; attempt <= 4; attempt++ {
+		max := base << uint(attempt-1)
+		for i := 0; i < 10; i++ {
+			d := retryBackoff(base, attempt)
+			require.True(d >= max/2 && d <= max,
+				"attempt %d: %s not in [%s, %s]", attempt, d, max/2, max)
+		}
+	}
+
+	for _, attempt := range []int{33, 42, 57, 64, 1000} {
+		d := retryBackoff(5*time.Second, attempt)
+		require.True(d >= math.MaxInt64/2, "attempt %d: %s", attempt, d)
+		require.Equal(maxReconnectBackoff, reconnectBackoff(0, attempt))
+	}
+}
@@ -0,0 +1,121 @@
+package borges
+
+import (
+	"bytes"
+	"sort"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// RootIndex is a RepositoryStore that indexes the roots of the rooted
+// repositories where the repositories fetched from each endpoint are stored.
+// The rooted repositories are identified by the initial commit of their
+// history, not by the endpoint, so different endpoints of the same history,
+// such as forks or mirrors, share them. With the index, the archiver reuses
+// the rooted repositories of an endpoint fetched before even if the
+// repository has no references stored, such as when it is added again with
+// a new ID, fetching only the objects they are missing.
+type RootIndex interface {
+	// Roots returns the roots of the rooted repositories of the endpoint,
+	// nil if it is not indexed.
+	Roots(endpoint string) ([]model.SHA1, error)
+	// SetRoots replaces the roots of the rooted repositories of the
+	// endpoint.
+	SetRoots(endpoint string, roots []model.SHA1) error
+}
+
+// rootIndexCreator is a RootIndex whose index must be created before using
+// it, see MigrateRootIndex.
+type rootIndexCreator interface {
+	createRootIndex() error
+}
+
+// MigrateRootIndex creates the root index of the store, if it is a RootIndex,
+// and adds to it the roots of the references of every repository stored for
+// all their endpoints, keeping the roots already indexed. It returns the
+// number of repositories indexed. It can be run again safely.
+func MigrateRootIndex(store RepositoryStore) (int, error) {
+	index, ok := store.(RootIndex)
+	if !ok {
+		return 0, nil
+	}
+
+	if c, ok := store.(rootIndexCreator); ok {
+		if err := c.createRootIndex(); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	err := NewRepositoryIter(store, &RepositoryQuery{}, 0).ForEach(func(r *model.Repository) error {
+		roots := repositoryRoots(r.References)
+		if len(roots) == 0 {
+			return nil
+		}
+
+		for _, e := range r.Endpoints {
+			indexed, err := index.Roots(e)
+			if err != nil {
+				return err
+			}
+
+			if err := index.SetRoots(e, mergeRoots(indexed, roots)); err != nil {
+				return err
+			}
+		}
+
+		n++
+		return nil
+	})
+
+	return n, err
+}
+
+// repositoryRoots returns the sorted roots of the given references, that is,
+// their initial commits.
+func repositoryRoots(refs []*model.Reference) []model.SHA1 {
+	var roots []model.SHA1
+	for _, ref := range refs {
+		roots = append(roots, ref.Init)
+	}
+
+	return mergeRoots(nil, roots)
+}
+
+// mergeRoots returns the sorted roots of both a and b, without duplicates.
+func mergeRoots(a, b []model.SHA1) []model.SHA1 {
+	all := append(append([]model.SHA1(nil), a...), b...)
+	sort.Slice(all, func(i, j int) bool {
+		return bytes.Compare(all[i][:], all[j][:]) < 0
+	})
+
+	var roots []model.SHA1
+	for i, r := range all {
+		if i == 0 || r != all[i-1] {
+			roots = append(roots, r)
+		}
+	}
+
+	return roots
+}
+
+// referenceHashes returns the hashes of the hash references of s.
+func referenceHashes(s storer.ReferenceStorer) ([]plumbing.Hash, error) {
+	iter, err := s.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []plumbing.Hash
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			hashes = append(hashes, ref.Hash())
+		}
+
+		return nil
+	})
+
+	return hashes, err
+}
@@ -0,0 +1,183 @@
+package borges
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	rrepository "gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy.v3/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestMigrateRootIndex(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "borges-roots")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(dir)) }()
+
+	store, err := OpenBoltRepositoryStore(filepath.Join(dir, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	a, b, c := model.NewSHA1("aa"), model.NewSHA1("bb"), model.NewSHA1("cc")
+	r := model.NewRepository()
+	r.Endpoints = []string{"https://github.com/foo/bar", "git://github.com/foo/bar"}
+	r.References = []*model.Reference{
+		{Name: "refs/heads/master", Init: b},
+		{Name: "refs/heads/foo", Init: a},
+		{Name: "refs/heads/bar", Init: b},
+	}
+	require.NoError(store.Create(r))
+
+	fork := model.NewRepository()
+	fork.Endpoints = []string{"https://github.com/baz/bar"}
+	fork.References = []*model.Reference{{Name: "refs/heads/master", Init: a}}
+	require.NoError(store.Create(fork))
+
+	empty := model.NewRepository()
+	empty.Endpoints = []string{"https://github.com/foo/empty"}
+	require.NoError(store.Create(empty))
+
+	require.NoError(store.SetRoots("https://github.com/baz/bar", []model.SHA1{c}))
+
+	for i := 0; i < 2; i++ {
+		n, err := MigrateRootIndex(store)
+		require.NoError(err)
+		require.Equal(2, n)
+
+		roots, err := store.Roots("https://github.com/foo/bar")
+		require.NoError(err)
+		require.Equal([]model.SHA1{a, b}, roots)
+
+		roots, err = store.Roots("git://github.com/foo/bar")
+		require.NoError(err)
+		require.Equal([]model.SHA1{a, b}, roots)
+
+		roots, err = store.Roots("https://github.com/baz/bar")
+		require.NoError(err)
+		require.Equal([]model.SHA1{a, c}, roots)
+
+		roots, err = store.Roots("https://github.com/foo/empty")
+		require.NoError(err)
+		require.Empty(roots)
+	}
+}
+
+func TestArchiverDo_SharedRoots(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("", "borges-roots")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	fs := osfs.New(tmp)
+	store, err := OpenBoltRepositoryStore(fs.Join(tmp, "repositories.db"))
+	require.NoError(err)
+	defer func() { require.NoError(store.Close()) }()
+
+	rootedFs, err := fs.Chroot("rooted")
+	require.NoError(err)
+	txFs, err := fs.Chroot("tx")
+	require.NoError(err)
+	tmpFs, err := fs.Chroot("tmp")
+	require.NoError(err)
+
+	tc := &incrementalCountingCloner{
+		IncrementalCloner: NewTemporaryCloner(tmpFs, CloneOptions{}).(IncrementalCloner),
+	}
+	a := NewArchiver(store, rrepository.NewSivaRootedTransactioner(rootedFs, txFs), tc)
+	a.Options.Incremental = true
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	commitFile(t, r, "README", "foo")
+	head, err := r.Reference("refs/heads/master", false)
+	require.NoError(err)
+
+	var endpoint string
+	for i := 0; i < 2; i++ {
+		// the same history at different endpoints
+		err = WithInProcRepository(r, func(url string) error {
+			endpoint = url
+			mr := model.NewRepository()
+			mr.Endpoints = []string{url}
+			require.NoError(store.Create(mr))
+			return a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)})
+		})
+		require.NoError(err)
+	}
+
+	fis, err := rootedFs.ReadDir(".")
+	require.NoError(err)
+	require.Len(fis, 1)
+
+	roots, err := store.Roots(endpoint)
+	require.NoError(err)
+	require.Len(roots, 1)
+	require.Equal(fis[0].Name(), roots[0].String()+".siva")
+	require.Equal(0, tc.incremental)
+
+	// an archived endpoint added again as a new repository is fetched from
+	// its rooted repository
+	err = withInProcRepositoryAt(endpoint, r, func() error {
+		mr := model.NewRepository()
+		mr.Endpoints = []string{endpoint}
+		require.NoError(store.Create(mr))
+		return a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)})
+	})
+	require.NoError(err)
+	require.Equal(1, tc.incremental)
+
+	tx, err := rrepository.NewSivaRootedTransactioner(rootedFs, txFs).Begin(plumbing.Hash(roots[0]))
+	require.NoError(err)
+	defer tx.Rollback()
+	hashes, err := referenceHashes(tx.Storer())
+	require.NoError(err)
+	require.Len(hashes, 3)
+	for _, h := range hashes {
+		require.Equal(head.Hash(), h)
+	}
+}
+
+// incrementalCountingCloner is an IncrementalCloner that counts the
+// incremental clones with haves.
+type incrementalCountingCloner struct {
+	IncrementalCloner
+	incremental int
+}
+
+func (c *incrementalCountingCloner) CloneIncremental(ctx context.Context, id, url string,
+	base []storer.EncodedObjectStorer, haves []plumbing.Hash) (TemporaryRepository, error) {
+	if len(haves) > 0 {
+		c.incremental++
+	}
+
+	return c.IncrementalCloner.CloneIncremental(ctx, id, url, base, haves)
+}
+
+// withInProcRepositoryAt serves r at the given url, which must have been
+// returned by WithInProcRepository, while calling f.
+func withInProcRepositoryAt(url string, r *git.Repository, f func() error) error {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return err
+	}
+
+	client.InstallProtocol(ep.Protocol(), server.NewClient(server.MapLoader{ep.String(): r.Storer}))
+	defer client.InstallProtocol(ep.Protocol(), nil)
+
+	return f()
+}
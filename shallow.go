@@ -0,0 +1,223 @@
+package borges
+
+import (
+	"io"
+
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/utils/ioutil"
+)
+
+// pushReachable pushes the given refspecs from a repository storage to the
+// given url. It is equivalent to git.Remote.Push, but history is not walked
+// past the shallow commits, whose parents are not available locally, and the
+// blobs skipped by the filter are left out of the packfile. Refspecs with
+// wildcards are not supported.
+func pushReachable(s storage.Storer, shallows []plumbing.Hash, f *blobFilter,
+	url string, refspecs []config.RefSpec) (err error) {
+
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return err
+	}
+
+	c, err := client.NewClient(ep)
+	if err != nil {
+		return err
+	}
+
+	sess, err := c.NewReceivePackSession(ep, nil)
+	if err != nil {
+		return err
+	}
+	defer ioutil.CheckClose(sess, &err)
+
+	ar, err := sess.AdvertisedReferences()
+	if err != nil {
+		return err
+	}
+
+	remoteRefs, err := ar.AllReferences()
+	if err != nil {
+		return err
+	}
+
+	req := packp.NewReferenceUpdateRequestFromCapabilities(ar.Capabilities)
+	var wants []plumbing.Hash
+	for _, rs := range refspecs {
+		cmd := &packp.Command{Name: rs.Dst("")}
+		if r, ok := remoteRefs[cmd.Name]; ok && r.Type() == plumbing.HashReference {
+			cmd.Old = r.Hash()
+		}
+
+		if !rs.IsDelete() {
+			src, err := s.Reference(plumbing.ReferenceName(rs.Src()))
+			if err != nil {
+				return err
+			}
+
+			cmd.New = src.Hash()
+			wants = append(wants, cmd.New)
+		}
+
+		if cmd.Old != cmd.New {
+			req.Commands = append(req.Commands, cmd)
+		}
+	}
+
+	if len(req.Commands) == 0 {
+		return nil
+	}
+
+	var haves []plumbing.Hash
+	for _, r := range remoteRefs {
+		if r.Type() == plumbing.HashReference {
+			haves = append(haves, r.Hash())
+		}
+	}
+
+	seen := make(map[plumbing.Hash]bool)
+	if err := walkObjects(s, haves, shallows, seen, true, nil, nil); err != nil {
+		return err
+	}
+
+	hashes, err := reachableObjects(s, wants, shallows, seen, f)
+	if err != nil {
+		return err
+	}
+
+	rd, wr := io.Pipe()
+	req.Packfile = rd
+	done := make(chan error, 1)
+	go func() {
+		e := packfile.NewEncoder(wr, s, false)
+		if _, err := e.Encode(hashes); err != nil {
+			_ = wr.CloseWithError(err)
+			done <- err
+			return
+		}
+
+		done <- wr.Close()
+	}()
+
+	rs, err := sess.ReceivePack(req)
+	if err != nil {
+		// the encoder may be blocked writing a packfile nobody reads
+		_ = rd.CloseWithError(err)
+		<-done
+		return err
+	}
+
+	if err := <-done; err != nil {
+		return err
+	}
+
+	return rs.Error()
+}
+
+// reachableObjects returns the hashes of all objects reachable from the given
+// ones, without walking past the shallow commits and skipping the objects
+// already seen and the blobs skipped by the filter.
+func reachableObjects(s storer.EncodedObjectStorer, from []plumbing.Hash,
+	shallows []plumbing.Hash, seen map[plumbing.Hash]bool, f *blobFilter) ([]plumbing.Hash, error) {
+
+	var result []plumbing.Hash
+	err := walkObjects(s, from, shallows, seen, false, f, func(h plumbing.Hash) {
+		result = append(result, h)
+	})
+
+	return result, err
+}
+
+// walkObjects marks as seen the objects reachable from the given ones, calling
+// visit, if any, with each of them. The objects already seen, the blobs skipped
+// by the filter and the parents of the shallow commits are not walked. If
+// allowMissing is true, the objects not in the storage are skipped too, as the
+// ones reachable from the references of the remote may not have been fetched.
+func walkObjects(s storer.EncodedObjectStorer, from []plumbing.Hash,
+	shallows []plumbing.Hash, seen map[plumbing.Hash]bool, allowMissing bool,
+	f *blobFilter, visit func(plumbing.Hash)) error {
+
+	isShallow := make(map[plumbing.Hash]bool, len(shallows))
+	for _, h := range shallows {
+		isShallow[h] = true
+	}
+
+	type pendingObject struct {
+		hash plumbing.Hash
+		blob bool
+	}
+
+	var pending []pendingObject
+	for _, h := range from {
+		pending = append(pending, pendingObject{hash: h})
+	}
+
+	for len(pending) > 0 {
+		p := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if seen[p.hash] {
+			continue
+		}
+
+		seen[p.hash] = true
+		eo, err := s.EncodedObject(plumbing.AnyObject, p.hash)
+		if err == plumbing.ErrObjectNotFound &&
+			(allowMissing || p.blob && f.skipMissing(p.hash)) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if p.blob && f.skip(eo) {
+			continue
+		}
+
+		if visit != nil {
+			visit(p.hash)
+		}
+
+		if eo.Type() == plumbing.BlobObject {
+			continue
+		}
+
+		o, err := object.DecodeObject(s, eo)
+		if err != nil {
+			return err
+		}
+
+		switch o := o.(type) {
+		case *object.Commit:
+			if !isShallow[p.hash] {
+				for _, h := range o.ParentHashes {
+					pending = append(pending, pendingObject{hash: h})
+				}
+			}
+
+			pending = append(pending, pendingObject{hash: o.TreeHash})
+		case *object.Tag:
+			pending = append(pending, pendingObject{hash: o.Target})
+		case *object.Tree:
+			for _, e := range o.Entries {
+				if e.Mode != filemode.Submodule {
+					pending = append(pending, pendingObject{
+						hash: e.Hash,
+						blob: e.Mode != filemode.Dir,
+					})
+				}
+			}
+		}
+	}
+
+	return nil
+}
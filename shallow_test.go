@@ -0,0 +1,60 @@
+package borges
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// TestPushReachable_Incremental pushes a repository twice, checking that the
+// second push only sends the objects the remote does not have already.
+func TestPushReachable_Incremental(t *testing.T) {
+	require := require.New(t)
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	root, blobs := commitFiles(t, r, map[string]string{"README": "foo", "big": "bar"})
+
+	received := &receivingStorer{Storer: memory.NewStorage()}
+	remote, err := git.Init(received, nil)
+	require.NoError(err)
+
+	refspecs := []config.RefSpec{"refs/heads/master:refs/heads/master"}
+	err = WithInProcRepository(remote, func(url string) error {
+		require.NoError(pushReachable(r.Storer, nil, nil, url, refspecs))
+		require.Len(received.hashes, 4)
+		require.Contains(received.hashes, blobs["README"])
+		require.Contains(received.hashes, blobs["big"])
+
+		received.hashes = nil
+		head, newBlobs := commitFiles(t, r,
+			map[string]string{"README": "baz", "big": "bar"}, root)
+		require.NoError(pushReachable(r.Storer, nil, nil, url, refspecs))
+
+		c, err := r.CommitObject(head)
+		require.NoError(err)
+		require.Len(received.hashes, 3)
+		require.Contains(received.hashes, head)
+		require.Contains(received.hashes, c.TreeHash)
+		require.Contains(received.hashes, newBlobs["README"])
+		return nil
+	})
+	require.NoError(err)
+}
+
+// receivingStorer is a storage that records the hashes of the objects stored.
+type receivingStorer struct {
+	storage.Storer
+	hashes []plumbing.Hash
+}
+
+func (s *receivingStorer) SetEncodedObject(o plumbing.EncodedObject) (plumbing.Hash, error) {
+	h, err := s.Storer.SetEncodedObject(o)
+	s.hashes = append(s.hashes, h)
+	return h, err
+}
@@ -0,0 +1,460 @@
+package borges
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy-siva.v3"
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-billy.v3/util"
+	"gopkg.in/src-d/go-errors.v0"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+)
+
+var (
+	// ErrCorruptSiva is returned when beginning a transaction if the siva
+	// file of the rooted repository was read from its storage, but it
+	// cannot be opened, such as when a crash left it truncated.
+	ErrCorruptSiva = errors.NewKind("siva file %s is corrupt")
+)
+
+// Aborter is a RootedTransactioner that can abort its transactions. Aborting
+// a transaction rolls it back and removes every file left by it, including
+// the partially written rooted repository of a commit that failed. It can be
+// called at any moment, even after the transaction was committed or rolled
+// back, or while doing it failed.
+type Aborter interface {
+	repository.RootedTransactioner
+	// Abort aborts the given transaction, which was begun by the
+	// transactioner.
+	Abort(tx repository.Tx) error
+}
+
+// Rewriter is a RootedTransactioner that can also begin transactions on an
+// empty rooted repository, whose commit replaces the one stored, so a corrupt
+// rooted repository can be rewritten from scratch.
+type Rewriter interface {
+	repository.RootedTransactioner
+	// BeginEmpty begins a transaction on the rooted repository of the
+	// given root like Begin does, but without reading the one stored.
+	BeginEmpty(h plumbing.Hash) (repository.Tx, error)
+}
+
+// abortTx aborts the transaction begun by rtx if it is an Aborter, or rolls
+// it back otherwise.
+func abortTx(rtx repository.RootedTransactioner, tx repository.Tx) error {
+	if a, ok := rtx.(Aborter); ok {
+		return a.Abort(tx)
+	}
+
+	return tx.Rollback()
+}
+
+// DefaultUploadRetryBackoff is the default base of the backoff between the
+// retries of a siva file upload.
+const DefaultUploadRetryBackoff = time.Second
+
+// uploadSuffix is the suffix of the temporary file a siva file is uploaded
+// to. Its size is the number of bytes uploaded so far, so a failed upload can
+// be resumed.
+const uploadSuffix = ".upload"
+
+// SivaOptions sets how the siva files of the rooted repositories are written
+// and how they are uploaded to their storage when a transaction is committed.
+type SivaOptions struct {
+	// Compression is the compression level of the objects in the packfiles
+	// pushed to the rooted repositories. With any level but
+	// DefaultCompression, the packfiles are recompressed while they are
+	// written to the siva file.
+	Compression CompressionLevel
+	// Retries is the number of times a failed upload is resumed, writing
+	// only the bytes that were not uploaded yet. Zero disables them.
+	Retries int
+	// RetryBackoff is the base of the exponential backoff between the
+	// retries. If it is zero, DefaultUploadRetryBackoff is used.
+	RetryBackoff time.Duration
+	// Limiter, if set, limits the transactions open at the same time,
+	// which can be shared by several transactioners. Begin waits for a
+	// free slot, which is freed once the transaction is committed, rolled
+	// back or aborted.
+	Limiter *TransactionLimiter
+	// Immutable makes each commit write a new version of the siva file,
+	// named after the time it is committed, instead of replacing it. The
+	// versions of each rooted repository are listed in a manifest next to
+	// them, whose last one is the current version, and which is the only
+	// file that is replaced. A version is never overwritten: the commit
+	// fails with ErrSivaVersionExists if it already exists.
+	Immutable bool
+	// KeepVersions is the number of versions of each siva file kept when
+	// Immutable is set, removing the oldest ones after a commit. Zero
+	// keeps all of them.
+	KeepVersions int
+	// DeltaWindow, if greater than zero, makes the packfiles pushed be
+	// repacked before they are written to the siva file, choosing the
+	// base of the delta of each blob and tree among this many objects
+	// before it, like the window of git repack. Larger windows make
+	// smaller siva files at a higher CPU cost. The packfiles are written
+	// to the transaction directory while they are repacked. If it is
+	// zero, the deltas are stored as they are pushed.
+	DeltaWindow int
+	// DeltaDepth is the maximum length of the chains of deltas of the
+	// packfiles repacked with DeltaWindow. If it is zero,
+	// DefaultDeltaDepth is used.
+	DeltaDepth int
+}
+
+type sivaTransactioner struct {
+	fs, local billy.Filesystem
+	opts      SivaOptions
+}
+
+// NewSivaRootedTransactioner returns an Aborter for the rooted repositories
+// stored as siva files in fs, which uses local to store the transactions in
+// progress, like the one of core-retrieval. Unlike it, the files of the
+// transactions are always removed from local when they are rolled back or
+// fail, and a siva file is first uploaded to a temporary file next to it in
+// fs and then renamed on commit, so a commit that fails never leaves a partial
+// siva file in fs. The objects pushed are repacked and compressed and an
+// upload that fails is resumed according to the given options. The temporary
+// file left by a process that died while uploading is detected and
+// overwritten by the next commit of the rooted repository, so only one
+// process must commit each rooted repository at a time.
+func NewSivaRootedTransactioner(fs, local billy.Filesystem, opts SivaOptions) Aborter {
+	if opts.RetryBackoff == 0 {
+		opts.RetryBackoff = DefaultUploadRetryBackoff
+	}
+
+	return &sivaTransactioner{fs: fs, local: local, opts: opts}
+}
+
+func (t *sivaTransactioner) Begin(h plumbing.Hash) (repository.Tx, error) {
+	return t.begin(h, false)
+}
+
+// BeginEmpty implements the Rewriter interface. If the store is immutable,
+// the versions before are kept, and the commit adds an empty one.
+func (t *sivaTransactioner) BeginEmpty(h plumbing.Hash) (repository.Tx, error) {
+	return t.begin(h, true)
+}
+
+func (t *sivaTransactioner) begin(h plumbing.Hash, empty bool) (repository.Tx, error) {
+	release := t.opts.Limiter.acquire()
+	localPath := t.local.Join(h.String(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	tx := &sivaTx{
+		fs:        t.fs,
+		local:     t.local,
+		opts:      t.opts,
+		origPath:  fmt.Sprintf("%s.siva", h),
+		localPath: localPath + ".siva",
+		tmpPath:   localPath + ".tmp",
+		release:   release,
+	}
+	tx.destPath = tx.origPath
+
+	if t.opts.Immutable {
+		tx.manifest = versionsPath(h)
+		var err error
+		tx.versions, err = readSivaVersions(t.fs, tx.manifest)
+		if err != nil {
+			_ = tx.abort()
+			return nil, err
+		}
+
+		tx.origPath = ""
+		if len(tx.versions) > 0 {
+			tx.origPath = tx.versions[len(tx.versions)-1]
+		}
+
+		tx.destPath = sivaVersionPath(h, time.Now())
+	}
+
+	if empty {
+		tx.origPath = ""
+	}
+
+	if err := tx.begin(); err != nil {
+		_ = tx.abort()
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+func (t *sivaTransactioner) Abort(tx repository.Tx) error {
+	if stx, ok := tx.(*sivaTx); ok {
+		return stx.abort()
+	}
+
+	return tx.Rollback()
+}
+
+// sivaTx is a transaction of a sivaTransactioner. The siva file of the
+// rooted repository is copied from origPath in fs to localPath in local,
+// using tmpPath in local as the temporary directory of the siva filesystem,
+// and committed to destPath in fs, which is origPath unless the store is
+// immutable.
+type sivaTx struct {
+	fs, local billy.Filesystem
+	opts      SivaOptions
+	origPath  string
+	destPath  string
+	localPath string
+	tmpPath   string
+	// manifest is the path in fs of the manifest of the versions of the
+	// siva file, which are the given ones, if the store is immutable.
+	manifest string
+	versions []string
+	// remotePath is the temporary file in fs the siva file is being
+	// copied to while committing, if any.
+	remotePath string
+	sivafs     sivafs.SivaFS
+	s          storage.Storer
+	// release frees the slot of the transaction in the Limiter.
+	release func()
+}
+
+func (tx *sivaTx) begin() error {
+	if tx.origPath != "" {
+		if err := copySivaFile(tx.fs, tx.local, tx.origPath, tx.localPath); err != nil {
+			return err
+		}
+	}
+
+	tmpFs, err := tx.local.Chroot(tx.tmpPath)
+	if err != nil {
+		return err
+	}
+
+	tx.sivafs, err = sivafs.NewFilesystem(tx.local, tx.localPath, tmpFs)
+	if err != nil {
+		return tx.corrupt(err)
+	}
+
+	s, err := filesystem.NewStorage(tx.sivafs)
+	if err != nil {
+		return tx.corrupt(err)
+	}
+
+	_, err = git.Open(s, nil)
+	if err == git.ErrRepositoryNotExists {
+		_, err = git.Init(s, nil)
+	}
+
+	if err != nil {
+		return tx.corrupt(err)
+	}
+
+	repackFs, err := tmpFs.Chroot("repack")
+	if err != nil {
+		return err
+	}
+
+	tx.s = withPacking(s, repackFs, tx.opts)
+	return nil
+}
+
+// corrupt returns the error opening the local copy of the siva file as an
+// ErrCorruptSiva, since the file could be copied. Without a siva file to copy,
+// it is returned as it is.
+func (tx *sivaTx) corrupt(err error) error {
+	if tx.origPath == "" {
+		return err
+	}
+
+	return ErrCorruptSiva.Wrap(err, tx.origPath)
+}
+
+func (tx *sivaTx) Storer() storage.Storer {
+	return tx.s
+}
+
+func (tx *sivaTx) Commit() error {
+	if err := tx.sivafs.Sync(); err != nil {
+		_ = tx.abort()
+		return err
+	}
+
+	tx.remotePath = tx.destPath + uploadSuffix
+	if err := tx.upload(); err != nil {
+		_ = tx.abort()
+		return err
+	}
+
+	if tx.manifest != "" {
+		if _, err := tx.fs.Stat(tx.destPath); err == nil {
+			_ = tx.abort()
+			return ErrSivaVersionExists.New(tx.destPath)
+		}
+	}
+
+	if err := tx.fs.Rename(tx.remotePath, tx.destPath); err != nil {
+		_ = tx.abort()
+		return err
+	}
+
+	tx.remotePath = ""
+	if tx.manifest != "" {
+		if err := tx.commitVersion(); err != nil {
+			_ = tx.abort()
+			return err
+		}
+	}
+
+	defer tx.release()
+	return tx.cleanUp()
+}
+
+// upload uploads the local siva file to remotePath, resuming the upload from
+// the bytes already uploaded if it fails, up to the number of retries of the
+// options. A file left at remotePath by a previous upload that did not finish
+// is overwritten.
+func (tx *sivaTx) upload() error {
+	if _, err := tx.fs.Stat(tx.remotePath); err == nil {
+		log.Warn("unfinished upload of siva file found, uploading it again",
+			"file", tx.destPath)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := uploadSivaFile(tx.local, tx.fs, tx.localPath, tx.remotePath, attempt > 0)
+		if err == nil || attempt >= tx.opts.Retries {
+			return err
+		}
+
+		backoff := retryBackoff(tx.opts.RetryBackoff, attempt+1)
+		log.Warn("error uploading siva file, resuming upload",
+			"file", tx.destPath, "attempt", attempt+1, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+	}
+}
+
+func (tx *sivaTx) Rollback() error {
+	return tx.abort()
+}
+
+// abort removes the files of the transaction, including the temporary siva
+// file in fs of a commit in progress.
+func (tx *sivaTx) abort() error {
+	defer tx.release()
+
+	var err error
+	if tx.remotePath != "" {
+		if rErr := tx.fs.Remove(tx.remotePath); rErr != nil && !os.IsNotExist(rErr) {
+			err = rErr
+		}
+
+		tx.remotePath = ""
+	}
+
+	if cErr := tx.cleanUp(); cErr != nil && err == nil {
+		err = cErr
+	}
+
+	return err
+}
+
+// cleanUp removes the files of the transaction in local.
+func (tx *sivaTx) cleanUp() error {
+	err := util.RemoveAll(tx.local, tx.localPath)
+	if rErr := util.RemoveAll(tx.local, tx.tmpPath); rErr != nil && err == nil {
+		err = rErr
+	}
+
+	return err
+}
+
+// copySivaFile copies the file from fromFs to toFs, if it exists. A partial
+// destination file is removed if the copy fails.
+func copySivaFile(fromFs, toFs billy.Filesystem, from, to string) (err error) {
+	src, err := fromFs.Open(from)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer checkClose(src, &err)
+
+	dst, err := toFs.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	checkClose(dst, &err)
+	if err != nil {
+		_ = toFs.Remove(to)
+	}
+
+	return err
+}
+
+func checkClose(c io.Closer, err *error) {
+	if cErr := c.Close(); cErr != nil && *err == nil {
+		*err = cErr
+	}
+}
+
+// uploadSivaFile copies the file from fromFs to toFs. If resume is true, only
+// the bytes of the file after the ones already in the destination file are
+// copied. It fails if the destination file does not end up with the size of
+// the source one.
+func uploadSivaFile(fromFs, toFs billy.Filesystem, from, to string, resume bool) (err error) {
+	src, err := fromFs.Open(from)
+	if err != nil {
+		return err
+	}
+	defer checkClose(src, &err)
+
+	fi, err := fromFs.Stat(from)
+	if err != nil {
+		return err
+	}
+
+	flag := os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	var offset int64
+	if resume {
+		dfi, err := toFs.Stat(to)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err == nil && dfi.Size() <= fi.Size() {
+			flag = os.O_CREATE | os.O_APPEND | os.O_WRONLY
+			offset = dfi.Size()
+		}
+	}
+
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	dst, err := toFs.OpenFile(to, flag, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	checkClose(dst, &err)
+	if err != nil {
+		return err
+	}
+
+	dfi, err := toFs.Stat(to)
+	if err != nil {
+		return err
+	}
+
+	if dfi.Size() != fi.Size() {
+		return fmt.Errorf("uploaded %d bytes of %d to %s", dfi.Size(), fi.Size(), to)
+	}
+
+	return nil
+}
@@ -0,0 +1,329 @@
+package borges
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+	"gopkg.in/src-d/go-billy.v3/util"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage"
+)
+
+func TestSivaRootedTransactioner(t *testing.T) {
+	require := require.New(t)
+
+	fs, local := memfs.New(), memfs.New()
+	rtx := NewSivaRootedTransactioner(fs, local, SivaOptions{})
+	h := plumbing.NewHash("e41f091c11a338f62796a738c83d879936a508ec")
+
+	tx, err := rtx.Begin(h)
+	require.NoError(err)
+	commitToTx(t, tx.Storer())
+	require.NoError(tx.Commit())
+
+	requireFiles(t, fs, h.String()+".siva")
+	requireFiles(t, local, h.String())
+
+	tx, err = rtx.Begin(h)
+	require.NoError(err)
+	r, err := git.Open(tx.Storer(), nil)
+	require.NoError(err)
+	_, err = r.Reference("refs/heads/master", false)
+	require.NoError(err)
+	require.NoError(tx.Rollback())
+	requireFiles(t, local, h.String())
+}
+
+func TestSivaRootedTransactioner_AbortBeforeCommit(t *testing.T) {
+	require := require.New(t)
+
+	fs, local := memfs.New(), memfs.New()
+	rtx := NewSivaRootedTransactioner(fs, local, SivaOptions{})
+	h := plumbing.NewHash("e41f091c11a338f62796a738c83d879936a508ec")
+
+	tx, err := rtx.Begin(h)
+	require.NoError(err)
+	commitToTx(t, tx.Storer())
+	require.NoError(rtx.Abort(tx))
+
+	requireFiles(t, fs)
+	requireFiles(t, local, h.String())
+
+	// aborting again, or after a rollback, does nothing
+	require.NoError(rtx.Abort(tx))
+	require.NoError(tx.Rollback())
+}
+
+func TestSivaRootedTransactioner_CommitFails(t *testing.T) {
+	require := require.New(t)
+
+	fs, local := memfs.New(), memfs.New()
+	rtx := NewSivaRootedTransactioner(&failingWriteFilesystem{fs}, local, SivaOptions{})
+	h := plumbing.NewHash("e41f091c11a338f62796a738c83d879936a508ec")
+
+	tx, err := rtx.Begin(h)
+	require.NoError(err)
+	commitToTx(t, tx.Storer())
+	require.Error(tx.Commit())
+
+	requireFiles(t, fs)
+	requireFiles(t, local, h.String())
+	require.NoError(rtx.Abort(tx))
+}
+
+func TestSivaRootedTransactioner_ResumeUpload(t *testing.T) {
+	require := require.New(t)
+
+	fs, local := memfs.New(), memfs.New()
+	flaky := &flakyWriteFilesystem{Filesystem: fs, limit: 100}
+	rtx := NewSivaRootedTransactioner(flaky, local, SivaOptions{
+		Retries:      100,
+		RetryBackoff: time.Nanosecond,
+	})
+	h := plumbing.NewHash("e41f091c11a338f62796a738c83d879936a508ec")
+
+	tx, err := rtx.Begin(h)
+	require.NoError(err)
+	commitToTx(t, tx.Storer())
+	require.NoError(tx.Commit())
+
+	requireFiles(t, fs, h.String()+".siva")
+	fi, err := fs.Stat(h.String() + ".siva")
+	require.NoError(err)
+	require.True(flaky.opened > 1)
+	require.Equal(fi.Size(), flaky.written)
+	requireMasterInSiva(t, fs, h)
+}
+
+func TestSivaRootedTransactioner_UnfinishedUpload(t *testing.T) {
+	require := require.New(t)
+
+	fs, local := memfs.New(), memfs.New()
+	h := plumbing.NewHash("e41f091c11a338f62796a738c83d879936a508ec")
+	// left by a process that died while uploading
+	garbage := make([]byte, 1<<16)
+	require.NoError(util.WriteFile(fs, h.String()+".siva"+uploadSuffix, garbage, 0644))
+
+	rtx := NewSivaRootedTransactioner(fs, local, SivaOptions{})
+	tx, err := rtx.Begin(h)
+	require.NoError(err)
+	commitToTx(t, tx.Storer())
+	require.NoError(tx.Commit())
+
+	requireFiles(t, fs, h.String()+".siva")
+	requireMasterInSiva(t, fs, h)
+}
+
+func TestSivaRootedTransactioner_Immutable(t *testing.T) {
+	require := require.New(t)
+
+	fs := memfs.New()
+	rtx := NewSivaRootedTransactioner(fs, memfs.New(), SivaOptions{
+		Immutable:    true,
+		KeepVersions: 2,
+	})
+	h := plumbing.NewHash("e41f091c11a338f62796a738c83d879936a508ec")
+
+	var written []string
+	for i := 0; i < 3; i++ {
+		tx, err := rtx.Begin(h)
+		require.NoError(err)
+		commitFile(t, openTx(t, tx), "README", fmt.Sprintf("foo %d", i))
+		require.NoError(tx.Commit())
+
+		versions, err := readSivaVersions(fs, h.String()+".versions")
+		require.NoError(err)
+		written = append(written, versions[len(versions)-1])
+	}
+
+	// the oldest version is removed, the others are never overwritten
+	require.Equal([]string{written[1], written[2], h.String() + ".versions"}, sortedFiles(t, fs))
+	versions, err := readSivaVersions(fs, h.String()+".versions")
+	require.NoError(err)
+	require.Equal(written[1:], versions)
+
+	// the changes of the last commit are in the current version
+	tx, err := rtx.Begin(h)
+	require.NoError(err)
+	r := openTx(t, tx)
+	ref, err := r.Reference("refs/heads/master", false)
+	require.NoError(err)
+	c, err := r.CommitObject(ref.Hash())
+	require.NoError(err)
+	f, err := c.File("README")
+	require.NoError(err)
+	content, err := f.Contents()
+	require.NoError(err)
+	require.Equal("foo 2", content)
+	require.NoError(tx.Rollback())
+
+	_, size, err := rtx.(RootedStatter).StatRooted(h)
+	require.NoError(err)
+	fi, err := fs.Stat(written[2])
+	require.NoError(err)
+	require.Equal(fi.Size(), size)
+}
+
+func openTx(t *testing.T, tx repository.Tx) *git.Repository {
+	r, err := git.Open(tx.Storer(), nil)
+	require.NoError(t, err)
+	return r
+}
+
+func TestLayoutTransactioner_Abort(t *testing.T) {
+	require := require.New(t)
+
+	fs, local := memfs.New(), memfs.New()
+	et, err := NewLayoutTransactioner(fs, local, nil, []*Layout{
+		{Host: "github.com", Root: "github"},
+	}, SivaOptions{})
+	require.NoError(err)
+
+	rtx, err := et.ForEndpoint("https://github.com/foo/bar")
+	require.NoError(err)
+	tx, err := rtx.Begin(plumbing.NewHash("e41f091c11a338f62796a738c83d879936a508ec"))
+	require.NoError(err)
+	commitToTx(t, tx.Storer())
+
+	require.Implements((*Aborter)(nil), et)
+	require.NoError(abortTx(et, tx))
+	requireFiles(t, local, "e41f091c11a338f62796a738c83d879936a508ec")
+}
+
+// commitToTx stores a commit in the master branch of the repository of a
+// transaction.
+func commitToTx(t *testing.T, s storage.Storer) {
+	r, err := git.Open(s, nil)
+	require.NoError(t, err)
+	commitFile(t, r, "README", "foo")
+}
+
+// requireFiles checks that the files at the root of fs are the given ones.
+func requireFiles(t *testing.T, fs billy.Filesystem, expected ...string) {
+	fis, err := fs.ReadDir("/")
+	if os.IsNotExist(err) {
+		require.Empty(t, expected)
+		return
+	}
+
+	require.NoError(t, err)
+	var names []string
+	for _, fi := range fis {
+		if fi.IsDir() {
+			sub, err := fs.ReadDir(fs.Join("/", fi.Name()))
+			require.NoError(t, err)
+			require.Empty(t, sub, "directory %s", fi.Name())
+		}
+
+		names = append(names, fi.Name())
+	}
+
+	require.Equal(t, len(expected), len(names), "%v", names)
+	for i, n := range expected {
+		require.Equal(t, n, names[i])
+	}
+}
+
+// sortedFiles returns the sorted names of the files at the root of fs.
+func sortedFiles(t *testing.T, fs billy.Filesystem) []string {
+	fis, err := fs.ReadDir("/")
+	require.NoError(t, err)
+
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// failingWriteFilesystem is a filesystem whose files opened with OpenFile
+// fail after the first write.
+type failingWriteFilesystem struct {
+	billy.Filesystem
+}
+
+func (fs *failingWriteFilesystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := fs.Filesystem.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &failingWriteFile{File: f}, nil
+}
+
+type failingWriteFile struct {
+	billy.File
+	written bool
+}
+
+func (f *failingWriteFile) Write(p []byte) (int, error) {
+	if f.written {
+		return 0, fmt.Errorf("disk full")
+	}
+
+	f.written = true
+	return f.File.Write(p[:len(p)/2])
+}
+
+// requireMasterInSiva checks that the rooted repository h in fs has a master
+// branch.
+func requireMasterInSiva(t *testing.T, fs billy.Filesystem, h plumbing.Hash) {
+	tx, err := NewSivaRootedTransactioner(fs, memfs.New(), SivaOptions{}).Begin(h)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, tx.Rollback()) }()
+
+	r, err := git.Open(tx.Storer(), nil)
+	require.NoError(t, err)
+	_, err = r.Reference("refs/heads/master", false)
+	require.NoError(t, err)
+}
+
+// flakyWriteFilesystem is a filesystem whose files opened with OpenFile fail
+// after writing limit bytes to them. It counts the files opened and the bytes
+// written.
+type flakyWriteFilesystem struct {
+	billy.Filesystem
+	limit   int64
+	opened  int
+	written int64
+}
+
+func (fs *flakyWriteFilesystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := fs.Filesystem.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.opened++
+	return &flakyWriteFile{File: f, fs: fs}, nil
+}
+
+type flakyWriteFile struct {
+	billy.File
+	fs      *flakyWriteFilesystem
+	written int64
+}
+
+func (f *flakyWriteFile) Write(p []byte) (int, error) {
+	if left := f.fs.limit - f.written; int64(len(p)) > left {
+		n, _ := f.File.Write(p[:left])
+		f.written += int64(n)
+		f.fs.written += int64(n)
+		return n, fmt.Errorf("connection reset")
+	}
+
+	n, err := f.File.Write(p)
+	f.written += int64(n)
+	f.fs.written += int64(n)
+	return n, err
+}
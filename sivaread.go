@@ -0,0 +1,372 @@
+package borges
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-billy.v3/helper/chroot"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+	"gopkg.in/src-d/go-siva.v1"
+)
+
+// indexEntryOverhead is the approximate number of bytes taken in memory by an
+// entry of a siva index, besides its name.
+const indexEntryOverhead = 96
+
+// SivaIndexCache is a cache of the indexes of siva files, so the files read
+// several times, such as by OpenSivaStorer, are only indexed once. The
+// indexes are kept by path along with the modification time and size of
+// their file, and read again when the file changes. The least recently used
+// ones are evicted when the indexes cached take more memory than the maximum
+// size. All the methods can be called on a nil cache, which reads the index
+// every time.
+type SivaIndexCache struct {
+	maxSize int64
+	m       sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type cachedIndex struct {
+	path    string
+	modTime time.Time
+	size    int64
+	index   siva.Index
+	mem     int64
+}
+
+// NewSivaIndexCache returns a SivaIndexCache keeping indexes taking up to
+// maxSize bytes of memory. With a maxSize of zero or less, nothing is cached.
+func NewSivaIndexCache(maxSize int64) *SivaIndexCache {
+	return &SivaIndexCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Index returns the index of the siva file at path in fs, with only the last
+// version of each file and without the deleted ones. It is read from the
+// cache if the file was not modified since it was cached.
+func (c *SivaIndexCache) Index(fs billy.Filesystem, path string) (siva.Index, error) {
+	fi, err := fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if index := c.get(path, fi); index != nil {
+		return index, nil
+	}
+
+	index, err := readSivaIndex(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.add(path, fi, index)
+	return index, nil
+}
+
+// Len returns the number of indexes cached.
+func (c *SivaIndexCache) Len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.lru.Len()
+}
+
+func (c *SivaIndexCache) get(path string, fi os.FileInfo) siva.Index {
+	if c == nil {
+		return nil
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	e, ok := c.entries[path]
+	if !ok {
+		return nil
+	}
+
+	ci := e.Value.(*cachedIndex)
+	if !ci.modTime.Equal(fi.ModTime()) || ci.size != fi.Size() {
+		c.remove(e)
+		return nil
+	}
+
+	c.lru.MoveToFront(e)
+	return ci.index
+}
+
+func (c *SivaIndexCache) add(path string, fi os.FileInfo, index siva.Index) {
+	if c == nil {
+		return
+	}
+
+	mem := indexMemSize(index)
+	if mem > c.maxSize {
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if e, ok := c.entries[path]; ok {
+		c.remove(e)
+	}
+
+	c.entries[path] = c.lru.PushFront(&cachedIndex{
+		path:    path,
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		index:   index,
+		mem:     mem,
+	})
+	c.size += mem
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *SivaIndexCache) remove(e *list.Element) {
+	ci := c.lru.Remove(e).(*cachedIndex)
+	delete(c.entries, ci.path)
+	c.size -= ci.mem
+}
+
+func indexMemSize(index siva.Index) int64 {
+	var size int64
+	for _, e := range index {
+		size += int64(len(e.Name)) + indexEntryOverhead
+	}
+
+	return size
+}
+
+// readSivaIndex reads and validates the index of the siva file at path in fs,
+// keeping only the last version of the files not deleted.
+func readSivaIndex(fs billy.Filesystem, path string) (index siva.Index, err error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer checkClose(f, &err)
+
+	index, err = siva.NewReader(f).Index()
+	if err != nil {
+		return nil, err
+	}
+
+	return index.Filter(), nil
+}
+
+// OpenSivaStorer returns a read-only storer of the rooted repository stored in
+// the siva file at path in fs. Unlike the storers of a RootedTransactioner,
+// the siva file is read in place, without copying it, and its index is read
+// with the given cache, which can be nil. The file must not be modified while
+// the storer is used.
+func OpenSivaStorer(fs billy.Filesystem, path string, cache *SivaIndexCache) (storage.Storer, error) {
+	index, err := cache.Index(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	rfs := &sivaReadFS{fs: fs, path: path, index: index}
+	return filesystem.NewStorage(chroot.New(rfs, "/"))
+}
+
+// sivaReadFS is a read-only billy.Basic, billy.Dir and billy.Symlink with the
+// files of a siva file with the given index.
+type sivaReadFS struct {
+	fs    billy.Filesystem
+	path  string
+	index siva.Index
+}
+
+func (fs *sivaReadFS) Create(filename string) (billy.File, error) {
+	return nil, billy.ErrReadOnly
+}
+
+func (fs *sivaReadFS) Open(filename string) (billy.File, error) {
+	return fs.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (fs *sivaReadFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_TRUNC) != 0 {
+		return nil, billy.ErrReadOnly
+	}
+
+	e := fs.index.Find(sivaEntryName(filename))
+	if e == nil {
+		return nil, os.ErrNotExist
+	}
+
+	f, err := fs.fs.Open(fs.path)
+	if err != nil {
+		return nil, err
+	}
+
+	sr, err := siva.NewReader(f).Get(e)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &sivaReadFile{SectionReader: sr, name: filename, f: f}, nil
+}
+
+func (fs *sivaReadFS) Stat(filename string) (os.FileInfo, error) {
+	name := sivaEntryName(filename)
+	if e := fs.index.Find(name); e != nil {
+		return &sivaFileInfo{name: path.Base(name), size: int64(e.Size),
+			mode: e.Mode, modTime: e.ModTime}, nil
+	}
+
+	prefix := sivaDirPrefix(name)
+	var fi *sivaFileInfo
+	for _, e := range fs.index {
+		if !strings.HasPrefix(e.Name, prefix) {
+			continue
+		}
+
+		if fi == nil {
+			fi = &sivaFileInfo{name: path.Base(name), mode: os.ModeDir | 0755}
+		}
+
+		if e.ModTime.After(fi.modTime) {
+			fi.modTime = e.ModTime
+		}
+	}
+
+	if fi == nil {
+		return nil, os.ErrNotExist
+	}
+
+	return fi, nil
+}
+
+func (fs *sivaReadFS) Lstat(filename string) (os.FileInfo, error) {
+	return fs.Stat(filename)
+}
+
+func (fs *sivaReadFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	prefix := sivaDirPrefix(sivaEntryName(dirname))
+	dirs := make(map[string]*sivaFileInfo)
+	var fis []os.FileInfo
+	for _, e := range fs.index {
+		if !strings.HasPrefix(e.Name, prefix) {
+			continue
+		}
+
+		rel := e.Name[len(prefix):]
+		if i := strings.Index(rel, "/"); i >= 0 {
+			name := rel[:i]
+			d, ok := dirs[name]
+			if !ok {
+				d = &sivaFileInfo{name: name, mode: os.ModeDir | 0755}
+				dirs[name] = d
+				fis = append(fis, d)
+			}
+
+			if e.ModTime.After(d.modTime) {
+				d.modTime = e.ModTime
+			}
+
+			continue
+		}
+
+		fis = append(fis, &sivaFileInfo{name: rel, size: int64(e.Size),
+			mode: e.Mode, modTime: e.ModTime})
+	}
+
+	if len(fis) == 0 && prefix != "" {
+		return nil, os.ErrNotExist
+	}
+
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+func (fs *sivaReadFS) MkdirAll(filename string, perm os.FileMode) error {
+	return billy.ErrReadOnly
+}
+
+func (fs *sivaReadFS) Rename(oldpath, newpath string) error {
+	return billy.ErrReadOnly
+}
+
+func (fs *sivaReadFS) Remove(filename string) error {
+	return billy.ErrReadOnly
+}
+
+func (fs *sivaReadFS) Symlink(target, link string) error {
+	return billy.ErrReadOnly
+}
+
+func (fs *sivaReadFS) Readlink(link string) (string, error) {
+	return "", billy.ErrNotSupported
+}
+
+func (fs *sivaReadFS) Join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+// sivaEntryName returns the name in the siva index of the file with the given
+// path, which has no leading slash.
+func sivaEntryName(filename string) string {
+	return strings.TrimPrefix(path.Join("/", filepath.ToSlash(filename)), "/")
+}
+
+// sivaDirPrefix returns the prefix of the names in the siva index of the
+// files in the directory with the given name.
+func sivaDirPrefix(dir string) string {
+	if dir == "" {
+		return ""
+	}
+
+	return dir + "/"
+}
+
+type sivaReadFile struct {
+	*io.SectionReader
+	name string
+	f    billy.File
+}
+
+func (f *sivaReadFile) Name() string {
+	return f.name
+}
+
+func (f *sivaReadFile) Write(p []byte) (int, error) {
+	return 0, billy.ErrReadOnly
+}
+
+func (f *sivaReadFile) Close() error {
+	return f.f.Close()
+}
+
+type sivaFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *sivaFileInfo) Name() string       { return fi.name }
+func (fi *sivaFileInfo) Size() int64        { return fi.size }
+func (fi *sivaFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *sivaFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *sivaFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *sivaFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,144 @@
+package borges
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+	"gopkg.in/src-d/go-billy.v3/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestOpenSivaStorer(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "borges-siva-read")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	fs := osfs.New(dir)
+	h := plumbing.NewHash("e41f091c11a338f62796a738c83d879936a508ec")
+	rtx := NewSivaRootedTransactioner(fs, memfs.New(), SivaOptions{})
+	tx, err := rtx.Begin(h)
+	require.NoError(err)
+	commitToTx(t, tx.Storer())
+	require.NoError(tx.Commit())
+
+	name := h.String() + sivaExt
+	cache := NewSivaIndexCache(1 << 20)
+	for i := 0; i < 2; i++ {
+		s, err := OpenSivaStorer(fs, name, cache)
+		require.NoError(err)
+
+		r, err := git.Open(s, nil)
+		require.NoError(err)
+		ref, err := r.Reference("refs/heads/master", false)
+		require.NoError(err)
+		_, err = r.CommitObject(ref.Hash())
+		require.NoError(err)
+
+		_, err = ValidateRootedRepository(s, ValidateOptions{})
+		require.NoError(err)
+		require.Equal(1, cache.Len())
+
+		// the storer is read-only
+		require.Error(s.SetReference(plumbing.NewHashReference("refs/heads/foo", ref.Hash())))
+	}
+
+	_, err = OpenSivaStorer(fs, "missing.siva", cache)
+	require.Error(err)
+
+	// a nil cache reads the index every time
+	_, err = OpenSivaStorer(fs, name, nil)
+	require.NoError(err)
+}
+
+func TestSivaIndexCache_Modified(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "borges-siva-read")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	fs := osfs.New(dir)
+	h := plumbing.NewHash("e41f091c11a338f62796a738c83d879936a508ec")
+	rtx := NewSivaRootedTransactioner(fs, memfs.New(), SivaOptions{})
+	commit := func(branch string) {
+		tx, err := rtx.Begin(h)
+		require.NoError(err)
+		r, err := git.Open(tx.Storer(), nil)
+		require.NoError(err)
+		commitFile(t, r, branch, branch)
+		head, err := r.Head()
+		require.NoError(err)
+		require.NoError(r.Storer.SetReference(
+			plumbing.NewHashReference(plumbing.ReferenceName("refs/heads/"+branch), head.Hash())))
+		require.NoError(tx.Commit())
+	}
+
+	name := h.String() + sivaExt
+	cache := NewSivaIndexCache(1 << 20)
+	commit("foo")
+	first, err := cache.Index(fs, name)
+	require.NoError(err)
+
+	commit("bar")
+	// the modification time may not change within the same second
+	future := time.Now().Add(time.Minute)
+	require.NoError(os.Chtimes(filepath.Join(dir, name), future, future))
+
+	second, err := cache.Index(fs, name)
+	require.NoError(err)
+	require.True(len(second) > len(first))
+	require.Nil(first.Find("refs/heads/bar"))
+	require.NotNil(second.Find("refs/heads/bar"))
+	require.Equal(1, cache.Len())
+}
+
+func TestSivaIndexCache_Evict(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "borges-siva-read")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	fs := osfs.New(dir)
+	rtx := NewSivaRootedTransactioner(fs, memfs.New(), SivaOptions{})
+	var names []string
+	for _, hash := range []string{
+		"e41f091c11a338f62796a738c83d879936a508ec",
+		"f41f091c11a338f62796a738c83d879936a508ec",
+		"a41f091c11a338f62796a738c83d879936a508ec",
+	} {
+		h := plumbing.NewHash(hash)
+		tx, err := rtx.Begin(h)
+		require.NoError(err)
+		commitToTx(t, tx.Storer())
+		require.NoError(tx.Commit())
+		names = append(names, h.String()+sivaExt)
+	}
+
+	index, err := readSivaIndex(fs, names[0])
+	require.NoError(err)
+	size := indexMemSize(index)
+
+	cache := NewSivaIndexCache(2 * size)
+	for _, name := range names {
+		_, err := cache.Index(fs, name)
+		require.NoError(err)
+	}
+
+	require.Equal(2, cache.Len())
+	require.Nil(cache.get(names[0], nil))
+
+	// nothing fits
+	cache = NewSivaIndexCache(size - 1)
+	_, err = cache.Index(fs, names[0])
+	require.NoError(err)
+	require.Zero(cache.Len())
+}
@@ -0,0 +1,52 @@
+package borges
+
+import (
+	"io"
+
+	"gopkg.in/src-d/go-errors.v0"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage"
+)
+
+var (
+	ErrRepoTooLarge = errors.NewKind("repository %s is larger than %d bytes")
+)
+
+// sizeLimitedStorage is a storage that fails writing packfiles bigger than a
+// maximum size. Since fetched packfiles are copied straight from the
+// transport, the fetch is aborted as soon as the limit is reached, before the
+// whole packfile is downloaded. The wrapped storage must implement
+// storer.PackfileWriter.
+type sizeLimitedStorage struct {
+	storage.Storer
+	endpoint string
+	maxSize  int64
+}
+
+func (s *sizeLimitedStorage) PackfileWriter() (io.WriteCloser, error) {
+	w, err := s.Storer.(storer.PackfileWriter).PackfileWriter()
+	if err != nil {
+		return nil, err
+	}
+
+	return &sizeLimitedWriter{WriteCloser: w, endpoint: s.endpoint, maxSize: s.maxSize}, nil
+}
+
+// sizeLimitedWriter fails with ErrRepoTooLarge when more than maxSize bytes
+// are written to it. Nothing is written by the write exceeding the limit.
+type sizeLimitedWriter struct {
+	io.WriteCloser
+	endpoint string
+	maxSize  int64
+	written  int64
+}
+
+func (w *sizeLimitedWriter) Write(p []byte) (int, error) {
+	if w.written+int64(len(p)) > w.maxSize {
+		return 0, ErrRepoTooLarge.New(w.endpoint, w.maxSize)
+	}
+
+	n, err := w.WriteCloser.Write(p)
+	w.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,27 @@
+package borges
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSizeLimitedWriter(t *testing.T) {
+	require := require.New(t)
+
+	buf := &nopWriteCloser{}
+	w := &sizeLimitedWriter{WriteCloser: buf, endpoint: "foo", maxSize: 10}
+
+	n, err := w.Write(make([]byte, 6))
+	require.NoError(err)
+	require.Equal(6, n)
+
+	n, err = w.Write(make([]byte, 4))
+	require.NoError(err)
+	require.Equal(4, n)
+
+	n, err = w.Write(make([]byte, 1))
+	require.True(ErrRepoTooLarge.Is(err))
+	require.Equal(0, n)
+	require.Equal(10, buf.Len())
+}
@@ -0,0 +1,163 @@
+package borges
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-errors.v0"
+)
+
+var (
+	ErrNotEnoughSpace    = errors.NewKind("not enough free space in %s: %d bytes free, %d required")
+	ErrInvalidWatermarks = errors.NewKind("low watermark %d is higher than the high watermark %d")
+)
+
+// NewMinFreeSpaceCheck returns a preflight check for a WorkerPool, see
+// WorkerPool.Preflight, that fails with ErrNotEnoughSpace if the filesystem
+// has less than min bytes available. The filesystem must be backed by the
+// operating system, as the ones created with osfs, so its root is a path in a
+// real filesystem.
+func NewMinFreeSpaceCheck(fs billy.Filesystem, min uint64) func(*Job) error {
+	return func(*Job) error {
+		free, err := freeSpace(fs.Root())
+		if err != nil {
+			return err
+		}
+
+		if free < min {
+			return ErrNotEnoughSpace.New(fs.Root(), free, min)
+		}
+
+		return nil
+	}
+}
+
+// freeSpace returns the number of bytes available to unprivileged users in the
+// filesystem containing path.
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// DefaultTempUsageInterval is the default minimum time between measures of
+// the usage of a TempUsageBackpressure.
+const DefaultTempUsageInterval = 5 * time.Second
+
+// TempUsageBackpressure pauses the workers of a pool while the temporary
+// directory of their clones uses too much space, see WorkerPool.Backpressure.
+// The workers are paused once the bytes used by all the files in the
+// directory reach the high watermark, and resumed once they drop below the
+// low watermark, so the jobs in progress can finish and free their space
+// before new ones are started. The usage is measured when the workers check
+// whether they are paused, at most once per Interval.
+type TempUsageBackpressure struct {
+	// Notifiers are called whenever the usage is measured.
+	Notifiers struct {
+		// Usage function, if set, is called with the bytes used.
+		Usage func(uint64)
+	}
+
+	// Interval is the minimum time between measures of the usage. Zero
+	// means DefaultTempUsageInterval. It must be set before using it.
+	Interval time.Duration
+
+	fs        billy.Filesystem
+	high, low uint64
+
+	m          sync.Mutex
+	paused     bool
+	measuredAt time.Time
+}
+
+// NewTempUsageBackpressure returns a TempUsageBackpressure of the temporary
+// directory at the root of fs with the given watermarks, in bytes. If low is
+// zero, it is 80% of high. It fails with ErrInvalidWatermarks if low is
+// higher than high. Like with NewMinFreeSpaceCheck, the filesystem must be
+// backed by the operating system.
+func NewTempUsageBackpressure(fs billy.Filesystem, high, low uint64) (*TempUsageBackpressure, error) {
+	if low == 0 {
+		low = high / 10 * 8
+	}
+
+	if low > high {
+		return nil, ErrInvalidWatermarks.New(low, high)
+	}
+
+	return &TempUsageBackpressure{fs: fs, high: high, low: low}, nil
+}
+
+// Paused returns whether the workers must be paused, measuring the usage of
+// the directory again if it was measured more than Interval ago. If it cannot
+// be measured, the workers stay as they were.
+func (b *TempUsageBackpressure) Paused() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if time.Since(b.measuredAt) < b.interval() {
+		return b.paused
+	}
+
+	b.measuredAt = time.Now()
+	usage, err := diskUsage(b.fs.Root())
+	if err != nil {
+		log.Warn("error measuring temporary directory usage", "dir", b.fs.Root(), "error", err)
+		return b.paused
+	}
+
+	if b.Notifiers.Usage != nil {
+		b.Notifiers.Usage(usage)
+	}
+
+	switch {
+	case !b.paused && usage >= b.high:
+		log.Warn("temporary directory usage over the high watermark, pausing workers",
+			"dir", b.fs.Root(), "usage", usage, "high", b.high)
+		b.paused = true
+	case b.paused && usage < b.low:
+		log.Info("temporary directory usage below the low watermark, resuming workers",
+			"dir", b.fs.Root(), "usage", usage, "low", b.low)
+		b.paused = false
+	}
+
+	return b.paused
+}
+
+func (b *TempUsageBackpressure) interval() time.Duration {
+	if b.Interval <= 0 {
+		return DefaultTempUsageInterval
+	}
+
+	return b.Interval
+}
+
+// diskUsage returns the number of bytes of the regular files in the directory
+// tree at path. Files removed while walking it are ignored, since clones are
+// removed all the time.
+func diskUsage(path string) (uint64, error) {
+	var usage uint64
+	err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			usage += uint64(fi.Size())
+		}
+
+		return nil
+	})
+
+	return usage, err
+}
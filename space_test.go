@@ -0,0 +1,72 @@
+package borges
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v3/osfs"
+	"gopkg.in/src-d/go-billy.v3/util"
+)
+
+func TestNewMinFreeSpaceCheck(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "borges-space")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	fs := osfs.New(dir)
+	require.NoError(NewMinFreeSpaceCheck(fs, 1)(&Job{}))
+
+	err = NewMinFreeSpaceCheck(fs, ^uint64(0))(&Job{})
+	require.True(ErrNotEnoughSpace.Is(err))
+}
+
+func TestTempUsageBackpressure(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "borges-space")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	fs := osfs.New(dir)
+	_, err = NewTempUsageBackpressure(fs, 100, 200)
+	require.True(ErrInvalidWatermarks.Is(err))
+
+	bp, err := NewTempUsageBackpressure(fs, 100, 50)
+	require.NoError(err)
+	bp.Interval = time.Nanosecond
+	var usage uint64
+	bp.Notifiers.Usage = func(u uint64) { usage = u }
+
+	require.False(bp.Paused())
+	require.Zero(usage)
+
+	require.NoError(util.WriteFile(fs, "a/pack", make([]byte, 60), 0644))
+	require.NoError(util.WriteFile(fs, "b/pack", make([]byte, 40), 0644))
+	require.True(bp.Paused())
+	require.Equal(uint64(100), usage)
+
+	// still over the low watermark
+	require.NoError(fs.Remove("b/pack"))
+	require.True(bp.Paused())
+	require.Equal(uint64(60), usage)
+
+	require.NoError(util.RemoveAll(fs, "a"))
+	require.False(bp.Paused())
+	require.Zero(usage)
+
+	// the usage is not measured again until the interval passes
+	bp.Interval = time.Hour
+	require.NoError(util.WriteFile(fs, "c/pack", make([]byte, 100), 0644))
+	require.False(bp.Paused())
+}
+
+func TestNewTempUsageBackpressure_DefaultLow(t *testing.T) {
+	bp, err := NewTempUsageBackpressure(osfs.New(os.TempDir()), 1000, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(800), bp.low)
+}
@@ -0,0 +1,281 @@
+package borges
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// WorkerPoolStats is a snapshot of the statistics of the jobs processed by the
+// workers of a WorkerPool since it was created, see WorkerPool.Stats.
+type WorkerPoolStats struct {
+	// Processed is the number of jobs processed successfully.
+	Processed uint64
+	// Failed is the number of jobs whose processing failed.
+	Failed uint64
+	// Requeued is the number of jobs requeued without processing them,
+	// because they failed the preflight check or their host was busy.
+	Requeued uint64
+	// Panics is the number of jobs whose processing panicked, which are
+	// also counted as failed, see WorkerPool.RecoverPanics.
+	Panics uint64
+	// Collapsed is the number of jobs that finished with the result of an
+	// identical job in flight instead of being processed, which are also
+	// counted as processed or failed, see WorkerPool.SingleFlight.
+	Collapsed uint64
+	// InFlight is the number of jobs being processed.
+	InFlight int
+	// AverageDuration is the average time spent processing the jobs, both
+	// processed and failed ones.
+	AverageDuration time.Duration
+	// AveragePhaseDuration is the average time spent on each phase of the
+	// jobs, for the phases notified by the processing function, see
+	// NewArchiverWorkerPool.
+	AveragePhaseDuration map[Phase]time.Duration
+}
+
+// workerPoolStats holds the statistics of a WorkerPool. They are all updated
+// and read under the same lock, so a snapshot is always consistent, such as
+// the in-flight jobs never being counted as finished too.
+type workerPoolStats struct {
+	m         sync.Mutex
+	processed uint64
+	failed    uint64
+	requeued  uint64
+	panics    uint64
+	collapsed uint64
+	inFlight  int
+	total     time.Duration
+	phases    map[Phase]*phaseStats
+}
+
+type phaseStats struct {
+	count uint64
+	total time.Duration
+}
+
+func newWorkerPoolStats() *workerPoolStats {
+	return &workerPoolStats{phases: make(map[Phase]*phaseStats)}
+}
+
+// start counts a job as in flight.
+func (s *workerPoolStats) start() {
+	if s == nil {
+		return
+	}
+
+	s.m.Lock()
+	s.inFlight++
+	s.m.Unlock()
+}
+
+// stop counts a job in flight as finished after the given time, failed if err
+// is not nil.
+func (s *workerPoolStats) stop(d time.Duration, err error) {
+	if s == nil {
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.inFlight--
+	s.total += d
+	if err != nil {
+		s.failed++
+	} else {
+		s.processed++
+	}
+}
+
+// requeue counts a job in flight as requeued, or one that was never in flight
+// if inFlight is false.
+func (s *workerPoolStats) requeue(inFlight bool) {
+	if s == nil {
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if inFlight {
+		s.inFlight--
+	}
+
+	s.requeued++
+}
+
+// panicked counts a recovered panic of a job in flight, which is counted as
+// failed once it stops.
+func (s *workerPoolStats) panicked() {
+	if s == nil {
+		return
+	}
+
+	s.m.Lock()
+	s.panics++
+	s.m.Unlock()
+}
+
+// collapse counts a job in flight that finished with the result of another
+// one, which is counted as processed or failed once it stops.
+func (s *workerPoolStats) collapse() {
+	if s == nil {
+		return
+	}
+
+	s.m.Lock()
+	s.collapsed++
+	s.m.Unlock()
+}
+
+func (s *workerPoolStats) phaseDone(p Phase, d time.Duration) {
+	if s == nil {
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	ps, ok := s.phases[p]
+	if !ok {
+		ps = &phaseStats{}
+		s.phases[p] = ps
+	}
+
+	ps.count++
+	ps.total += d
+}
+
+func (s *workerPoolStats) snapshot() WorkerPoolStats {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	st := WorkerPoolStats{
+		Processed:            s.processed,
+		Failed:               s.failed,
+		Requeued:             s.requeued,
+		Panics:               s.panics,
+		Collapsed:            s.collapsed,
+		InFlight:             s.inFlight,
+		AveragePhaseDuration: make(map[Phase]time.Duration, len(s.phases)),
+	}
+
+	if n := s.processed + s.failed; n > 0 {
+		st.AverageDuration = s.total / time.Duration(n)
+	}
+
+	for p, ps := range s.phases {
+		st.AveragePhaseDuration[p] = ps.total / time.Duration(ps.count)
+	}
+
+	return st
+}
+
+// WorkerStatus is what a worker of a WorkerPool is doing at a given moment,
+// see WorkerPool.Status.
+type WorkerStatus struct {
+	// ID is the ID of the worker, as in its WorkerContext.
+	ID int
+	// Job is the job being processed, nil if the worker is idle.
+	Job *Job
+	// Started is the time the job started being processed.
+	Started time.Time
+	// Endpoint is the endpoint of the last repository of the job fetched,
+	// if any.
+	Endpoint string
+	// Phase is the phase of the job in progress, empty until the first
+	// one starts. Its value is kept after the phase is done, until the next
+	// one starts.
+	Phase Phase
+	// PhaseStarted is the time the phase started.
+	PhaseStarted time.Time
+}
+
+// workerStatuses holds the status of every worker of a WorkerPool, which
+// is published by the workers themselves.
+type workerStatuses struct {
+	m        sync.Mutex
+	statuses map[*Worker]*WorkerStatus
+}
+
+func newWorkerStatuses() *workerStatuses {
+	return &workerStatuses{statuses: make(map[*Worker]*WorkerStatus)}
+}
+
+func (s *workerStatuses) add(w *Worker) {
+	s.m.Lock()
+	s.statuses[w] = &WorkerStatus{ID: w.ctx.ID}
+	s.m.Unlock()
+}
+
+func (s *workerStatuses) remove(w *Worker) {
+	s.m.Lock()
+	delete(s.statuses, w)
+	s.m.Unlock()
+}
+
+// update calls f with the status of the worker, if it is in the pool.
+func (s *workerStatuses) update(w *Worker, f func(*WorkerStatus)) {
+	if s == nil {
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if st, ok := s.statuses[w]; ok {
+		f(st)
+	}
+}
+
+// updateByContext is like update, for the worker with the given context.
+func (s *workerStatuses) updateByContext(ctx *WorkerContext, f func(*WorkerStatus)) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for w, st := range s.statuses {
+		if w.ctx == ctx {
+			f(st)
+			return
+		}
+	}
+}
+
+func (s *workerStatuses) start(w *Worker, j *Job) {
+	s.update(w, func(st *WorkerStatus) {
+		*st = WorkerStatus{ID: st.ID, Job: j, Started: time.Now()}
+	})
+}
+
+func (s *workerStatuses) stop(w *Worker) {
+	s.update(w, func(st *WorkerStatus) {
+		*st = WorkerStatus{ID: st.ID}
+	})
+}
+
+func (s *workerStatuses) phaseStart(ctx *WorkerContext, p Phase, endpoint string) {
+	s.updateByContext(ctx, func(st *WorkerStatus) {
+		st.Phase = p
+		st.PhaseStarted = time.Now()
+		if endpoint != "" {
+			st.Endpoint = endpoint
+		}
+	})
+}
+
+func (s *workerStatuses) snapshot() []WorkerStatus {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	statuses := make([]WorkerStatus, 0, len(s.statuses))
+	for _, st := range s.statuses {
+		statuses = append(statuses, *st)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ID < statuses[j].ID
+	})
+
+	return statuses
+}
@@ -0,0 +1,42 @@
+package borges
+
+import (
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-errors.v0"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+const (
+	// Fetching means that a worker is currently fetching the repository.
+	Fetching model.FetchStatus = "fetching"
+	// Errored means that the last fetch of the repository failed. The time
+	// of the failure is stored as the fetch error time of the repository.
+	Errored model.FetchStatus = "errored"
+	// Gone means that the repository no longer exists at its endpoint,
+	// because it was deleted or made private. Its references and the
+	// rooted repositories where it was archived are kept. The time it was
+	// found gone is stored as the fetch error time of the repository.
+	Gone model.FetchStatus = "gone"
+	// TooManyRefs means that the last fetch of the repository was aborted
+	// because it had more references than allowed, see CloneOptions.MaxRefs.
+	// Their number is stored in its ArchiveStats and the time of the
+	// failure as its fetch error time.
+	TooManyRefs model.FetchStatus = "too_many_refs"
+)
+
+var (
+	ErrStaleRepository = errors.NewKind("repository %s was updated by someone else since it was read with status %s")
+)
+
+// UpdateRepositoryStatus atomically changes the status of the repository to
+// the given one, storing also the given columns. The change is only made if
+// the status and update time of the repository in the store are still the
+// ones of r, so a worker with an outdated copy of the repository, such as one
+// that timed out while another worker fetched the repository again, cannot
+// overwrite a newer state. Otherwise, an error of kind ErrStaleRepository is
+// returned. On success, the status and update time of r are the stored ones.
+// See RepositoryStore.UpdateStatus.
+func UpdateRepositoryStatus(store RepositoryStore, r *model.Repository,
+	status model.FetchStatus, cols ...kallax.SchemaField) error {
+	return store.UpdateStatus(r, status, cols...)
+}
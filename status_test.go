@@ -0,0 +1,67 @@
+package borges
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/core-retrieval.v0/test"
+)
+
+func TestUpdateRepositoryStatus(t *testing.T) {
+	suite.Run(t, new(UpdateRepositoryStatusSuite))
+}
+
+type UpdateRepositoryStatusSuite struct {
+	test.Suite
+	store *model.RepositoryStore
+}
+
+func (s *UpdateRepositoryStatusSuite) SetupTest() {
+	s.Suite.Setup()
+	s.store = model.NewRepositoryStore(s.DB)
+}
+
+func (s *UpdateRepositoryStatusSuite) TearDownTest() {
+	s.Suite.TearDown()
+}
+
+func (s *UpdateRepositoryStatusSuite) TestTransitions() {
+	r := s.newRepository()
+
+	s.NoError(UpdateRepositoryStatus(NewSQLRepositoryStore(s.store), r, Fetching))
+	s.Equal(Fetching, r.Status)
+
+	s.NoError(UpdateRepositoryStatus(NewSQLRepositoryStore(s.store), r, Errored))
+	stored := s.findRepository(r)
+	s.Equal(Errored, stored.Status)
+	s.True(stored.UpdatedAt.Equal(r.UpdatedAt))
+}
+
+func (s *UpdateRepositoryStatusSuite) TestStaleRepository() {
+	stale := s.newRepository()
+	r := s.findRepository(stale)
+
+	s.NoError(UpdateRepositoryStatus(NewSQLRepositoryStore(s.store), r, Fetching))
+	s.NoError(UpdateRepositoryStatus(NewSQLRepositoryStore(s.store), r, model.Fetched))
+
+	err := UpdateRepositoryStatus(NewSQLRepositoryStore(s.store), stale, Errored)
+	s.True(ErrStaleRepository.Is(err))
+	s.Equal(model.FetchStatus(model.Pending), stale.Status)
+	s.Equal(model.FetchStatus(model.Fetched), s.findRepository(r).Status)
+}
+
+func (s *UpdateRepositoryStatusSuite) newRepository() *model.Repository {
+	r := model.NewRepository()
+	r.Endpoints = []string{"https://github.com/foo/bar"}
+	_, err := s.store.Save(r)
+	s.NoError(err)
+
+	return s.findRepository(r)
+}
+
+func (s *UpdateRepositoryStatusSuite) findRepository(r *model.Repository) *model.Repository {
+	r, err := s.store.FindOne(model.NewRepositoryQuery().FindByID(r.ID))
+	s.NoError(err)
+	return r
+}
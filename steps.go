@@ -0,0 +1,184 @@
+package borges
+
+import (
+	"context"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+)
+
+// Step is a step of the archiving of a job by an Archiver, which runs the
+// steps of ArchiverOptions.Steps in order, sharing the state of the job. If a
+// step fails, the rest are not run, and the repositories of the job not
+// finished yet fail with its error.
+type Step interface {
+	// Run runs the step on the job, stopping as soon as possible if the
+	// context is cancelled.
+	Run(ctx context.Context, s *JobState) error
+}
+
+// StepFunc is a function used as a Step.
+type StepFunc func(ctx context.Context, s *JobState) error
+
+// Run implements the Step interface.
+func (f StepFunc) Run(ctx context.Context, s *JobState) error {
+	return f(ctx, s)
+}
+
+var (
+	// FetchStep clones the repository of the job and its forks, and
+	// computes their changes. It fails only if the host of the repository
+	// of the job is busy, see ArchiverOptions.PerHostConcurrency, any other
+	// error fails the repository it happened to.
+	FetchStep Step = StepFunc(fetchStep)
+	// PackStep pushes the changes of the repositories fetched to their
+	// rooted repositories and commits them. The roots that cannot be
+	// archived fail their repositories once they are stored.
+	PackStep Step = StepFunc(packStep)
+	// StoreStep stores the repositories of the job in the repository
+	// store, along with their status, and removes their temporary clones.
+	// It fails with the error of the repository of the job, if any. The
+	// archiver runs it anyway after the other steps if it is not one of
+	// them, so the repositories are always stored and cleaned up.
+	StoreStep Step = StepFunc(storeStep)
+)
+
+// DefaultSteps returns the steps of the archiving of a job used if none are
+// given in ArchiverOptions.Steps: FetchStep, PackStep and StoreStep.
+func DefaultSteps() []Step {
+	return []Step{FetchStep, PackStep, StoreStep}
+}
+
+// JobState is the state of a job being archived, shared by its steps.
+type JobState struct {
+	// Job is the job being archived.
+	Job *Job
+
+	a       *Archiver
+	started time.Time
+	remotes []*remote
+}
+
+// Repositories returns the repositories of the job fetched so far, the one of
+// the job first and then its forks.
+func (s *JobState) Repositories() []*RepositoryState {
+	rs := make([]*RepositoryState, len(s.remotes))
+	for i, rm := range s.remotes {
+		rs[i] = &RepositoryState{rm: rm}
+	}
+
+	return rs
+}
+
+// fail fails the repositories not finished nor failed yet with err.
+func (s *JobState) fail(err error) {
+	for _, rm := range s.remotes {
+		if !rm.finished && rm.err == nil {
+			rm.err = err
+		}
+	}
+}
+
+// RepositoryState is the state of a repository archived by a job, which can
+// be either the repository of the job or one of its forks.
+type RepositoryState struct {
+	rm *remote
+}
+
+// ID returns the ID of the repository.
+func (r *RepositoryState) ID() uuid.UUID {
+	return r.rm.id
+}
+
+// Model returns the model of the repository, nil if it was not read from the
+// store, because it failed or it was skipped.
+func (r *RepositoryState) Model() *model.Repository {
+	return r.rm.model
+}
+
+// Clone returns the temporary clone of the repository, nil if it was not
+// cloned or it was already removed.
+func (r *RepositoryState) Clone() TemporaryRepository {
+	return r.rm.tr
+}
+
+// Changes returns the changes of the repository to push to its rooted
+// repositories, by root.
+func (r *RepositoryState) Changes() Changes {
+	return r.rm.changes
+}
+
+// Err returns the error that stopped the archiving of the repository, if any.
+func (r *RepositoryState) Err() error {
+	return r.rm.err
+}
+
+// Fail stops archiving the repository with the given error, so its changes
+// are not pushed, if they were not yet, and it is stored as errored.
+func (r *RepositoryState) Fail(err error) {
+	if r.rm.err == nil {
+		r.rm.err = err
+	}
+}
+
+func fetchStep(ctx context.Context, s *JobState) error {
+	ids := append([]uuid.UUID{s.Job.RepositoryID}, s.Job.Forks...)
+	for i, id := range ids {
+		rm := &remote{id: id, log: log.New("job", s.Job.RepositoryID, "repository", id)}
+		s.remotes = append(s.remotes, rm)
+		s.a.fetch(ctx, s.Job, rm)
+		if i == 0 && ErrHostBusy.Is(rm.err) {
+			return rm.err
+		}
+	}
+
+	return nil
+}
+
+func packStep(ctx context.Context, s *JobState) error {
+	s.a.pushChangesToRootedRepositories(ctx, s.Job, s.remotes)
+	return nil
+}
+
+func storeStep(ctx context.Context, s *JobState) error {
+	if len(s.remotes) == 0 {
+		return nil
+	}
+
+	for _, rm := range s.remotes[1:] {
+		if rm.finished {
+			continue
+		}
+
+		if err := s.a.finish(s.Job, rm, s.started); err != nil {
+			s.a.notifyWarn(s.Job, ErrArchivingFork.Wrap(err, rm.id.String()))
+		}
+	}
+
+	if s.remotes[0].finished {
+		return nil
+	}
+
+	return s.a.finish(s.Job, s.remotes[0], s.started)
+}
+
+// runSteps runs the steps of the archiver on the job until one fails. Then
+// the repositories not finished yet are stored, failing with the error of
+// the step, if any, see StoreStep.
+func (a *Archiver) runSteps(ctx context.Context, s *JobState) error {
+	steps := a.Options.Steps
+	if len(steps) == 0 {
+		steps = DefaultSteps()
+	}
+
+	for _, step := range steps {
+		if err := step.Run(ctx, s); err != nil {
+			s.fail(err)
+			_ = storeStep(ctx, s)
+			return err
+		}
+	}
+
+	return storeStep(ctx, s)
+}
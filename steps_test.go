@@ -0,0 +1,135 @@
+package borges
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	rrepository "gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-billy.v3/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestArchiverDo_Steps(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("", "borges-steps")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	store, rootedFs, a := newStepsArchiver(t, tmp)
+	defer func() { require.NoError(store.Close()) }()
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	commitFile(t, r, "README", "foo")
+
+	var clones int
+	scanErr := fmt.Errorf("virus found")
+	a.Options.Steps = []Step{
+		FetchStep,
+		StepFunc(func(ctx context.Context, s *JobState) error {
+			for _, r := range s.Repositories() {
+				require.NotNil(r.Model())
+				require.NoError(r.Err())
+				require.Len(r.Changes(), 1)
+				if r.Clone() != nil {
+					clones++
+				}
+
+				r.Fail(scanErr)
+			}
+
+			return nil
+		}),
+		PackStep,
+		StoreStep,
+	}
+
+	mr := model.NewRepository()
+	err = WithInProcRepository(r, func(url string) error {
+		mr.Endpoints = []string{url}
+		require.NoError(store.Create(mr))
+		return a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)})
+	})
+	require.Equal(scanErr, err)
+	require.Equal(1, clones)
+
+	stored, err := store.Get(mr.ID)
+	require.NoError(err)
+	require.Equal(Errored, stored.Status)
+	require.Empty(stored.References)
+
+	fis, err := readDirIfExists(rootedFs, "")
+	require.NoError(err)
+	require.Empty(fis)
+}
+
+func TestArchiverDo_StepFails(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("", "borges-steps")
+	require.NoError(err)
+	defer func() { require.NoError(os.RemoveAll(tmp)) }()
+
+	store, _, a := newStepsArchiver(t, tmp)
+	defer func() { require.NoError(store.Close()) }()
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	commitFile(t, r, "README", "foo")
+
+	// the repository is stored even without StoreStep
+	stepErr := fmt.Errorf("foo")
+	var packed bool
+	a.Options.Steps = []Step{
+		FetchStep,
+		StepFunc(func(context.Context, *JobState) error { return stepErr }),
+		StepFunc(func(context.Context, *JobState) error {
+			packed = true
+			return nil
+		}),
+	}
+
+	mr := model.NewRepository()
+	err = WithInProcRepository(r, func(url string) error {
+		mr.Endpoints = []string{url}
+		require.NoError(store.Create(mr))
+		return a.Do(&Job{RepositoryID: uuid.UUID(mr.ID)})
+	})
+	require.Equal(stepErr, err)
+	require.False(packed)
+
+	stored, err := store.Get(mr.ID)
+	require.NoError(err)
+	require.Equal(Errored, stored.Status)
+}
+
+// newStepsArchiver returns an archiver storing the repositories in a store and
+// the rooted repositories in a filesystem, both in the directory tmp. The
+// store must be closed.
+func newStepsArchiver(t *testing.T, tmp string) (*BoltRepositoryStore, billy.Filesystem, *Archiver) {
+	require := require.New(t)
+
+	fs := osfs.New(tmp)
+	store, err := OpenBoltRepositoryStore(fs.Join(tmp, "repositories.db"))
+	require.NoError(err)
+
+	rootedFs, err := fs.Chroot("rooted")
+	require.NoError(err)
+	txFs, err := fs.Chroot("tx")
+	require.NoError(err)
+	tmpFs, err := fs.Chroot("tmp")
+	require.NoError(err)
+
+	a := NewArchiver(store, rrepository.NewSivaRootedTransactioner(rootedFs, txFs),
+		NewTemporaryCloner(tmpFs, CloneOptions{}))
+	return store, rootedFs, a
+}
@@ -0,0 +1,354 @@
+package borges
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+// RepositoryStore is where the repository models are stored. The default one
+// is a SQL database, see NewSQLRepositoryStore, but single node setups can use
+// an embedded store instead, see OpenBoltRepositoryStore. Implementations
+// must be safe for concurrent use.
+type RepositoryStore interface {
+	// Get returns the repository with the given ID. It fails with an error
+	// of kind ErrRepositoryIDNotFound if there is none.
+	Get(id kallax.ULID) (*model.Repository, error)
+	// FindByEndpoint returns the repositories having the given endpoint.
+	FindByEndpoint(endpoint string) ([]*model.Repository, error)
+	// Find returns a page of at most limit repositories selected by the
+	// query, in its order, starting after the given repository, if not
+	// nil, which is the last one of the previous page. Zero means no
+	// limit. See RepositoryIter.
+	Find(q *RepositoryQuery, after *model.Repository, limit uint64) ([]*model.Repository, error)
+	// Create stores a new repository, setting its creation and update
+	// times.
+	Create(r *model.Repository) error
+	// UpdateStatus atomically changes the status of the repository, along
+	// with the given columns, as described in UpdateRepositoryStatus.
+	// Stores that cannot update single columns may store all of them.
+	UpdateStatus(r *model.Repository, status model.FetchStatus, cols ...kallax.SchemaField) error
+}
+
+// NewSQLRepositoryStore returns a RepositoryStore that stores the repositories
+// in the SQL database of the given kallax store.
+func NewSQLRepositoryStore(store *model.RepositoryStore) RepositoryStore {
+	return &sqlRepositoryStore{store}
+}
+
+type sqlRepositoryStore struct {
+	store *model.RepositoryStore
+}
+
+func (s *sqlRepositoryStore) Get(id kallax.ULID) (*model.Repository, error) {
+	r, err := s.store.FindOne(model.NewRepositoryQuery().FindByID(id))
+	if err != nil {
+		return nil, ErrRepositoryIDNotFound.Wrap(err, id.String())
+	}
+
+	return r, nil
+}
+
+func (s *sqlRepositoryStore) FindByEndpoint(endpoint string) ([]*model.Repository, error) {
+	rs, err := s.store.Find(
+		model.NewRepositoryQuery().
+			Where(kallax.And(kallax.ArrayContains(
+				model.Schema.Repository.Endpoints, endpoint,
+			))),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return rs.All()
+}
+
+// endpointsMatch matches repositories with any endpoint matching the given
+// regular expression.
+var endpointsMatch = kallax.NewOperator("array_to_string(:col:, ' ') ~ :arg:")
+
+func (s *sqlRepositoryStore) Find(q *RepositoryQuery, after *model.Repository,
+	limit uint64) ([]*model.Repository, error) {
+	schema := model.Schema.Repository
+	mq := model.NewRepositoryQuery()
+	if limit > 0 {
+		mq = mq.Limit(limit)
+	}
+
+	if len(q.Statuses) > 0 {
+		statuses := make([]interface{}, len(q.Statuses))
+		for i, st := range q.Statuses {
+			statuses[i] = st
+		}
+
+		mq = mq.Where(kallax.In(schema.Status, statuses...))
+	}
+
+	if q.Provider != "" {
+		mq = mq.Where(endpointsMatch(schema.Endpoints, q.providerRegexp()))
+	}
+
+	mq = whereTimeRange(mq, schema.UpdatedAt, q.UpdatedAfter, q.UpdatedBefore)
+	mq = whereTimeRange(mq, schema.FetchErrorAt, q.FetchErrorAfter, q.FetchErrorBefore)
+	mq = whereTimeRange(mq, schema.FetchedAt, q.FetchedAfter, q.FetchedBefore)
+
+	var (
+		col kallax.SchemaField
+		key interface{}
+	)
+	switch q.Order {
+	case OrderByCreatedAt:
+		col = schema.CreatedAt
+		if after != nil {
+			key = after.CreatedAt
+		}
+	case OrderByUpdatedAt:
+		col = schema.UpdatedAt
+		if after != nil {
+			key = after.UpdatedAt
+		}
+	case OrderByFetchErrorAt:
+		col = schema.FetchErrorAt
+		// excludes the repositories without a fetch error time
+		mq = mq.Where(kallax.Gt(col, time.Time{}))
+		if after != nil {
+			key = *after.FetchErrorAt
+		}
+	}
+
+	if col == nil {
+		mq = mq.Order(kallax.Asc(schema.ID))
+		if after != nil {
+			mq = mq.Where(kallax.Gt(schema.ID, after.ID))
+		}
+	} else {
+		mq = mq.Order(kallax.Asc(col), kallax.Asc(schema.ID))
+		if after != nil {
+			mq = mq.Where(kallax.Or(
+				kallax.Gt(col, key),
+				kallax.And(kallax.Eq(col, key), kallax.Gt(schema.ID, after.ID)),
+			))
+		}
+	}
+
+	rs, err := s.store.Find(mq)
+	if err != nil {
+		return nil, err
+	}
+
+	return rs.All()
+}
+
+// whereTimeRange selects the repositories with the given time column after
+// the first time and at or before the second one, ignoring the zero ones.
+func whereTimeRange(q *model.RepositoryQuery, col kallax.SchemaField,
+	after, before time.Time) *model.RepositoryQuery {
+	if !after.IsZero() {
+		q = q.Where(kallax.Gt(col, after))
+	}
+
+	if !before.IsZero() {
+		q = q.Where(kallax.LtOrEq(col, before))
+	}
+
+	return q
+}
+
+func (s *sqlRepositoryStore) Create(r *model.Repository) error {
+	_, err := s.store.Save(r)
+	return err
+}
+
+func (s *sqlRepositoryStore) UpdateStatus(r *model.Repository,
+	status model.FetchStatus, cols ...kallax.SchemaField) error {
+
+	prevStatus, prevUpdatedAt := r.Status, r.UpdatedAt
+	err := s.store.Transaction(func(store *model.RepositoryStore) error {
+		current, updatedAt, err := lockRepositoryStatus(store, r.ID)
+		if err != nil {
+			return err
+		}
+
+		if current != prevStatus || !updatedAt.Equal(prevUpdatedAt) {
+			return ErrStaleRepository.New(r.ID, prevStatus)
+		}
+
+		r.Status = status
+		cols = append(cols,
+			model.Schema.Repository.Status,
+			model.Schema.Repository.UpdatedAt,
+		)
+		if _, err := store.Update(r, cols...); err != nil {
+			return err
+		}
+
+		// the update time is read back, since the database does not store it
+		// with the same precision
+		_, r.UpdatedAt, err = lockRepositoryStatus(store, r.ID)
+		return err
+	})
+	if err != nil {
+		r.Status, r.UpdatedAt = prevStatus, prevUpdatedAt
+	}
+
+	return err
+}
+
+// createRootIndex implements the rootIndexCreator interface. The roots of each
+// endpoint are stored as their hexadecimal strings separated by spaces.
+func (s *sqlRepositoryStore) createRootIndex() error {
+	_, err := s.store.RawExec(`CREATE TABLE IF NOT EXISTS endpoint_roots (
+		endpoint text PRIMARY KEY,
+		roots text NOT NULL
+	)`)
+	return err
+}
+
+// Roots implements the RootIndex interface.
+func (s *sqlRepositoryStore) Roots(endpoint string) ([]model.SHA1, error) {
+	rs, err := s.store.RawQuery(
+		`SELECT roots FROM endpoint_roots WHERE endpoint = $1`, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	if !rs.Next() {
+		return nil, nil
+	}
+
+	var value string
+	if err := rs.RawScan(&value); err != nil {
+		return nil, err
+	}
+
+	var roots []model.SHA1
+	for _, r := range strings.Fields(value) {
+		roots = append(roots, model.NewSHA1(r))
+	}
+
+	return roots, nil
+}
+
+// SetRoots implements the RootIndex interface.
+func (s *sqlRepositoryStore) SetRoots(endpoint string, roots []model.SHA1) error {
+	strs := make([]string, len(roots))
+	for i, r := range roots {
+		strs[i] = r.String()
+	}
+
+	_, err := s.store.RawExec(`INSERT INTO endpoint_roots (endpoint, roots)
+		VALUES ($1, $2)
+		ON CONFLICT (endpoint) DO UPDATE SET roots = EXCLUDED.roots`,
+		endpoint, strings.Join(strs, " "))
+	return err
+}
+
+// createArchiveStats implements the archiveStatsCreator interface. The stats
+// of each repository are stored in a row of their own, referencing the one of
+// the repository, which is deleted along with it.
+func (s *sqlRepositoryStore) createArchiveStats() error {
+	_, err := s.store.RawExec(`CREATE TABLE IF NOT EXISTS repository_archive_stats (
+		id uuid PRIMARY KEY REFERENCES repositories (id) ON DELETE CASCADE,
+		objects bigint NOT NULL,
+		refs integer NOT NULL,
+		siva_size bigint NOT NULL,
+		updated_at timestamptz NOT NULL,
+		filtered_blobs text NOT NULL DEFAULT '',
+		fetch_duration bigint NOT NULL DEFAULT 0,
+		remote_refs integer NOT NULL DEFAULT 0
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// the filtered blobs, the fetch duration and the remote references
+	// were added later, the columns are missing in the tables created
+	// before
+	for _, column := range []string{
+		`filtered_blobs text NOT NULL DEFAULT ''`,
+		`fetch_duration bigint NOT NULL DEFAULT 0`,
+		`remote_refs integer NOT NULL DEFAULT 0`,
+	} {
+		_, err := s.store.RawExec(`ALTER TABLE repository_archive_stats
+			ADD COLUMN IF NOT EXISTS ` + column)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ArchiveStats implements the ArchiveStatsStore interface.
+func (s *sqlRepositoryStore) ArchiveStats(id kallax.ULID) (*ArchiveStats, error) {
+	rs, err := s.store.RawQuery(`SELECT objects, refs, siva_size, updated_at,
+		filtered_blobs, fetch_duration, remote_refs FROM repository_archive_stats
+		WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	if !rs.Next() {
+		return nil, nil
+	}
+
+	var (
+		stats    ArchiveStats
+		filtered string
+	)
+	err = rs.RawScan(&stats.Objects, &stats.References, &stats.SivaSize,
+		&stats.UpdatedAt, &filtered, &stats.FetchDuration, &stats.RemoteReferences)
+	if err != nil {
+		return nil, err
+	}
+
+	stats.FilteredBlobs = strings.Fields(filtered)
+	return &stats, nil
+}
+
+// SetArchiveStats implements the ArchiveStatsStore interface.
+func (s *sqlRepositoryStore) SetArchiveStats(id kallax.ULID, stats *ArchiveStats) error {
+	_, err := s.store.RawExec(`INSERT INTO repository_archive_stats
+		(id, objects, refs, siva_size, updated_at, filtered_blobs, fetch_duration,
+			remote_refs)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET objects = EXCLUDED.objects,
+			refs = EXCLUDED.refs, siva_size = EXCLUDED.siva_size,
+			updated_at = EXCLUDED.updated_at,
+			filtered_blobs = EXCLUDED.filtered_blobs,
+			fetch_duration = EXCLUDED.fetch_duration,
+			remote_refs = EXCLUDED.remote_refs`,
+		id, stats.Objects, stats.References, stats.SivaSize, stats.UpdatedAt,
+		strings.Join(stats.FilteredBlobs, " "), int64(stats.FetchDuration),
+		stats.RemoteReferences)
+	return err
+}
+
+// lockRepositoryStatus returns the status and update time of the repository,
+// locking its row until the end of the current transaction.
+func lockRepositoryStatus(store *model.RepositoryStore, id kallax.ULID) (model.FetchStatus, time.Time, error) {
+	rs, err := store.RawQuery(
+		`SELECT status, updated_at FROM repositories WHERE id = $1 FOR UPDATE`, id)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer rs.Close()
+
+	if !rs.Next() {
+		return "", time.Time{}, ErrRepositoryIDNotFound.New(id)
+	}
+
+	var (
+		status    string
+		updatedAt time.Time
+	)
+	if err := rs.RawScan(&status, &updatedAt); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return model.FetchStatus(status), updatedAt, nil
+}
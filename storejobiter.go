@@ -0,0 +1,44 @@
+package borges
+
+import (
+	"context"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+)
+
+// DefaultStorePageSize is the page size used by NewStoreJobIter when it is
+// given a zero page size.
+const DefaultStorePageSize = DefaultRepositoryPageSize
+
+type storeJobIter struct {
+	iter *RepositoryIter
+}
+
+// NewStoreJobIter returns a JobIter that returns a job for every repository
+// in the store with one of the given statuses, or for all of them if no status
+// is given. The repositories are read by their ID in pages of pageSize, so
+// the whole table is never loaded at once. Repositories created while
+// iterating may or may not be returned.
+func NewStoreJobIter(store RepositoryStore, pageSize uint64,
+	statuses ...model.FetchStatus) JobIter {
+	q := &RepositoryQuery{Statuses: statuses}
+	return &storeJobIter{NewRepositoryIter(store, q, pageSize)}
+}
+
+func (i *storeJobIter) Next(ctx context.Context) (*Job, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r, err := i.iter.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Job{RepositoryID: uuid.UUID(r.ID)}, nil
+}
+
+func (i *storeJobIter) Close() error {
+	return nil
+}
@@ -0,0 +1,93 @@
+package borges
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/core-retrieval.v0/test"
+)
+
+func TestStoreJobIter(t *testing.T) {
+	suite.Run(t, new(StoreJobIterSuite))
+}
+
+type StoreJobIterSuite struct {
+	test.Suite
+	store *model.RepositoryStore
+}
+
+func (s *StoreJobIterSuite) SetupTest() {
+	s.Suite.Setup()
+	s.store = model.NewRepositoryStore(s.DB)
+}
+
+func (s *StoreJobIterSuite) TearDownTest() {
+	s.Suite.TearDown()
+}
+
+func (s *StoreJobIterSuite) TestStatuses() {
+	pending := s.createRepositories(5, model.Pending)
+	errored := s.createRepositories(2, Errored)
+	s.createRepositories(3, model.Fetched)
+
+	// the page size makes the last page have a single repository
+	s.Equal(sortedIDs(append(pending, errored...)), s.jobs(NewStoreJobIter(NewSQLRepositoryStore(s.store), 3,
+		model.Pending, Errored)))
+}
+
+func (s *StoreJobIterSuite) TestAll() {
+	ids := s.createRepositories(4, model.Pending)
+	ids = append(ids, s.createRepositories(2, model.Fetched)...)
+
+	// the page size makes the last page empty
+	s.Equal(sortedIDs(ids), s.jobs(NewStoreJobIter(NewSQLRepositoryStore(s.store), 2)))
+}
+
+func (s *StoreJobIterSuite) TestEmpty() {
+	s.Empty(s.jobs(NewStoreJobIter(NewSQLRepositoryStore(s.store), 0)))
+}
+
+func (s *StoreJobIterSuite) createRepositories(n int, status model.FetchStatus) []uuid.UUID {
+	var ids []uuid.UUID
+	for i := 0; i < n; i++ {
+		r := model.NewRepository()
+		r.Status = status
+		_, err := s.store.Save(r)
+		s.NoError(err)
+		ids = append(ids, uuid.UUID(r.ID))
+	}
+
+	return ids
+}
+
+func (s *StoreJobIterSuite) jobs(iter JobIter) []uuid.UUID {
+	var ids []uuid.UUID
+	for {
+		j, err := iter.Next(context.Background())
+		if err == io.EOF {
+			break
+		}
+
+		s.NoError(err)
+		ids = append(ids, j.RepositoryID)
+	}
+
+	s.NoError(iter.Close())
+	return ids
+}
+
+// sortedIDs sorts the IDs in the order they are stored, which may not be the
+// order they were created in if they were created in the same millisecond.
+func sortedIDs(ids []uuid.UUID) []uuid.UUID {
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i].Bytes(), ids[j].Bytes()) < 0
+	})
+
+	return ids
+}
@@ -0,0 +1,197 @@
+package borges
+
+import (
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/src-d/go-errors.v0"
+	"gopkg.in/src-d/go-git.v4/config"
+)
+
+var (
+	ErrInvalidSubmodulePolicy = errors.NewKind("invalid submodule policy: %s")
+	ErrSubmoduleURL           = errors.NewKind("invalid URL %q of submodule of %s")
+	ErrSubmodules             = errors.NewKind("listing submodules of repository %s failed")
+)
+
+// gitmodulesFile is the file where the submodules of a repository are
+// declared.
+const gitmodulesFile = ".gitmodules"
+
+// SubmodulePolicy sets what the archiver does with the submodules of the
+// repositories it archives. The content of the submodules is never archived in
+// the rooted repositories of the repository that declares them.
+type SubmodulePolicy int
+
+const (
+	// IgnoreSubmodules does not look for submodules. It is the default.
+	IgnoreSubmodules SubmodulePolicy = iota
+	// RecordSubmodules reports the URLs of the submodules found, see the
+	// Submodules notifier of the Archiver.
+	RecordSubmodules
+	// FetchSubmodules reports the submodules found like RecordSubmodules
+	// does, along with a job to archive each one of them as a repository on
+	// its own, so they end up in their own rooted repositories.
+	FetchSubmodules
+)
+
+// ParseSubmodulePolicy returns the SubmodulePolicy with the given name, which
+// can be "ignore", "record" or "fetch".
+func ParseSubmodulePolicy(name string) (SubmodulePolicy, error) {
+	switch name {
+	case "ignore":
+		return IgnoreSubmodules, nil
+	case "record":
+		return RecordSubmodules, nil
+	case "fetch":
+		return FetchSubmodules, nil
+	default:
+		return 0, ErrInvalidSubmodulePolicy.New(name)
+	}
+}
+
+func (p SubmodulePolicy) String() string {
+	switch p {
+	case IgnoreSubmodules:
+		return "ignore"
+	case RecordSubmodules:
+		return "record"
+	case FetchSubmodules:
+		return "fetch"
+	default:
+		return "unknown"
+	}
+}
+
+// Submodule is a submodule found in a repository being archived.
+type Submodule struct {
+	// Endpoint is the URL of the submodule, resolved against the endpoint
+	// of the repository that declares it if it is relative.
+	Endpoint string
+	// Job is the job to archive the submodule, only set with the
+	// FetchSubmodules policy.
+	Job *Job
+}
+
+// SubmoduleRepository is a TemporaryRepository that can list the submodules
+// declared in it.
+type SubmoduleRepository interface {
+	TemporaryRepository
+	// Submodules returns the URLs of the submodules declared in the
+	// .gitmodules files of all the branches of the repository, sorted and
+	// without duplicates. Relative URLs are resolved against the URL the
+	// repository was cloned from.
+	Submodules() ([]string, error)
+}
+
+// Submodules implements the SubmoduleRepository interface.
+func (r *temporaryRepository) Submodules() ([]string, error) {
+	urls := make(map[string]bool)
+	err := r.forEachBranchFile(gitmodulesFile, func(content string) error {
+		m := config.NewModules()
+		if err := m.Unmarshal([]byte(content)); err != nil {
+			return err
+		}
+
+		for _, s := range m.Submodules {
+			u, err := resolveSubmoduleURL(r.Endpoint, s.URL)
+			if err != nil {
+				return err
+			}
+
+			urls[u] = true
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for u := range urls {
+		result = append(result, u)
+	}
+
+	sort.Strings(result)
+	return result, nil
+}
+
+// submodules returns the submodules of the temporary repository of the remote
+// according to the Submodules option, if it is a SubmoduleRepository.
+func (a *Archiver) submodules(rm *remote) ([]*Submodule, error) {
+	sr, ok := rm.tr.(SubmoduleRepository)
+	if a.Options.Submodules == IgnoreSubmodules || !ok {
+		return nil, nil
+	}
+
+	urls, err := sr.Submodules()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Submodule
+	for _, u := range urls {
+		s := &Submodule{Endpoint: u}
+		if a.Options.Submodules == FetchSubmodules {
+			id, err := RepositoryID(u, a.RepositoryStorage)
+			if err != nil {
+				return nil, err
+			}
+
+			s.Job = &Job{RepositoryID: id}
+		}
+
+		result = append(result, s)
+	}
+
+	return result, nil
+}
+
+// notifySubmodulesOf calls the Submodules notifier with the submodules of the
+// remote, if any. A failure listing them is reported as a warning.
+func (a *Archiver) notifySubmodulesOf(j *Job, rm *remote) {
+	subs, err := a.submodules(rm)
+	if err != nil {
+		a.notifyWarn(j, ErrSubmodules.Wrap(err, rm.id.String()))
+		return
+	}
+
+	if len(subs) > 0 {
+		rm.log.Debug("submodules found", "submodules", len(subs))
+		a.notifySubmodules(j, subs)
+	}
+}
+
+// resolveSubmoduleURL returns the URL of a submodule of the repository at the
+// parent URL. As in git, URLs starting with ./ or ../ are relative to the
+// parent URL, with ../ removing its last path element.
+func resolveSubmoduleURL(parent, u string) (string, error) {
+	if u == "" {
+		return "", ErrSubmoduleURL.New(u, parent)
+	}
+
+	if !strings.HasPrefix(u, "./") && !strings.HasPrefix(u, "../") {
+		return u, nil
+	}
+
+	if strings.Contains(parent, "://") {
+		pu, err := url.Parse(parent)
+		if err != nil {
+			return "", ErrSubmoduleURL.Wrap(err, u, parent)
+		}
+
+		pu.Path = path.Join(pu.Path, u)
+		return pu.String(), nil
+	}
+
+	// scp-like URL, such as git@github.com:foo/bar.git
+	i := strings.Index(parent, ":")
+	if i < 0 {
+		return "", ErrSubmoduleURL.New(u, parent)
+	}
+
+	return parent[:i+1] + path.Join(parent[i+1:], u), nil
+}
@@ -0,0 +1,159 @@
+package borges
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestParseSubmodulePolicy(t *testing.T) {
+	require := require.New(t)
+
+	for _, p := range []SubmodulePolicy{IgnoreSubmodules, RecordSubmodules, FetchSubmodules} {
+		parsed, err := ParseSubmodulePolicy(p.String())
+		require.NoError(err)
+		require.Equal(p, parsed)
+	}
+
+	_, err := ParseSubmodulePolicy("inline")
+	require.True(ErrInvalidSubmodulePolicy.Is(err))
+}
+
+func TestResolveSubmoduleURL(t *testing.T) {
+	require := require.New(t)
+
+	cases := []struct {
+		parent, url, expected string
+	}{
+		{"https://github.com/foo/bar.git", "https://github.com/baz/qux.git", "https://github.com/baz/qux.git"},
+		{"https://github.com/foo/bar.git", "../qux.git", "https://github.com/foo/qux.git"},
+		{"https://github.com/foo/bar", "../../baz/qux", "https://github.com/baz/qux"},
+		{"https://github.com/foo/bar", "./qux", "https://github.com/foo/bar/qux"},
+		{"git@github.com:foo/bar.git", "../qux.git", "git@github.com:foo/qux.git"},
+	}
+
+	for _, c := range cases {
+		u, err := resolveSubmoduleURL(c.parent, c.url)
+		require.NoError(err, c.url)
+		require.Equal(c.expected, u, c.url)
+	}
+
+	_, err := resolveSubmoduleURL("https://github.com/foo/bar", "")
+	require.True(ErrSubmoduleURL.Is(err))
+
+	_, err = resolveSubmoduleURL("/foo/bar", "../qux")
+	require.True(ErrSubmoduleURL.Is(err))
+}
+
+const testGitmodules = `[submodule "qux"]
+	path = qux
+	url = ../qux.git
+[submodule "baz"]
+	path = vendor/baz
+	url = https://example.com/baz.git
+`
+
+func TestTemporaryRepositorySubmodules(t *testing.T) {
+	require := require.New(t)
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	commitFile(t, r, gitmodulesFile, testGitmodules)
+
+	tr := &temporaryRepository{Repository: r, Endpoint: "https://github.com/foo/bar.git"}
+	urls, err := tr.Submodules()
+	require.NoError(err)
+	require.Equal([]string{
+		"https://example.com/baz.git",
+		"https://github.com/foo/qux.git",
+	}, urls)
+}
+
+// commitFile makes the master branch of the repository point to a new commit
+// with just a file with the given name and content. The objects are stored
+// directly, because the worktree cannot commit a .gitmodules file with
+// submodules not checked out.
+func commitFile(t *testing.T, r *git.Repository, name, content string) {
+	require := require.New(t)
+
+	blob := r.Storer.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	w, err := blob.Writer()
+	require.NoError(err)
+	_, err = w.Write([]byte(content))
+	require.NoError(err)
+	require.NoError(w.Close())
+	blobHash, err := r.Storer.SetEncodedObject(blob)
+	require.NoError(err)
+
+	tree := &object.Tree{Entries: []object.TreeEntry{
+		{Name: name, Mode: filemode.Regular, Hash: blobHash},
+	}}
+	treeHash := storeObject(t, r, tree)
+
+	sig := object.Signature{Name: "foo", Email: "foo@example.com", When: time.Now()}
+	commit := &object.Commit{
+		Author:    sig,
+		Committer: sig,
+		Message:   "add " + name,
+		TreeHash:  treeHash,
+	}
+	commitHash := storeObject(t, r, commit)
+
+	require.NoError(r.Storer.SetReference(
+		plumbing.NewHashReference("refs/heads/master", commitHash)))
+}
+
+func storeObject(t *testing.T, r *git.Repository, o object.Object) plumbing.Hash {
+	require := require.New(t)
+
+	obj := r.Storer.NewEncodedObject()
+	require.NoError(o.Encode(obj))
+	h, err := r.Storer.SetEncodedObject(obj)
+	require.NoError(err)
+	return h
+}
+
+func TestTemporaryRepositorySubmodules_None(t *testing.T) {
+	require := require.New(t)
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+
+	tr := &temporaryRepository{Repository: r, Endpoint: "https://github.com/foo/bar.git"}
+	urls, err := tr.Submodules()
+	require.NoError(err)
+	require.Empty(urls)
+}
+
+func TestArchiverSubmodules(t *testing.T) {
+	require := require.New(t)
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	commitFile(t, r, gitmodulesFile, testGitmodules)
+
+	rm := &remote{tr: &temporaryRepository{
+		Repository: r,
+		Endpoint:   "https://github.com/foo/bar.git",
+	}}
+
+	a := NewArchiver(nil, nil, nil)
+	subs, err := a.submodules(rm)
+	require.NoError(err)
+	require.Nil(subs)
+
+	a.Options.Submodules = RecordSubmodules
+	subs, err = a.submodules(rm)
+	require.NoError(err)
+	require.Equal([]*Submodule{
+		{Endpoint: "https://example.com/baz.git"},
+		{Endpoint: "https://github.com/foo/qux.git"},
+	}, subs)
+}
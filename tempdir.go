@@ -0,0 +1,203 @@
+package borges
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-billy.v3/util"
+)
+
+// TemporaryDirLockFile is the name of the file, inside a temporary directory,
+// holding the host name and the pid of the process using it.
+const TemporaryDirLockFile = "borges.lock"
+
+// LockTemporaryDir marks the root of the given filesystem as being used by the
+// current process, so CleanOrphanTemporaryDirs run by other processes do not
+// remove it.
+func LockTemporaryDir(fs billy.Filesystem) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	content := fmt.Sprintf("%s\n%d\n", host, os.Getpid())
+	return util.WriteFile(fs, TemporaryDirLockFile, []byte(content), 0644)
+}
+
+// CleanOrphanTemporaryDirs removes the directories in parent that were not
+// modified for maxAge and are not used by a live process, according to their
+// lock file, see LockTemporaryDir. Directories locked by processes of other
+// hosts are never removed, since there is no way to tell whether they are
+// alive. It returns the paths of the removed directories.
+func CleanOrphanTemporaryDirs(parent string, maxAge time.Duration) ([]string, error) {
+	fis, err := ioutil.ReadDir(parent)
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, fi := range fis {
+		if !fi.IsDir() || time.Since(fi.ModTime()) < maxAge {
+			continue
+		}
+
+		dir := filepath.Join(parent, fi.Name())
+		if isTemporaryDirLocked(dir, host) {
+			continue
+		}
+
+		if err := os.RemoveAll(dir); err != nil {
+			return removed, err
+		}
+
+		removed = append(removed, dir)
+	}
+
+	return removed, nil
+}
+
+// isTemporaryDirLocked returns whether the directory is locked by a process
+// that may be alive. Directories without a valid lock file are not locked.
+func isTemporaryDirLocked(dir, host string) bool {
+	content, err := ioutil.ReadFile(filepath.Join(dir, TemporaryDirLockFile))
+	if err != nil {
+		return false
+	}
+
+	fields := strings.Fields(string(content))
+	if len(fields) != 2 {
+		return false
+	}
+
+	if fields[0] != host {
+		return true
+	}
+
+	pid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return false
+	}
+
+	return isProcessAlive(pid)
+}
+
+// isProcessAlive returns whether there is a process with the given pid.
+func isProcessAlive(pid int) bool {
+	if pid == os.Getpid() {
+		return true
+	}
+
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// workerTempDirsPath is the directory of the temporary filesystem with the
+// directories of the workers, see ArchiverOptions.WorkerTempDirs.
+const workerTempDirsPath = "workers"
+
+// ScopedCloner is a TemporaryCloner that can make TemporaryCloners confined to
+// a directory of its temporary filesystem.
+type ScopedCloner interface {
+	TemporaryCloner
+	// Scope returns a TemporaryCloner like this one, sharing its options
+	// and limits, that clones into the given directory of the temporary
+	// filesystem. The files outside of it cannot be reached by the clones.
+	// The returned function removes everything in the directory.
+	Scope(dir string) (TemporaryCloner, func() error, error)
+}
+
+// Scope implements the ScopedCloner interface.
+func (b *temporaryRepositoryBuilder) Scope(dir string) (TemporaryCloner, func() error, error) {
+	fs, err := b.TempFilesystem.Chroot(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scoped := *b
+	scoped.TempFilesystem = fs
+	return &scoped, func() error { return removeDirContents(fs) }, nil
+}
+
+// removeDirContents removes every file in the root of fs, leaving the root
+// itself.
+func removeDirContents(fs billy.Filesystem) error {
+	fis, err := fs.ReadDir("/")
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range fis {
+		if err := util.RemoveAll(fs, fi.Name()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// workerClonerFactory returns the TemporaryCloner of each worker of a pool,
+// scoped to a directory of its own if the cloner is a ScopedCloner.
+type workerClonerFactory struct {
+	tc      TemporaryCloner
+	m       sync.Mutex
+	cloners map[int]*workerCloner
+}
+
+type workerCloner struct {
+	TemporaryCloner
+	clean func() error
+}
+
+func newWorkerClonerFactory(tc TemporaryCloner) *workerClonerFactory {
+	return &workerClonerFactory{tc: tc, cloners: make(map[int]*workerCloner)}
+}
+
+// cloner returns the TemporaryCloner of the worker with the given context,
+// and the function that removes its temporary files, which must be called
+// after each job. If the cloner of the factory is not a ScopedCloner, it is
+// returned as it is for every worker, with a function that does nothing.
+func (f *workerClonerFactory) cloner(ctx *WorkerContext) (TemporaryCloner, func() error, error) {
+	sc, ok := f.tc.(ScopedCloner)
+	if !ok {
+		return f.tc, func() error { return nil }, nil
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if c, ok := f.cloners[ctx.ID]; ok {
+		return c.TemporaryCloner, c.clean, nil
+	}
+
+	dir := path.Join(workerTempDirsPath, strconv.Itoa(ctx.ID))
+	tc, clean, err := sc.Scope(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// files left by a previous process using the same temporary directory
+	if err := clean(); err != nil {
+		return nil, nil, err
+	}
+
+	f.cloners[ctx.ID] = &workerCloner{TemporaryCloner: tc, clean: clean}
+	return tc, clean, nil
+}
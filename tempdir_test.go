@@ -0,0 +1,127 @@
+package borges
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+	"gopkg.in/src-d/go-billy.v3/osfs"
+	"gopkg.in/src-d/go-billy.v3/util"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestCleanOrphanTemporaryDirs(t *testing.T) {
+	require := require.New(t)
+
+	parent, err := ioutil.TempDir("", "borges-tempdirs")
+	require.NoError(err)
+	defer os.RemoveAll(parent)
+
+	host, err := os.Hostname()
+	require.NoError(err)
+
+	locks := map[string]string{
+		"live":       "",
+		"dead":       host + "\n999999999\n",
+		"other-host": "some-other-host\n1\n",
+		"unlocked":   "-",
+		"recent":     "-",
+	}
+	for name, lock := range locks {
+		dir := filepath.Join(parent, name)
+		require.NoError(os.Mkdir(dir, 0755))
+		switch lock {
+		case "":
+			require.NoError(LockTemporaryDir(osfs.New(dir)))
+		case "-":
+		default:
+			require.NoError(ioutil.WriteFile(
+				filepath.Join(dir, TemporaryDirLockFile), []byte(lock), 0644))
+		}
+
+		if name != "recent" {
+			old := time.Now().Add(-2 * time.Hour)
+			require.NoError(os.Chtimes(dir, old, old))
+		}
+	}
+
+	removed, err := CleanOrphanTemporaryDirs(parent, time.Hour)
+	require.NoError(err)
+	require.Equal([]string{
+		filepath.Join(parent, "dead"),
+		filepath.Join(parent, "unlocked"),
+	}, removed)
+
+	fis, err := ioutil.ReadDir(parent)
+	require.NoError(err)
+	require.Len(fis, 3)
+}
+
+func TestTemporaryCloner_Scope(t *testing.T) {
+	require := require.New(t)
+
+	tmpFs := memfs.New()
+	require.NoError(util.WriteFile(tmpFs, "shared", []byte("foo"), 0644))
+
+	f := newWorkerClonerFactory(NewTemporaryCloner(tmpFs, CloneOptions{}))
+	tc0, clean0, err := f.cloner(&WorkerContext{ID: 0})
+	require.NoError(err)
+	tc1, _, err := f.cloner(&WorkerContext{ID: 1})
+	require.NoError(err)
+	require.True(tc0 != tc1)
+	again, _, err := f.cloner(&WorkerContext{ID: 0})
+	require.NoError(err)
+	require.True(tc0 == again)
+
+	fs0 := tc0.(*temporaryRepositoryBuilder).TempFilesystem
+	_, err = fs0.Open("shared")
+	require.True(os.IsNotExist(err))
+	_, err = fs0.Open("../../shared")
+	require.Error(err)
+
+	r, err := git.Init(memory.NewStorage(), nil)
+	require.NoError(err)
+	commitFile(t, r, "README", "foo")
+	require.NoError(WithInProcRepository(r, func(url string) error {
+		tr, err := tc0.Clone(context.TODO(), "foo", url)
+		if err != nil {
+			return err
+		}
+
+		return tr.Close()
+	}))
+
+	fis, err := tmpFs.ReadDir("workers/0")
+	require.NoError(err)
+	require.NotEmpty(fis, "clone not in the worker directory")
+
+	require.NoError(clean0())
+	fis, err = tmpFs.ReadDir("workers/0")
+	require.NoError(err)
+	require.Empty(fis)
+	_, err = tmpFs.Stat("shared")
+	require.NoError(err)
+}
+
+func TestTemporaryCloner_NotScoped(t *testing.T) {
+	require := require.New(t)
+
+	tc := &unscopedCloner{}
+	tc0, clean, err := newWorkerClonerFactory(tc).cloner(&WorkerContext{ID: 0})
+	require.NoError(err)
+	require.True(tc0 == TemporaryCloner(tc))
+	require.NoError(clean())
+}
+
+type unscopedCloner struct{}
+
+func (*unscopedCloner) Clone(ctx context.Context, id, url string) (TemporaryRepository, error) {
+	return nil, fmt.Errorf("not implemented")
+}
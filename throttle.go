@@ -0,0 +1,71 @@
+package borges
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+)
+
+// newBandwidthLimiter returns a limiter of the given number of bytes per
+// second, or nil if it is zero or less.
+func newBandwidthLimiter(bytesPerSecond int) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), bytesPerSecond)
+}
+
+// throttledStorage is a filesystem storage that limits the rate at which
+// packfiles are written to it. Since fetched packfiles are copied straight
+// from the transport, this limits the rate at which they are downloaded,
+// whatever the protocol is.
+type throttledStorage struct {
+	*filesystem.Storage
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (s *throttledStorage) PackfileWriter() (io.WriteCloser, error) {
+	w, err := s.Storage.PackfileWriter()
+	if err != nil {
+		return nil, err
+	}
+
+	return &throttledWriter{WriteCloser: w, ctx: s.ctx, limiter: s.limiter}, nil
+}
+
+// throttledWriter waits for the limiter before every write. Writes are split
+// in chunks no bigger than the limiter burst. If the context is done while
+// waiting, the write fails with its error.
+type throttledWriter struct {
+	io.WriteCloser
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		if b := w.limiter.Burst(); n > b {
+			n = b
+		}
+
+		if err := w.limiter.WaitN(w.ctx, n); err != nil {
+			return written, err
+		}
+
+		n, err := w.WriteCloser.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
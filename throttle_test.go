@@ -0,0 +1,56 @@
+package borges
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type nopWriteCloser struct {
+	bytes.Buffer
+}
+
+func (*nopWriteCloser) Close() error { return nil }
+
+func TestThrottledWriter(t *testing.T) {
+	require := require.New(t)
+
+	buf := &nopWriteCloser{}
+	w := &throttledWriter{
+		WriteCloser: buf,
+		ctx:         context.Background(),
+		limiter:     newBandwidthLimiter(1000),
+	}
+
+	start := time.Now()
+	n, err := w.Write(make([]byte, 1500))
+	require.NoError(err)
+	require.Equal(1500, n)
+	require.Equal(1500, buf.Len())
+	require.True(time.Since(start) >= 400*time.Millisecond)
+}
+
+func TestThrottledWriter_ContextDone(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w := &throttledWriter{
+		WriteCloser: &nopWriteCloser{},
+		ctx:         ctx,
+		limiter:     newBandwidthLimiter(1000),
+	}
+
+	n, err := w.Write(make([]byte, 1500))
+	require.Error(err)
+	require.Equal(0, n)
+}
+
+func TestNewBandwidthLimiter(t *testing.T) {
+	require.Nil(t, newBandwidthLimiter(0))
+	require.NotNil(t, newBandwidthLimiter(1))
+}
@@ -0,0 +1,73 @@
+package borges
+
+import (
+	"sync"
+	"time"
+)
+
+// TransactionLimiter limits the number of transactions on rooted repositories
+// open at the same time, see SivaOptions. A worker can have several of them
+// open at once, one for each rooted repository of the job, so it bounds the
+// files and temporary directories in use regardless of the number of
+// workers. Incremental fetches keep the transactions on the rooted
+// repositories they read from open while committing the changes, so with
+// them the limit must be higher than the number of workers, or they can wait
+// for each other forever. It is safe for concurrent use.
+type TransactionLimiter struct {
+	Notifiers struct {
+		// Wait function, if set, is called whenever a transaction had
+		// to wait for a free slot to begin, with the time it waited.
+		Wait func(time.Duration)
+	}
+
+	slots chan struct{}
+}
+
+// NewTransactionLimiter returns a TransactionLimiter of max transactions, or
+// nil if max is not positive, which means no limit.
+func NewTransactionLimiter(max int) *TransactionLimiter {
+	if max <= 0 {
+		return nil
+	}
+
+	return &TransactionLimiter{slots: make(chan struct{}, max)}
+}
+
+// acquire takes a slot, waiting for one to be free, and returns the function
+// that frees it, which can be called several times. A nil limiter always has
+// free slots.
+func (l *TransactionLimiter) acquire() (release func()) {
+	if l == nil {
+		return func() {}
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		start := time.Now()
+		l.slots <- struct{}{}
+		l.notifyWait(time.Since(start))
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-l.slots })
+	}
+}
+
+// Len returns the number of transactions open.
+func (l *TransactionLimiter) Len() int {
+	if l == nil {
+		return 0
+	}
+
+	return len(l.slots)
+}
+
+func (l *TransactionLimiter) notifyWait(d time.Duration) {
+	if l.Notifiers.Wait == nil {
+		return
+	}
+
+	l.Notifiers.Wait(d)
+}
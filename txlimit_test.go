@@ -0,0 +1,55 @@
+package borges
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestTransactionLimiter(t *testing.T) {
+	require := require.New(t)
+
+	limiter := NewTransactionLimiter(1)
+	waits := make(chan time.Duration, 1)
+	limiter.Notifiers.Wait = func(d time.Duration) { waits <- d }
+
+	rtx := NewSivaRootedTransactioner(memfs.New(), memfs.New(), SivaOptions{Limiter: limiter})
+	h1 := plumbing.NewHash("e41f091c11a338f62796a738c83d879936a508ec")
+	h2 := plumbing.NewHash("b029517f6300c2da0f4b651b8642506cd6aaf45d")
+
+	tx1, err := rtx.Begin(h1)
+	require.NoError(err)
+	require.Equal(1, limiter.Len())
+
+	begun := make(chan repository.Tx)
+	go func() {
+		tx, err := rtx.Begin(h2)
+		require.NoError(err)
+		begun <- tx
+	}()
+
+	select {
+	case <-begun:
+		require.FailNow("transaction begun over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	commitToTx(t, tx1.Storer())
+	require.NoError(tx1.Commit())
+
+	tx2 := <-begun
+	require.True(<-waits >= 50*time.Millisecond)
+	require.Equal(1, limiter.Len())
+
+	// the slot is freed only once
+	require.NoError(tx2.Rollback())
+	require.NoError(rtx.Abort(tx2))
+	require.Equal(0, limiter.Len())
+
+	require.Nil(NewTransactionLimiter(0))
+	require.Equal(0, (*TransactionLimiter)(nil).Len())
+}
@@ -0,0 +1,127 @@
+package borges
+
+import (
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/src-d/go-errors.v0"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage"
+)
+
+var (
+	ErrInitNotFound         = errors.NewKind("init commit %s not found in rooted repository")
+	ErrRepositoryNotInRoots = errors.NewKind("no references of repository %s found in rooted repository")
+)
+
+// RootedReferenceName splits the name of a reference stored in a rooted
+// repository into the original reference name and the ID of the repository
+// it belongs to. Rooted repositories store the references of every repository
+// sharing the same init commit, so their names are suffixed with the
+// repository ID (see Archiver). It returns false if the name has no valid
+// repository ID suffix.
+func RootedReferenceName(n plumbing.ReferenceName) (plumbing.ReferenceName, string, bool) {
+	name := n.String()
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return "", "", false
+	}
+
+	id := name[i+1:]
+	if _, err := uuid.FromString(id); err != nil {
+		return "", "", false
+	}
+
+	return plumbing.ReferenceName(name[:i]), id, true
+}
+
+// Unpack copies the objects of the rooted repository with the given init
+// commit into dst, together with its references. If id is not empty, only the
+// references of the repository with that ID are copied, with their original
+// names. Otherwise, the references of all the repositories are copied under
+// refs/remotes/<id>/, so they do not collide with each other.
+func Unpack(rooted storage.Storer, init plumbing.Hash, dst storage.Storer, id string) error {
+	c, err := object.GetCommit(rooted, init)
+	if err == plumbing.ErrObjectNotFound || (err == nil && !isRootCommit(rooted, c)) {
+		return ErrInitNotFound.New(init)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	refs, err := unpackReferences(rooted, id)
+	if err != nil {
+		return err
+	}
+
+	if id != "" && len(refs) == 0 {
+		return ErrRepositoryNotInRoots.New(id)
+	}
+
+	iter, err := rooted.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		return err
+	}
+
+	err = iter.ForEach(func(obj plumbing.EncodedObject) error {
+		_, err := dst.SetEncodedObject(obj)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range refs {
+		if err := dst.SetReference(ref); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isRootCommit returns true if none of the parents of the commit are in the
+// storer, which is also the case of the shallow commits of shallow clones.
+func isRootCommit(s storer.EncodedObjectStorer, c *object.Commit) bool {
+	for _, h := range c.ParentHashes {
+		if _, err := s.EncodedObject(plumbing.CommitObject, h); err == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func unpackReferences(rooted storer.ReferenceStorer, id string) ([]*plumbing.Reference, error) {
+	iter, err := rooted.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+
+		name, refID, ok := RootedReferenceName(ref.Name())
+		if !ok {
+			return nil
+		}
+
+		if id == "" {
+			name = plumbing.ReferenceName("refs/remotes/" + refID + "/" +
+				strings.TrimPrefix(strings.TrimPrefix(name.String(), "refs/"), "heads/"))
+		} else if refID != id {
+			return nil
+		}
+
+		refs = append(refs, plumbing.NewHashReference(name, ref.Hash()))
+		return nil
+	})
+
+	return refs, err
+}
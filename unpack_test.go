@@ -0,0 +1,105 @@
+package borges
+
+import (
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestRootedReferenceName(t *testing.T) {
+	require := require.New(t)
+
+	id := uuid.NewV4().String()
+	name, refID, ok := RootedReferenceName(plumbing.ReferenceName("refs/heads/master/" + id))
+	require.True(ok)
+	require.Equal(plumbing.ReferenceName("refs/heads/master"), name)
+	require.Equal(id, refID)
+
+	_, _, ok = RootedReferenceName(plumbing.ReferenceName("refs/heads/master"))
+	require.False(ok)
+}
+
+func TestUnpack(t *testing.T) {
+	require := require.New(t)
+
+	rooted := memory.NewStorage()
+	root := testCommit(t, rooted)
+	child := testCommit(t, rooted, root)
+
+	id1, id2 := uuid.NewV4().String(), uuid.NewV4().String()
+	for name, h := range map[string]plumbing.Hash{
+		"refs/heads/master/" + id1: child,
+		"refs/tags/v1/" + id2:      root,
+		"refs/heads/foo":           child,
+	} {
+		ref := plumbing.NewHashReference(plumbing.ReferenceName(name), h)
+		require.NoError(rooted.SetReference(ref))
+	}
+
+	dst := memory.NewStorage()
+	require.NoError(Unpack(rooted, root, dst, id1))
+	require.Equal(map[string]plumbing.Hash{
+		"refs/heads/master": child,
+	}, testReferences(t, dst))
+	_, err := object.GetCommit(dst, child)
+	require.NoError(err)
+
+	dst = memory.NewStorage()
+	require.NoError(Unpack(rooted, root, dst, ""))
+	require.Equal(map[string]plumbing.Hash{
+		"refs/remotes/" + id1 + "/master":  child,
+		"refs/remotes/" + id2 + "/tags/v1": root,
+	}, testReferences(t, dst))
+
+	err = Unpack(rooted, child, memory.NewStorage(), "")
+	require.True(ErrInitNotFound.Is(err))
+
+	err = Unpack(rooted, plumbing.NewHash("f7b877701fbf855b44c0a9e86f3fdce2c298b07f"), memory.NewStorage(), "")
+	require.True(ErrInitNotFound.Is(err))
+
+	err = Unpack(rooted, root, memory.NewStorage(), uuid.NewV4().String())
+	require.True(ErrRepositoryNotInRoots.Is(err))
+}
+
+func testCommit(t *testing.T, s storage.Storer, parents ...plumbing.Hash) plumbing.Hash {
+	require := require.New(t)
+
+	tree := s.NewEncodedObject()
+	require.NoError((&object.Tree{}).Encode(tree))
+	treeHash, err := s.SetEncodedObject(tree)
+	require.NoError(err)
+
+	sig := object.Signature{Name: "foo", Email: "foo@bar.com", When: time.Now()}
+	c := &object.Commit{
+		Author:       sig,
+		Committer:    sig,
+		Message:      "foo",
+		TreeHash:     treeHash,
+		ParentHashes: parents,
+	}
+
+	obj := s.NewEncodedObject()
+	require.NoError(c.Encode(obj))
+	h, err := s.SetEncodedObject(obj)
+	require.NoError(err)
+	return h
+}
+
+func testReferences(t *testing.T, s storage.Storer) map[string]plumbing.Hash {
+	iter, err := s.IterReferences()
+	require.NoError(t, err)
+
+	refs := make(map[string]plumbing.Hash)
+	require.NoError(t, iter.ForEach(func(ref *plumbing.Reference) error {
+		refs[ref.Name().String()] = ref.Hash()
+		return nil
+	}))
+
+	return refs
+}
@@ -0,0 +1,166 @@
+package borges
+
+import (
+	"io/ioutil"
+	"sort"
+
+	"gopkg.in/src-d/go-errors.v0"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage"
+)
+
+var (
+	ErrObjectHashMismatch = errors.NewKind("object %s content does not match its hash, got %s")
+	ErrMissingObject      = errors.NewKind("object %s referenced by %s is missing")
+)
+
+// RootedRepositoryReport is the result of validating a rooted repository.
+type RootedRepositoryReport struct {
+	// Objects is the number of objects stored in the rooted repository.
+	Objects int
+	// References is the number of references of each repository stored in
+	// the rooted repository, by repository ID.
+	References map[string]int
+}
+
+// RepositoryIDs returns the sorted IDs of the repositories stored in the
+// rooted repository.
+func (r *RootedRepositoryReport) RepositoryIDs() []string {
+	ids := make([]string, 0, len(r.References))
+	for id := range r.References {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+// ValidateOptions are the options of ValidateRootedRepository. The zero value
+// requires every object reachable from the references to be present.
+type ValidateOptions struct {
+	// AllowMissingBlobs makes the blobs missing from the rooted repository
+	// valid, as are the ones left out by CloneOptions.MaxBlobSize.
+	AllowMissingBlobs bool
+}
+
+// ValidateRootedRepository checks that the content of every object of the
+// rooted repository matches its hash, and that all the objects reachable from
+// its references are present, according to the given options. Missing parents
+// of commits are allowed, since they are the boundary of shallow clones.
+func ValidateRootedRepository(s storage.Storer, opts ValidateOptions) (*RootedRepositoryReport, error) {
+	report := &RootedRepositoryReport{References: make(map[string]int)}
+
+	iter, err := s.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		return nil, err
+	}
+
+	err = iter.ForEach(func(obj plumbing.EncodedObject) error {
+		report.Objects++
+		return checkObjectHash(obj)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := s.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[plumbing.Hash]bool)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+
+		if _, id, ok := RootedReferenceName(ref.Name()); ok {
+			report.References[id]++
+		}
+
+		return checkReachableObjects(s, ref, seen, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func checkObjectHash(obj plumbing.EncodedObject) error {
+	r, err := obj.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if h := plumbing.ComputeHash(obj.Type(), content); h != obj.Hash() {
+		return ErrObjectHashMismatch.New(obj.Hash(), h)
+	}
+
+	return nil
+}
+
+func checkReachableObjects(s storage.Storer, ref *plumbing.Reference,
+	seen map[plumbing.Hash]bool, opts ValidateOptions) error {
+
+	type pendingObject struct {
+		hash, from   plumbing.Hash
+		parent, blob bool
+	}
+
+	pending := []pendingObject{{hash: ref.Hash()}}
+	for len(pending) > 0 {
+		p := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if seen[p.hash] {
+			continue
+		}
+
+		o, err := object.GetObject(s, p.hash)
+		if err == plumbing.ErrObjectNotFound {
+			if p.parent || p.blob && opts.AllowMissingBlobs {
+				continue
+			}
+
+			from := ref.Name().String()
+			if !p.from.IsZero() {
+				from = p.from.String()
+			}
+
+			return ErrMissingObject.New(p.hash, from)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		seen[p.hash] = true
+		switch o := o.(type) {
+		case *object.Commit:
+			for _, h := range o.ParentHashes {
+				pending = append(pending, pendingObject{h, p.hash, true, false})
+			}
+
+			pending = append(pending, pendingObject{o.TreeHash, p.hash, false, false})
+		case *object.Tag:
+			pending = append(pending, pendingObject{o.Target, p.hash, false, false})
+		case *object.Tree:
+			for _, e := range o.Entries {
+				if e.Mode != filemode.Submodule {
+					blob := e.Mode != filemode.Dir
+					pending = append(pending, pendingObject{e.Hash, p.hash, false, blob})
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package borges
+
+import (
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestValidateRootedRepository(t *testing.T) {
+	require := require.New(t)
+
+	s := memory.NewStorage()
+	root := testCommit(t, s)
+	child := testCommit(t, s, root)
+
+	id := uuid.NewV4().String()
+	for name, h := range map[string]plumbing.Hash{
+		"refs/heads/master/" + id: child,
+		"refs/heads/foo/" + id:    root,
+	} {
+		ref := plumbing.NewHashReference(plumbing.ReferenceName(name), h)
+		require.NoError(s.SetReference(ref))
+	}
+
+	report, err := ValidateRootedRepository(s, ValidateOptions{})
+	require.NoError(err)
+	require.Equal(3, report.Objects)
+	require.Equal([]string{id}, report.RepositoryIDs())
+	require.Equal(2, report.References[id])
+}
+
+func TestValidateRootedRepository_MissingObject(t *testing.T) {
+	require := require.New(t)
+
+	s := memory.NewStorage()
+	root := testCommit(t, s)
+	ref := plumbing.NewHashReference("refs/heads/master/"+plumbing.ReferenceName(uuid.NewV4().String()), root)
+	require.NoError(s.SetReference(ref))
+
+	// the tree of the commit is removed
+	c, err := s.EncodedObject(plumbing.CommitObject, root)
+	require.NoError(err)
+	s = memory.NewStorage()
+	_, err = s.SetEncodedObject(c)
+	require.NoError(err)
+	require.NoError(s.SetReference(ref))
+
+	_, err = ValidateRootedRepository(s, ValidateOptions{})
+	require.True(ErrMissingObject.Is(err))
+	_, err = ValidateRootedRepository(s, ValidateOptions{AllowMissingBlobs: true})
+	require.True(ErrMissingObject.Is(err))
+}
+
+func TestValidateRootedRepository_MissingBlob(t *testing.T) {
+	require := require.New(t)
+
+	s := memory.NewStorage()
+	blob := plumbing.NewHash("e69de29bb2d1d6434b8b29ae775ad8c2e48c5391")
+	tree := &object.Tree{Entries: []object.TreeEntry{
+		{Name: "big", Mode: filemode.Regular, Hash: blob},
+	}}
+	obj := s.NewEncodedObject()
+	require.NoError(tree.Encode(obj))
+	treeHash, err := s.SetEncodedObject(obj)
+	require.NoError(err)
+
+	sig := object.Signature{Name: "foo", Email: "foo@bar.com", When: time.Now()}
+	obj = s.NewEncodedObject()
+	require.NoError((&object.Commit{
+		Author:    sig,
+		Committer: sig,
+		Message:   "foo",
+		TreeHash:  treeHash,
+	}).Encode(obj))
+	commit, err := s.SetEncodedObject(obj)
+	require.NoError(err)
+	ref := plumbing.NewHashReference("refs/heads/master/"+plumbing.ReferenceName(uuid.NewV4().String()), commit)
+	require.NoError(s.SetReference(ref))
+
+	_, err = ValidateRootedRepository(s, ValidateOptions{})
+	require.True(ErrMissingObject.Is(err))
+	_, err = ValidateRootedRepository(s, ValidateOptions{AllowMissingBlobs: true})
+	require.NoError(err)
+}
+
+func TestValidateRootedRepository_HashMismatch(t *testing.T) {
+	require := require.New(t)
+
+	s := memory.NewStorage()
+	obj := &plumbing.MemoryObject{}
+	obj.SetType(plumbing.BlobObject)
+	_, err := obj.Write([]byte("foo"))
+	require.NoError(err)
+	obj.Hash()
+
+	// the hash is not computed again on write
+	_, err = obj.Write([]byte("bar"))
+	require.NoError(err)
+	_, err = s.SetEncodedObject(obj)
+	require.NoError(err)
+
+	_, err = ValidateRootedRepository(s, ValidateOptions{})
+	require.True(ErrObjectHashMismatch.Is(err))
+}
@@ -0,0 +1,127 @@
+package borges
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-errors.v0"
+)
+
+var (
+	ErrUploadCorrupted = errors.NewKind("file %s was corrupted while writing it: %s")
+)
+
+// NewVerifiedFilesystem returns a billy.Filesystem that verifies the files
+// written to it. Files created or truncated are written to a temporary file
+// next to them, and when they are closed the size and the SHA-1 of the
+// temporary file are checked against the bytes written. If they match, the
+// temporary file is renamed to the actual one, otherwise it is removed and
+// Close fails with ErrUploadCorrupted, leaving the previous version of the
+// file untouched.
+//
+// Used as the filesystem of a siva RootedTransactioner, it makes the commits
+// of transactions fail if the rooted repository did not arrive intact.
+func NewVerifiedFilesystem(fs billy.Filesystem) billy.Filesystem {
+	return &verifiedFilesystem{Filesystem: fs}
+}
+
+type verifiedFilesystem struct {
+	billy.Filesystem
+}
+
+func (fs *verifiedFilesystem) Create(filename string) (billy.File, error) {
+	return fs.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *verifiedFilesystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&os.O_TRUNC == 0 || flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return fs.Filesystem.OpenFile(filename, flag, perm)
+	}
+
+	tmp := fmt.Sprintf("%s.%d.tmp", filename, time.Now().UnixNano())
+	f, err := fs.Filesystem.OpenFile(tmp, flag|os.O_CREATE, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &verifiedFile{
+		File: f,
+		fs:   fs.Filesystem,
+		name: filename,
+		tmp:  tmp,
+		hash: sha1.New(),
+	}, nil
+}
+
+// verifiedFile is a file written to a temporary file that is verified on
+// Close. Only sequential writes are supported.
+type verifiedFile struct {
+	billy.File
+	fs   billy.Filesystem
+	name string
+	tmp  string
+	hash hash.Hash
+	size int64
+}
+
+// Name returns the name of the actual file, not the temporary one.
+func (f *verifiedFile) Name() string {
+	return f.name
+}
+
+func (f *verifiedFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	f.hash.Write(p[:n])
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *verifiedFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		_ = f.fs.Remove(f.tmp)
+		return err
+	}
+
+	if err := f.verify(); err != nil {
+		_ = f.fs.Remove(f.tmp)
+		return err
+	}
+
+	return f.fs.Rename(f.tmp, f.name)
+}
+
+// verify checks the size and the hash of the temporary file.
+func (f *verifiedFile) verify() error {
+	fi, err := f.fs.Stat(f.tmp)
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() != f.size {
+		return ErrUploadCorrupted.New(f.name,
+			fmt.Sprintf("%d bytes written, %d bytes stored", f.size, fi.Size()))
+	}
+
+	r, err := f.fs.Open(f.tmp)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(h.Sum(nil), f.hash.Sum(nil)) {
+		return ErrUploadCorrupted.New(f.name, "checksum mismatch")
+	}
+
+	return nil
+}
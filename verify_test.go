@@ -0,0 +1,76 @@
+package borges
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v3"
+	"gopkg.in/src-d/go-billy.v3/memfs"
+	"gopkg.in/src-d/go-billy.v3/util"
+)
+
+func TestVerifiedFilesystem(t *testing.T) {
+	require := require.New(t)
+
+	fs := memfs.New()
+	vfs := NewVerifiedFilesystem(fs)
+
+	require.NoError(util.WriteFile(vfs, "foo.siva", []byte("foo"), 0644))
+	require.NoError(util.WriteFile(vfs, "foo.siva", []byte("bar"), 0644))
+	requireFileContent(t, fs, "foo.siva", "bar")
+
+	fis, err := fs.ReadDir(".")
+	require.NoError(err)
+	require.Len(fis, 1)
+}
+
+func TestVerifiedFilesystem_Corrupted(t *testing.T) {
+	require := require.New(t)
+
+	fs := memfs.New()
+	require.NoError(util.WriteFile(fs, "foo.siva", []byte("foo"), 0644))
+
+	vfs := NewVerifiedFilesystem(&corruptingFilesystem{fs})
+	err := util.WriteFile(vfs, "foo.siva", []byte("bar"), 0644)
+	require.True(ErrUploadCorrupted.Is(err))
+	requireFileContent(t, fs, "foo.siva", "foo")
+
+	fis, err := fs.ReadDir(".")
+	require.NoError(err)
+	require.Len(fis, 1)
+}
+
+func requireFileContent(t *testing.T, fs billy.Filesystem, name, expected string) {
+	f, err := fs.Open(name)
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, expected, string(content))
+}
+
+// corruptingFilesystem is a filesystem that flips the first byte of every
+// write to the files opened with OpenFile.
+type corruptingFilesystem struct {
+	billy.Filesystem
+}
+
+func (fs *corruptingFilesystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := fs.Filesystem.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &corruptingFile{f}, nil
+}
+
+type corruptingFile struct {
+	billy.File
+}
+
+func (f *corruptingFile) Write(p []byte) (int, error) {
+	corrupted := append([]byte{^p[0]}, p[1:]...)
+	return f.File.Write(corrupted)
+}
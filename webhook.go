@@ -0,0 +1,353 @@
+package borges
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-errors.v0"
+)
+
+var (
+	ErrWebhookQueueFull = errors.NewKind("webhook queue full, result of job %s dropped")
+	ErrWebhookClosed    = errors.NewKind("webhook notifier closed, result of job %s dropped")
+	ErrWebhookStatus    = errors.NewKind("webhook %s responded with status %d")
+)
+
+const (
+	// DefaultWebhookQueueSize is the number of job results waiting to be
+	// posted to the webhook if none is given.
+	DefaultWebhookQueueSize = 1000
+	// DefaultWebhookTimeout is the time each post to the webhook can take
+	// if none is given.
+	DefaultWebhookTimeout = 10 * time.Second
+	// DefaultWebhookRetryBackoff is the base of the backoff between the
+	// retries of a post to the webhook if none is given.
+	DefaultWebhookRetryBackoff = time.Second
+)
+
+const (
+	// JobSucceeded is the status of the JobResult of a job that was
+	// processed successfully.
+	JobSucceeded = "succeeded"
+	// JobFailed is the status of the JobResult of a job that failed.
+	JobFailed = "failed"
+)
+
+// JobResult is the payload posted as JSON to the webhook of a WebhookNotifier
+// when a job finishes.
+type JobResult struct {
+	// RepositoryID is the ID of the repository of the job.
+	RepositoryID string `json:"repository_id"`
+	// Status is JobSucceeded or JobFailed.
+	Status string `json:"status"`
+	// Error is the message of the error that made the job fail, if any.
+	Error string `json:"error,omitempty"`
+	// Endpoints are the endpoints fetched by the job, in order.
+	Endpoints []string `json:"endpoints,omitempty"`
+	// Duration is the time the job took, in seconds.
+	Duration float64 `json:"duration"`
+	// Phases is the time spent in each phase of the job, in seconds, added
+	// up for all the repositories of the job.
+	Phases map[Phase]float64 `json:"phases,omitempty"`
+	// Repositories are the ones of the job archived or found gone, which
+	// include the forks archived along with the repository, if any.
+	Repositories []*RepositoryResult `json:"repositories,omitempty"`
+}
+
+// RepositoryResult is the result of a repository of a job archived or found
+// gone, see JobResult.
+type RepositoryResult struct {
+	// ID is the ID of the repository.
+	ID string `json:"id"`
+	// Endpoints are the endpoints of the repository.
+	Endpoints []string `json:"endpoints"`
+	// Status is the fetch status of the repository.
+	Status model.FetchStatus `json:"status"`
+	// Stats are the ArchiveStats of the repository, if it was archived and
+	// they could be computed.
+	Stats *ArchiveStats `json:"stats,omitempty"`
+}
+
+// WebhookOptions are the options of a WebhookNotifier. The zero value is
+// posting every result once, with the default queue size and timeout.
+type WebhookOptions struct {
+	// QueueSize is the maximum number of results waiting to be posted.
+	// The results of the jobs finishing while the queue is full are
+	// dropped, so a slow webhook never delays the jobs. Zero means
+	// DefaultWebhookQueueSize.
+	QueueSize int
+	// Retries is the number of times a post is retried if it fails with a
+	// network error or a 5xx or 429 status.
+	Retries int
+	// RetryBackoff is the base of the exponential backoff between the
+	// retries. Zero means DefaultWebhookRetryBackoff.
+	RetryBackoff time.Duration
+	// Timeout is the maximum time each post can take. Zero means
+	// DefaultWebhookTimeout.
+	Timeout time.Duration
+}
+
+// WebhookNotifier posts a JobResult to a webhook every time a job finishes.
+// Its methods have the signatures of the Notifiers of the WorkerPool, so they
+// can be set as them, or called from them, and collect the result of each job
+// from the moment it starts. The results are posted in the background, one
+// after the other. Its methods can be called on a nil WebhookNotifier, which
+// does nothing.
+type WebhookNotifier struct {
+	// Notifiers, if set, are called from the workers and the goroutine
+	// posting the results, so they must be safe for concurrent use. They
+	// must be set before any job finishes.
+	Notifiers struct {
+		// Error function, if set, is called with every result that
+		// could not be posted, after retrying it, or was dropped
+		// because the queue was full or the notifier was closed, and
+		// the error.
+		Error func(*JobResult, error)
+	}
+
+	url    string
+	opts   WebhookOptions
+	client *http.Client
+
+	m       sync.Mutex
+	running map[int]*runningJob
+	closed  bool
+
+	queue chan *JobResult
+	done  chan struct{}
+}
+
+// runningJob is the result of a job being processed by a worker.
+type runningJob struct {
+	result *JobResult
+	start  time.Time
+}
+
+// NewWebhookNotifier returns a WebhookNotifier posting the results to the
+// given URL, which must be closed to post the results still in its queue.
+func NewWebhookNotifier(url string, opts WebhookOptions) *WebhookNotifier {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultWebhookQueueSize
+	}
+
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = DefaultWebhookRetryBackoff
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultWebhookTimeout
+	}
+
+	n := &WebhookNotifier{
+		url:     url,
+		opts:    opts,
+		client:  &http.Client{Timeout: opts.Timeout},
+		running: make(map[int]*runningJob),
+		queue:   make(chan *JobResult, opts.QueueSize),
+		done:    make(chan struct{}),
+	}
+
+	go n.run()
+	return n
+}
+
+// Start starts collecting the result of the job processed by the worker.
+func (n *WebhookNotifier) Start(ctx *WorkerContext, j *Job) {
+	if n == nil {
+		return
+	}
+
+	n.m.Lock()
+	n.running[ctx.ID] = &runningJob{
+		result: &JobResult{RepositoryID: j.RepositoryID.String()},
+		start:  time.Now(),
+	}
+	n.m.Unlock()
+}
+
+// PhaseStart records the endpoint fetched by the job.
+func (n *WebhookNotifier) PhaseStart(ctx *WorkerContext, j *Job, p Phase, endpoint string) {
+	if p != FetchPhase || endpoint == "" {
+		return
+	}
+
+	n.update(ctx, func(r *JobResult) {
+		r.Endpoints = append(r.Endpoints, endpoint)
+	})
+}
+
+// PhaseDone records the time spent in the phase of the job.
+func (n *WebhookNotifier) PhaseDone(ctx *WorkerContext, j *Job, p Phase, d time.Duration) {
+	n.update(ctx, func(r *JobResult) {
+		if r.Phases == nil {
+			r.Phases = make(map[Phase]float64)
+		}
+
+		r.Phases[p] += d.Seconds()
+	})
+}
+
+// Gone records the repository of the job found gone.
+func (n *WebhookNotifier) Gone(ctx *WorkerContext, j *Job, r *model.Repository) {
+	n.update(ctx, func(jr *JobResult) {
+		jr.Repositories = append(jr.Repositories, &RepositoryResult{
+			ID:        uuid.UUID(r.ID).String(),
+			Endpoints: r.Endpoints,
+			Status:    Gone,
+		})
+	})
+}
+
+// Done records the repository of the job archived and its stats.
+func (n *WebhookNotifier) Done(ctx *WorkerContext, j *Job, r *model.Repository, s *ArchiveStats) {
+	n.update(ctx, func(jr *JobResult) {
+		jr.Repositories = append(jr.Repositories, &RepositoryResult{
+			ID:        uuid.UUID(r.ID).String(),
+			Endpoints: r.Endpoints,
+			Status:    r.Status,
+			Stats:     s,
+		})
+	})
+}
+
+// Stop finishes the result of the job with its error, if any, and queues it
+// to be posted. If the queue is full, or the notifier is closed, the result
+// is dropped.
+func (n *WebhookNotifier) Stop(ctx *WorkerContext, j *Job, err error) {
+	if n == nil {
+		return
+	}
+
+	n.m.Lock()
+	rj, ok := n.running[ctx.ID]
+	delete(n.running, ctx.ID)
+	if !ok {
+		rj = &runningJob{result: &JobResult{RepositoryID: j.RepositoryID.String()}, start: time.Now()}
+	}
+
+	r := rj.result
+	r.Duration = time.Since(rj.start).Seconds()
+	r.Status = JobSucceeded
+	if err != nil {
+		r.Status, r.Error = JobFailed, err.Error()
+	}
+
+	dropErr := n.enqueue(r)
+	n.m.Unlock()
+
+	if dropErr != nil {
+		n.notifyError(r, dropErr)
+	}
+}
+
+// enqueue queues the result without blocking. It must be called with the
+// lock held, so the queue is not closed meanwhile.
+func (n *WebhookNotifier) enqueue(r *JobResult) error {
+	if n.closed {
+		return ErrWebhookClosed.New(r.RepositoryID)
+	}
+
+	select {
+	case n.queue <- r:
+		return nil
+	default:
+		return ErrWebhookQueueFull.New(r.RepositoryID)
+	}
+}
+
+// Close stops queueing results and waits until the ones in the queue are
+// posted.
+func (n *WebhookNotifier) Close() error {
+	if n == nil {
+		return nil
+	}
+
+	n.m.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.m.Unlock()
+
+	<-n.done
+	return nil
+}
+
+// update calls fn with the result of the job processed by the worker, if it
+// was started.
+func (n *WebhookNotifier) update(ctx *WorkerContext, fn func(*JobResult)) {
+	if n == nil {
+		return
+	}
+
+	n.m.Lock()
+	defer n.m.Unlock()
+	if rj, ok := n.running[ctx.ID]; ok {
+		fn(rj.result)
+	}
+}
+
+func (n *WebhookNotifier) run() {
+	defer close(n.done)
+	for r := range n.queue {
+		if err := n.post(r); err != nil {
+			n.notifyError(r, err)
+		}
+	}
+}
+
+// post posts the result, retrying it with backoff as many times as set in the
+// options if it fails with a transient error.
+func (n *WebhookNotifier) post(r *JobResult) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		retry, err := n.postOnce(body)
+		if err == nil || !retry || attempt > n.opts.Retries {
+			return err
+		}
+
+		time.Sleep(retryBackoff(n.opts.RetryBackoff, attempt))
+	}
+}
+
+// postOnce posts the body to the webhook. It returns whether the post can be
+// retried if it failed.
+func (n *WebhookNotifier) postOnce(body []byte) (bool, error) {
+	res, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+
+	// the body is read so the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	if err := res.Body.Close(); err != nil {
+		return true, err
+	}
+
+	code := res.StatusCode
+	if code >= 200 && code < 300 {
+		return false, nil
+	}
+
+	return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests,
+		ErrWebhookStatus.New(n.url, code)
+}
+
+func (n *WebhookNotifier) notifyError(r *JobResult, err error) {
+	if n.Notifiers.Error == nil {
+		return
+	}
+
+	n.Notifiers.Error(r, err)
+}
@@ -0,0 +1,134 @@
+package borges
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	require := require.New(t)
+
+	var (
+		m        sync.Mutex
+		requests int
+		results  []*JobResult
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		requests++
+		var res JobResult
+		require.NoError(json.NewDecoder(r.Body).Decode(&res))
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		results = append(results, &res)
+	}))
+	defer srv.Close()
+
+	n := NewWebhookNotifier(srv.URL, WebhookOptions{Retries: 1, RetryBackoff: time.Millisecond})
+	n.Notifiers.Error = func(r *JobResult, err error) {
+		require.FailNow("result not posted", "%v", err)
+	}
+
+	ctx := &WorkerContext{ID: 1}
+	repo := model.NewRepository()
+	repo.Endpoints = []string{"https://example.com/foo"}
+	repo.Status = model.FetchStatus(model.Fetched)
+	j := &Job{RepositoryID: uuid.UUID(repo.ID)}
+	n.Start(ctx, j)
+	n.PhaseStart(ctx, j, FetchPhase, repo.Endpoints[0])
+	n.PhaseDone(ctx, j, FetchPhase, time.Second)
+	n.PhaseStart(ctx, j, PackPhase, "")
+	n.PhaseDone(ctx, j, PackPhase, 2*time.Second)
+	n.Done(ctx, j, repo, &ArchiveStats{References: 1})
+	n.Stop(ctx, j, nil)
+
+	failed := &Job{RepositoryID: uuid.NewV4()}
+	n.Start(ctx, failed)
+	n.Stop(ctx, failed, errors.New("foo"))
+	require.NoError(n.Close())
+
+	m.Lock()
+	defer m.Unlock()
+	require.Equal(3, requests)
+	require.Len(results, 2)
+
+	r := results[0]
+	require.Equal(j.RepositoryID.String(), r.RepositoryID)
+	require.Equal(JobSucceeded, r.Status)
+	require.Empty(r.Error)
+	require.Equal(repo.Endpoints, r.Endpoints)
+	require.Equal(map[Phase]float64{FetchPhase: 1, PackPhase: 2}, r.Phases)
+	require.Len(r.Repositories, 1)
+	require.Equal(uuid.UUID(repo.ID).String(), r.Repositories[0].ID)
+	require.Equal(repo.Status, r.Repositories[0].Status)
+	require.Equal(1, r.Repositories[0].Stats.References)
+
+	r = results[1]
+	require.Equal(failed.RepositoryID.String(), r.RepositoryID)
+	require.Equal(JobFailed, r.Status)
+	require.Equal("foo", r.Error)
+	require.Empty(r.Repositories)
+}
+
+func TestWebhookNotifier_QueueFull(t *testing.T) {
+	require := require.New(t)
+
+	received := make(chan struct{}, 3)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+	}))
+	defer srv.Close()
+
+	n := NewWebhookNotifier(srv.URL, WebhookOptions{QueueSize: 1})
+	var dropped []string
+	n.Notifiers.Error = func(r *JobResult, err error) {
+		require.True(ErrWebhookQueueFull.Is(err), "%v", err)
+		dropped = append(dropped, r.RepositoryID)
+	}
+
+	ctx := &WorkerContext{ID: 1}
+	jobs := []*Job{
+		{RepositoryID: uuid.NewV4()},
+		{RepositoryID: uuid.NewV4()},
+		{RepositoryID: uuid.NewV4()},
+	}
+
+	// the first result is being posted and the second one fills the queue
+	n.Stop(ctx, jobs[0], nil)
+	<-received
+	n.Stop(ctx, jobs[1], nil)
+	n.Stop(ctx, jobs[2], nil)
+	require.Equal([]string{jobs[2].RepositoryID.String()}, dropped)
+
+	close(release)
+	require.NoError(n.Close())
+	require.Len(received, 1)
+}
+
+func TestWebhookNotifier_Nil(t *testing.T) {
+	var n *WebhookNotifier
+	ctx := &WorkerContext{ID: 1}
+	j := &Job{RepositoryID: uuid.NewV4()}
+	n.Start(ctx, j)
+	n.PhaseStart(ctx, j, FetchPhase, "https://example.com/foo")
+	n.PhaseDone(ctx, j, FetchPhase, time.Second)
+	n.Gone(ctx, j, model.NewRepository())
+	n.Done(ctx, j, model.NewRepository(), nil)
+	n.Stop(ctx, j, nil)
+	require.NoError(t, n.Close())
+}
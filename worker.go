@@ -1,12 +1,60 @@
 package borges
 
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	"gopkg.in/src-d/go-errors.v0"
+)
+
+// ErrJobPanic is the error of the jobs whose processing panicked, recovered by
+// the workers of a pool with RecoverPanics.
+var ErrJobPanic = errors.NewKind("panic processing job: %v")
+
+// preflightBackoff is the time a worker waits after requeueing a job that
+// failed the preflight check, so it does not take it again right away.
+const preflightBackoff = 5 * time.Second
+
+// backpressureBackoff is the time a paused worker waits before checking the
+// backpressure again.
+const backpressureBackoff = time.Second
+
 // Worker is a worker that processes jobs from a channel.
 type Worker struct {
-	ctx        *WorkerContext
-	do         func(*WorkerContext, *Job) error
+	ctx       *WorkerContext
+	do        func(*WorkerContext, *Job) error
+	preflight func(*Job) error
+	// backpressure returns true while the worker must not take new jobs.
+	backpressure func() bool
+	// stats are the statistics of the pool of the worker, if any.
+	stats *workerPoolStats
+	// statuses are where the worker publishes its status, if it is in a
+	// pool.
+	statuses *workerStatuses
+	// rateLimitBackoff is the delay of the rate limited jobs whose remote
+	// did not say how long to wait.
+	rateLimitBackoff time.Duration
+	// recoverPanics makes the worker fail the jobs whose processing
+	// panics instead of crashing.
+	recoverPanics bool
+	// singleFlight returns the key of the jobs collapsed in flights, the
+	// group shared by the workers of the pool, if any, see
+	// WorkerPool.SingleFlight.
+	singleFlight func(*Job) string
+	flights      *singleflight.Group
+	// affinity is the channel of the jobs dispatched to this worker by the
+	// affinity of its pool, if any, see WorkerPool.Affinity.
+	affinity   chan *WorkerJob
 	jobChannel chan *WorkerJob
 	quit       chan struct{}
 	running    bool
+
+	// km guards busy and key, the affinity key of the job being processed.
+	km   sync.Mutex
+	busy bool
+	key  string
 }
 
 // NewWorker creates a new Worker. The first parameter is a WorkerContext that
@@ -23,7 +71,10 @@ func NewWorker(ctx *WorkerContext, do func(*WorkerContext, *Job) error, ch chan
 }
 
 // Start processes jobs from the input channel until it is stopped. Start blocks
-// until the worker is stopped or the channel is closed.
+// until the worker is stopped or the channel is closed. A job is only
+// acknowledged once the processing function succeeds, which for the archiver
+// is after every rooted repository of the job has been committed, so a job
+// is delivered again if the process dies while processing it.
 func (w *Worker) Start() {
 	log := log.New("module", "worker", "id", w.ctx.ID)
 
@@ -32,29 +83,216 @@ func (w *Worker) Start() {
 
 	log.Debug("starting")
 	for {
+		w.setJob(nil)
+		if w.checkBackpressure() {
+			select {
+			case <-time.After(backpressureBackoff):
+			case <-w.quit:
+				return
+			}
+
+			continue
+		}
+
+		var job *WorkerJob
 		select {
-		case job, ok := <-w.jobChannel:
+		case j, ok := <-w.jobChannel:
 			if !ok {
 				return
 			}
 
-			if err := w.do(w.ctx, job.Job); err != nil {
-				if err := job.Reject(false); err != nil {
-					log.Error("error rejecting job", "err", err)
+			job = j
+		case job = <-w.affinity:
+		case <-w.quit:
+			return
+		}
+
+		w.setJob(job)
+		if err := w.checkPreflight(job.Job); err != nil {
+			log.Warn("preflight check failed, requeueing job",
+				"RepositoryID", job.Job.RepositoryID, "err", err)
+			w.stats.requeue(false)
+			if err := job.Reject(true); err != nil {
+				log.Error("error requeueing job", "RepositoryID", job.Job.RepositoryID, "err", err)
+			}
+
+			select {
+			case <-time.After(preflightBackoff):
+			case <-w.quit:
+				return
+			}
+
+			continue
+		}
+
+		w.stats.start()
+		w.statuses.start(w, job.Job)
+		start := time.Now()
+		err := w.process(job.Job)
+		w.statuses.stop(w)
+		if ErrHostBusy.Is(err) {
+			w.stats.requeue(true)
+		} else {
+			w.stats.stop(time.Since(start), err)
+		}
+
+		if err != nil {
+			if ErrHostBusy.Is(err) {
+				log.Debug("host busy, requeueing job",
+					"RepositoryID", job.Job.RepositoryID, "err", err)
+				if err := job.Reject(true); err != nil {
+					log.Error("error requeueing job", "RepositoryID", job.Job.RepositoryID, "err", err)
 				}
 
-				log.Error("error on job", "err", err)
+				select {
+				case <-time.After(hostBusyBackoff):
+				case <-w.quit:
+					return
+				}
 
 				continue
 			}
 
-			if err := job.Ack(); err != nil {
-				log.Error("error ack'ing job", "err", err)
+			if err := w.reject(job, err); err != nil {
+				log.Error("error rejecting job", "RepositoryID", job.Job.RepositoryID, "err", err)
 			}
-		case <-w.quit:
-			return
+
+			log.Error("error on job", "RepositoryID", job.Job.RepositoryID, "err", err)
+
+			continue
+		}
+
+		if err := job.Ack(); err != nil {
+			log.Error("error ack'ing job", "RepositoryID", job.Job.RepositoryID, "err", err)
+		}
+	}
+}
+
+// setJob records the job the worker is handling, nil if it is idle.
+func (w *Worker) setJob(j *WorkerJob) {
+	w.km.Lock()
+	defer w.km.Unlock()
+
+	w.busy = j != nil
+	w.key = ""
+	if j != nil {
+		w.key = j.key
+	}
+}
+
+// accepts returns whether a job with the given affinity key can be dispatched
+// to the worker: while it is idle or handling a job with the same key.
+func (w *Worker) accepts(key string) bool {
+	w.km.Lock()
+	defer w.km.Unlock()
+
+	return !w.busy || w.key == key
+}
+
+// process calls the processing function with the job. If the worker recovers
+// panics, a panic while processing it is logged along with its stack and
+// returned as an ErrJobPanic, so the job fails like any other does. The
+// processing function must clean up after itself when panicking, as the
+// archiver does.
+func (w *Worker) process(j *Job) (err error) {
+	if w.recoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Error("panic processing job, recovered", "module", "worker", "id", w.ctx.ID,
+					"RepositoryID", j.RepositoryID, "panic", r, "stack", string(debug.Stack()))
+				w.stats.panicked()
+				err = ErrJobPanic.New(r)
+			}
+		}()
+	}
+
+	return w.doOnce(j)
+}
+
+// doOnce calls the processing function with the job, unless the worker has a
+// single flight and another worker is processing a job with the same key, in
+// which case it waits for it and returns its error.
+func (w *Worker) doOnce(j *Job) error {
+	if w.singleFlight == nil {
+		return w.do(w.ctx, j)
+	}
+
+	var processed bool
+	key := w.singleFlight(j)
+	_, err, _ := w.flights.Do(key, func() (interface{}, error) {
+		processed = true
+		return nil, w.do(w.ctx, j)
+	})
+
+	if !processed {
+		log.Debug("job collapsed into the one in flight with the same key",
+			"module", "worker", "id", w.ctx.ID, "RepositoryID", j.RepositoryID,
+			"key", key, "err", err)
+		w.stats.collapse()
+	}
+
+	return err
+}
+
+func (w *Worker) checkPreflight(j *Job) error {
+	if w.preflight == nil {
+		return nil
+	}
+
+	return w.preflight(j)
+}
+
+func (w *Worker) checkBackpressure() bool {
+	return w.backpressure != nil && w.backpressure()
+}
+
+// reject handles a failed job. If it was rate limited, it is published again
+// to be delivered after the delay asked by the remote, or the rate limit
+// backoff of the worker, and acknowledged. Otherwise, if it can be retried, it
+// is published again to be retried and acknowledged. Otherwise, it is rejected
+// without requeueing it or, if the job has a dead letter queue, it is published
+// there along with the error and acknowledged.
+func (w *Worker) reject(job *WorkerJob, jobErr error) error {
+	if rlErr, ok := asRateLimitError(jobErr); ok && job.retryQueue != nil {
+		delay := rlErr.RetryAfter
+		if delay <= 0 {
+			delay = w.rateLimitBackoff
+		}
+
+		err := delayJob(job.retryQueue, job.Job, delay)
+		if err == nil {
+			log.Warn("job rate limited, requeued with a delay", "module", "worker", "id", w.ctx.ID,
+				"RepositoryID", job.Job.RepositoryID, "delay", delay)
+			return job.Ack()
+		}
+
+		log.Error("error requeueing rate limited job",
+			"module", "worker", "id", w.ctx.ID, "RepositoryID", job.Job.RepositoryID, "err", err)
+	}
+
+	if job.canRetry() {
+		err := retryJob(job.retryQueue, job.Job)
+		if err == nil {
+			log.Warn("job failed, requeued to retry it", "module", "worker", "id", w.ctx.ID,
+				"RepositoryID", job.Job.RepositoryID, "retries", job.Job.Retries+1)
+			return job.Ack()
 		}
+
+		log.Error("error requeueing failed job",
+			"module", "worker", "id", w.ctx.ID, "RepositoryID", job.Job.RepositoryID, "err", err)
 	}
+
+	if job.deadLetter == nil {
+		return job.Reject(false)
+	}
+
+	if err := publishDeadLetter(job.deadLetter, job.Job, jobErr); err != nil {
+		log.Error("error publishing job to dead letter queue",
+			"module", "worker", "id", w.ctx.ID, "RepositoryID", job.Job.RepositoryID, "err", err)
+		return job.Reject(false)
+	}
+
+	return job.Ack()
 }
 
 // Stop stops the worker. It blocks until it is actually stopped. If it is
@@ -1,16 +1,37 @@
 package borges
 
 import (
+	"hash/fnv"
 	"sync"
+	"time"
 
+	"golang.org/x/sync/singleflight"
+	"gopkg.in/src-d/core-retrieval.v0/model"
 	"gopkg.in/src-d/framework.v0/queue"
 )
 
+// DefaultRateLimitBackoff is the default RateLimitBackoff of the worker pools.
+const DefaultRateLimitBackoff = time.Minute
+
 // A WorkerJob is a job to be passed to the worker. It contains the Job itself
 // and an acknowledger that the worker uses to signal that it finished the job.
 type WorkerJob struct {
 	*Job
 	queue.Acknowledger
+
+	// deadLetter, if not nil, is the queue where the job is published if
+	// it fails.
+	deadLetter queue.Queue
+	// retryQueue, if not nil, is the queue where the job is published again
+	// if it fails and it was retried less than maxRetries times.
+	retryQueue queue.Queue
+	maxRetries int
+	// key is the affinity key of the job, if the pool has an Affinity.
+	key string
+}
+
+func (j *WorkerJob) canRetry() bool {
+	return j.retryQueue != nil && j.Job.Retries < j.maxRetries
 }
 
 // WorkerContext is a context specific to each worker and is passed to the
@@ -22,11 +43,101 @@ type WorkerContext struct {
 
 // WorkerPool is a pool of workers that can process jobs.
 type WorkerPool struct {
+	// Notifiers are called by the workers while processing jobs. They can
+	// be called concurrently from different workers, so they must be safe
+	// for concurrent use. They must be set before any worker is started.
+	// Whether they are called or not depends on the processing function
+	// (see NewArchiverWorkerPool).
+	Notifiers struct {
+		// Start function, if set, is called whenever a job is started.
+		Start func(*WorkerContext, *Job)
+		// Stop function, if set, is called whenever a job stops. If
+		// there was an error, it is passed as third parameter,
+		// otherwise, it is nil.
+		Stop func(*WorkerContext, *Job, error)
+		// Warn function, if set, is called whenever there is a warning
+		// during the processing of a job.
+		Warn func(*WorkerContext, *Job, error)
+		// PhaseDone function, if set, is called whenever a phase of the
+		// processing of a job finishes, with the time it took.
+		PhaseDone func(*WorkerContext, *Job, Phase, time.Duration)
+		// PhaseStart function, if set, is called whenever a phase of
+		// the processing of a job starts, with the endpoint being
+		// fetched in FetchPhase, or empty in the other phases.
+		PhaseStart func(*WorkerContext, *Job, Phase, string)
+		// Submodules function, if set, is called with the submodules
+		// found in the repositories of a job.
+		Submodules func(*WorkerContext, *Job, []*Submodule)
+		// Gone function, if set, is called with the repositories of a
+		// job that no longer exist.
+		Gone func(*WorkerContext, *Job, *model.Repository)
+		// Done function, if set, is called with the repositories of a
+		// job successfully archived and their ArchiveStats.
+		Done func(*WorkerContext, *Job, *model.Repository, *ArchiveStats)
+	}
+
+	// Preflight, if set, is called by the workers before processing each
+	// job. If it returns an error, the job is requeued without processing
+	// it, so another consumer with the resources it needs can take it. It
+	// must be set before any worker is started. See NewMinFreeSpaceCheck.
+	Preflight func(*Job) error
+
+	// Backpressure, if set, is called by the idle workers before waiting
+	// for a job. While it returns true, they wait without taking any, so
+	// no job is started until it returns false again. It must be set
+	// before any worker is started. See TempUsageBackpressure.
+	Backpressure func() bool
+
+	// RateLimitBackoff is the delay the jobs rate limited by their remote
+	// are requeued with, if the remote did not say how long to wait, see
+	// RateLimitError. Zero means DefaultRateLimitBackoff. Jobs are only
+	// requeued if they have a retry queue, that is, if they are not
+	// acknowledged on receipt. It must be set before any worker is
+	// started.
+	RateLimitBackoff time.Duration
+
+	// RecoverPanics makes the workers recover from the panics while
+	// processing a job, which then fails with ErrJobPanic, instead of
+	// crashing the whole process along with the other jobs in flight. The
+	// recovered panics are counted in the Stats. It must be set before any
+	// worker is started.
+	RecoverPanics bool
+
+	// Affinity, if set, returns the key of each job, such as the root of
+	// its repository (see NewRootAffinity), and makes the pool dispatch the
+	// jobs with the same key to the same worker, chosen by hashing it, so
+	// they are processed one after the other. A job only goes to its
+	// worker while it is idle or processing a job with the same key, and
+	// only one job at a time waits for it. Otherwise, any idle worker
+	// takes the job, so a slow job does not hold the unrelated ones and
+	// the load stays balanced. It must be set before any worker is
+	// started.
+	Affinity func(*Job) string
+
+	// SingleFlight, if set, returns the key of each job, such as the root
+	// and the repository of the job (see NewRootSingleFlight), and makes a
+	// worker taking a job with the same key as the one being processed by
+	// another worker wait for it and finish with its result, instead of
+	// processing it too, so the identical jobs arriving at the same time
+	// are cloned once. Only the jobs taken while the first one is in
+	// flight are collapsed, the ones taken after it finishes are processed
+	// as usual. It must be set before any worker is started.
+	SingleFlight func(*Job) string
+
 	do         func(*WorkerContext, *Job) error
+	stats      *workerPoolStats
+	statuses   *workerStatuses
+	hosts      *hostLimiter
+	flights    *singleflight.Group
 	jobChannel chan *WorkerJob
 	workers    []*Worker
 	wg         *sync.WaitGroup
 	m          *sync.Mutex
+	// affine are the workers the jobs are dispatched to by their affinity
+	// key, guarded by am and not by m, so jobs keep being dispatched while
+	// the pool waits for the workers to stop.
+	affine []*Worker
+	am     *sync.Mutex
 }
 
 // NewWorkerPool creates a new empty worker pool. It takes a function to be used
@@ -35,23 +146,74 @@ type WorkerPool struct {
 func NewWorkerPool(f func(*WorkerContext, *Job) error) *WorkerPool {
 	return &WorkerPool{
 		do:         f,
+		stats:      newWorkerPoolStats(),
+		statuses:   newWorkerStatuses(),
+		flights:    &singleflight.Group{},
 		jobChannel: make(chan *WorkerJob),
 		workers:    nil,
 		wg:         &sync.WaitGroup{},
 		m:          &sync.Mutex{},
+		am:         &sync.Mutex{},
 	}
 }
 
 // Do executes a job. It blocks until a worker is assigned to process the job
 // and then it returns, with the worker processing the job asynchronously.
 func (wp *WorkerPool) Do(j *WorkerJob) {
-	wp.jobChannel <- j
+	wp.doOrCancel(j, nil)
+}
+
+// doOrCancel is like Do, but it gives up if the given channel is closed
+// before a worker is assigned to the job, in which case it returns false.
+func (wp *WorkerPool) doOrCancel(j *WorkerJob, cancel <-chan struct{}) bool {
+	if wp.dispatchByAffinity(j) {
+		return true
+	}
+
+	select {
+	case wp.jobChannel <- j:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// dispatchByAffinity sends the job to the worker its affinity key maps to, if
+// the pool has an Affinity and the worker accepts it without waiting. It
+// returns whether the job was dispatched.
+func (wp *WorkerPool) dispatchByAffinity(j *WorkerJob) bool {
+	if wp.Affinity == nil {
+		return false
+	}
+
+	j.key = wp.Affinity(j.Job)
+
+	wp.am.Lock()
+	defer wp.am.Unlock()
+	if len(wp.affine) == 0 {
+		return false
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(j.key))
+	w := wp.affine[h.Sum32()%uint32(len(wp.affine))]
+	if !w.accepts(j.key) {
+		return false
+	}
+
+	select {
+	case w.affinity <- j:
+		return true
+	default:
+		return false
+	}
 }
 
 // SetWorkerCount changes the number of running workers. Workers will be started
 // or stopped as necessary to satisfy the new worker count. It blocks until the
 // all required workers are started or stopped. Each worker, if busy, will
-// finish its current job before stopping.
+// finish its current job before stopping. It is safe to call it at any time
+// while the pool is running.
 func (wp *WorkerPool) SetWorkerCount(workers int) {
 	wp.m.Lock()
 	defer wp.m.Unlock()
@@ -64,6 +226,25 @@ func (wp *WorkerPool) SetWorkerCount(workers int) {
 	}
 }
 
+// Stats returns a snapshot of the statistics of the jobs processed by the
+// workers of the pool. It is safe to call it at any time.
+func (wp *WorkerPool) Stats() WorkerPoolStats {
+	return wp.stats.snapshot()
+}
+
+// Status returns what every worker of the pool is doing, sorted by their ID.
+// It is safe to call it at any time, and it does not wait for the workers.
+func (wp *WorkerPool) Status() []WorkerStatus {
+	return wp.statuses.snapshot()
+}
+
+// RunningClones returns the number of clones running from each host, if the
+// pool limits the clones per host, see ArchiverOptions.PerHostConcurrency.
+// Otherwise, it returns nil.
+func (wp *WorkerPool) RunningClones() map[string]int {
+	return wp.hosts.runningClones()
+}
+
 // Len returns the number of workers currently in the pool.
 func (wp *WorkerPool) Len() int {
 	wp.m.Lock()
@@ -74,8 +255,26 @@ func (wp *WorkerPool) Len() int {
 func (wp *WorkerPool) add(n int) {
 	wp.wg.Add(n)
 	for i := 0; i < n; i++ {
-		ctx := &WorkerContext{ID: i}
+		ctx := &WorkerContext{ID: len(wp.workers)}
 		w := NewWorker(ctx, wp.do, wp.jobChannel)
+		w.preflight = wp.Preflight
+		w.backpressure = wp.Backpressure
+		w.stats = wp.stats
+		w.statuses = wp.statuses
+		w.rateLimitBackoff = wp.rateLimitBackoff()
+		w.recoverPanics = wp.RecoverPanics
+		if wp.SingleFlight != nil {
+			w.singleFlight, w.flights = wp.SingleFlight, wp.flights
+		}
+
+		if wp.Affinity != nil {
+			w.affinity = make(chan *WorkerJob, 1)
+			wp.am.Lock()
+			wp.affine = append(wp.affine, w)
+			wp.am.Unlock()
+		}
+
+		wp.statuses.add(w)
 		go func() {
 			defer wp.wg.Done()
 			w.Start()
@@ -91,14 +290,43 @@ func (wp *WorkerPool) del(n int) {
 		wg.Add(1)
 		w := wp.workers[i]
 		wp.workers = wp.workers[:len(wp.workers)-1]
+		wp.removeAffine(w)
 		go func() {
 			w.Stop()
+			wp.requeueAffine(w)
+			wp.statuses.remove(w)
 			wg.Done()
 		}()
 	}
 	wg.Wait()
 }
 
+// removeAffine stops dispatching jobs to the worker by their affinity key.
+func (wp *WorkerPool) removeAffine(w *Worker) {
+	wp.am.Lock()
+	defer wp.am.Unlock()
+
+	for i, a := range wp.affine {
+		if a == w {
+			wp.affine = append(wp.affine[:i], wp.affine[i+1:]...)
+			return
+		}
+	}
+}
+
+// requeueAffine requeues the job dispatched to the stopped worker by its
+// affinity key that it did not take, if any.
+func (wp *WorkerPool) requeueAffine(w *Worker) {
+	select {
+	case j := <-w.affinity:
+		if err := j.Reject(true); err != nil {
+			log.Error("error requeueing job", "module", "worker", "id", w.ctx.ID,
+				"RepositoryID", j.Job.RepositoryID, "err", err)
+		}
+	default:
+	}
+}
+
 // Close stops all the workers in the pool and frees resources used by it.
 // Workers are
 // It blocks until it finishes.
@@ -108,3 +336,77 @@ func (wp *WorkerPool) Close() error {
 	close(wp.jobChannel)
 	return nil
 }
+
+func (wp *WorkerPool) rateLimitBackoff() time.Duration {
+	if wp.RateLimitBackoff <= 0 {
+		return DefaultRateLimitBackoff
+	}
+
+	return wp.RateLimitBackoff
+}
+
+func (wp *WorkerPool) notifyStart(ctx *WorkerContext, j *Job) {
+	if wp.Notifiers.Start == nil {
+		return
+	}
+
+	wp.Notifiers.Start(ctx, j)
+}
+
+func (wp *WorkerPool) notifyStop(ctx *WorkerContext, j *Job, err error) {
+	if wp.Notifiers.Stop == nil {
+		return
+	}
+
+	wp.Notifiers.Stop(ctx, j, err)
+}
+
+func (wp *WorkerPool) notifyWarn(ctx *WorkerContext, j *Job, err error) {
+	if wp.Notifiers.Warn == nil {
+		return
+	}
+
+	wp.Notifiers.Warn(ctx, j, err)
+}
+
+func (wp *WorkerPool) notifyPhaseDone(ctx *WorkerContext, j *Job, p Phase, d time.Duration) {
+	wp.stats.phaseDone(p, d)
+	if wp.Notifiers.PhaseDone == nil {
+		return
+	}
+
+	wp.Notifiers.PhaseDone(ctx, j, p, d)
+}
+
+func (wp *WorkerPool) notifyPhaseStart(ctx *WorkerContext, j *Job, p Phase, endpoint string) {
+	wp.statuses.phaseStart(ctx, p, endpoint)
+	if wp.Notifiers.PhaseStart == nil {
+		return
+	}
+
+	wp.Notifiers.PhaseStart(ctx, j, p, endpoint)
+}
+
+func (wp *WorkerPool) notifySubmodules(ctx *WorkerContext, j *Job, subs []*Submodule) {
+	if wp.Notifiers.Submodules == nil {
+		return
+	}
+
+	wp.Notifiers.Submodules(ctx, j, subs)
+}
+
+func (wp *WorkerPool) notifyGone(ctx *WorkerContext, j *Job, r *model.Repository) {
+	if wp.Notifiers.Gone == nil {
+		return
+	}
+
+	wp.Notifiers.Gone(ctx, j, r)
+}
+
+func (wp *WorkerPool) notifyDone(ctx *WorkerContext, j *Job, r *model.Repository, s *ArchiveStats) {
+	if wp.Notifiers.Done == nil {
+		return
+	}
+
+	wp.Notifiers.Done(ctx, j, r, s)
+}
@@ -0,0 +1,447 @@
+package borges
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/framework.v0/queue"
+)
+
+func TestWorkerPool_SetWorkerCount(t *testing.T) {
+	require := require.New(t)
+
+	var m sync.Mutex
+	ids := make(map[int]bool)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	wp := NewWorkerPool(func(ctx *WorkerContext, j *Job) error {
+		m.Lock()
+		ids[ctx.ID] = true
+		m.Unlock()
+
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+
+	wp.SetWorkerCount(1)
+	require.Equal(1, wp.Len())
+	wp.SetWorkerCount(3)
+	require.Equal(3, wp.Len())
+
+	for i := 0; i < 3; i++ {
+		go wp.Do(&WorkerJob{Job: &Job{}, Acknowledger: &dummyAck{}})
+		require.NoError(timeoutChan(started, time.Second))
+	}
+
+	require.Len(ids, 3)
+
+	// draining waits for the in-flight jobs to finish
+	done := make(chan struct{})
+	go func() {
+		wp.SetWorkerCount(1)
+		close(done)
+	}()
+
+	require.Error(timeoutChan(done, 100*time.Millisecond))
+	close(release)
+	require.NoError(timeoutChan(done, time.Second))
+	require.Equal(1, wp.Len())
+
+	require.NoError(wp.Close())
+	require.Equal(0, wp.Len())
+}
+
+func TestWorkerPool_Preflight(t *testing.T) {
+	require := require.New(t)
+
+	wp := NewWorkerPool(func(ctx *WorkerContext, j *Job) error {
+		require.Fail("job processed")
+		return nil
+	})
+	wp.Preflight = func(*Job) error { return ErrNotEnoughSpace.New("foo", 0, 1) }
+	wp.SetWorkerCount(1)
+
+	ack := &requeueAck{requeued: make(chan bool, 1)}
+	wp.Do(&WorkerJob{Job: &Job{}, Acknowledger: ack})
+	select {
+	case requeue := <-ack.requeued:
+		require.True(requeue)
+	case <-time.After(time.Second):
+		require.Fail("job not rejected")
+	}
+
+	require.NoError(wp.Close())
+}
+
+func TestWorkerPool_Backpressure(t *testing.T) {
+	require := require.New(t)
+
+	done := make(chan struct{}, 1)
+	wp := NewWorkerPool(func(ctx *WorkerContext, j *Job) error {
+		done <- struct{}{}
+		return nil
+	})
+	var paused int32 = 1
+	wp.Backpressure = func() bool { return atomic.LoadInt32(&paused) == 1 }
+	wp.SetWorkerCount(1)
+
+	job := &WorkerJob{Job: &Job{}, Acknowledger: &channelAck{acked: make(chan struct{}, 1)}}
+	cancel := make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() { close(cancel) })
+	require.False(wp.doOrCancel(job, cancel), "paused worker took a job")
+
+	atomic.StoreInt32(&paused, 0)
+	wp.Do(job)
+	require.NoError(timeoutChan(done, 2*backpressureBackoff))
+	require.NoError(wp.Close())
+}
+
+func TestWorkerPool_HostBusy(t *testing.T) {
+	require := require.New(t)
+
+	wp := NewWorkerPool(func(ctx *WorkerContext, j *Job) error {
+		return ErrHostBusy.New("github.com")
+	})
+	wp.SetWorkerCount(1)
+
+	ack := &requeueAck{requeued: make(chan bool, 1)}
+	wp.Do(&WorkerJob{Job: &Job{}, Acknowledger: ack})
+	select {
+	case requeue := <-ack.requeued:
+		require.True(requeue)
+	case <-time.After(time.Second):
+		require.Fail("job not rejected")
+	}
+
+	require.NoError(wp.Close())
+	require.Equal(uint64(1), wp.Stats().Requeued)
+	require.Zero(wp.Stats().Failed)
+}
+
+func TestWorkerPool_RateLimited(t *testing.T) {
+	require := require.New(t)
+
+	b, err := queue.NewBroker("memory://")
+	require.NoError(err)
+	defer b.Close()
+	q, err := b.Queue("rate-limited")
+	require.NoError(err)
+
+	rlErr := &RateLimitError{Endpoint: "foo", Err: fmt.Errorf("rate limit exceeded")}
+	wp := NewWorkerPool(func(ctx *WorkerContext, j *Job) error {
+		return ErrClone.Wrap(rlErr, "foo")
+	})
+	wp.RateLimitBackoff = 10 * time.Millisecond
+	wp.SetWorkerCount(1)
+
+	acked := make(chan struct{}, 1)
+	job := &Job{RepositoryID: uuid.NewV4()}
+	wp.Do(&WorkerJob{
+		Job:          job,
+		Acknowledger: &channelAck{acked: acked},
+		retryQueue:   q,
+		maxRetries:   3,
+	})
+	require.NoError(timeoutChan(acked, time.Second))
+	require.NoError(wp.Close())
+
+	iter, err := q.Consume(1)
+	require.NoError(err)
+	defer iter.Close()
+
+	qj, err := iter.Next()
+	require.NoError(err)
+	var delayed Job
+	require.NoError(qj.Decode(&delayed))
+	require.Equal(job.RepositoryID, delayed.RepositoryID)
+	require.Equal(0, delayed.Retries)
+}
+
+func TestWorkerPool_Stats(t *testing.T) {
+	require := require.New(t)
+
+	var wp *WorkerPool
+	started := make(chan struct{}, 2)
+	release := make(chan error)
+	wp = NewWorkerPool(func(ctx *WorkerContext, j *Job) error {
+		started <- struct{}{}
+		err := <-release
+		wp.notifyPhaseDone(ctx, j, FetchPhase, 2*time.Second)
+		return err
+	})
+	wp.SetWorkerCount(2)
+
+	stats := wp.Stats()
+	require.Zero(stats.Processed)
+	require.Zero(stats.InFlight)
+	require.Zero(stats.AverageDuration)
+	require.Empty(stats.AveragePhaseDuration)
+
+	acked := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		wp.Do(&WorkerJob{Job: &Job{}, Acknowledger: &channelAck{acked: acked}})
+		require.NoError(timeoutChan(started, time.Second))
+	}
+
+	require.Equal(2, wp.Stats().InFlight)
+	release <- nil
+	require.NoError(timeoutChan(acked, time.Second))
+	stats = wp.Stats()
+	require.Equal(uint64(1), stats.Processed)
+	require.Equal(1, stats.InFlight)
+
+	release <- fmt.Errorf("foo")
+	require.NoError(wp.Close())
+
+	stats = wp.Stats()
+	require.Equal(uint64(1), stats.Processed)
+	require.Equal(uint64(1), stats.Failed)
+	require.Zero(stats.Requeued)
+	require.Zero(stats.InFlight)
+	require.True(stats.AverageDuration > 0)
+	require.Equal(map[Phase]time.Duration{FetchPhase: 2 * time.Second},
+		stats.AveragePhaseDuration)
+
+	// the snapshot is a copy
+	stats.AveragePhaseDuration[PackPhase] = time.Second
+	require.Len(wp.Stats().AveragePhaseDuration, 1)
+}
+
+func TestWorkerPool_Status(t *testing.T) {
+	require := require.New(t)
+
+	var wp *WorkerPool
+	started := make(chan struct{})
+	release := make(chan struct{})
+	wp = NewWorkerPool(func(ctx *WorkerContext, j *Job) error {
+		wp.notifyPhaseStart(ctx, j, FetchPhase, "git://foo/bar")
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+	wp.SetWorkerCount(2)
+	require.Equal([]WorkerStatus{{ID: 0}, {ID: 1}}, wp.Status())
+
+	job := &Job{RepositoryID: uuid.NewV4()}
+	acked := make(chan struct{}, 1)
+	wp.Do(&WorkerJob{Job: job, Acknowledger: &channelAck{acked: acked}})
+	require.NoError(timeoutChan(started, time.Second))
+
+	statuses := wp.Status()
+	require.Len(statuses, 2)
+	var busy WorkerStatus
+	for _, s := range statuses {
+		if s.Job != nil {
+			busy = s
+		}
+	}
+
+	require.Equal(job, busy.Job)
+	require.Equal("git://foo/bar", busy.Endpoint)
+	require.Equal(FetchPhase, busy.Phase)
+	require.False(busy.Started.IsZero())
+	require.False(busy.PhaseStarted.Before(busy.Started))
+
+	close(release)
+	require.NoError(timeoutChan(acked, time.Second))
+	wp.SetWorkerCount(1)
+	require.Len(wp.Status(), 1)
+	require.Nil(wp.Status()[0].Job)
+	require.Nil(wp.RunningClones())
+
+	require.NoError(wp.Close())
+	require.Empty(wp.Status())
+}
+
+// channelAck sends to acked every acknowledgement.
+type channelAck struct {
+	acked chan struct{}
+}
+
+func (a *channelAck) Ack() error {
+	a.acked <- struct{}{}
+	return nil
+}
+
+func (*channelAck) Reject(requeue bool) error { return nil }
+
+// requeueAck sends the requeue argument of every rejection to requeued.
+type requeueAck struct {
+	requeued chan bool
+}
+
+func (*requeueAck) Ack() error { return nil }
+func (a *requeueAck) Reject(requeue bool) error {
+	a.requeued <- requeue
+	return nil
+}
+
+type dummyAck struct{}
+
+func (*dummyAck) Ack() error                { return nil }
+func (*dummyAck) Reject(requeue bool) error { return nil }
+
+func TestWorkerPool_RecoverPanics(t *testing.T) {
+	require := require.New(t)
+
+	wp := NewWorkerPool(func(ctx *WorkerContext, j *Job) error {
+		if j.Retries == 0 {
+			panic("foo")
+		}
+
+		return nil
+	})
+	wp.RecoverPanics = true
+	wp.SetWorkerCount(1)
+
+	ack := &requeueAck{requeued: make(chan bool, 1)}
+	wp.Do(&WorkerJob{Job: &Job{}, Acknowledger: ack})
+	select {
+	case requeue := <-ack.requeued:
+		require.False(requeue)
+	case <-time.After(time.Second):
+		require.Fail("job not rejected")
+	}
+
+	// the worker keeps processing jobs
+	acked := make(chan struct{}, 1)
+	wp.Do(&WorkerJob{Job: &Job{Retries: 1}, Acknowledger: &channelAck{acked: acked}})
+	require.NoError(timeoutChan(acked, time.Second))
+	require.NoError(wp.Close())
+
+	stats := wp.Stats()
+	require.Equal(uint64(1), stats.Panics)
+	require.Equal(uint64(1), stats.Failed)
+	require.Equal(uint64(1), stats.Processed)
+	require.Zero(stats.InFlight)
+}
+
+func TestWorkerPool_Affinity(t *testing.T) {
+	require := require.New(t)
+
+	release := make(chan struct{})
+	started := make(chan int, 1)
+	var m sync.Mutex
+	workers := make(map[uuid.UUID]int)
+	wp := NewWorkerPool(func(ctx *WorkerContext, j *Job) error {
+		m.Lock()
+		workers[j.RepositoryID] = ctx.ID
+		m.Unlock()
+
+		if j.Retries == 1 {
+			started <- ctx.ID
+			<-release
+		}
+
+		return nil
+	})
+	wp.Affinity = func(*Job) string { return "foo" }
+	wp.SetWorkerCount(2)
+
+	do := func(j *Job) chan struct{} {
+		acked := make(chan struct{}, 1)
+		wp.Do(&WorkerJob{Job: j, Acknowledger: &channelAck{acked: acked}})
+		return acked
+	}
+
+	workerOf := func(j *Job) int {
+		m.Lock()
+		defer m.Unlock()
+		return workers[j.RepositoryID]
+	}
+
+	// jobs with the same key go to the same worker
+	first := &Job{RepositoryID: uuid.NewV4()}
+	require.NoError(timeoutChan(do(first), time.Second))
+	for i := 0; i < 5; i++ {
+		j := &Job{RepositoryID: uuid.NewV4()}
+		require.NoError(timeoutChan(do(j), time.Second))
+		require.Equal(workerOf(first), workerOf(j))
+	}
+
+	slow := &Job{RepositoryID: uuid.NewV4(), Retries: 1}
+	slowAcked := do(slow)
+	var id int
+	select {
+	case id = <-started:
+	case <-time.After(time.Second):
+		require.Fail("slow job not started")
+	}
+
+	// the next job waits for the worker busy with the same key, and
+	// another one does not wait behind it
+	waiting := &Job{RepositoryID: uuid.NewV4()}
+	waitingAcked := do(waiting)
+	other := &Job{RepositoryID: uuid.NewV4()}
+	require.NoError(timeoutChan(do(other), time.Second))
+	require.Error(timeoutChan(waitingAcked, 100*time.Millisecond))
+
+	close(release)
+	require.NoError(timeoutChan(slowAcked, time.Second))
+	require.NoError(timeoutChan(waitingAcked, time.Second))
+	require.NoError(wp.Close())
+
+	require.Equal(id, workerOf(waiting))
+	require.NotEqual(id, workerOf(other))
+}
+
+func TestWorkerPool_SingleFlight(t *testing.T) {
+	require := require.New(t)
+
+	var m sync.Mutex
+	var clones int
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	wp := NewWorkerPool(func(ctx *WorkerContext, j *Job) error {
+		m.Lock()
+		clones++
+		m.Unlock()
+
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+
+	keyed := make(chan struct{}, 3)
+	wp.SingleFlight = func(j *Job) string {
+		keyed <- struct{}{}
+		return j.RepositoryID.String()
+	}
+	wp.SetWorkerCount(3)
+
+	acked := make(chan struct{}, 3)
+	do := func(j *Job) {
+		wp.Do(&WorkerJob{Job: j, Acknowledger: &channelAck{acked: acked}})
+		require.NoError(timeoutChan(keyed, time.Second))
+	}
+
+	id := uuid.NewV4()
+	do(&Job{RepositoryID: id})
+	require.NoError(timeoutChan(started, time.Second))
+
+	// the identical job waits for the one in flight instead of cloning the
+	// repository again, while a different one is processed as usual
+	do(&Job{RepositoryID: id})
+	do(&Job{RepositoryID: uuid.NewV4()})
+	require.NoError(timeoutChan(started, time.Second))
+	require.Error(timeoutChan(started, 100*time.Millisecond))
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		require.NoError(timeoutChan(acked, time.Second))
+	}
+
+	require.NoError(wp.Close())
+	require.Equal(2, clones)
+
+	stats := wp.Stats()
+	require.Equal(uint64(3), stats.Processed)
+	require.Equal(uint64(1), stats.Collapsed)
+	require.Zero(stats.InFlight)
+}